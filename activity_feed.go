@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +14,12 @@ const (
 	EventTypeRateLimitRejected        = "rate_limit_rejected"
 	EventTypeCircuitBreakerStateChange = "circuit_breaker_state_change"
 	EventTypeRedisFailure             = "redis_failure"
+	EventTypeQuotaExhausted           = "quota_exhausted"
+	EventTypePenaltyBanIssued         = "penalty_ban_issued"
+	EventTypePenaltyBanExpired        = "penalty_ban_expired"
+	EventTypeRedisFailover            = "redis_failover"
+	EventTypePeerMembership           = "peer_membership"
+	EventTypeReconciled               = "reconciled"
 )
 
 // ActivityEvent represents a system event for the activity feed
@@ -22,6 +30,8 @@ type ActivityEvent struct {
 	IP        string                 `json:"ip,omitempty"`
 	Path      string                 `json:"path,omitempty"`
 	Details   map[string]interface{} `json:"details,omitempty"`
+	// Instance that emitted the event, set when events are shared
+	Instance string `json:"instance,omitempty"`
 }
 
 // ActivityFeed manages a circular buffer of events
@@ -162,10 +172,45 @@ func (b *SSEBroadcaster) Broadcast(event *ActivityEvent) {
 type EventEmitter struct {
 	feed        *ActivityFeed
 	broadcaster *SSEBroadcaster
+	// Shares events with other instances when set
+	relay atomic.Pointer[eventRelay]
+	// Keeps events in the shared history when set
+	history atomic.Pointer[eventHistory]
 }
 
 // Emit adds an event to the feed and broadcasts it
 func (e *EventEmitter) Emit(event *ActivityEvent) {
+	relay, history := e.relay.Load(), e.history.Load()
+	if relay != nil {
+		event.Instance = relay.instance
+	} else if history != nil {
+		event.Instance = history.instance
+	}
+	e.deliver(event)
+	if relay != nil {
+		relay.publish(event)
+	}
+	if history != nil {
+		history.append(event)
+	}
+}
+
+// RecentEvents returns up to limit recent events, oldest first. With a
+// shared history they come from every instance; when it can't be read the
+// local feed is used.
+func (e *EventEmitter) RecentEvents(limit int) []*ActivityEvent {
+	if history := e.history.Load(); history != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), historyReadTimeout)
+		defer cancel()
+		if events, err := history.recent(ctx, limit); err == nil {
+			return events
+		}
+	}
+	return e.feed.GetRecentEvents(limit)
+}
+
+// deliver adds an event to the local feed and broadcasts it to SSE clients
+func (e *EventEmitter) deliver(event *ActivityEvent) {
 	e.feed.AddEvent(event)
 	e.broadcaster.Broadcast(event)
 }
@@ -209,7 +254,105 @@ func (e *EventEmitter) EmitRedisFailure(operation string, err error) {
 		Details: map[string]interface{}{
 			"operation": operation,
 			"error":     err.Error(),
+			"class":     string(classifyRedisError(err)),
+		},
+	}
+	e.Emit(event)
+}
+
+// EmitQuotaExhausted emits an event when a calendar quota rejects a request
+func (e *EventEmitter) EmitQuotaExhausted(r *http.Request, period string, limit int64, resetAt time.Time) {
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("qe-%d", time.Now().UnixNano()),
+		Type:      EventTypeQuotaExhausted,
+		Timestamp: time.Now(),
+		IP:        getClientIP(r),
+		Path:      r.URL.Path,
+		Details: map[string]interface{}{
+			"method":     r.Method,
+			"period":     period,
+			"limit":      limit,
+			"reset_date": resetAt.Format("2006-01-02"),
+			"reset_at":   resetAt.Format(time.RFC3339),
+		},
+	}
+	e.Emit(event)
+}
+
+// EmitPenaltyBanIssued emits an event when a repeat offender is banned
+func (e *EventEmitter) EmitPenaltyBanIssued(ip string, level int, duration time.Duration, until time.Time) {
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("pb-%d", time.Now().UnixNano()),
+		Type:      EventTypePenaltyBanIssued,
+		Timestamp: time.Now(),
+		IP:        ip,
+		Details: map[string]interface{}{
+			"level":    level,
+			"duration": duration.String(),
+			"until":    until.Format(time.RFC3339),
+		},
+	}
+	e.Emit(event)
+}
+
+// EmitPenaltyBanExpired emits an event when a ban runs out
+func (e *EventEmitter) EmitPenaltyBanExpired(ip string, level int) {
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("pe-%d", time.Now().UnixNano()),
+		Type:      EventTypePenaltyBanExpired,
+		Timestamp: time.Now(),
+		IP:        ip,
+		Details: map[string]interface{}{
+			"level": level,
+		},
+	}
+	e.Emit(event)
+}
+
+// EmitRedisFailover emits an event as Sentinel fails over the Redis primary
+func (e *EventEmitter) EmitRedisFailover(phase, master, oldAddr, newAddr string) {
+	details := map[string]interface{}{
+		"phase":  phase,
+		"master": master,
+		"from":   oldAddr,
+	}
+	if newAddr != "" {
+		details["to"] = newAddr
+	}
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("fo-%d", time.Now().UnixNano()),
+		Type:      EventTypeRedisFailover,
+		Timestamp: time.Now(),
+		Details:   details,
+	}
+	e.Emit(event)
+}
+
+// EmitPeerMembership emits an event when peers join or leave the cluster
+func (e *EventEmitter) EmitPeerMembership(members, joined, left []string) {
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("pm-%d", time.Now().UnixNano()),
+		Type:      EventTypePeerMembership,
+		Timestamp: time.Now(),
+		Details: map[string]interface{}{
+			"members": members,
+			"joined":  joined,
+			"left":    left,
 		},
 	}
 	e.Emit(event)
-}
\ No newline at end of file
+}
+
+// EmitReconciled emits an event after fallback usage was synced to the store
+func (e *EventEmitter) EmitReconciled(keys, units int) {
+	event := &ActivityEvent{
+		ID:        fmt.Sprintf("rc-%d", time.Now().UnixNano()),
+		Type:      EventTypeReconciled,
+		Timestamp: time.Now(),
+		Details: map[string]interface{}{
+			"keys":  keys,
+			"units": units,
+		},
+	}
+	e.Emit(event)
+}
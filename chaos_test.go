@@ -0,0 +1,206 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ahafonof/claude-code-requirements-builder/internal/chaosproxy"
+)
+
+// chaosLimiter starts a fake Redis behind a fault-injection proxy and a
+// limiter connected through it with short timeouts and no retries
+func chaosLimiter(t *testing.T, recoveryInterval time.Duration) (*DistributedRateLimiter, *chaosproxy.Proxy, *EventEmitter) {
+	t.Helper()
+	srv := startFakeRedis(t)
+	proxy, err := chaosproxy.Start("127.0.0.1:0", srv.Addr())
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Close() })
+
+	eventEmitter := createTestEmitter()
+	cfg := testConfig()
+	cfg.RedisURL = "redis://" + proxy.Addr() + "/0?dial_timeout=50ms&read_timeout=50ms&write_timeout=50ms&max_retries=-1"
+	cfg.Limit = 100
+	cfg.FailureThreshold = 3
+	cfg.RecoveryInterval = recoveryInterval
+
+	drl, err := NewDistributedRateLimiter(cfg, eventEmitter)
+	if err != nil {
+		t.Fatalf("Failed to create DistributedRateLimiter: %v", err)
+	}
+	t.Cleanup(func() { _ = drl.Close() })
+	return drl, proxy, eventEmitter
+}
+
+// breakerEvents returns the redis_failure and circuit_breaker_state_change
+// events in order, as "failure" or "<old>-><new>"
+func breakerEvents(eventEmitter *EventEmitter) []string {
+	var sequence []string
+	for _, event := range eventEmitter.feed.GetRecentEvents(1000) {
+		switch event.Type {
+		case EventTypeRedisFailure:
+			sequence = append(sequence, "failure")
+		case EventTypeCircuitBreakerStateChange:
+			sequence = append(sequence, event.Details["old_state"].(string)+"->"+event.Details["new_state"].(string))
+		}
+	}
+	return sequence
+}
+
+func equalSequence(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestChaos_FaultsOpenCircuit tests the breaker under faults that make every
+// Redis call fail
+func TestChaos_FaultsOpenCircuit(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault string
+	}{
+		{"blackhole", "blackhole"},
+		{"truncated_replies", "truncate 2"},
+		{"down", "down"},
+		{"latency_over_timeout", "latency 100ms"},
+	}
+
+	// Three failures open the circuit; the last two requests never reach Redis
+	want := []string{"failure", "failure", "closed->open", "failure"}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			drl, proxy, eventEmitter := chaosLimiter(t, time.Hour)
+			if !drl.Allow("10.6.6.6") {
+				t.Fatal("Request should be allowed before the fault")
+			}
+
+			if err := proxy.Apply(tc.fault); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+			// Pooled connections may already hold a reply in flight
+			proxy.DropConnections()
+
+			for i := 0; i < 5; i++ {
+				drl.Allow("10.6.6.6")
+			}
+
+			if got := breakerEvents(eventEmitter); !equalSequence(got, want) {
+				t.Errorf("Expected events %v, got %v", want, got)
+			}
+			metrics := drl.GetMetrics()
+			if metrics.FallbackCount != 5 {
+				t.Errorf("Expected 5 fallback requests, got %d", metrics.FallbackCount)
+			}
+			if metrics.FallbackMode != "fallback" {
+				t.Errorf("Expected fallback mode, got %s", metrics.FallbackMode)
+			}
+		})
+	}
+}
+
+// TestChaos_LatencyUnderTimeout tests that slow but working Redis keeps the
+// circuit closed
+func TestChaos_LatencyUnderTimeout(t *testing.T) {
+	drl, proxy, eventEmitter := chaosLimiter(t, time.Hour)
+	proxy.SetLatency(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if !drl.Allow("10.6.6.7") {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if got := breakerEvents(eventEmitter); len(got) != 0 {
+		t.Errorf("Expected no breaker events, got %v", got)
+	}
+	if metrics := drl.GetMetrics(); metrics.FallbackCount != 0 {
+		t.Errorf("Expected no fallback requests, got %d", metrics.FallbackCount)
+	}
+}
+
+// TestChaos_Recovery tests that the limiter returns to Redis once a fault clears
+func TestChaos_Recovery(t *testing.T) {
+	drl, proxy, eventEmitter := chaosLimiter(t, 50*time.Millisecond)
+
+	proxy.SetBlackhole(true)
+	proxy.DropConnections()
+	for i := 0; i < 3; i++ {
+		drl.Allow("10.6.6.8")
+	}
+	if !drl.circuitBreaker.IsOpen() {
+		t.Fatal("Circuit should be open during the blackhole")
+	}
+
+	proxy.Clear()
+	proxy.DropConnections()
+	time.Sleep(200 * time.Millisecond)
+
+	before := drl.GetMetrics().FallbackCount
+	for i := 0; i < 3; i++ {
+		drl.Allow("10.6.6.8")
+	}
+	metrics := drl.GetMetrics()
+	if metrics.FallbackCount != before {
+		t.Errorf("Requests after recovery should not fall back, got %d more", metrics.FallbackCount-before)
+	}
+	if metrics.FallbackMode != "distributed" {
+		t.Errorf("Expected distributed mode after recovery, got %s", metrics.FallbackMode)
+	}
+
+	want := []string{"failure", "failure", "closed->open", "failure", "open->half-open", "half-open->closed"}
+	if got := breakerEvents(eventEmitter); !equalSequence(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+}
+
+// TestChaos_Flapping tests that a flapping link never leaves requests
+// unserved and that every failure is answered by the fallback
+func TestChaos_Flapping(t *testing.T) {
+	drl, proxy, eventEmitter := chaosLimiter(t, 20*time.Millisecond)
+	proxy.Flap(30 * time.Millisecond)
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	requests := 0
+	for time.Now().Before(deadline) {
+		drl.Allow("10.6.6.9")
+		requests++
+		time.Sleep(2 * time.Millisecond)
+	}
+	proxy.Clear()
+
+	failures := 0
+	for _, event := range breakerEvents(eventEmitter) {
+		if event == "failure" {
+			failures++
+			continue
+		}
+		switch event {
+		case "closed->open", "open->half-open", "half-open->open", "half-open->closed":
+		default:
+			t.Errorf("Unexpected transition %s", event)
+		}
+	}
+	if failures == 0 {
+		t.Fatal("Expected the flapping link to cause failures")
+	}
+
+	metrics := drl.GetMetrics()
+	if metrics.TotalRequests != int64(requests) {
+		t.Errorf("Expected %d requests, got %d", requests, metrics.TotalRequests)
+	}
+	if metrics.FallbackCount < int64(failures) {
+		t.Errorf("Every failure should be served by the fallback, got %d fallbacks for %d failures", metrics.FallbackCount, failures)
+	}
+	if metrics.AllowedRequests+metrics.RejectedRequests != int64(requests) {
+		t.Errorf("Every request should be answered, got %d of %d", metrics.AllowedRequests+metrics.RejectedRequests, requests)
+	}
+}
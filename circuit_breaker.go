@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFailureWindow is how long failures count towards tripping
+	DefaultFailureWindow = 10 * time.Second
+	// DefaultHalfOpenProbes is how many calls may test a half-open circuit
+	DefaultHalfOpenProbes = 3
+	// DefaultSuccessThreshold is how many probes must succeed to close it
+	DefaultSuccessThreshold = 2
+	// defaultBackoffFactor caps the recovery backoff at this multiple of the
+	// recovery interval
+	defaultBackoffFactor = 16
+)
+
+// ErrCircuitOpen is returned by store calls the circuit breaker held back
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// breakerBuckets is the number of slices the failure window is divided into
+const breakerBuckets = 10
+
+// BreakerConfig tunes a CircuitBreaker
+type BreakerConfig struct {
+	// FailureThreshold is the number of failures within FailureWindow that
+	// opens the circuit
+	FailureThreshold int
+	// TimeoutThreshold is the number of timeouts within FailureWindow that
+	// opens the circuit. Timeouts are counted apart from other failures and
+	// default to the same threshold.
+	TimeoutThreshold int
+	// FailureRate, when set, additionally requires this fraction of the calls
+	// within FailureWindow to have failed or timed out, once MinRequests were
+	// made
+	FailureRate float64
+	MinRequests int
+	// FailureWindow is how long a failure counts, defaulting to
+	// DefaultFailureWindow
+	FailureWindow time.Duration
+	// RecoveryInterval is how long the circuit stays open before probing.
+	// It doubles after every failed probe up to MaxRecoveryInterval.
+	RecoveryInterval    time.Duration
+	MaxRecoveryInterval time.Duration
+	// HalfOpenProbes limits the calls let through while half-open
+	HalfOpenProbes int
+	// SuccessThreshold is the number of successful probes that close it
+	SuccessThreshold int
+}
+
+// withDefaults fills in unset fields
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 1
+	}
+	if c.TimeoutThreshold <= 0 {
+		c.TimeoutThreshold = c.FailureThreshold
+	}
+	if c.FailureWindow <= 0 {
+		c.FailureWindow = DefaultFailureWindow
+	}
+	if c.RecoveryInterval <= 0 {
+		c.RecoveryInterval = time.Second
+	}
+	if c.MaxRecoveryInterval < c.RecoveryInterval {
+		c.MaxRecoveryInterval = defaultBackoffFactor * c.RecoveryInterval
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = DefaultHalfOpenProbes
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = DefaultSuccessThreshold
+	}
+	if c.SuccessThreshold > c.HalfOpenProbes {
+		c.SuccessThreshold = c.HalfOpenProbes
+	}
+	return c
+}
+
+// String returns the name used in events and metrics
+func (s CircuitState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// StateChangeHook is called after every transition of a CircuitBreaker with
+// the number of failures, timeouts included, that led to it
+type StateChangeHook func(from, to CircuitState, failures int)
+
+// breakerBucket counts outcomes in one slice of the failure window
+type breakerBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+	timeouts  int
+}
+
+// breakerTransition is a state change waiting to be reported to the hooks
+type breakerTransition struct {
+	from, to CircuitState
+	failures int
+}
+
+// CircuitBreaker guards calls to a backend. It opens after enough failures
+// within a rolling window, lets a few probe calls through once it has been
+// open for the recovery interval, and closes after enough probes succeed.
+// Failed probes reopen it and double the recovery interval.
+type CircuitBreaker struct {
+	mu              sync.RWMutex
+	config          BreakerConfig
+	state           CircuitState
+	failures        int
+	buckets         [breakerBuckets]breakerBucket
+	lastFailureTime time.Time
+	openedAt        time.Time
+	backoff         time.Duration
+	halfOpenAt      time.Time
+	probes          int
+	successes       int
+	hooks           []StateChangeHook
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	cfg = cfg.withDefaults()
+	return &CircuitBreaker{
+		config:  cfg,
+		state:   StateClosed,
+		backoff: cfg.RecoveryInterval,
+	}
+}
+
+// OnStateChange registers a hook called after every transition
+func (cb *CircuitBreaker) OnStateChange(hook StateChangeHook) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.hooks = append(cb.hooks, hook)
+}
+
+// State returns the current state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.state
+}
+
+// IsOpen checks if circuit is open
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	return cb.state == StateOpen
+}
+
+// Allow reports whether a call may go to the backend. While half-open only
+// HalfOpenProbes calls are let through; if their outcomes never arrive a new
+// round of probes starts after the current backoff.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case StateClosed:
+		return true
+	case StateHalfOpen:
+		if cb.probes >= cb.config.HalfOpenProbes {
+			if time.Since(cb.halfOpenAt) < cb.backoff {
+				return false
+			}
+			cb.halfOpenAt = time.Now()
+			cb.probes = 0
+		}
+		cb.probes++
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadyToProbe reports whether the circuit has been open for its current
+// backoff, and returns when it will be otherwise
+func (cb *CircuitBreaker) ReadyToProbe() (bool, time.Time) {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	at := cb.openedAt.Add(cb.backoff)
+	return cb.state == StateOpen && !time.Now().Before(at), at
+}
+
+// RecordFailure records a failed call
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.record(false)
+}
+
+// RecordTimeout records a call that ran out of time
+func (cb *CircuitBreaker) RecordTimeout() {
+	cb.record(true)
+}
+
+// record counts a failure or timeout and opens the circuit when needed
+func (cb *CircuitBreaker) record(timeout bool) {
+	cb.mu.Lock()
+	now := time.Now()
+	cb.lastFailureTime = now
+
+	var transition *breakerTransition
+	switch cb.state {
+	case StateClosed:
+		if timeout {
+			cb.bucket(now).timeouts++
+		} else {
+			cb.bucket(now).failures++
+		}
+		successes, failures, timeouts := cb.totals(now)
+		cb.failures = failures + timeouts
+		if cb.shouldTrip(successes, failures, timeouts) {
+			cb.backoff = cb.config.RecoveryInterval
+			transition = cb.transition(StateOpen, now)
+		}
+	case StateHalfOpen:
+		cb.failures++
+		cb.growBackoff()
+		transition = cb.transition(StateOpen, now)
+	case StateOpen:
+		// A failed recovery check keeps it open for longer
+		cb.growBackoff()
+		cb.openedAt = now
+	}
+	cb.mu.Unlock()
+
+	cb.notify(transition)
+}
+
+// RecordSuccess records a successful call
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	now := time.Now()
+
+	var transition *breakerTransition
+	switch cb.state {
+	case StateClosed:
+		cb.bucket(now).successes++
+	case StateHalfOpen:
+		cb.successes++
+		if cb.successes >= cb.config.SuccessThreshold {
+			cb.backoff = cb.config.RecoveryInterval
+			transition = cb.transition(StateClosed, now)
+		}
+	}
+	cb.mu.Unlock()
+
+	cb.notify(transition)
+}
+
+// Reset moves an open circuit to half-open so probes can test the backend
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	var transition *breakerTransition
+	if cb.state == StateOpen {
+		transition = cb.transition(StateHalfOpen, time.Now())
+	}
+	cb.mu.Unlock()
+
+	cb.notify(transition)
+}
+
+// shouldTrip decides whether the failures and timeouts in the window open
+// the circuit. Must be called with cb.mu held.
+func (cb *CircuitBreaker) shouldTrip(successes, failures, timeouts int) bool {
+	if failures < cb.config.FailureThreshold && timeouts < cb.config.TimeoutThreshold {
+		return false
+	}
+	if cb.config.FailureRate <= 0 {
+		return true
+	}
+	total := successes + failures + timeouts
+	if total < cb.config.MinRequests {
+		return false
+	}
+	return float64(failures+timeouts)/float64(total) >= cb.config.FailureRate
+}
+
+// growBackoff doubles the recovery backoff up to its maximum. Must be called
+// with cb.mu held.
+func (cb *CircuitBreaker) growBackoff() {
+	cb.backoff *= 2
+	if cb.backoff > cb.config.MaxRecoveryInterval {
+		cb.backoff = cb.config.MaxRecoveryInterval
+	}
+}
+
+// transition changes state and returns the change to report. Must be called
+// with cb.mu held.
+func (cb *CircuitBreaker) transition(to CircuitState, now time.Time) *breakerTransition {
+	t := &breakerTransition{from: cb.state, to: to, failures: cb.failures}
+	cb.state = to
+	cb.probes = 0
+	cb.successes = 0
+
+	switch to {
+	case StateOpen:
+		cb.openedAt = now
+	case StateHalfOpen:
+		cb.halfOpenAt = now
+	case StateClosed:
+		cb.failures = 0
+		cb.buckets = [breakerBuckets]breakerBucket{}
+	}
+	return t
+}
+
+// notify calls the hooks for a transition outside the lock
+func (cb *CircuitBreaker) notify(t *breakerTransition) {
+	if t == nil {
+		return
+	}
+	cb.mu.RLock()
+	hooks := cb.hooks
+	cb.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(t.from, t.to, t.failures)
+	}
+}
+
+// bucket returns the window slice now falls in, recycling a stale one. Must
+// be called with cb.mu held.
+func (cb *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := cb.bucketWidth()
+	start := now.Truncate(width)
+	b := &cb.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
+
+// totals sums the outcomes inside the failure window. Must be called with
+// cb.mu held.
+func (cb *CircuitBreaker) totals(now time.Time) (successes, failures, timeouts int) {
+	oldest := now.Truncate(cb.bucketWidth()).Add(-cb.config.FailureWindow)
+	for _, b := range cb.buckets {
+		if b.start.After(oldest) {
+			successes += b.successes
+			failures += b.failures
+			timeouts += b.timeouts
+		}
+	}
+	return successes, failures, timeouts
+}
+
+// bucketWidth is the duration of one window slice
+func (cb *CircuitBreaker) bucketWidth() time.Duration {
+	width := cb.config.FailureWindow / breakerBuckets
+	if width <= 0 {
+		width = time.Millisecond
+	}
+	return width
+}
+
+// breakerConfigFromEnv reads RATE_LIMIT_BREAKER_WINDOW,
+// RATE_LIMIT_BREAKER_FAILURE_RATE, RATE_LIMIT_BREAKER_MIN_REQUESTS,
+// RATE_LIMIT_BREAKER_PROBES, RATE_LIMIT_BREAKER_SUCCESS_THRESHOLD,
+// RATE_LIMIT_BREAKER_TIMEOUT_THRESHOLD and RATE_LIMIT_BREAKER_MAX_BACKOFF
+func breakerConfigFromEnv() (BreakerConfig, error) {
+	var cfg BreakerConfig
+	durations := map[string]*time.Duration{
+		"RATE_LIMIT_BREAKER_WINDOW":      &cfg.FailureWindow,
+		"RATE_LIMIT_BREAKER_MAX_BACKOFF": &cfg.MaxRecoveryInterval,
+	}
+	for name, field := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return BreakerConfig{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*field = d
+		}
+	}
+
+	counts := map[string]*int{
+		"RATE_LIMIT_BREAKER_MIN_REQUESTS":      &cfg.MinRequests,
+		"RATE_LIMIT_BREAKER_PROBES":            &cfg.HalfOpenProbes,
+		"RATE_LIMIT_BREAKER_SUCCESS_THRESHOLD": &cfg.SuccessThreshold,
+		"RATE_LIMIT_BREAKER_TIMEOUT_THRESHOLD": &cfg.TimeoutThreshold,
+	}
+	for name, field := range counts {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return BreakerConfig{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*field = n
+		}
+	}
+
+	if v := os.Getenv("RATE_LIMIT_BREAKER_FAILURE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return BreakerConfig{}, fmt.Errorf("invalid RATE_LIMIT_BREAKER_FAILURE_RATE %q", v)
+		}
+		cfg.FailureRate = rate
+	}
+	return cfg, nil
+}
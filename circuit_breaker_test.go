@@ -0,0 +1,187 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// tripBreaker records enough failures to open cb
+func tripBreaker(cb *CircuitBreaker) {
+	for i := 0; i < cb.config.FailureThreshold; i++ {
+		cb.RecordFailure()
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, RecoveryInterval: time.Hour, HalfOpenProbes: 3, SuccessThreshold: 2})
+	tripBreaker(cb)
+	if cb.Allow() {
+		t.Fatal("Open circuit should not let calls through")
+	}
+
+	cb.Reset()
+	for i := 0; i < 3; i++ {
+		if !cb.Allow() {
+			t.Fatalf("Probe %d should be let through", i+1)
+		}
+	}
+	if cb.Allow() {
+		t.Error("Only 3 probes should be let through while half-open")
+	}
+
+	cb.RecordSuccess()
+	if cb.State() != StateHalfOpen {
+		t.Errorf("One success should not close the circuit, got %v", cb.State())
+	}
+	cb.RecordSuccess()
+	if cb.State() != StateClosed {
+		t.Errorf("Two successes should close the circuit, got %v", cb.State())
+	}
+	if !cb.Allow() {
+		t.Error("Closed circuit should let calls through")
+	}
+}
+
+func TestCircuitBreaker_ProbeRoundRestarts(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, RecoveryInterval: 20 * time.Millisecond, HalfOpenProbes: 1})
+	tripBreaker(cb)
+	cb.Reset()
+
+	if !cb.Allow() || cb.Allow() {
+		t.Fatal("Expected exactly one probe")
+	}
+
+	// The probe's outcome never arrives
+	time.Sleep(30 * time.Millisecond)
+	if !cb.Allow() {
+		t.Error("A new probe should be let through after the backoff")
+	}
+}
+
+func TestCircuitBreaker_Backoff(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{
+		FailureThreshold:    1,
+		RecoveryInterval:    10 * time.Millisecond,
+		MaxRecoveryInterval: 40 * time.Millisecond,
+	})
+	tripBreaker(cb)
+
+	if ready, _ := cb.ReadyToProbe(); ready {
+		t.Error("Circuit should not be probed right after opening")
+	}
+	time.Sleep(15 * time.Millisecond)
+	if ready, _ := cb.ReadyToProbe(); !ready {
+		t.Error("Circuit should be ready to probe after the recovery interval")
+	}
+
+	// A failed probe reopens it and doubles the interval
+	cb.Reset()
+	cb.Allow()
+	cb.RecordFailure()
+	if cb.State() != StateOpen || cb.backoff != 20*time.Millisecond {
+		t.Errorf("Expected open with 20ms backoff, got %v with %v", cb.State(), cb.backoff)
+	}
+
+	// So does a failed recovery check while open, up to the maximum
+	cb.RecordFailure()
+	cb.RecordFailure()
+	if cb.backoff != 40*time.Millisecond {
+		t.Errorf("Expected backoff capped at 40ms, got %v", cb.backoff)
+	}
+
+	cb.Reset()
+	cb.Allow()
+	cb.RecordSuccess()
+	cb.Allow()
+	cb.RecordSuccess()
+	if cb.State() != StateClosed || cb.backoff != 10*time.Millisecond {
+		t.Errorf("Expected closed with the backoff reset, got %v with %v", cb.State(), cb.backoff)
+	}
+}
+
+func TestCircuitBreaker_FailureWindow(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, FailureWindow: 50 * time.Millisecond})
+
+	cb.RecordFailure()
+	time.Sleep(80 * time.Millisecond)
+	cb.RecordFailure()
+	if cb.IsOpen() {
+		t.Error("Failures outside the window should not open the circuit")
+	}
+
+	cb.RecordFailure()
+	if !cb.IsOpen() {
+		t.Error("Two failures within the window should open the circuit")
+	}
+}
+
+func TestCircuitBreaker_FailureRate(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{
+		FailureThreshold: 2,
+		FailureRate:      0.5,
+		MinRequests:      10,
+		FailureWindow:    time.Minute,
+	})
+
+	for i := 0; i < 18; i++ {
+		cb.RecordSuccess()
+	}
+	cb.RecordFailure()
+	cb.RecordFailure()
+	if cb.IsOpen() {
+		t.Fatal("2 failures in 20 calls should not open the circuit")
+	}
+
+	for i := 0; i < 15; i++ {
+		cb.RecordFailure()
+	}
+	if cb.IsOpen() {
+		t.Fatal("17 failures in 35 calls is below the failure rate")
+	}
+	cb.RecordFailure()
+	if !cb.IsOpen() {
+		t.Error("18 failures in 36 calls should open the circuit")
+	}
+}
+
+func TestCircuitBreaker_Hooks(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, RecoveryInterval: time.Hour, SuccessThreshold: 1})
+
+	var transitions []string
+	cb.OnStateChange(func(from, to CircuitState, failures int) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+
+	tripBreaker(cb)
+	cb.Reset()
+	cb.Allow()
+	cb.RecordFailure()
+	cb.Reset()
+	cb.Allow()
+	cb.RecordSuccess()
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if !equalSequence(transitions, want) {
+		t.Errorf("Expected transitions %v, got %v", want, transitions)
+	}
+}
+
+func TestBreakerConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_BREAKER_PROBES")
+	defer os.Unsetenv("RATE_LIMIT_BREAKER_FAILURE_RATE")
+	defer os.Unsetenv("RATE_LIMIT_BREAKER_WINDOW")
+
+	os.Setenv("RATE_LIMIT_BREAKER_PROBES", "5")
+	os.Setenv("RATE_LIMIT_BREAKER_FAILURE_RATE", "0.25")
+	os.Setenv("RATE_LIMIT_BREAKER_WINDOW", "30s")
+	cfg, err := breakerConfigFromEnv()
+	if err != nil || cfg.HalfOpenProbes != 5 || cfg.FailureRate != 0.25 || cfg.FailureWindow != 30*time.Second {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_BREAKER_FAILURE_RATE", "2")
+	if _, err := breakerConfigFromEnv(); err == nil {
+		t.Error("Expected error for a failure rate above 1")
+	}
+}
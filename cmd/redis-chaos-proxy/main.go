@@ -0,0 +1,69 @@
+// Command redis-chaos-proxy sits between the rate limiter and a Redis server
+// and injects network faults. Faults are applied from a schedule given on
+// the command line and from commands typed on stdin, one per line:
+//
+//	redis-chaos-proxy -listen 127.0.0.1:6380 -upstream 127.0.0.1:6379 \
+//	    -schedule "10s=latency 200ms; 20s=blackhole; 30s=clear"
+//
+// Point REDIS_URL at the listen address to route the limiter through it.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/ahafonof/claude-code-requirements-builder/internal/chaosproxy"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:6380", "address to accept clients on")
+	upstream := flag.String("upstream", "127.0.0.1:6379", "Redis address to forward to")
+	schedule := flag.String("schedule", "", `fault schedule, e.g. "5s=latency 100ms; 15s=clear"`)
+	flag.Parse()
+
+	steps, err := chaosproxy.ParseSchedule(*schedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid schedule: %v\n", err)
+		os.Exit(2)
+	}
+
+	proxy, err := chaosproxy.Start(*listen, *upstream)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start proxy: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() { _ = proxy.Close() }()
+	fmt.Printf("Proxying %s -> %s\n", proxy.Addr(), *upstream)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if len(steps) > 0 {
+		go func() {
+			if err := proxy.RunSchedule(ctx, steps); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Schedule stopped: %v\n", err)
+			}
+		}()
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			if err := proxy.Apply(line); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			fmt.Printf("Applied: %s\n", line)
+		}
+	}()
+
+	<-ctx.Done()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConsistencyLevel trades the latency of a decision against how exactly the
+// limit holds across instances. It applies to the sliding window only:
+// calendar quotas are always charged in the store, so with quotas
+// configured every allowed request still costs a synchronous round trip.
+type ConsistencyLevel string
+
+const (
+	// ConsistencyStrict checks the shared store on every request
+	ConsistencyStrict ConsistencyLevel = "strict"
+	// ConsistencyAsync decides on the last synced count and pushes
+	// admissions to the store in the background
+	ConsistencyAsync ConsistencyLevel = "async"
+	// ConsistencyLocalFirst limits locally until a key nears its limit
+	ConsistencyLocalFirst ConsistencyLevel = "local-first"
+)
+
+// DefaultSyncInterval is how often locally decided requests are pushed
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// DefaultMaxStaleness bounds the age of the counts async decisions use
+const DefaultMaxStaleness = time.Second
+
+// DefaultLocalFirstThreshold is the share of the limit after which
+// local-first keys are checked against the store
+const DefaultLocalFirstThreshold = 0.8
+
+// ConsistencyConfig tunes the async and local-first consistency levels
+type ConsistencyConfig struct {
+	// SyncInterval is how often locally decided requests are pushed to the
+	// store and the shared counts read back
+	SyncInterval time.Duration
+	// MaxStaleness is the oldest synced count an async decision may use.
+	// Keys synced longer ago are checked strictly.
+	MaxStaleness time.Duration
+	// LocalFirstThreshold is the share of the limit, between 0 and 1, at
+	// which local-first keys switch to strict checks
+	LocalFirstThreshold float64
+}
+
+// validate checks a consistency level named by a policy
+func (l ConsistencyLevel) validate() error {
+	switch l {
+	case ConsistencyStrict, ConsistencyAsync, ConsistencyLocalFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown consistency level %q", l)
+}
+
+// syncedWindow is what this instance knows about one key decided locally
+type syncedWindow struct {
+	keys WindowKeys
+	// Admitted here and not yet pushed to the store
+	pending []WindowEntry
+	// Being pushed by the running sync
+	inflight []WindowEntry
+	// Admitted here and still inside the window
+	admitted []time.Time
+	// Store count at the last sync, including everything pushed so far
+	remote   int
+	syncedAt time.Time
+	// Last request that asked about the key
+	lastSeen time.Time
+}
+
+// trim drops local admissions that left the window
+func (w *syncedWindow) trim(windowStart time.Time) {
+	i := 0
+	for i < len(w.admitted) && !w.admitted[i].After(windowStart) {
+		i++
+	}
+	w.admitted = w.admitted[i:]
+}
+
+// syncTable tracks the keys decided locally by this instance, by window key
+type syncTable struct {
+	mu      sync.Mutex
+	windows map[string]*syncedWindow
+}
+
+func newSyncTable() *syncTable {
+	return &syncTable{windows: make(map[string]*syncedWindow)}
+}
+
+// forget drops a refunded local admission. It reports true when the entry
+// had not been pushed yet, so the store never needs to hear about it.
+func (t *syncTable) forget(window, member string, at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[window]
+	if !ok {
+		return false
+	}
+	for i, a := range w.admitted {
+		if a.Equal(at) {
+			w.admitted = append(w.admitted[:i], w.admitted[i+1:]...)
+			break
+		}
+	}
+	for i, e := range w.pending {
+		if e.Member == member {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// localAllow decides a request under the async or local-first level. It
+// reports false for handled when the key must be checked strictly instead.
+func (drl *DistributedRateLimiter) localAllow(keys WindowKeys, ip string, level ConsistencyLevel) (d windowDecision, handled bool) {
+	cfg := drl.consistencyConfig()
+	now := time.Now()
+
+	t := drl.syncs
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[keys.Window]
+	if !ok {
+		w = &syncedWindow{keys: keys}
+		t.windows[keys.Window] = w
+	}
+	w.trim(now.Add(-drl.config.Window))
+	w.lastSeen = now
+
+	fresh := !w.syncedAt.IsZero() && now.Sub(w.syncedAt) <= cfg.MaxStaleness
+	estimate := 0
+	if fresh {
+		estimate = w.remote + len(w.pending) + len(w.inflight)
+	}
+
+	if level == ConsistencyAsync {
+		// Without a recent count the decision would be a guess
+		if !fresh {
+			return windowDecision{}, false
+		}
+	} else {
+		if local := len(w.admitted) * drl.clusterSize(); local > estimate {
+			estimate = local
+		}
+		if float64(estimate+1) > cfg.LocalFirstThreshold*float64(drl.config.Limit) {
+			return windowDecision{}, false
+		}
+	}
+
+	drl.metrics.mu.Lock()
+	drl.metrics.LocalDecisions++
+	drl.metrics.mu.Unlock()
+	if estimate >= drl.config.Limit {
+		return windowDecision{}, true
+	}
+
+	entry := WindowEntry{Member: uuid.New().String(), At: now}
+	w.pending = append(w.pending, entry)
+	w.admitted = append(w.admitted, now)
+	return windowDecision{allowed: true, unit: &consumedUnit{key: ip, keys: keys, at: now, member: entry.Member, remote: drl}}, true
+}
+
+// startSync pushes local decisions to the store every sync interval until
+// the limiter is closed
+func (drl *DistributedRateLimiter) startSync() {
+	ticker := time.NewTicker(drl.consistencyConfig().SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-drl.done:
+			return
+		case <-ticker.C:
+		}
+		drl.syncWindows()
+	}
+}
+
+// syncWindows pushes pending admissions and reads the shared counts back,
+// for the tracked keys that have entries pending or whose count would go
+// stale before the next round, all in one store call. On failure the keys
+// keep their entries for the next round, as they do while the circuit
+// breaker keeps the store out.
+func (drl *DistributedRateLimiter) syncWindows() {
+	cfg := drl.consistencyConfig()
+	now := time.Now()
+	windowStart := now.Add(-drl.config.Window)
+
+	t := drl.syncs
+	t.mu.Lock()
+	var syncs []WindowSync
+	for key, w := range t.windows {
+		w.trim(windowStart)
+		if len(w.pending) == 0 && now.Sub(w.lastSeen) > drl.config.Window {
+			delete(t.windows, key)
+			continue
+		}
+		if len(w.pending) == 0 && !w.syncedAt.IsZero() && now.Add(cfg.SyncInterval).Sub(w.syncedAt) <= cfg.MaxStaleness {
+			continue
+		}
+		w.inflight = w.pending
+		w.pending = nil
+		syncs = append(syncs, WindowSync{Keys: w.keys, Entries: w.inflight})
+	}
+	t.mu.Unlock()
+	if len(syncs) == 0 {
+		return
+	}
+
+	counts, err := drl.pushWindows(syncs, now)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, sync := range syncs {
+		w, ok := t.windows[sync.Keys.Window]
+		if !ok {
+			continue
+		}
+		if err != nil {
+			w.pending = append(w.inflight, w.pending...)
+		} else {
+			w.remote = int(counts[i])
+			w.syncedAt = now
+		}
+		w.inflight = nil
+	}
+}
+
+// pushWindows replays the syncs into the shared windows, which also trims
+// them, and returns the resulting counts
+func (drl *DistributedRateLimiter) pushWindows(syncs []WindowSync, now time.Time) ([]int64, error) {
+	if !drl.circuitBreaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+	var counts []int64
+	err := drl.storeCall("consistency_sync", func() (err error) {
+		counts, err = drl.store.SyncWindows(ctx, syncs, now, drl.config.Window)
+		return err
+	})
+	return counts, err
+}
+
+// consistencyConfig returns the configured settings with defaults filled in
+func (drl *DistributedRateLimiter) consistencyConfig() ConsistencyConfig {
+	cfg := drl.config.Consistency
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+	if cfg.MaxStaleness <= 0 {
+		cfg.MaxStaleness = DefaultMaxStaleness
+	}
+	if cfg.LocalFirstThreshold <= 0 || cfg.LocalFirstThreshold > 1 {
+		cfg.LocalFirstThreshold = DefaultLocalFirstThreshold
+	}
+	return cfg
+}
+
+// clusterSize returns the last known number of live instances
+func (drl *DistributedRateLimiter) clusterSize() int {
+	drl.metrics.mu.RLock()
+	defer drl.metrics.mu.RUnlock()
+	if drl.metrics.ClusterSize < 1 {
+		return 1
+	}
+	return int(drl.metrics.ClusterSize)
+}
+
+// consistencyConfigFromEnv reads RATE_LIMIT_SYNC_INTERVAL,
+// RATE_LIMIT_MAX_STALENESS and RATE_LIMIT_LOCAL_FIRST_THRESHOLD
+func consistencyConfigFromEnv() (ConsistencyConfig, error) {
+	var cfg ConsistencyConfig
+	durations := map[string]*time.Duration{
+		"RATE_LIMIT_SYNC_INTERVAL": &cfg.SyncInterval,
+		"RATE_LIMIT_MAX_STALENESS": &cfg.MaxStaleness,
+	}
+	for name, field := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return ConsistencyConfig{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*field = d
+		}
+	}
+	if v := os.Getenv("RATE_LIMIT_LOCAL_FIRST_THRESHOLD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return ConsistencyConfig{}, fmt.Errorf("invalid RATE_LIMIT_LOCAL_FIRST_THRESHOLD %q", v)
+		}
+		cfg.LocalFirstThreshold = f
+	}
+	return cfg, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// Policies deciding at the async and local-first consistency levels
+var (
+	asyncPolicy      = &Policy{Name: "default", Consistency: ConsistencyAsync}
+	localFirstPolicy = &Policy{Name: "default", Consistency: ConsistencyLocalFirst}
+)
+
+// TestDistributedRateLimiter_AsyncConsistency tests deciding on synced
+// counts and pushing admissions in the background
+func TestDistributedRateLimiter_AsyncConsistency(t *testing.T) {
+	cfg := testConfig()
+	cfg.Limit = 5
+	cfg.Consistency = ConsistencyConfig{SyncInterval: time.Hour, MaxStaleness: time.Minute}
+	store := &countingStore{Store: NewMemoryStore()}
+	drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+	defer func() { _ = drl.Close() }()
+	ctx := context.Background()
+
+	// Nothing synced yet, so the first request is checked strictly
+	if allowed, _, _ := drl.allowWithQuotas(ctx, "async-ip", asyncPolicy); !allowed {
+		t.Fatal("First request should be allowed")
+	}
+	if n := store.allows.Load(); n != 1 {
+		t.Fatalf("Expected a strict check before the first sync, got %d", n)
+	}
+
+	drl.syncWindows()
+	for i := 0; i < 4; i++ {
+		if allowed, _, _ := drl.allowWithQuotas(ctx, "async-ip", asyncPolicy); !allowed {
+			t.Fatalf("Request %d should be allowed", i+2)
+		}
+	}
+	if allowed, _, _ := drl.allowWithQuotas(ctx, "async-ip", asyncPolicy); allowed {
+		t.Error("Request over the limit should be rejected locally")
+	}
+	if n := store.allows.Load(); n != 1 {
+		t.Errorf("Expected no store calls after the sync, got %d", n)
+	}
+	if n := drl.GetMetrics().LocalDecisions; n != 5 {
+		t.Errorf("Expected 5 local decisions, got %d", n)
+	}
+
+	drl.syncWindows()
+	if count, _ := store.Count(ctx, testKeys.windowKeys("async-ip").Window); count != 5 {
+		t.Errorf("Expected local admissions pushed to the store, got %d", count)
+	}
+
+	// A count older than the staleness bound is not trusted
+	drl.syncs.windows[testKeys.windowKeys("async-ip").Window].syncedAt = time.Now().Add(-2 * time.Minute)
+	if allowed, _, _ := drl.allowWithQuotas(ctx, "async-ip", asyncPolicy); allowed {
+		t.Error("Stale key should be checked strictly and rejected")
+	}
+	if n := store.allows.Load(); n != 2 {
+		t.Errorf("Expected a strict check for the stale key, got %d", n)
+	}
+}
+
+// TestDistributedRateLimiter_SyncOnlyPendingOrStale tests that keys with
+// nothing pending and a count fresh enough are left out of a sync
+func TestDistributedRateLimiter_SyncOnlyPendingOrStale(t *testing.T) {
+	cfg := testConfig()
+	cfg.Consistency = ConsistencyConfig{SyncInterval: time.Hour, MaxStaleness: 2 * time.Hour}
+	store := &countingStore{Store: NewMemoryStore()}
+	drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+	defer func() { _ = drl.Close() }()
+	ctx := context.Background()
+
+	drl.allowWithQuotas(ctx, "sync-a", localFirstPolicy)
+	drl.allowWithQuotas(ctx, "sync-b", localFirstPolicy)
+	drl.syncWindows()
+	if n := store.syncs.Load(); n != 1 {
+		t.Fatalf("Expected both keys pushed in one store call, got %d", n)
+	}
+
+	drl.syncWindows()
+	if n := store.syncs.Load(); n != 1 {
+		t.Errorf("Expected no store call with nothing pending, got %d", n)
+	}
+
+	drl.allowWithQuotas(ctx, "sync-a", localFirstPolicy)
+	drl.syncs.windows[testKeys.windowKeys("sync-b").Window].syncedAt = time.Now().Add(-2 * time.Hour)
+	drl.syncWindows()
+	if n := store.syncs.Load(); n != 2 {
+		t.Errorf("Expected the pending and the stale key synced together, got %d calls", n)
+	}
+	if w := drl.syncs.windows[testKeys.windowKeys("sync-b").Window]; time.Since(w.syncedAt) > time.Minute {
+		t.Error("Expected the stale key to be synced")
+	}
+	if count, _ := store.Count(ctx, testKeys.windowKeys("sync-a").Window); count != 2 {
+		t.Errorf("Expected both admissions of sync-a pushed, got %d", count)
+	}
+}
+
+// TestDistributedRateLimiter_LocalFirstConsistency tests local limiting
+// until a key nears its limit
+func TestDistributedRateLimiter_LocalFirstConsistency(t *testing.T) {
+	cfg := testConfig()
+	cfg.Limit = 10
+	cfg.Consistency = ConsistencyConfig{SyncInterval: time.Hour, LocalFirstThreshold: 0.5}
+	store := &countingStore{Store: NewMemoryStore()}
+	drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+	defer func() { _ = drl.Close() }()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if allowed, _, _ := drl.allowWithQuotas(ctx, "local-ip", localFirstPolicy); !allowed {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+	if n := store.allows.Load(); n != 0 {
+		t.Fatalf("Expected no store calls below the threshold, got %d", n)
+	}
+
+	// Past the threshold the local admissions reach the store first
+	drl.syncWindows()
+	for i := 0; i < 5; i++ {
+		if allowed, _, _ := drl.allowWithQuotas(ctx, "local-ip", localFirstPolicy); !allowed {
+			t.Fatalf("Request %d should be allowed", i+6)
+		}
+	}
+	if n := store.allows.Load(); n != 5 {
+		t.Errorf("Expected strict checks near the limit, got %d", n)
+	}
+	if allowed, _, _ := drl.allowWithQuotas(ctx, "local-ip", localFirstPolicy); allowed {
+		t.Error("Request over the limit should be rejected")
+	}
+}
+
+// TestDistributedRateLimiter_RefundLocalDecision tests that a refunded unit
+// that was never pushed does not reach the store
+func TestDistributedRateLimiter_RefundLocalDecision(t *testing.T) {
+	cfg := testConfig()
+	cfg.Consistency = ConsistencyConfig{SyncInterval: time.Hour}
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+	ctx := context.Background()
+
+	allowed, unit, _ := drl.allowWithQuotas(ctx, "refund-local-ip", localFirstPolicy)
+	if !allowed || unit == nil {
+		t.Fatal("Request should be allowed locally")
+	}
+	drl.allowWithQuotas(ctx, "refund-local-ip", localFirstPolicy)
+	if err := unit.Refund(context.Background()); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+
+	drl.syncWindows()
+	if count, _ := drl.store.Count(ctx, testKeys.windowKeys("refund-local-ip").Window); count != 1 {
+		t.Errorf("Expected only the kept unit pushed, got %d", count)
+	}
+}
+
+func TestConsistencyConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_MAX_STALENESS")
+	defer os.Unsetenv("RATE_LIMIT_LOCAL_FIRST_THRESHOLD")
+
+	os.Setenv("RATE_LIMIT_MAX_STALENESS", "500ms")
+	os.Setenv("RATE_LIMIT_LOCAL_FIRST_THRESHOLD", "0.9")
+	cfg, err := consistencyConfigFromEnv()
+	if err != nil || cfg.MaxStaleness != 500*time.Millisecond || cfg.LocalFirstThreshold != 0.9 {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_LOCAL_FIRST_THRESHOLD", "1.5")
+	if _, err := consistencyConfigFromEnv(); err == nil {
+		t.Error("Expected error for a threshold above 1")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultDecisionTimeout bounds the store calls made for one decision
+const DefaultDecisionTimeout = 100 * time.Millisecond
+
+// decisionContext derives the context for one rate limit decision from
+// parent, expiring after the configured decision timeout
+func (drl *DistributedRateLimiter) decisionContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := drl.config.DecisionTimeout
+	if timeout <= 0 {
+		timeout = DefaultDecisionTimeout
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// isTimeout reports whether err means a store call ran out of time, either
+// on its context deadline or on a network timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// decisionTimeoutFromEnv reads RATE_LIMIT_DECISION_TIMEOUT
+func decisionTimeoutFromEnv() (time.Duration, error) {
+	v := os.Getenv("RATE_LIMIT_DECISION_TIMEOUT")
+	if v == "" {
+		return DefaultDecisionTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return DefaultDecisionTimeout, fmt.Errorf("invalid RATE_LIMIT_DECISION_TIMEOUT %q", v)
+	}
+	return d, nil
+}
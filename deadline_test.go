@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestDistributedRateLimiter_DecisionTimeout tests that a slow store makes
+// the request fall back once the decision deadline passes
+func TestDistributedRateLimiter_DecisionTimeout(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	cfg.DecisionTimeout = 20 * time.Millisecond
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	srv.SetLatency(500 * time.Millisecond)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	start := time.Now()
+	if !drl.AllowWithRequest("deadline-ip", r) {
+		t.Fatal("Request should be allowed by the fallback limiter")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("Decision took %v, expected it to stop at the deadline", elapsed)
+	}
+
+	metrics := drl.GetMetrics()
+	if metrics.FallbackCount != 1 {
+		t.Errorf("Expected 1 fallback request, got %d", metrics.FallbackCount)
+	}
+	if metrics.RedisTimeouts != 1 || metrics.RedisFailures != 0 {
+		t.Errorf("Expected 1 timeout and no other failures, got %d and %d", metrics.RedisTimeouts, metrics.RedisFailures)
+	}
+}
+
+// TestDistributedRateLimiter_ClientGone tests that a cancelled request
+// context does not count against the circuit breaker
+func TestDistributedRateLimiter_ClientGone(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.FailureThreshold = 1
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	drl.AllowWithRequest("client-gone-ip", r)
+
+	if drl.circuitBreaker.IsOpen() {
+		t.Error("A cancelled request should not open the circuit")
+	}
+	if metrics := drl.GetMetrics(); metrics.RedisTimeouts != 0 || metrics.RedisFailures != 0 {
+		t.Errorf("Expected no failures recorded, got %d timeouts and %d failures", metrics.RedisTimeouts, metrics.RedisFailures)
+	}
+}
+
+// TestDistributedRateLimiter_RequestCallsDeadline tests that the store calls
+// made around a decision stop at the deadline and count as timeouts
+func TestDistributedRateLimiter_RequestCallsDeadline(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	cfg.DecisionTimeout = 20 * time.Millisecond
+	cfg.FailureThreshold = 10
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+	pb := NewPenaltyBox(PenaltyConfig{}, drl, nil)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	allowed, unit := drl.allowUnitWithRequest("request-deadline-ip", r)
+	if !allowed {
+		t.Fatal("Request should be allowed")
+	}
+	srv.SetLatency(500 * time.Millisecond)
+	defer srv.SetLatency(0)
+
+	start := time.Now()
+	if err := unit.Refund(r.Context()); err == nil {
+		t.Error("Expected the refund to time out")
+	}
+	pb.Banned(r.Context(), "request-deadline-ip")
+	pb.RecordRejection(r.Context(), "request-deadline-ip")
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Calls took %v, expected each to stop at the deadline", elapsed)
+	}
+
+	if metrics := drl.GetMetrics(); metrics.RedisTimeouts != 3 || metrics.RedisFailures != 0 {
+		t.Errorf("Expected 3 timeouts and no other failures, got %d and %d", metrics.RedisTimeouts, metrics.RedisFailures)
+	}
+}
+
+// TestDistributedRateLimiter_BackgroundCallsDeadline tests that heartbeats
+// and fallback reconciliation stop waiting on a hung store
+func TestDistributedRateLimiter_BackgroundCallsDeadline(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	cfg.DecisionTimeout = 20 * time.Millisecond
+	cfg.FailureThreshold = 10
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	drl.fallbackAllow(DefaultKeyspaceName, "background-deadline-ip")
+	before := drl.GetMetrics().RedisTimeouts
+	srv.SetLatency(500 * time.Millisecond)
+	defer srv.SetLatency(0)
+
+	start := time.Now()
+	drl.heartbeat(time.Minute)
+	drl.reconcileFallback()
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Calls took %v, expected each to stop at the deadline", elapsed)
+	}
+	if n := drl.GetMetrics().RedisTimeouts - before; n != 2 {
+		t.Errorf("Expected 2 timeouts recorded, got %d", n)
+	}
+}
+
+func TestCircuitBreaker_TimeoutThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 3, TimeoutThreshold: 2})
+
+	cb.RecordFailure()
+	cb.RecordFailure()
+	cb.RecordTimeout()
+	if cb.IsOpen() {
+		t.Fatal("Timeouts and failures should be counted apart")
+	}
+	cb.RecordTimeout()
+	if !cb.IsOpen() {
+		t.Error("Two timeouts should open the circuit")
+	}
+
+	if cb := NewCircuitBreaker(BreakerConfig{FailureThreshold: 4}); cb.config.TimeoutThreshold != 4 {
+		t.Errorf("Timeout threshold should default to the failure threshold, got %d", cb.config.TimeoutThreshold)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("lease: %w", context.DeadlineExceeded), true},
+		{os.ErrDeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("ERR unknown command"), false},
+	}
+	for _, tc := range tests {
+		if got := isTimeout(tc.err); got != tc.want {
+			t.Errorf("isTimeout(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDecisionTimeoutFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_DECISION_TIMEOUT")
+
+	if d, err := decisionTimeoutFromEnv(); err != nil || d != DefaultDecisionTimeout {
+		t.Errorf("Expected the default timeout, got %v, %v", d, err)
+	}
+
+	os.Setenv("RATE_LIMIT_DECISION_TIMEOUT", "50ms")
+	if d, err := decisionTimeoutFromEnv(); err != nil || d != 50*time.Millisecond {
+		t.Errorf("Expected 50ms, got %v, %v", d, err)
+	}
+
+	os.Setenv("RATE_LIMIT_DECISION_TIMEOUT", "-1s")
+	if _, err := decisionTimeoutFromEnv(); err == nil {
+		t.Error("Expected error for a negative timeout")
+	}
+}
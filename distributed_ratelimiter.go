@@ -26,6 +26,60 @@ type Config struct {
 	Window           time.Duration
 	FailureThreshold int
 	RecoveryInterval time.Duration
+	ReservationTTL   time.Duration
+	// Calendar quotas, checked in the store on every allowed request even
+	// under the async and local-first consistency levels
+	Quotas           []QuotaConfig
+
+	// Namespace of every key this limiter writes
+	Keys Keyspace
+	
+	// Convert keys left by releases without a keyspace when connecting. Off
+	// unless no instance of such a release still runs against the store.
+	MigrateOnStart bool
+
+	// Sync and staleness settings of the async and local-first policies
+	Consistency ConsistencyConfig
+	
+	// Per-region G-counters exchanged with the Redis of other regions
+	Regions RegionConfig
+	
+	// Share activity events with the other instances over Redis Pub/Sub
+	EventRelay bool
+	
+	// Keep activity events in a capped Redis Stream
+	EventHistory EventHistoryConfig
+
+	// Sentinel-managed primary, used instead of the RedisURL address
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+
+	// Redis Cluster seed nodes, used instead of the RedisURL address
+	ClusterAddrs []string
+	
+	// TLS, ACL and pool settings applied on top of RedisURL
+	Redis RedisConnConfig
+
+	// Pipelining of concurrent sliding window checks
+	Batch BatchConfig
+	
+	// Local leasing of sliding window budget
+	Lease LeaseConfig
+	
+	// How often this instance announces itself to learn the cluster size
+	HeartbeatInterval time.Duration
+	
+	// Probing, backoff and failure-rate settings of the circuit breaker.
+	// FailureThreshold and RecoveryInterval above take precedence.
+	Breaker BreakerConfig
+	
+	// Deadline for the store calls of one decision, after which the request
+	// falls back to local limiting
+	DecisionTimeout time.Duration
+	
+	// Reaction to each class of store errors, overriding the defaults
+	ErrorPolicies map[RedisErrorClass]ErrorPolicy
 }
 
 // Metrics tracks rate limiter performance
@@ -36,29 +90,35 @@ type Metrics struct {
 	RejectedRequests int64
 	RedisLatency     time.Duration
 	RedisFailures    int64
+	RedisTimeouts    int64
+	FailuresByClass  map[RedisErrorClass]int64
+	RefundedRequests int64
 	FallbackMode     string
 	FallbackCount    int64
+	LeaseHits        int64
+	LocalDecisions   int64
+	ReplicationLag   map[string]time.Duration
+	ClusterSize      int64
 	LastUpdated      time.Time
 }
 
-// CircuitBreaker manages Redis connection health
-type CircuitBreaker struct {
-	mu               sync.RWMutex
-	state            CircuitState
-	failures         int
-	failureThreshold int
-	lastFailureTime  time.Time
-	recoveryInterval time.Duration
-}
-
-// DistributedRateLimiter extends basic rate limiter with Redis support
+// DistributedRateLimiter extends basic rate limiter with a shared Store
 type DistributedRateLimiter struct {
-	redisClient     *redis.Client
+	store           Store
 	fallbackLimiter *RateLimiter
 	circuitBreaker  *CircuitBreaker
 	metrics         *Metrics
 	config          *Config
-	luaScript       *redis.Script
+	localQuotas     *quotaCounters
+	leases          *leaseTable
+	syncs           *syncTable
+	regions         *regionCounters
+	relay           *eventRelay
+	history         *eventHistory
+	registry        *instanceRegistry
+	failover        *failoverWatcher
+	instanceID      string
+	done            chan struct{}
 	ctx             context.Context
 	eventEmitter    *EventEmitter
 }
@@ -66,163 +126,289 @@ type DistributedRateLimiter struct {
 // NewDistributedRateLimiter creates a new distributed rate limiter
 func NewDistributedRateLimiter(cfg *Config, eventEmitter *EventEmitter) (*DistributedRateLimiter, error) {
 	// Initialize Redis client
-	opt, err := redis.ParseURL(cfg.RedisURL)
+	opts, err := universalOptions(cfg)
 	if err != nil {
 		return nil, err
 	}
 	
-	redisClient := redis.NewClient(opt)
-	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(opts)
+	
+	// Test Redis connection. When Redis is not available we continue with
+	// fallback and load the scripts once the circuit recovers.
+	pingErr := redisClient.Ping(context.Background()).Err()
+	
+	store := NewRedisStore(redisClient)
+	store.EnableBatching(cfg.Batch)
+	
+	var regions *regionCounters
+	if cfg.Regions.enabled() {
+		regions, err = newRegionCounters(cfg, redisClient)
+		if err != nil {
+			_ = redisClient.Close()
+			return nil, err
+		}
+	}
+	
+	drl := newDistributedRateLimiter(cfg, store, eventEmitter, newInstanceRegistry(redisClient, cfg.Keys))
+	if opts.MasterName != "" {
+		drl.failover = watchFailover(opts, eventEmitter)
+	}
+	if regions != nil {
+		drl.regions = regions
+	}
 	
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		// Redis not available, but we'll continue with fallback
-		// Log the error for debugging purposes
-		_ = err
+	// A script that doesn't compile would fail every request
+	if pingErr == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), scriptLoadTimeout)
+		err := drl.loadScripts(ctx)
+		cancel()
+		if isScriptLoadError(err) {
+			_ = drl.Close()
+			return nil, err
+		}
 	}
 	
+	if regions != nil {
+		go drl.startRegionSync()
+	}
+	if cfg.MigrateOnStart && pingErr == nil {
+		go drl.migrateOnStart(redisClient)
+	}
+	if cfg.EventRelay && eventEmitter != nil {
+		drl.relay = startEventRelay(redisClient, cfg.Keys, drl.instanceID, eventEmitter)
+	}
+	if cfg.EventHistory.Enabled && eventEmitter != nil {
+		drl.history = startEventHistory(redisClient, cfg.Keys, drl.instanceID, cfg.EventHistory, eventEmitter, drl.circuitBreaker)
+	}
+	return drl, nil
+}
+
+// NewDistributedRateLimiterWithStore creates a distributed rate limiter on
+// top of any Store implementation
+func NewDistributedRateLimiterWithStore(cfg *Config, store Store, eventEmitter *EventEmitter) *DistributedRateLimiter {
+	return newDistributedRateLimiter(cfg, store, eventEmitter, nil)
+}
+
+// newDistributedRateLimiter creates the limiter and starts its background
+// work. A registry publishes this instance's reports with every heartbeat.
+func newDistributedRateLimiter(cfg *Config, store Store, eventEmitter *EventEmitter, registry *instanceRegistry) *DistributedRateLimiter {
 	// Create fallback limiter
 	fallbackLimiter := &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    cfg.Limit,
-		window:   cfg.Window,
+		requests:       make(map[string][]time.Time),
+		limit:          cfg.Limit,
+		window:         cfg.Window,
+		reservationTTL: cfg.ReservationTTL,
 	}
 	
 	// Create circuit breaker
-	circuitBreaker := &CircuitBreaker{
-		state:            StateClosed,
-		failureThreshold: cfg.FailureThreshold,
-		recoveryInterval: cfg.RecoveryInterval,
-	}
+	breakerCfg := cfg.Breaker
+	breakerCfg.FailureThreshold = cfg.FailureThreshold
+	breakerCfg.RecoveryInterval = cfg.RecoveryInterval
+	circuitBreaker := NewCircuitBreaker(breakerCfg)
 	
 	// Initialize metrics
 	metrics := &Metrics{
 		FallbackMode: "distributed",
+		ClusterSize:  1,
 		LastUpdated:  time.Now(),
 	}
 	
-	// Lua script for atomic rate limiting
-	luaScript := redis.NewScript(`
-		local key = KEYS[1]
-		local now = ARGV[1]
-		local windowStart = ARGV[2]
-		local limit = tonumber(ARGV[3])
-		local requestId = ARGV[4]
-		
-		-- Remove old entries
-		redis.call('ZREMRANGEBYSCORE', key, 0, windowStart)
-		
-		-- Count current requests
-		local count = redis.call('ZCARD', key)
-		
-		-- Check limit
-		if count >= limit then
-			return 0
-		else
-			redis.call('ZADD', key, now, requestId)
-			redis.call('EXPIRE', key, 120)
-			return 1
-		end
-	`)
-	
 	drl := &DistributedRateLimiter{
-		redisClient:     redisClient,
+		store:           store,
 		fallbackLimiter: fallbackLimiter,
 		circuitBreaker:  circuitBreaker,
 		metrics:         metrics,
 		config:          cfg,
-		luaScript:       luaScript,
-		ctx:             ctx,
+		localQuotas:     newQuotaCounters(),
+		leases:          newLeaseTable(),
+		syncs:           newSyncTable(),
+		registry:        registry,
+		instanceID:      newInstanceID(),
+		done:            make(chan struct{}),
+		ctx:             context.Background(),
 		eventEmitter:    eventEmitter,
 	}
 	
+	circuitBreaker.OnStateChange(drl.onCircuitStateChange)
+	
 	// Start recovery goroutine
 	go drl.startRecoveryMonitor()
 	
-	return drl, nil
+	// Learn how many instances share the limit
+	go drl.startHeartbeat()
+	
+	// Push decisions made by async and local-first policies
+	go drl.startSync()
+	
+	return drl
 }
 
 // Allow checks if request from IP should be allowed
 func (drl *DistributedRateLimiter) Allow(ip string) bool {
+	allowed, _ := drl.allowUnit(ip)
+	return allowed
+}
+
+// allowUnit checks if request from IP should be allowed and returns the unit it consumed
+func (drl *DistributedRateLimiter) allowUnit(ip string) (bool, *consumedUnit) {
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+	
+	allowed, unit, _ := drl.allowWithQuotas(ctx, ip, defaultPolicy)
+	return allowed, unit
+}
+
+// windowDecision is the outcome of the sliding window check of a request
+type windowDecision struct {
+	allowed bool
+	unit    *consumedUnit
+	// Store round trip of the decision, zero when decided locally
+	latency time.Duration
+	// Decided by the fallback limiter
+	fallback bool
+}
+
+// allowWithQuotas applies the sliding window and then the calendar quotas
+// in the counters of policy, reporting which quota rejected the request if
+// any. The quotas are charged in the store whatever the consistency of the
+// policy: a period counter is only exact if every unit reaches it, and a
+// request the window admitted locally is still checked strictly here.
+func (drl *DistributedRateLimiter) allowWithQuotas(ctx context.Context, ip string, policy *Policy) (bool, *consumedUnit, *quotaExhaustion) {
+	keys := drl.config.Keys.forPolicy(policy.Name)
+	d := drl.windowAllow(ctx, keys, ip, policy.Consistency)
+	
+	var exhausted *quotaExhaustion
+	if d.allowed && len(drl.config.Quotas) > 0 {
+		var charge *quotaCharge
+		exhausted, charge = drl.consumeQuotas(ctx, keys, ip)
+		if exhausted != nil {
+			// The window unit was taken for a request the quota rejects
+			if d.unit != nil {
+				_ = d.unit.release(ctx)
+			}
+			d.allowed, d.unit = false, nil
+		} else {
+			if d.unit == nil {
+				d.unit = &consumedUnit{key: ip}
+			}
+			d.unit.quotas = charge
+		}
+	}
+	
+	drl.recordMetrics(d.allowed, d.latency, d.fallback)
+	return d.allowed, d.unit, exhausted
+}
+
+// windowAllow applies the sliding window limit in keys at the given
+// consistency level
+func (drl *DistributedRateLimiter) windowAllow(ctx context.Context, keys Keyspace, ip string, level ConsistencyLevel) windowDecision {
 	start := time.Now()
 	drl.metrics.mu.Lock()
 	drl.metrics.TotalRequests++
 	drl.metrics.mu.Unlock()
 	
 	// Check circuit breaker state
-	if drl.circuitBreaker.IsOpen() {
-		return drl.fallbackAllow(ip)
+	if !drl.circuitBreaker.Allow() {
+		return drl.fallbackAllow(keys.Policy, ip)
 	}
 	
-	// Try Redis operation
-	allowed, err := drl.redisAllow(ip)
-	if err != nil {
-		drl.circuitBreaker.RecordFailure(drl.eventEmitter)
-		// Emit Redis failure event
-		if drl.eventEmitter != nil {
-			drl.eventEmitter.EmitRedisFailure("rate_limit_check", err)
+	// Count against the merged counts of every region
+	if drl.regions != nil {
+		return drl.regionAllow(ctx, keys, ip, start)
+	}
+	
+	// Decide without a round trip when the policy tolerates over-admission
+	if level == ConsistencyAsync || level == ConsistencyLocalFirst {
+		if d, handled := drl.localAllow(keys.windowKeys(ip), ip, level); handled {
+			return d
 		}
-		return drl.fallbackAllow(ip)
 	}
 	
-	// Record success
-	drl.circuitBreaker.RecordSuccess()
-	drl.recordMetrics(allowed, time.Since(start), false)
+	// Serve from a locally leased chunk of the window when enabled
+	if drl.config.Lease.Size > 0 {
+		return drl.leaseAllow(ctx, keys, ip, start)
+	}
 	
-	return allowed
+	// Try Redis operation
+	wk := keys.windowKeys(ip)
+	var allowed bool
+	var requestID string
+	err := drl.storeCall("rate_limit_check", func() (err error) {
+		allowed, requestID, err = drl.redisAllow(ctx, wk)
+		return err
+	})
+	if err != nil {
+		return drl.fallbackAllow(keys.Policy, ip)
+	}
+	
+	d := windowDecision{allowed: allowed, latency: time.Since(start)}
+	if allowed {
+		d.unit = &consumedUnit{key: ip, keys: wk, member: requestID, remote: drl}
+	}
+	return d
 }
 
 // AllowWithRequest checks if request should be allowed and emits events
 func (drl *DistributedRateLimiter) AllowWithRequest(ip string, r *http.Request) bool {
-	allowed := drl.Allow(ip)
+	allowed, _ := drl.allowUnitWithRequest(ip, r)
+	return allowed
+}
+
+// allowUnitWithRequest is AllowWithRequest returning the consumed unit
+func (drl *DistributedRateLimiter) allowUnitWithRequest(ip string, r *http.Request) (bool, *consumedUnit) {
+	// Stop waiting on the store once the decision deadline passes or the
+	// client goes away
+	ctx, cancel := drl.decisionContext(r.Context())
+	defer cancel()
+	
+	allowed, unit, exhausted := drl.allowWithQuotas(ctx, ip, policyForRequest(r))
 	
 	// Emit rate limit rejection event if applicable
 	if !allowed && drl.eventEmitter != nil {
-		drl.eventEmitter.EmitRateLimitRejection(r)
+		if exhausted != nil {
+			drl.eventEmitter.EmitQuotaExhausted(r, string(exhausted.Period), exhausted.Limit, exhausted.ResetAt)
+		} else {
+			drl.eventEmitter.EmitRateLimitRejection(r)
+		}
 	}
 	
-	return allowed
+	return allowed, unit
 }
 
-// redisAllow performs rate limiting using Redis
-func (drl *DistributedRateLimiter) redisAllow(ip string) (bool, error) {
-	key := "rate_limit:" + ip
-	now := time.Now().UnixMilli()
-	windowStart := now - int64(drl.config.Window.Milliseconds())
+// redisAllow performs rate limiting in the shared window keys and returns
+// the member recorded for an allowed request
+func (drl *DistributedRateLimiter) redisAllow(ctx context.Context, keys WindowKeys) (bool, string, error) {
 	requestID := uuid.New().String()
 	
-	result, err := drl.luaScript.Run(
-		drl.ctx,
-		drl.redisClient,
-		[]string{key},
-		now,
-		windowStart,
-		drl.config.Limit,
+	allowed, err := drl.store.AllowRequest(
+		ctx,
+		keys,
 		requestID,
-	).Result()
-	
+		time.Now(),
+		drl.config.Window,
+		drl.config.Limit,
+	)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 	
-	allowed := result.(int64) == 1
-	return allowed, nil
+	return allowed, requestID, nil
 }
 
-// fallbackAllow uses local rate limiter when Redis is unavailable
-func (drl *DistributedRateLimiter) fallbackAllow(ip string) bool {
+// fallbackAllow uses local rate limiter when Redis is unavailable, counting
+// ip under the named policy
+func (drl *DistributedRateLimiter) fallbackAllow(policy, ip string) windowDecision {
 	drl.metrics.mu.Lock()
 	drl.metrics.FallbackCount++
 	drl.metrics.FallbackMode = "fallback"
 	drl.metrics.mu.Unlock()
 	
-	allowed := drl.fallbackLimiter.allow(ip)
-	drl.recordMetrics(allowed, 0, true)
-	
-	return allowed
+	allowed, unit := drl.fallbackLimiter.allowUnit(fallbackKey(policy, ip))
+	return windowDecision{allowed: allowed, unit: unit, fallback: true}
 }
 
-// recordMetrics updates performance metrics
+// recordMetrics updates performance metrics. Decisions made without a
+// round trip leave the last store latency as it is.
 func (drl *DistributedRateLimiter) recordMetrics(allowed bool, latency time.Duration, isFallback bool) {
 	drl.metrics.mu.Lock()
 	defer drl.metrics.mu.Unlock()
@@ -233,7 +419,7 @@ func (drl *DistributedRateLimiter) recordMetrics(allowed bool, latency time.Dura
 		drl.metrics.RejectedRequests++
 	}
 	
-	if !isFallback {
+	if !isFallback && latency > 0 {
 		drl.metrics.RedisLatency = latency
 	}
 	
@@ -245,6 +431,19 @@ func (drl *DistributedRateLimiter) GetMetrics() Metrics {
 	drl.metrics.mu.RLock()
 	defer drl.metrics.mu.RUnlock()
 	
+	var lag map[string]time.Duration
+	if drl.regions != nil {
+		lag = drl.regions.lag(time.Now())
+	}
+	
+	var byClass map[RedisErrorClass]int64
+	if len(drl.metrics.FailuresByClass) > 0 {
+		byClass = make(map[RedisErrorClass]int64, len(drl.metrics.FailuresByClass))
+		for class, n := range drl.metrics.FailuresByClass {
+			byClass[class] = n
+		}
+	}
+	
 	// Create a copy without the mutex
 	return Metrics{
 		TotalRequests:    drl.metrics.TotalRequests,
@@ -252,85 +451,99 @@ func (drl *DistributedRateLimiter) GetMetrics() Metrics {
 		RejectedRequests: drl.metrics.RejectedRequests,
 		RedisLatency:     drl.metrics.RedisLatency,
 		RedisFailures:    drl.metrics.RedisFailures,
+		RedisTimeouts:    drl.metrics.RedisTimeouts,
+		FailuresByClass:  byClass,
+		RefundedRequests: drl.metrics.RefundedRequests,
 		FallbackMode:     drl.metrics.FallbackMode,
 		FallbackCount:    drl.metrics.FallbackCount,
+		LeaseHits:        drl.metrics.LeaseHits,
+		LocalDecisions:   drl.metrics.LocalDecisions,
+		ReplicationLag:   lag,
+		ClusterSize:      drl.metrics.ClusterSize,
 		LastUpdated:      drl.metrics.LastUpdated,
 	}
 }
 
-// startRecoveryMonitor periodically checks if Redis is available
+// recoveryInterval returns the recovery interval of the breaker, which has
+// the default applied to an unset one
+func (drl *DistributedRateLimiter) recoveryInterval() time.Duration {
+	return drl.circuitBreaker.config.RecoveryInterval
+}
+
+// startRecoveryMonitor checks if Redis is available again once the circuit
+// has been open for its current backoff
 func (drl *DistributedRateLimiter) startRecoveryMonitor() {
-	ticker := time.NewTicker(drl.config.RecoveryInterval)
-	defer ticker.Stop()
+	interval := drl.recoveryInterval()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 	
-	for range ticker.C {
-		if drl.circuitBreaker.IsOpen() {
-			// Try to ping Redis
-			if err := drl.redisClient.Ping(drl.ctx).Err(); err == nil {
+	for {
+		select {
+		case <-drl.done:
+			return
+		case <-timer.C:
+		}
+		
+		ready, at := drl.circuitBreaker.ReadyToProbe()
+		if ready {
+			// Try to ping Redis, then make sure it knows our scripts
+			if err := drl.store.Ping(drl.ctx); err != nil {
+				drl.circuitBreaker.RecordFailure()
+			} else if err := drl.loadScripts(drl.ctx); err != nil {
+				if drl.eventEmitter != nil {
+					drl.eventEmitter.EmitRedisFailure("script_load", err)
+				}
+				drl.circuitBreaker.RecordFailure()
+			} else {
 				drl.circuitBreaker.Reset()
-				drl.metrics.mu.Lock()
-				drl.metrics.FallbackMode = "distributed"
-				drl.metrics.mu.Unlock()
 			}
+			_, at = drl.circuitBreaker.ReadyToProbe()
+		}
+		
+		wait := time.Until(at)
+		if wait <= 0 || wait > interval {
+			wait = interval
 		}
+		timer.Reset(wait)
 	}
 }
 
-// Close closes Redis connection
-func (drl *DistributedRateLimiter) Close() error {
-	return drl.redisClient.Close()
-}
-
-// CircuitBreaker methods
-
-// IsOpen checks if circuit is open
-func (cb *CircuitBreaker) IsOpen() bool {
-	cb.mu.RLock()
-	defer cb.mu.RUnlock()
+// onCircuitStateChange reports breaker transitions and switches between
+// distributed and fallback mode
+func (drl *DistributedRateLimiter) onCircuitStateChange(from, to CircuitState, failures int) {
+	if drl.eventEmitter != nil {
+		drl.eventEmitter.EmitCircuitBreakerStateChange(from.String(), to.String(), failures)
+	}
 	
-	return cb.state == StateOpen
-}
-
-// RecordFailure records a Redis failure
-func (cb *CircuitBreaker) RecordFailure(eventEmitter *EventEmitter) {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
-	
-	oldState := cb.state
-	cb.failures++
-	cb.lastFailureTime = time.Now()
-	
-	if cb.failures >= cb.failureThreshold {
-		cb.state = StateOpen
-		// Emit circuit breaker state change event
-		if eventEmitter != nil && oldState != StateOpen {
-			stateNames := map[CircuitState]string{
-				StateClosed:   "closed",
-				StateOpen:     "open",
-				StateHalfOpen: "half-open",
-			}
-			eventEmitter.EmitCircuitBreakerStateChange(stateNames[oldState], stateNames[StateOpen], cb.failures)
-		}
+	if from == StateOpen {
+		drl.metrics.mu.Lock()
+		drl.metrics.FallbackMode = "distributed"
+		drl.metrics.mu.Unlock()
 	}
-}
-
-// RecordSuccess records a successful Redis operation
-func (cb *CircuitBreaker) RecordSuccess() {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
 	
-	if cb.state == StateHalfOpen {
-		cb.state = StateClosed
-		cb.failures = 0
+	// Carry usage from the outage over to the shared counters
+	if to == StateClosed {
+		go drl.reconcileFallback()
 	}
 }
 
-// Reset attempts to reset the circuit breaker
-func (cb *CircuitBreaker) Reset() {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
-	
-	if cb.state == StateOpen {
-		cb.state = StateHalfOpen
+// Close closes the store connection
+func (drl *DistributedRateLimiter) Close() error {
+	select {
+	case <-drl.done:
+	default:
+		close(drl.done)
 	}
-}
\ No newline at end of file
+	_ = drl.failover.Close()
+	drl.relay.close()
+	drl.history.close()
+	if drl.regions != nil {
+		drl.regions.close()
+	}
+	drl.returnAllLeases()
+	_ = drl.store.Deregister(drl.ctx, drl.config.Keys.instancesKey(), drl.instanceID)
+	if drl.registry != nil {
+		_ = drl.registry.remove(drl.ctx, drl.instanceID)
+	}
+	return drl.store.Close()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultEventHistoryLen is how many events the shared history keeps
+	DefaultEventHistoryLen = 1000
+	// DefaultEventHistoryAge is how long the shared history keeps an event
+	DefaultEventHistoryAge = 24 * time.Hour
+	// historyReadTimeout bounds loading history, after which the local
+	// feed is used instead
+	historyReadTimeout = 500 * time.Millisecond
+	// historyLoadLen is how many events a starting instance loads into its
+	// feed
+	historyLoadLen = 1000
+	// historyBatchLen is the most queued events appended in one round trip
+	historyBatchLen = 64
+	// historyTrimEvery is how many appends go by between trims by age
+	historyTrimEvery = 100
+)
+
+// EventHistoryConfig keeps activity events in a capped Redis Stream shared
+// by every instance, so a new instance or a reconnecting dashboard starts
+// from recent history instead of an empty feed
+type EventHistoryConfig struct {
+	Enabled bool
+	// Most events kept, trimmed approximately
+	MaxLen int64
+	// Oldest event kept
+	MaxAge time.Duration
+}
+
+// withDefaults fills in unset retention limits
+func (c EventHistoryConfig) withDefaults() EventHistoryConfig {
+	if c.MaxLen <= 0 {
+		c.MaxLen = DefaultEventHistoryLen
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = DefaultEventHistoryAge
+	}
+	return c
+}
+
+// eventHistory appends emitted events to the shared stream in the
+// background and reads them back
+type eventHistory struct {
+	client   redis.UniversalClient
+	key      string
+	instance string
+	cfg      EventHistoryConfig
+	emitter  *EventEmitter
+	breaker  *CircuitBreaker
+	outbox   chan *ActivityEvent
+	done     chan struct{}
+
+	// Appends since the last trim by age and when it ran, owned by the
+	// write loop
+	untrimmed int
+	trimmedAt time.Time
+}
+
+// startEventHistory loads the shared history into the feed of emitter and
+// attaches the history to it. Events are left out of the history while
+// breaker keeps Redis out.
+func startEventHistory(client redis.UniversalClient, keys Keyspace, instance string, cfg EventHistoryConfig, emitter *EventEmitter, breaker *CircuitBreaker) *eventHistory {
+	h := &eventHistory{
+		client:   client,
+		key:      keys.eventsStreamKey(),
+		instance: instance,
+		cfg:      cfg.withDefaults(),
+		emitter:  emitter,
+		breaker:  breaker,
+		outbox:   make(chan *ActivityEvent, relayBacklog),
+		done:     make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), historyReadTimeout)
+	events, err := h.recent(ctx, historyLoadLen)
+	cancel()
+	if err == nil {
+		for _, event := range events {
+			emitter.feed.AddEvent(event)
+		}
+	}
+
+	go h.writeLoop()
+	emitter.history.Store(h)
+	return h
+}
+
+// append queues an event without blocking the caller
+func (h *eventHistory) append(event *ActivityEvent) {
+	select {
+	case h.outbox <- event:
+	default:
+		// Redis is slow or down, the event stays out of the history
+	}
+}
+
+// writeLoop appends queued events, as many per round trip as are waiting,
+// until the history is closed
+func (h *eventHistory) writeLoop() {
+	for {
+		var event *ActivityEvent
+		select {
+		case <-h.done:
+			return
+		case event = <-h.outbox:
+		}
+
+		batch := []*ActivityEvent{event}
+	collect:
+		for len(batch) < historyBatchLen {
+			select {
+			case event := <-h.outbox:
+				batch = append(batch, event)
+			default:
+				break collect
+			}
+		}
+
+		// The breaker already knows Redis is failing; the events stay local
+		if h.breaker != nil && h.breaker.State() != StateClosed {
+			continue
+		}
+
+		payloads := make([][]byte, 0, len(batch))
+		for _, event := range batch {
+			if payload, err := json.Marshal(event); err == nil {
+				payloads = append(payloads, payload)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), relayPublishTimeout)
+		// Reporting a failure would emit another event to append
+		_ = h.write(ctx, payloads, time.Now())
+		cancel()
+	}
+}
+
+// write appends events and caps the stream to the configured length. The
+// stream is trimmed by age every historyTrimEvery appends, and at least
+// once per age limit so a quiet stream still sheds old events.
+func (h *eventHistory) write(ctx context.Context, payloads [][]byte, now time.Time) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	h.untrimmed += len(payloads)
+	trim := h.untrimmed >= historyTrimEvery || now.Sub(h.trimmedAt) >= h.cfg.MaxAge
+
+	_, err := h.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, payload := range payloads {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: h.key,
+				MaxLen: h.cfg.MaxLen,
+				Approx: true,
+				Values: []string{"event", string(payload)},
+			})
+		}
+		if trim {
+			minID := strconv.FormatInt(now.Add(-h.cfg.MaxAge).UnixMilli(), 10)
+			pipe.XTrimMinIDApprox(ctx, h.key, minID, 0)
+		}
+		// An idle stream goes away with its last event
+		pipe.PExpire(ctx, h.key, h.cfg.MaxAge)
+		return nil
+	})
+	if err == nil && trim {
+		h.untrimmed, h.trimmedAt = 0, now
+	}
+	return err
+}
+
+// recent returns up to n of the latest events still within the age limit,
+// oldest first
+func (h *eventHistory) recent(ctx context.Context, n int) ([]*ActivityEvent, error) {
+	msgs, err := h.client.XRevRangeN(ctx, h.key, "+", "-", int64(n)).Result()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-h.cfg.MaxAge)
+	events := make([]*ActivityEvent, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		payload, ok := msgs[i].Values["event"].(string)
+		if !ok {
+			continue
+		}
+		var event ActivityEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			continue
+		}
+		if event.Timestamp.Before(cutoff) {
+			continue
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// close detaches the history and stops writing
+func (h *eventHistory) close() {
+	if h == nil {
+		return
+	}
+	h.emitter.history.CompareAndSwap(h, nil)
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+}
+
+// eventHistoryConfigFromEnv reads RATE_LIMIT_EVENT_HISTORY, which defaults
+// to enabled, RATE_LIMIT_EVENT_HISTORY_LEN and RATE_LIMIT_EVENT_HISTORY_AGE
+func eventHistoryConfigFromEnv() (EventHistoryConfig, error) {
+	cfg := EventHistoryConfig{Enabled: true}
+	if v := os.Getenv("RATE_LIMIT_EVENT_HISTORY"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return EventHistoryConfig{}, fmt.Errorf("invalid RATE_LIMIT_EVENT_HISTORY %q", v)
+		}
+		cfg.Enabled = enabled
+	}
+	if v := os.Getenv("RATE_LIMIT_EVENT_HISTORY_LEN"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return EventHistoryConfig{}, fmt.Errorf("invalid RATE_LIMIT_EVENT_HISTORY_LEN %q", v)
+		}
+		cfg.MaxLen = n
+	}
+	if v := os.Getenv("RATE_LIMIT_EVENT_HISTORY_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return EventHistoryConfig{}, fmt.Errorf("invalid RATE_LIMIT_EVENT_HISTORY_AGE %q", v)
+		}
+		cfg.MaxAge = d
+	}
+	return cfg, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ahafonof/claude-code-requirements-builder/internal/fakeredis"
+)
+
+// newHistoryLimiter creates a limiter on url that keeps its events in the
+// shared history through a fresh emitter
+func newHistoryLimiter(t *testing.T, url string, history EventHistoryConfig) (*DistributedRateLimiter, *EventEmitter) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.RedisURL = url
+	history.Enabled = true
+	cfg.EventHistory = history
+	emitter := &EventEmitter{
+		feed:        NewActivityFeed(100),
+		broadcaster: NewSSEBroadcaster(),
+	}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	t.Cleanup(func() { _ = drl.Close() })
+	return drl, emitter
+}
+
+// waitForHistory waits until the shared history on srv holds n events
+func waitForHistory(t *testing.T, srv *fakeredis.Server, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var got int64
+		srv.DB(func(db *fakeredis.DB) { got = db.XLen(testKeys.eventsStreamKey()) })
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("History holds %d events, want %d", got, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestEventHistory_LoadsOnStart tests that a new instance starts with the
+// events of the instances before it, capped by count
+func TestEventHistory_LoadsOnStart(t *testing.T) {
+	srv := startFakeRedis(t)
+	first, emitter := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{MaxLen: 3})
+
+	for i := 0; i < 5; i++ {
+		emitter.EmitRedisFailure(fmt.Sprintf("op-%d", i), errors.New("boom"))
+	}
+	waitForHistory(t, srv, 3)
+
+	_, later := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{MaxLen: 3})
+	events := later.feed.GetRecentEvents(100)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events loaded from history, got %d", len(events))
+	}
+	for i, e := range events {
+		if want := fmt.Sprintf("op-%d", i+2); e.Details["operation"] != want {
+			t.Errorf("Event %d: expected %s, got %v", i, want, e.Details["operation"])
+		}
+		if e.Instance != first.instanceID {
+			t.Errorf("Event %d: expected instance %s, got %q", i, first.instanceID, e.Instance)
+		}
+	}
+}
+
+// TestEventHistory_MaxAge tests that events older than the age limit are
+// trimmed and not served
+func TestEventHistory_MaxAge(t *testing.T) {
+	srv := startFakeRedis(t)
+	_, emitter := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{MaxAge: 100 * time.Millisecond})
+
+	emitter.EmitRedisFailure("old", errors.New("boom"))
+	waitForHistory(t, srv, 1)
+	if events := emitter.RecentEvents(10); len(events) != 1 {
+		t.Fatalf("Expected the fresh event, got %d", len(events))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if events := emitter.RecentEvents(10); len(events) != 0 {
+		t.Errorf("Expected an expired event to be hidden, got %d", len(events))
+	}
+
+	emitter.EmitRedisFailure("new", errors.New("boom"))
+	waitForHistory(t, srv, 1)
+	events := emitter.RecentEvents(10)
+	if len(events) != 1 || events[0].Details["operation"] != "new" {
+		t.Errorf("Expected only the new event, got %v", events)
+	}
+}
+
+// TestEventHistory_RedisDown tests that emitting never blocks on the
+// history and reads fall back to the local feed
+func TestEventHistory_RedisDown(t *testing.T) {
+	srv := startFakeRedis(t)
+	_, emitter := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{})
+
+	srv.SetDown(true)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < relayBacklog*2; i++ {
+			emitter.EmitCircuitBreakerStateChange("closed", "open", i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked while Redis was down")
+	}
+	if events := emitter.RecentEvents(10); len(events) != 10 {
+		t.Errorf("Expected the local feed while Redis is down, got %d events", len(events))
+	}
+}
+
+// TestEventHistory_Write tests that each append refreshes the stream TTL
+func TestEventHistory_Write(t *testing.T) {
+	srv := startFakeRedis(t)
+	drl, _ := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{MaxAge: time.Minute})
+
+	if err := drl.history.write(context.Background(), [][]byte{[]byte(`{"id":"x"}`)}, time.Now()); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var ttl int64
+	srv.DB(func(db *fakeredis.DB) { ttl = db.PTTL(testKeys.eventsStreamKey()) })
+	if ttl <= 0 || ttl > time.Minute.Milliseconds() {
+		t.Errorf("Expected the stream to expire within the age limit, got %dms", ttl)
+	}
+}
+
+// TestEventHistory_Batching tests that queued events share round trips
+// and trims, and stay out of the history while the circuit is open
+func TestEventHistory_Batching(t *testing.T) {
+	srv := startFakeRedis(t)
+	drl, emitter := newHistoryLimiter(t, srv.URL(), EventHistoryConfig{})
+	waitForHistory(t, srv, 0)
+
+	adds, trims := srv.CommandCount("XADD"), srv.CommandCount("XTRIM")
+	for i := 0; i < historyTrimEvery*2; i++ {
+		emitter.EmitRedisFailure(fmt.Sprintf("op-%d", i), errors.New("boom"))
+	}
+	waitForHistory(t, srv, historyTrimEvery*2)
+	if n := srv.CommandCount("XADD") - adds; n != historyTrimEvery*2 {
+		t.Errorf("Expected %d appends, got %d", historyTrimEvery*2, n)
+	}
+	if n := srv.CommandCount("XTRIM") - trims; n > 2 {
+		t.Errorf("Expected at most 2 trims for %d appends, got %d", historyTrimEvery*2, n)
+	}
+
+	drl.circuitBreaker.Reset()
+	for i := 0; i < drl.config.FailureThreshold; i++ {
+		drl.circuitBreaker.RecordFailure()
+	}
+	if !drl.circuitBreaker.IsOpen() {
+		t.Fatal("Expected the circuit to be open")
+	}
+	adds = srv.CommandCount("XADD")
+	emitter.EmitRedisFailure("while-open", errors.New("boom"))
+	time.Sleep(50 * time.Millisecond)
+	if n := srv.CommandCount("XADD") - adds; n != 0 {
+		t.Errorf("Expected no appends while the circuit is open, got %d", n)
+	}
+}
+
+// TestEventHistoryConfigFromEnv tests retention settings parsing
+func TestEventHistoryConfigFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY", "")
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY_LEN", "500")
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY_AGE", "2h")
+	cfg, err := eventHistoryConfigFromEnv()
+	if err != nil || !cfg.Enabled || cfg.MaxLen != 500 || cfg.MaxAge != 2*time.Hour {
+		t.Errorf("Unexpected config %+v (%v)", cfg, err)
+	}
+
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY", "false")
+	if cfg, _ := eventHistoryConfigFromEnv(); cfg.Enabled {
+		t.Error("Expected history to be disabled")
+	}
+
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY", "true")
+	t.Setenv("RATE_LIMIT_EVENT_HISTORY_LEN", "-1")
+	if _, err := eventHistoryConfigFromEnv(); err == nil {
+		t.Error("Expected an error for a negative length")
+	}
+}
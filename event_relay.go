@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// relayBacklog is how many events may wait to be published before new
+	// ones are dropped
+	relayBacklog = 256
+	// relayPublishTimeout bounds one PUBLISH so a slow Redis can't stall the
+	// events queued behind it
+	relayPublishTimeout = time.Second
+	// relaySeenEvents is how many remote events are remembered to drop
+	// duplicates
+	relaySeenEvents = 1000
+)
+
+// eventRelay shares activity events between instances over a Redis channel.
+// Events emitted here are published tagged with the instance ID, and events
+// published by other instances are merged into the local feed. While Redis is
+// unreachable publishing fails quietly and the feed shows local events only.
+type eventRelay struct {
+	client   redis.UniversalClient
+	channel  string
+	instance string
+	emitter  *EventEmitter
+	pubsub   *redis.PubSub
+	outbox   chan *ActivityEvent
+	seen     *seenEvents
+	done     chan struct{}
+}
+
+// startEventRelay subscribes to the event channel of keys and attaches the
+// relay to emitter
+func startEventRelay(client redis.UniversalClient, keys Keyspace, instance string, emitter *EventEmitter) *eventRelay {
+	r := &eventRelay{
+		client:   client,
+		channel:  keys.eventsChannel(),
+		instance: instance,
+		emitter:  emitter,
+		outbox:   make(chan *ActivityEvent, relayBacklog),
+		seen:     newSeenEvents(relaySeenEvents),
+		done:     make(chan struct{}),
+	}
+	// go-redis resubscribes by itself after a reconnect
+	r.pubsub = client.Subscribe(context.Background(), r.channel)
+
+	go r.publishLoop()
+	go r.receiveLoop()
+	emitter.relay.Store(r)
+	return r
+}
+
+// publish queues a local event without blocking the caller
+func (r *eventRelay) publish(event *ActivityEvent) {
+	select {
+	case r.outbox <- event:
+	default:
+		// Redis is slow or down, the event stays local
+	}
+}
+
+// publishLoop sends queued events until the relay is closed
+func (r *eventRelay) publishLoop() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case event := <-r.outbox:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), relayPublishTimeout)
+			// Reporting a failure would emit another event to publish
+			_ = r.client.Publish(ctx, r.channel, payload).Err()
+			cancel()
+		}
+	}
+}
+
+// receiveLoop merges events from other instances until the subscription is
+// closed
+func (r *eventRelay) receiveLoop() {
+	for msg := range r.pubsub.Channel() {
+		var event ActivityEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			continue
+		}
+		if event.Instance == "" || event.Instance == r.instance {
+			continue
+		}
+		if !r.seen.add(event.Instance + "/" + event.ID) {
+			continue
+		}
+		r.emitter.deliver(&event)
+	}
+}
+
+// close detaches the relay and stops publishing and receiving
+func (r *eventRelay) close() {
+	if r == nil {
+		return
+	}
+	r.emitter.relay.CompareAndSwap(r, nil)
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	_ = r.pubsub.Close()
+}
+
+// seenEvents remembers the most recent event keys
+type seenEvents struct {
+	keys  map[string]struct{}
+	order []string
+	next  int
+}
+
+func newSeenEvents(size int) *seenEvents {
+	return &seenEvents{
+		keys:  make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// add records key and reports false if it was already recorded
+func (s *seenEvents) add(key string) bool {
+	if _, ok := s.keys[key]; ok {
+		return false
+	}
+	if old := s.order[s.next]; old != "" {
+		delete(s.keys, old)
+	}
+	s.order[s.next] = key
+	s.next = (s.next + 1) % len(s.order)
+	s.keys[key] = struct{}{}
+	return true
+}
+
+// eventRelayFromEnv reads RATE_LIMIT_EVENT_RELAY, which defaults to enabled
+func eventRelayFromEnv() (bool, error) {
+	v := os.Getenv("RATE_LIMIT_EVENT_RELAY")
+	if v == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid RATE_LIMIT_EVENT_RELAY %q", v)
+	}
+	return enabled, nil
+}
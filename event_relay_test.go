@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ahafonof/claude-code-requirements-builder/internal/fakeredis"
+)
+
+// newRelayLimiter creates a limiter on url that shares its events through
+// a fresh emitter
+func newRelayLimiter(t *testing.T, url string) (*DistributedRateLimiter, *EventEmitter) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.RedisURL = url
+	cfg.EventRelay = true
+	emitter := &EventEmitter{
+		feed:        NewActivityFeed(100),
+		broadcaster: NewSSEBroadcaster(),
+	}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	t.Cleanup(func() { _ = drl.Close() })
+	return drl, emitter
+}
+
+// waitForSubscribers waits until n relays have subscribed on srv
+func waitForSubscribers(t *testing.T, srv *fakeredis.Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for srv.CommandCount("subscribe") < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of %d relays subscribed", srv.CommandCount("subscribe"), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// eventsOfType returns the events of one type in emitter's feed
+func eventsOfType(emitter *EventEmitter, eventType string) []*ActivityEvent {
+	var events []*ActivityEvent
+	for _, e := range emitter.feed.GetRecentEvents(100) {
+		if e.Type == eventType {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// waitForEvents waits until emitter's feed holds n events of eventType
+func waitForEvents(t *testing.T, emitter *EventEmitter, eventType string, n int) []*ActivityEvent {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		events := eventsOfType(emitter, eventType)
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestEventRelay_SharesEvents tests that events reach the feed and SSE
+// clients of other instances, tagged with the emitting instance
+func TestEventRelay_SharesEvents(t *testing.T) {
+	srv := startFakeRedis(t)
+	a, emitterA := newRelayLimiter(t, srv.URL())
+	_, emitterB := newRelayLimiter(t, srv.URL())
+	waitForSubscribers(t, srv, 2)
+
+	client := emitterB.broadcaster.Subscribe(nil)
+	defer emitterB.broadcaster.Unsubscribe(client)
+
+	emitterA.EmitRedisFailure("allow", errors.New("boom"))
+
+	remote := waitForEvents(t, emitterB, EventTypeRedisFailure, 1)
+	if len(remote) != 1 {
+		t.Fatalf("Expected the event on the other instance, got %d", len(remote))
+	}
+	if remote[0].Instance != a.instanceID {
+		t.Errorf("Expected instance %s, got %q", a.instanceID, remote[0].Instance)
+	}
+	if remote[0].Details["operation"] != "allow" {
+		t.Errorf("Expected the details to survive, got %v", remote[0].Details)
+	}
+
+	select {
+	case e := <-client.Events:
+		if e.Type != EventTypeRedisFailure {
+			t.Errorf("Expected the remote event on SSE, got %s", e.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("Remote event was not broadcast to SSE clients")
+	}
+
+	// The publishing instance must not merge its own event back
+	time.Sleep(50 * time.Millisecond)
+	if local := eventsOfType(emitterA, EventTypeRedisFailure); len(local) != 1 {
+		t.Errorf("Expected the event once on the emitting instance, got %d", len(local))
+	}
+}
+
+// TestEventRelay_SuppressesDuplicates tests that a redelivered event is
+// merged once
+func TestEventRelay_SuppressesDuplicates(t *testing.T) {
+	srv := startFakeRedis(t)
+	drl, emitter := newRelayLimiter(t, srv.URL())
+	waitForSubscribers(t, srv, 1)
+
+	event := &ActivityEvent{
+		ID:        "rf-1",
+		Type:      EventTypeRedisFailure,
+		Timestamp: time.Now(),
+		Instance:  "other-instance",
+	}
+	payload, _ := json.Marshal(event)
+	for i := 0; i < 3; i++ {
+		drl.relay.client.Publish(drl.ctx, drl.config.Keys.eventsChannel(), payload)
+	}
+
+	// A different instance may reuse the ID
+	event.Instance = "third-instance"
+	payload, _ = json.Marshal(event)
+	drl.relay.client.Publish(drl.ctx, drl.config.Keys.eventsChannel(), payload)
+
+	waitForEvents(t, emitter, EventTypeRedisFailure, 2)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(eventsOfType(emitter, EventTypeRedisFailure)); n != 2 {
+		t.Errorf("Expected 2 distinct events, got %d", n)
+	}
+}
+
+// TestEventRelay_RedisDown tests that emitting keeps working locally while
+// Redis is unreachable
+func TestEventRelay_RedisDown(t *testing.T) {
+	srv := startFakeRedis(t)
+	_, emitter := newRelayLimiter(t, srv.URL())
+	waitForSubscribers(t, srv, 1)
+
+	srv.SetDown(true)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < relayBacklog*2; i++ {
+			emitter.EmitCircuitBreakerStateChange("closed", "open", i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked while Redis was down")
+	}
+	if n := len(eventsOfType(emitter, EventTypeCircuitBreakerStateChange)); n != 100 {
+		t.Errorf("Expected the local feed to keep filling, got %d events", n)
+	}
+}
+
+// TestSeenEvents tests the bounded duplicate filter
+func TestSeenEvents(t *testing.T) {
+	s := newSeenEvents(2)
+	if !s.add("a") || !s.add("b") {
+		t.Fatal("New keys should be added")
+	}
+	if s.add("a") {
+		t.Error("Repeated key should be rejected")
+	}
+	s.add("c")
+	if !s.add("a") {
+		t.Error("Evicted key should be accepted again")
+	}
+}
+
+// TestEventRelayFromEnv tests RATE_LIMIT_EVENT_RELAY parsing
+func TestEventRelayFromEnv(t *testing.T) {
+	cases := map[string]bool{"": true, "true": true, "false": false, "0": false}
+	for v, want := range cases {
+		t.Setenv("RATE_LIMIT_EVENT_RELAY", v)
+		if got, err := eventRelayFromEnv(); err != nil || got != want {
+			t.Errorf("RATE_LIMIT_EVENT_RELAY=%q: got %v, %v, want %v", v, got, err, want)
+		}
+	}
+
+	t.Setenv("RATE_LIMIT_EVENT_RELAY", "junk")
+	if enabled, err := eventRelayFromEnv(); err == nil || enabled {
+		t.Errorf("Expected invalid value to be rejected and the relay disabled, got %v, %v", enabled, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ahafonof/claude-code-requirements-builder/internal/fakeredis"
+)
+
+// startFakeRedis starts an in-process Redis that runs our Lua scripts
+// in an embedded interpreter
+func startFakeRedis(t testing.TB) *fakeredis.Server {
+	t.Helper()
+	srv, err := fakeredis.Start()
+	if err != nil {
+		t.Fatalf("Failed to start fake Redis: %v", err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return srv
+}
+
+// testRedisConfig returns testConfig pointing at a fresh fake Redis
+func testRedisConfig(t *testing.T) *Config {
+	cfg := testConfig()
+	cfg.RedisURL = startFakeRedis(t).URL()
+	return cfg
+}
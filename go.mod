@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/google/uuid v1.6.0
 	github.com/redis/go-redis/v9 v9.11.0
+	github.com/yuin/gopher-lua v1.1.1
 )
 
 require (
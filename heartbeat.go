@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultHeartbeatInterval is how often an instance announces itself
+const DefaultHeartbeatInterval = 5 * time.Second
+
+// heartbeatMisses is how many intervals an instance may miss before it is
+// no longer counted as alive
+const heartbeatMisses = 3
+
+// startHeartbeat registers this instance in the store and keeps the live
+// instance count up to date until the limiter is closed
+func (drl *DistributedRateLimiter) startHeartbeat() {
+	interval := drl.heartbeatInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		drl.heartbeat(interval * heartbeatMisses)
+		drl.register(interval)
+		select {
+		case <-drl.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeatInterval returns the configured interval or the default
+func (drl *DistributedRateLimiter) heartbeatInterval() time.Duration {
+	if drl.config.HeartbeatInterval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return drl.config.HeartbeatInterval
+}
+
+// heartbeat renews this instance's registration within the decision
+// deadline. When the store is unreachable the last known cluster size stays
+// in effect.
+func (drl *DistributedRateLimiter) heartbeat(ttl time.Duration) {
+	if !drl.circuitBreaker.Allow() {
+		return
+	}
+
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+	var n int
+	err := drl.storeCall("heartbeat", func() (err error) {
+		n, err = drl.store.Heartbeat(ctx, drl.config.Keys.instancesKey(), drl.instanceID, time.Now(), ttl)
+		return err
+	})
+	if err != nil || n < 1 {
+		return
+	}
+	drl.setClusterSize(n)
+}
+
+// setClusterSize records the live instance count and divides the limit
+// enforced in fallback mode among the instances
+func (drl *DistributedRateLimiter) setClusterSize(n int) {
+	drl.metrics.mu.Lock()
+	drl.metrics.ClusterSize = int64(n)
+	drl.metrics.mu.Unlock()
+
+	drl.fallbackLimiter.setLimit(fallbackLimit(drl.config.Limit, n))
+}
+
+// fallbackLimit is an instance's share of limit among n instances, never
+// less than one request
+func fallbackLimit(limit, n int) int {
+	if n < 1 {
+		return limit
+	}
+	if share := limit / n; share > 0 {
+		return share
+	}
+	return 1
+}
+
+// setLimit changes the number of requests allowed per window
+func (rl *RateLimiter) setLimit(limit int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+}
+
+// newInstanceID returns an identifier for this limiter instance
+func newInstanceID() string {
+	return uuid.New().String()
+}
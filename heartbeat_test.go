@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestStore_Heartbeat tests counting of live instances
+func TestStore_Heartbeat(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		if _, ok := store.(*PeerStore); ok {
+			t.Skip("peers count ring members instead of heartbeats")
+		}
+		ctx := context.Background()
+		_ = store.Delete(ctx, testKeys.instancesKey())
+
+		now := time.Now()
+		if n, err := store.Heartbeat(ctx, testKeys.instancesKey(), "a", now, time.Second); err != nil || n != 1 {
+			t.Fatalf("Expected 1 live instance, got %d: %v", n, err)
+		}
+		if n, _ := store.Heartbeat(ctx, testKeys.instancesKey(), "b", now, 3*time.Second); n != 2 {
+			t.Errorf("Expected 2 live instances, got %d", n)
+		}
+		if n, _ := store.Heartbeat(ctx, testKeys.instancesKey(), "b", now, 3*time.Second); n != 2 {
+			t.Errorf("Expected a repeated heartbeat to count once, got %d", n)
+		}
+
+		// a stopped beating and expires
+		if n, _ := store.Heartbeat(ctx, testKeys.instancesKey(), "b", now.Add(2*time.Second), 3*time.Second); n != 1 {
+			t.Errorf("Expected the silent instance to expire, got %d", n)
+		}
+
+		if err := store.Deregister(ctx, testKeys.instancesKey(), "b"); err != nil {
+			t.Fatalf("Deregister failed: %v", err)
+		}
+		if n, _ := store.Heartbeat(ctx, testKeys.instancesKey(), "c", now.Add(2*time.Second), 3*time.Second); n != 1 {
+			t.Errorf("Expected only the new instance after deregistering, got %d", n)
+		}
+	})
+}
+
+// TestDistributedRateLimiter_FallbackSharesLimit tests that each instance
+// enforces its share of the limit while the circuit is open
+func TestDistributedRateLimiter_FallbackSharesLimit(t *testing.T) {
+	store := NewMemoryStore()
+	cfg := testConfig()
+	cfg.Limit = 10
+	cfg.HeartbeatInterval = 10 * time.Millisecond
+
+	limiters := make([]*DistributedRateLimiter, 4)
+	for i := range limiters {
+		limiters[i] = NewDistributedRateLimiterWithStore(cfg, store, nil)
+	}
+	drl := limiters[0]
+	defer func() {
+		for _, l := range limiters[1:] {
+			close(l.done)
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for drl.GetMetrics().ClusterSize != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected cluster size 4, got %d", drl.GetMetrics().ClusterSize)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < cfg.FailureThreshold; i++ {
+		drl.circuitBreaker.RecordFailure()
+	}
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if drl.Allow("share-ip") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected 10/4 = 2 requests allowed in fallback, got %d", allowed)
+	}
+}
+
+// TestDistributedRateLimiter_ClusterSizeKeptOnFailure tests that the last
+// known cluster size stays in effect while the store is unreachable
+func TestDistributedRateLimiter_ClusterSizeKeptOnFailure(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.Limit = 9
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	_ = drl.store.Close()
+	drl.setClusterSize(3)
+	drl.heartbeat(time.Second)
+
+	if n := drl.GetMetrics().ClusterSize; n != 3 {
+		t.Errorf("Expected the last known cluster size 3, got %d", n)
+	}
+	if limit := drl.fallbackLimiter.limit; limit != 3 {
+		t.Errorf("Expected a fallback limit of 3, got %d", limit)
+	}
+}
+
+func TestFallbackLimit(t *testing.T) {
+	tests := []struct {
+		limit, n, want int
+	}{
+		{100, 1, 100},
+		{100, 10, 10},
+		{100, 3, 33},
+		{5, 10, 1},
+		{100, 0, 100},
+	}
+	for _, tt := range tests {
+		if got := fallbackLimit(tt.limit, tt.n); got != tt.want {
+			t.Errorf("fallbackLimit(%d, %d) = %d, want %d", tt.limit, tt.n, got, tt.want)
+		}
+	}
+}
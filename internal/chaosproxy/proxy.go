@@ -0,0 +1,265 @@
+// Package chaosproxy is a fault-injecting TCP proxy for exercising the Redis
+// path under partial network failure. It forwards traffic between clients
+// and an upstream server and can add latency, drop connections, blackhole
+// traffic, truncate replies and flap, on command or on a schedule.
+package chaosproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy forwards TCP connections to an upstream address
+type Proxy struct {
+	ln       net.Listener
+	upstream string
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	latency   time.Duration
+	blackhole bool
+	truncate  int
+	down      bool
+	flapStop  chan struct{}
+	links     map[*link]struct{}
+}
+
+// link is one proxied client connection
+type link struct {
+	client   net.Conn
+	upstream net.Conn
+	once     sync.Once
+	replied  int
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		_ = l.client.Close()
+		_ = l.upstream.Close()
+	})
+}
+
+// Start listens on listenAddr and forwards connections to upstream. Use
+// "127.0.0.1:0" to pick a free port.
+func Start(listenAddr, upstream string) (*Proxy, error) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		ln:       ln,
+		upstream: upstream,
+		links:    make(map[*link]struct{}),
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr returns the address clients connect to
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Close stops the proxy and drops every connection
+func (p *Proxy) Close() error {
+	p.Clear()
+	err := p.ln.Close()
+	p.DropConnections()
+	p.wg.Wait()
+	return err
+}
+
+// SetLatency delays every reply chunk by d
+func (p *Proxy) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = d
+}
+
+// SetBlackhole silently discards traffic in both directions while on.
+// Connections stay open, so clients only notice through their timeouts.
+func (p *Proxy) SetBlackhole(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blackhole = on
+}
+
+// TruncateReplies cuts each connection after n reply bytes, leaving the
+// client with a partial reply. Zero disables truncation.
+func (p *Proxy) TruncateReplies(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.truncate = n
+}
+
+// SetDown refuses new connections and drops open ones while down is true
+func (p *Proxy) SetDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+	if down {
+		p.DropConnections()
+	}
+}
+
+// DropConnections closes every open connection
+func (p *Proxy) DropConnections() {
+	p.mu.Lock()
+	links := make([]*link, 0, len(p.links))
+	for l := range p.links {
+		links = append(links, l)
+	}
+	p.mu.Unlock()
+
+	for _, l := range links {
+		l.close()
+	}
+}
+
+// Flap takes the upstream down and back up every period until Clear
+func (p *Proxy) Flap(period time.Duration) {
+	p.mu.Lock()
+	if p.flapStop != nil {
+		close(p.flapStop)
+	}
+	stop := make(chan struct{})
+	p.flapStop = stop
+	p.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		down := false
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				if p.flapStop != stop {
+					p.mu.Unlock()
+					return
+				}
+				down = !down
+				p.down = down
+				p.mu.Unlock()
+				if down {
+					p.DropConnections()
+				}
+			}
+		}
+	}()
+}
+
+// Clear removes every fault
+func (p *Proxy) Clear() {
+	p.mu.Lock()
+	if p.flapStop != nil {
+		close(p.flapStop)
+		p.flapStop = nil
+	}
+	p.latency = 0
+	p.blackhole = false
+	p.truncate = 0
+	p.down = false
+	p.mu.Unlock()
+}
+
+// serve accepts client connections until the listener is closed
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		down := p.down
+		p.mu.Unlock()
+		if down {
+			_ = client.Close()
+			continue
+		}
+
+		upstream, err := net.DialTimeout("tcp", p.upstream, 5*time.Second)
+		if err != nil {
+			_ = client.Close()
+			continue
+		}
+
+		l := &link{client: client, upstream: upstream}
+		p.mu.Lock()
+		p.links[l] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(2)
+		go p.forward(l, l.client, l.upstream, false)
+		go p.forward(l, l.upstream, l.client, true)
+	}
+}
+
+// forward copies src to dst, applying faults. reply is true for the
+// upstream-to-client direction.
+func (p *Proxy) forward(l *link, src, dst net.Conn, reply bool) {
+	defer p.wg.Done()
+	defer func() {
+		l.close()
+		p.mu.Lock()
+		delete(p.links, l)
+		p.mu.Unlock()
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk, cut := p.shape(l, buf[:n], reply)
+			if len(chunk) > 0 {
+				if _, werr := dst.Write(chunk); werr != nil {
+					return
+				}
+			}
+			if cut {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// shape applies the current faults to a chunk, returning what to forward
+// and whether the connection must be cut afterwards
+func (p *Proxy) shape(l *link, chunk []byte, reply bool) ([]byte, bool) {
+	p.mu.Lock()
+	latency, blackhole, truncate := p.latency, p.blackhole, p.truncate
+	p.mu.Unlock()
+
+	if blackhole {
+		return nil, false
+	}
+	if !reply {
+		return chunk, false
+	}
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if truncate > 0 {
+		left := truncate - l.replied
+		if left <= 0 {
+			return nil, true
+		}
+		if len(chunk) >= left {
+			l.replied = truncate
+			return chunk[:left], true
+		}
+	}
+	l.replied += len(chunk)
+	return chunk, false
+}
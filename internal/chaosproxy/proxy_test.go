@@ -0,0 +1,207 @@
+package chaosproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEcho starts an upstream that echoes everything back
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startProxy(t *testing.T) *Proxy {
+	t.Helper()
+	p, err := Start("127.0.0.1:0", startEcho(t))
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+// roundTrip writes msg and reads back up to len(msg) bytes within timeout
+func roundTrip(t *testing.T, conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, len(msg))
+	n, err := io.ReadFull(conn, buf)
+	return string(buf[:n]), err
+}
+
+func dial(t *testing.T, p *Proxy) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// TestProxy_Forwarding tests that traffic passes through unchanged
+func TestProxy_Forwarding(t *testing.T) {
+	p := startProxy(t)
+	conn := dial(t, p)
+
+	if reply, err := roundTrip(t, conn, "PING", time.Second); err != nil || reply != "PING" {
+		t.Errorf("Expected echo, got %q (%v)", reply, err)
+	}
+}
+
+// TestProxy_Faults tests each injected fault
+func TestProxy_Faults(t *testing.T) {
+	t.Run("latency", func(t *testing.T) {
+		p := startProxy(t)
+		p.SetLatency(50 * time.Millisecond)
+		conn := dial(t, p)
+
+		start := time.Now()
+		if _, err := roundTrip(t, conn, "hello", time.Second); err != nil {
+			t.Fatalf("Round trip failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Reply came after %v, want at least 50ms", elapsed)
+		}
+	})
+
+	t.Run("blackhole", func(t *testing.T) {
+		p := startProxy(t)
+		p.SetBlackhole(true)
+		conn := dial(t, p)
+
+		_, err := roundTrip(t, conn, "hello", 50*time.Millisecond)
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		p := startProxy(t)
+		p.TruncateReplies(3)
+		conn := dial(t, p)
+
+		reply, err := roundTrip(t, conn, "hello", time.Second)
+		if reply != "hel" || err == nil {
+			t.Errorf("Expected a cut reply, got %q (%v)", reply, err)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		p := startProxy(t)
+		conn := dial(t, p)
+		if _, err := roundTrip(t, conn, "a", time.Second); err != nil {
+			t.Fatalf("Round trip failed: %v", err)
+		}
+
+		p.DropConnections()
+		if _, err := roundTrip(t, conn, "b", time.Second); err == nil {
+			t.Error("Expected an error on a dropped connection")
+		}
+		if reply, err := roundTrip(t, dial(t, p), "c", time.Second); err != nil || reply != "c" {
+			t.Errorf("New connections should work after a drop, got %q (%v)", reply, err)
+		}
+	})
+
+	t.Run("down", func(t *testing.T) {
+		p := startProxy(t)
+		p.SetDown(true)
+		if _, err := roundTrip(t, dial(t, p), "a", 100*time.Millisecond); err == nil {
+			t.Error("Expected connections to be refused while down")
+		}
+		p.SetDown(false)
+		if _, err := roundTrip(t, dial(t, p), "a", time.Second); err != nil {
+			t.Errorf("Expected connections to work after coming up: %v", err)
+		}
+	})
+}
+
+// TestProxy_Schedule tests parsing and running a fault schedule
+func TestProxy_Schedule(t *testing.T) {
+	steps, err := ParseSchedule("0s=latency 50ms; 30ms=blackhole ;60ms=clear")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(steps) != 3 || steps[1].At != 30*time.Millisecond || steps[1].Command != "blackhole" {
+		t.Fatalf("Unexpected steps: %+v", steps)
+	}
+
+	for _, spec := range []string{"blackhole", "soon=clear", "0s=teleport", "0s=latency fast"} {
+		parsed, err := ParseSchedule(spec)
+		if err == nil {
+			p := startProxy(t)
+			err = p.RunSchedule(context.Background(), parsed)
+		}
+		if err == nil {
+			t.Errorf("Expected error for schedule %q", spec)
+		}
+	}
+
+	p := startProxy(t)
+	if err := p.RunSchedule(context.Background(), steps); err != nil {
+		t.Fatalf("RunSchedule failed: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency != 0 || p.blackhole {
+		t.Error("Schedule should end with every fault cleared")
+	}
+}
+
+// TestProxy_Flap tests that flapping alternates between down and up
+func TestProxy_Flap(t *testing.T) {
+	p := startProxy(t)
+	if err := p.Apply("flap 40ms"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	seenDown, seenUp := false, false
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) && !(seenDown && seenUp) {
+		p.mu.Lock()
+		down := p.down
+		p.mu.Unlock()
+		if down {
+			seenDown = true
+		} else if seenDown {
+			seenUp = true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !seenDown || !seenUp {
+		t.Errorf("Expected the proxy to go down and back up, down=%v up=%v", seenDown, seenUp)
+	}
+
+	p.Clear()
+	time.Sleep(100 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		t.Error("Clear should stop flapping")
+	}
+}
@@ -0,0 +1,124 @@
+package chaosproxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step is one scheduled fault command
+type Step struct {
+	At      time.Duration
+	Command string
+}
+
+// Apply runs a fault command:
+//
+//	latency <duration>   delay replies
+//	blackhole            discard traffic without closing connections
+//	truncate <bytes>     cut connections after a partial reply
+//	drop                 close open connections
+//	down / up            refuse connections or accept them again
+//	flap <period>        alternate down and up every period
+//	clear                remove every fault
+func (p *Proxy) Apply(command string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	arg := func() (string, error) {
+		if len(fields) != 2 {
+			return "", fmt.Errorf("%s takes one argument", fields[0])
+		}
+		return fields[1], nil
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "latency":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid latency %q", v)
+		}
+		p.SetLatency(d)
+	case "blackhole":
+		p.SetBlackhole(true)
+	case "truncate":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid byte count %q", v)
+		}
+		p.TruncateReplies(n)
+	case "drop":
+		p.DropConnections()
+	case "down":
+		p.SetDown(true)
+	case "up":
+		p.SetDown(false)
+	case "flap":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid flap period %q", v)
+		}
+		p.Flap(d)
+	case "clear":
+		p.Clear()
+	default:
+		return fmt.Errorf("unknown command %q", fields[0])
+	}
+	return nil
+}
+
+// ParseSchedule parses steps such as "0s=latency 50ms; 5s=blackhole; 10s=clear"
+func ParseSchedule(spec string) ([]Step, error) {
+	var steps []Step
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		at, command, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid step %q, want <offset>=<command>", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(at))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid offset in step %q", part)
+		}
+		steps = append(steps, Step{At: d, Command: strings.TrimSpace(command)})
+	}
+	return steps, nil
+}
+
+// RunSchedule applies steps at their offsets from now, in order, until ctx
+// is done. It stops at the first invalid command.
+func (p *Proxy) RunSchedule(ctx context.Context, steps []Step) error {
+	start := time.Now()
+	for _, step := range steps {
+		timer := time.NewTimer(time.Until(start.Add(step.At)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if err := p.Apply(step.Command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package fakeredis
+
+import (
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry is one key: a string, a sorted set or a stream
+type entry struct {
+	str       string
+	zset      map[string]float64
+	stream    *stream
+	expiresAt time.Time
+}
+
+// DB is the keyspace of a Server. It must only be used with the server lock
+// held, as Server.DB does.
+type DB struct {
+	entries map[string]*entry
+}
+
+func newDB() *DB {
+	return &DB{entries: make(map[string]*entry)}
+}
+
+// lookup returns the live entry of key, dropping it if it has expired
+func (db *DB) lookup(key string) *entry {
+	e, ok := db.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt) {
+		delete(db.entries, key)
+		return nil
+	}
+	return e
+}
+
+// zset returns the sorted set of key, creating it when missing
+func (db *DB) zset(key string) map[string]float64 {
+	e := db.lookup(key)
+	if e == nil {
+		e = &entry{}
+		db.entries[key] = e
+	}
+	if e.zset == nil {
+		e.zset = make(map[string]float64)
+	}
+	return e.zset
+}
+
+// removeIfEmpty drops a sorted set without members, as Redis does
+func (db *DB) removeIfEmpty(key string) {
+	if e, ok := db.entries[key]; ok && e.zset != nil && len(e.zset) == 0 {
+		delete(db.entries, key)
+	}
+}
+
+// Exists reports whether key is set
+func (db *DB) Exists(key string) bool {
+	return db.lookup(key) != nil
+}
+
+// Del removes keys and returns how many existed
+func (db *DB) Del(keys ...string) int64 {
+	var n int64
+	for _, key := range keys {
+		if db.lookup(key) != nil {
+			delete(db.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Keys returns the live keys matching a glob pattern, in sorted order
+func (db *DB) Keys(pattern string) []string {
+	keys := []string{}
+	for key := range db.entries {
+		if ok, _ := path.Match(pattern, key); ok && db.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get returns the string value of key
+func (db *DB) Get(key string) (string, bool) {
+	e := db.lookup(key)
+	if e == nil || e.zset != nil || e.stream != nil {
+		return "", false
+	}
+	return e.str, true
+}
+
+// Set stores a string value, expiring after ttl when it is positive
+func (db *DB) Set(key, value string, ttl time.Duration) {
+	e := &entry{str: value}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+	db.entries[key] = e
+}
+
+// Incr increments the integer value of key
+func (db *DB) Incr(key string) (int64, error) {
+	return db.IncrBy(key, 1)
+}
+
+// Decr decrements the integer value of key
+func (db *DB) Decr(key string) (int64, error) {
+	return db.IncrBy(key, -1)
+}
+
+// IncrBy adds delta to the integer value of key
+func (db *DB) IncrBy(key string, delta int64) (int64, error) {
+	e := db.lookup(key)
+	if e == nil {
+		e = &entry{str: "0"}
+		db.entries[key] = e
+	}
+	n, err := strconv.ParseInt(e.str, 10, 64)
+	if err != nil || e.zset != nil || e.stream != nil {
+		return 0, errNotInteger
+	}
+	n += delta
+	e.str = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+// ExpireAt sets the expiry of key, reporting whether the key exists
+func (db *DB) ExpireAt(key string, at time.Time) bool {
+	e := db.lookup(key)
+	if e == nil {
+		return false
+	}
+	e.expiresAt = at
+	return true
+}
+
+// PTTL returns the remaining time to live in milliseconds, -2 for a
+// missing key and -1 for a key without expiry
+func (db *DB) PTTL(key string) int64 {
+	e := db.lookup(key)
+	if e == nil {
+		return -2
+	}
+	if e.expiresAt.IsZero() {
+		return -1
+	}
+	return time.Until(e.expiresAt).Milliseconds()
+}
+
+// Type returns the type of key as TYPE reports it
+func (db *DB) Type(key string) string {
+	e := db.lookup(key)
+	switch {
+	case e == nil:
+		return "none"
+	case e.zset != nil:
+		return "zset"
+	case e.stream != nil:
+		return "stream"
+	}
+	return "string"
+}
+
+// ZAdd adds or updates member and reports whether it was new
+func (db *DB) ZAdd(key string, score float64, member string) bool {
+	z := db.zset(key)
+	_, exists := z[member]
+	z[member] = score
+	return !exists
+}
+
+// ZIncrBy adds delta to the score of member and returns the new score
+func (db *DB) ZIncrBy(key string, delta float64, member string) float64 {
+	z := db.zset(key)
+	z[member] += delta
+	return z[member]
+}
+
+// ZRem removes members and returns how many were present
+func (db *DB) ZRem(key string, members ...string) int64 {
+	e := db.lookup(key)
+	if e == nil || e.zset == nil {
+		return 0
+	}
+	var n int64
+	for _, m := range members {
+		if _, ok := e.zset[m]; ok {
+			delete(e.zset, m)
+			n++
+		}
+	}
+	db.removeIfEmpty(key)
+	return n
+}
+
+// ZScore returns the score of member
+func (db *DB) ZScore(key, member string) (float64, bool) {
+	e := db.lookup(key)
+	if e == nil || e.zset == nil {
+		return 0, false
+	}
+	score, ok := e.zset[member]
+	return score, ok
+}
+
+// ZCard returns the number of members in a sorted set
+func (db *DB) ZCard(key string) int64 {
+	e := db.lookup(key)
+	if e == nil || e.zset == nil {
+		return 0
+	}
+	return int64(len(e.zset))
+}
+
+// ZRangeByScore returns members scored within [min, max] ordered by score
+func (db *DB) ZRangeByScore(key string, min, max float64) []string {
+	e := db.lookup(key)
+	if e == nil || e.zset == nil {
+		return []string{}
+	}
+	members := []string{}
+	for m, score := range e.zset {
+		if score >= min && score <= max {
+			members = append(members, m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		si, sj := e.zset[members[i]], e.zset[members[j]]
+		if si != sj {
+			return si < sj
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// ZRemRangeByScore removes members scored within [min, max]
+func (db *DB) ZRemRangeByScore(key string, min, max float64) int64 {
+	return db.ZRem(key, db.ZRangeByScore(key, min, max)...)
+}
+
+// parseScore parses a score bound such as 42, -inf or +inf
+func parseScore(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
@@ -0,0 +1,214 @@
+package fakeredis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaScripts runs script sources the way Redis does: one interpreter for
+// the whole server, KEYS and ARGV as globals, and redis.call dispatching
+// the same commands clients can send. Scripts run with the server lock
+// held, so each one is atomic like on a real server.
+type luaScripts struct {
+	state  *lua.LState
+	protos map[string]*lua.FunctionProto
+	// dispatch runs a command from a script. It is set by the server.
+	dispatch func(name string, args []string) interface{}
+}
+
+func newLuaScripts(dispatch func(name string, args []string) interface{}) *luaScripts {
+	l := &luaScripts{
+		state:    lua.NewState(),
+		protos:   make(map[string]*lua.FunctionProto),
+		dispatch: dispatch,
+	}
+
+	redisLib := l.state.NewTable()
+	redisLib.RawSetString("call", l.state.NewFunction(func(L *lua.LState) int { return l.call(L, true) }))
+	redisLib.RawSetString("pcall", l.state.NewFunction(func(L *lua.LState) int { return l.call(L, false) }))
+	redisLib.RawSetString("status_reply", l.state.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	redisLib.RawSetString("error_reply", l.state.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	l.state.SetGlobal("redis", redisLib)
+	return l
+}
+
+// compile parses src, as SCRIPT LOAD does, and keeps it under sha
+func (l *luaScripts) compile(sha, src string) error {
+	if _, ok := l.protos[sha]; ok {
+		return nil
+	}
+	name := "@user_script"
+	chunk, err := parse.Parse(strings.NewReader(src), name)
+	if err != nil {
+		return fmt.Errorf("ERR Error compiling script (new function): %v", err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return fmt.Errorf("ERR Error compiling script (new function): %v", err)
+	}
+	l.protos[sha] = proto
+	return nil
+}
+
+// run executes the compiled script sha and converts its result to a reply
+func (l *luaScripts) run(sha string, keys, args []string) interface{} {
+	proto, ok := l.protos[sha]
+	if !ok {
+		return errNoScript
+	}
+
+	L := l.state
+	L.SetGlobal("KEYS", stringTable(L, keys))
+	L.SetGlobal("ARGV", stringTable(L, args))
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		var reply *replyError
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if e, ok := apiErr.Object.(*lua.LUserData); ok {
+				if re, ok := e.Value.(*replyError); ok {
+					reply = re
+				}
+			}
+		}
+		if reply != nil {
+			return reply.err
+		}
+		return fmt.Errorf("ERR Error running script (call to f_%s): %v", sha, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return toReply(ret)
+}
+
+// replyError carries an error reply of redis.call out of the script, which
+// Redis returns to the client as it is
+type replyError struct {
+	err error
+}
+
+// call implements redis.call and, with raise false, redis.pcall
+func (l *luaScripts) call(L *lua.LState, raise bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+		return 0
+	}
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(v)
+		case lua.LNumber:
+			args[i-1] = v.String()
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+			return 0
+		}
+	}
+
+	reply := l.dispatch(strings.ToUpper(args[0]), args[1:])
+	if err, ok := reply.(error); ok {
+		if raise {
+			ud := L.NewUserData()
+			ud.Value = &replyError{err: err}
+			L.Error(ud, 0)
+			return 0
+		}
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(err.Error()))
+		L.Push(t)
+		return 1
+	}
+	L.Push(toLua(L, reply))
+	return 1
+}
+
+// stringTable returns values as a Lua array
+func stringTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// toLua converts a command reply to a Lua value as Redis does: nil
+// replies become false and status replies a table with an ok field
+func toLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LFalse
+	case Status:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case bool:
+		if v {
+			return lua.LNumber(1)
+		}
+		return lua.LNumber(0)
+	case string:
+		return lua.LString(v)
+	case []string:
+		return stringTable(L, v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// toReply converts a script result to a reply as Redis does: numbers are
+// truncated to integers, true becomes 1, false and nil a nil reply, and
+// arrays stop at their first nil
+func toReply(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return int64(v)
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case *lua.LTable:
+		if ok, isStr := v.RawGetString("ok").(lua.LString); isStr {
+			return Status(ok)
+		}
+		if msg, isStr := v.RawGetString("err").(lua.LString); isStr {
+			return errors.New(string(msg))
+		}
+		items := []interface{}{}
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, toReply(item))
+		}
+		return items
+	}
+	return nil
+}
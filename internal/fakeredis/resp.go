@@ -0,0 +1,101 @@
+package fakeredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Status is a simple string reply such as OK or PONG
+type Status string
+
+// readCommand reads one RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// Inline command
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid multibulk length %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// writeReply encodes v as a RESP2 reply
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case Status:
+		w.WriteString("+" + string(v) + "\r\n")
+	case error:
+		// Error replies are one line; Redis flattens script errors too
+		msg := strings.Join(strings.Fields(v.Error()), " ")
+		w.WriteString("-" + msg + "\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case bool:
+		if v {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString(":0\r\n")
+		}
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		w.WriteString(fmt.Sprintf("-ERR unsupported reply type %T\r\n", v))
+	}
+}
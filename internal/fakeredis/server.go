@@ -0,0 +1,683 @@
+// Package fakeredis is an in-process Redis server for hermetic tests. It
+// speaks RESP over TCP, implements the commands the rate limiter uses and
+// runs Lua scripts in an embedded interpreter, so the scripts shipped to
+// Redis are the ones under test. Knobs inject latency,
+// errors and dropped connections so failure handling can be tested
+// deterministically.
+package fakeredis
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errSyntax      = errors.New("ERR syntax error")
+	errNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errNotFloat    = errors.New("ERR value is not a valid float")
+	errNoScript    = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errWrongNumber = errors.New("ERR wrong number of arguments")
+)
+
+// Server is a fake Redis server listening on a local TCP port
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	db       *DB
+	scripts  *luaScripts
+	loaded   map[string]bool
+	rejected bool
+	conns    map[net.Conn]struct{}
+	latency  time.Duration
+	failErr  error
+	failures int
+	down     bool
+	commands map[string]int
+	channels map[string]map[*client]struct{}
+}
+
+// client is one connection. Its writer is shared between the replies to
+// its own commands and the messages published to its subscriptions.
+type client struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	channels map[string]bool
+}
+
+// send writes v to the client and flushes it
+func (c *client) send(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeReply(c.w, v)
+	return c.w.Flush()
+}
+
+// Start starts a server on a random local port
+func Start() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:       ln,
+		db:       newDB(),
+		loaded:   make(map[string]bool),
+		conns:    make(map[net.Conn]struct{}),
+		commands: make(map[string]int),
+		channels: make(map[string]map[*client]struct{}),
+	}
+	s.scripts = newLuaScripts(s.dispatch)
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// URL returns a redis:// URL for the server
+func (s *Server) URL() string {
+	return "redis://" + s.Addr() + "/0"
+}
+
+// Close stops the server and drops every connection
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	return err
+}
+
+// RejectScripts makes SCRIPT LOAD and EVAL refuse every script as if it
+// did not compile, while reject is true
+func (s *Server) RejectScripts(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected = reject
+}
+
+// FlushScripts forgets loaded scripts, as after a restart or SCRIPT FLUSH
+func (s *Server) FlushScripts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = make(map[string]bool)
+}
+
+// SetLatency delays the replies of every round trip by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// FailWith makes every command reply with err until ClearFailures
+func (s *Server) FailWith(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failErr = err
+	s.failures = -1
+}
+
+// FailNext makes the next n commands reply with err
+func (s *Server) FailNext(n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failErr = err
+	s.failures = n
+}
+
+// ClearFailures stops injecting errors
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failErr = nil
+	s.failures = 0
+}
+
+// Disconnect drops every open client connection
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// SetDown drops open connections and refuses new ones while down is true
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+	if down {
+		s.Disconnect()
+	}
+}
+
+// DB runs fn with exclusive access to the keyspace
+func (s *Server) DB(fn func(db *DB)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.db)
+}
+
+// CommandCount returns how often a command was received
+func (s *Server) CommandCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[strings.ToUpper(name)]
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.down {
+			s.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// handle serves commands of one client connection
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	c := &client{w: bufio.NewWriter(conn), channels: make(map[string]bool)}
+	defer s.drop(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			if err := s.subscribe(c, args[1:]); err != nil {
+				return
+			}
+			continue
+		case "UNSUBSCRIBE":
+			if err := s.unsubscribe(c, args[1:]); err != nil {
+				return
+			}
+			continue
+		}
+
+		reply, latency := s.exec(args)
+		c.mu.Lock()
+		writeReply(c.w, reply)
+		// Flush only once the client has no more pipelined commands queued,
+		// so latency is paid once per round trip
+		if r.Buffered() == 0 {
+			if latency > 0 {
+				time.Sleep(latency)
+			}
+			err = c.w.Flush()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// subscribe adds c to channels, confirming each subscription
+func (s *Server) subscribe(c *client, channels []string) error {
+	for _, ch := range channels {
+		s.mu.Lock()
+		s.commands["SUBSCRIBE"]++
+		if s.channels[ch] == nil {
+			s.channels[ch] = make(map[*client]struct{})
+		}
+		s.channels[ch][c] = struct{}{}
+		s.mu.Unlock()
+
+		c.mu.Lock()
+		c.channels[ch] = true
+		count := int64(len(c.channels))
+		c.mu.Unlock()
+		if err := c.send([]interface{}{"subscribe", ch, count}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop removes a disconnected client from every channel
+func (s *Server) drop(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range c.channels {
+		delete(s.channels[ch], c)
+	}
+}
+
+// unsubscribe removes c from channels, or from all of them when channels
+// is empty
+func (s *Server) unsubscribe(c *client, channels []string) error {
+	c.mu.Lock()
+	if len(channels) == 0 {
+		for ch := range c.channels {
+			channels = append(channels, ch)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		s.mu.Lock()
+		delete(s.channels[ch], c)
+		s.mu.Unlock()
+
+		c.mu.Lock()
+		delete(c.channels, ch)
+		count := int64(len(c.channels))
+		c.mu.Unlock()
+		if err := c.send([]interface{}{"unsubscribe", ch, count}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec runs one command and returns its reply and the injected latency
+func (s *Server) exec(args []string) (interface{}, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.ToUpper(args[0])
+	s.commands[name]++
+
+	if !isHandshake(name) && s.failures != 0 {
+		if s.failures > 0 {
+			s.failures--
+		}
+		return s.failErr, s.latency
+	}
+	return s.dispatch(name, args[1:]), s.latency
+}
+
+// isHandshake reports whether name is sent by clients while connecting.
+// Injected errors skip these so connections can still be established.
+func isHandshake(name string) bool {
+	switch name {
+	case "HELLO", "CLIENT", "SELECT", "AUTH":
+		return true
+	}
+	return false
+}
+
+// dispatch executes a command. Must be called with s.mu held.
+func (s *Server) dispatch(name string, args []string) interface{} {
+	db := s.db
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			return args[0]
+		}
+		return Status("PONG")
+
+	case "CLIENT", "SELECT":
+		return Status("OK")
+
+	case "FLUSHALL", "FLUSHDB":
+		s.db = newDB()
+		return Status("OK")
+
+	case "DEL":
+		if len(args) == 0 {
+			return errWrongNumber
+		}
+		return db.Del(args...)
+
+	case "EXISTS":
+		var n int64
+		for _, key := range args {
+			if db.Exists(key) {
+				n++
+			}
+		}
+		return n
+
+	case "SCAN":
+		return scan(db, args)
+
+	case "PUBLISH":
+		if len(args) != 2 {
+			return errWrongNumber
+		}
+		var n int64
+		for c := range s.channels[args[0]] {
+			if c.send([]interface{}{"message", args[0], args[1]}) == nil {
+				n++
+			}
+		}
+		return n
+
+	case "XADD":
+		return xadd(db, args)
+
+	case "XTRIM":
+		return xtrim(db, args)
+
+	case "XRANGE", "XREVRANGE":
+		return xrangeCommand(db, args, name == "XREVRANGE")
+
+	case "XLEN":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		return db.XLen(args[0])
+
+	case "GET":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		if v, ok := db.Get(args[0]); ok {
+			return v
+		}
+		return nil
+
+	case "SET":
+		if len(args) != 2 && len(args) != 4 {
+			return errWrongNumber
+		}
+		var ttl time.Duration
+		if len(args) == 4 {
+			n, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			switch strings.ToUpper(args[2]) {
+			case "PX":
+				ttl = time.Duration(n) * time.Millisecond
+			case "EX":
+				ttl = time.Duration(n) * time.Second
+			default:
+				return errSyntax
+			}
+		}
+		db.Set(args[0], args[1], ttl)
+		return Status("OK")
+
+	case "INCR", "DECR":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		incr := db.Incr
+		if name == "DECR" {
+			incr = db.Decr
+		}
+		n, err := incr(args[0])
+		if err != nil {
+			return err
+		}
+		return n
+
+	case "TYPE":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		return Status(db.Type(args[0]))
+
+	case "EXPIRE", "PEXPIRE", "PEXPIREAT":
+		if len(args) != 2 {
+			return errWrongNumber
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		at := time.Now().Add(time.Duration(n) * time.Second)
+		if name == "PEXPIRE" {
+			at = time.Now().Add(time.Duration(n) * time.Millisecond)
+		} else if name == "PEXPIREAT" {
+			at = time.UnixMilli(n)
+		}
+		return db.ExpireAt(args[0], at)
+
+	case "PTTL", "TTL":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		ttl := db.PTTL(args[0])
+		if name == "TTL" && ttl > 0 {
+			ttl = (ttl + 500) / 1000
+		}
+		return ttl
+
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errWrongNumber
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				return err
+			}
+			if db.ZAdd(args[0], score, args[i+1]) {
+				added++
+			}
+		}
+		return added
+
+	case "ZREM":
+		if len(args) < 2 {
+			return errWrongNumber
+		}
+		return db.ZRem(args[0], args[1:]...)
+
+	case "ZSCORE":
+		if len(args) != 2 {
+			return errWrongNumber
+		}
+		if score, ok := db.ZScore(args[0], args[1]); ok {
+			return strconv.FormatFloat(score, 'f', -1, 64)
+		}
+		return nil
+
+	case "ZINCRBY":
+		if len(args) != 3 {
+			return errWrongNumber
+		}
+		delta, err := parseScore(args[1])
+		if err != nil {
+			return err
+		}
+		return strconv.FormatFloat(db.ZIncrBy(args[0], delta, args[2]), 'f', -1, 64)
+
+	case "ZRANGE":
+		if len(args) != 3 && len(args) != 4 {
+			return errWrongNumber
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return errNotInteger
+		}
+		withScores := len(args) == 4
+		if withScores && strings.ToUpper(args[3]) != "WITHSCORES" {
+			return errSyntax
+		}
+		return zrange(db, args[0], start, stop, withScores)
+
+	case "ZCARD":
+		if len(args) != 1 {
+			return errWrongNumber
+		}
+		return db.ZCard(args[0])
+
+	case "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		if len(args) != 3 {
+			return errWrongNumber
+		}
+		min, err := parseScore(args[1])
+		if err != nil {
+			return err
+		}
+		max, err := parseScore(args[2])
+		if err != nil {
+			return err
+		}
+		if name == "ZRANGEBYSCORE" {
+			return db.ZRangeByScore(args[0], min, max)
+		}
+		return db.ZRemRangeByScore(args[0], min, max)
+
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			return errWrongNumber
+		}
+		sha := strings.ToLower(args[0])
+		if name == "EVAL" {
+			sha = scriptSHA(args[0])
+			if err := s.loadScript(sha, args[0]); err != nil {
+				return err
+			}
+		}
+		if !s.loaded[sha] {
+			return errNoScript
+		}
+
+		numKeys, err := strconv.Atoi(args[1])
+		if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+			return errors.New("ERR Number of keys can't be greater than number of args")
+		}
+		return s.scripts.run(sha, args[2:2+numKeys], args[2+numKeys:])
+
+	case "SCRIPT":
+		return s.script(args)
+	}
+
+	return fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+}
+
+// script implements SCRIPT LOAD, EXISTS and FLUSH. Must be called with s.mu held.
+func (s *Server) script(args []string) interface{} {
+	if len(args) == 0 {
+		return errWrongNumber
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return errWrongNumber
+		}
+		sha := scriptSHA(args[1])
+		if err := s.loadScript(sha, args[1]); err != nil {
+			return err
+		}
+		return sha
+	case "EXISTS":
+		exists := make([]interface{}, len(args)-1)
+		for i, sha := range args[1:] {
+			exists[i] = s.loaded[strings.ToLower(sha)]
+		}
+		return exists
+	case "FLUSH":
+		s.loaded = make(map[string]bool)
+		return Status("OK")
+	}
+	return errSyntax
+}
+
+// loadScript compiles src and makes it callable by sha. Must be called with
+// s.mu held.
+func (s *Server) loadScript(sha, src string) error {
+	if s.rejected {
+		return errors.New("ERR Error compiling script (new function): fakeredis: scripts rejected")
+	}
+	if err := s.scripts.compile(sha, src); err != nil {
+		return err
+	}
+	s.loaded[sha] = true
+	return nil
+}
+
+// zrange implements ZRANGE by rank, with negative ranks counting from the end
+func zrange(db *DB, key string, start, stop int, withScores bool) []string {
+	members := db.ZRangeByScore(key, math.Inf(-1), math.Inf(1))
+	n := len(members)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	reply := []string{}
+	for i := start; i <= stop; i++ {
+		reply = append(reply, members[i])
+		if withScores {
+			score, _ := db.ZScore(key, members[i])
+			reply = append(reply, strconv.FormatFloat(score, 'f', -1, 64))
+		}
+	}
+	return reply
+}
+
+// scan implements SCAN, returning every match in a single page
+func scan(db *DB, args []string) interface{} {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return errWrongNumber
+	}
+	pattern := "*"
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT", "TYPE":
+		default:
+			return errSyntax
+		}
+	}
+	return []interface{}{"0", db.Keys(pattern)}
+}
+
+// scriptSHA returns the SHA1 digest Redis uses to name a script
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,238 @@
+package fakeredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func startServer(t *testing.T) (*Server, *redis.Client) {
+	t.Helper()
+	srv, err := Start()
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = srv.Close()
+	})
+	return srv, client
+}
+
+// TestServer_Commands tests the commands used by the rate limiter
+func TestServer_Commands(t *testing.T) {
+	_, client := startServer(t)
+	ctx := context.Background()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("PING failed: %v", err)
+	}
+
+	client.ZAdd(ctx, "z", redis.Z{Score: 1, Member: "a"}, redis.Z{Score: 2, Member: "b"}, redis.Z{Score: 3, Member: "c"})
+	if n := client.ZCard(ctx, "z").Val(); n != 3 {
+		t.Errorf("ZCARD = %d, want 3", n)
+	}
+	if n := client.ZRemRangeByScore(ctx, "z", "0", "2").Val(); n != 2 {
+		t.Errorf("ZREMRANGEBYSCORE removed %d, want 2", n)
+	}
+	if members := client.ZRangeByScore(ctx, "z", &redis.ZRangeBy{Min: "-inf", Max: "+inf"}).Val(); len(members) != 1 || members[0] != "c" {
+		t.Errorf("ZRANGEBYSCORE = %v, want [c]", members)
+	}
+
+	client.PExpire(ctx, "z", 50*time.Millisecond)
+	if ttl := client.PTTL(ctx, "z").Val(); ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("PTTL = %v, want up to 50ms", ttl)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n := client.Exists(ctx, "z").Val(); n != 0 {
+		t.Error("Key should have expired")
+	}
+
+	if n := client.Incr(ctx, "counter").Val(); n != 1 {
+		t.Errorf("INCR = %d, want 1", n)
+	}
+	client.Set(ctx, "ban", "2", time.Minute)
+	if v := client.Get(ctx, "ban").Val(); v != "2" {
+		t.Errorf("GET = %q, want 2", v)
+	}
+	if keys, _, err := client.Scan(ctx, 0, "b*", 10).Result(); err != nil || len(keys) != 1 || keys[0] != "ban" {
+		t.Errorf("SCAN = %v, want [ban]: %v", keys, err)
+	}
+	if err := client.Do(ctx, "BLPOP", "list", 0).Err(); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("Expected unknown command error, got %v", err)
+	}
+}
+
+// TestServer_Scripts tests EVAL and EVALSHA of Lua scripts
+func TestServer_Scripts(t *testing.T) {
+	srv, client := startServer(t)
+	ctx := context.Background()
+
+	src := "return redis.call('INCR', KEYS[1]) + ARGV[1]"
+	script := redis.NewScript(src)
+
+	if err := script.EvalSha(ctx, client, []string{"k"}, 10).Err(); err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		t.Fatalf("Expected NOSCRIPT before loading, got %v", err)
+	}
+	if n, err := script.Run(ctx, client, []string{"k"}, 10).Int64(); err != nil || n != 11 {
+		t.Fatalf("Run = %d (%v), want 11", n, err)
+	}
+	if n, err := script.EvalSha(ctx, client, []string{"k"}, 10).Int64(); err != nil || n != 12 {
+		t.Errorf("EVALSHA after EVAL = %d (%v), want 12", n, err)
+	}
+
+	srv.FlushScripts()
+	if exists := script.Exists(ctx, client).Val(); len(exists) != 1 || exists[0] {
+		t.Errorf("Script should be unloaded after flush, got %v", exists)
+	}
+
+	if err := client.Eval(ctx, "return (", nil).Err(); err == nil || !strings.Contains(err.Error(), "compiling script") {
+		t.Errorf("Expected compile error, got %v", err)
+	}
+	if err := client.Eval(ctx, "return redis.call('ZADD', KEYS[1], 'x')", []string{"z"}).Err(); err == nil || !strings.Contains(err.Error(), "wrong number") {
+		t.Errorf("Expected the command error from the script, got %v", err)
+	}
+
+	srv.RejectScripts(true)
+	if err := client.ScriptLoad(ctx, src).Err(); err == nil {
+		t.Error("Expected SCRIPT LOAD to fail while scripts are rejected")
+	}
+}
+
+// TestServer_ScriptReplies tests the conversion of replies between Redis
+// and Lua
+func TestServer_ScriptReplies(t *testing.T) {
+	_, client := startServer(t)
+	ctx := context.Background()
+
+	client.ZAdd(ctx, "z", redis.Z{Score: 1.5, Member: "a"}, redis.Z{Score: 3, Member: "b"})
+	src := `
+local ttl = redis.call('PTTL', 'missing')
+local t = redis.call('TYPE', KEYS[1])['ok']
+local r = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+local g = redis.call('GET', 'missing')
+return {ttl, t, r[1], r[2], tostring(g), redis.call('ZINCRBY', KEYS[1], 2, 'a')}`
+	got, err := client.Eval(ctx, src, []string{"z"}).Slice()
+	if err != nil {
+		t.Fatalf("EVAL failed: %v", err)
+	}
+	want := []interface{}{int64(-2), "zset", "a", "1.5", "false", "3.5"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("EVAL = %v, want %v", got, want)
+	}
+}
+
+// TestServer_PubSub tests SUBSCRIBE and PUBLISH
+func TestServer_PubSub(t *testing.T) {
+	_, client := startServer(t)
+	ctx := context.Background()
+
+	sub := client.Subscribe(ctx, "events")
+	defer func() { _ = sub.Close() }()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("SUBSCRIBE failed: %v", err)
+	}
+
+	if n := client.Publish(ctx, "events", "hello").Val(); n != 1 {
+		t.Errorf("PUBLISH reached %d subscribers, want 1", n)
+	}
+	select {
+	case msg := <-sub.Channel():
+		if msg.Channel != "events" || msg.Payload != "hello" {
+			t.Errorf("Unexpected message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message was not delivered")
+	}
+
+	if n := client.Publish(ctx, "other", "ignored").Val(); n != 0 {
+		t.Errorf("PUBLISH to an unused channel reached %d subscribers", n)
+	}
+}
+
+// TestServer_Streams tests XADD, XTRIM and XRANGE
+func TestServer_Streams(t *testing.T) {
+	_, client := startServer(t)
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := client.XAdd(ctx, &redis.XAddArgs{
+			Stream: "s",
+			MaxLen: 3,
+			Approx: true,
+			Values: []string{"n", strconv.Itoa(i)},
+		}).Result()
+		if err != nil {
+			t.Fatalf("XADD failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if n := client.XLen(ctx, "s").Val(); n != 3 {
+		t.Errorf("XLEN = %d, want 3 after MAXLEN", n)
+	}
+
+	latest, err := client.XRevRangeN(ctx, "s", "+", "-", 2).Result()
+	if err != nil || len(latest) != 2 || latest[0].ID != ids[4] || latest[0].Values["n"] != "4" {
+		t.Errorf("XREVRANGE = %v (%v), want the newest entries first", latest, err)
+	}
+
+	if n := client.XTrimMinID(ctx, "s", ids[4]).Val(); n != 2 {
+		t.Errorf("XTRIM MINID removed %d, want 2", n)
+	}
+	if all := client.XRange(ctx, "s", "-", "+").Val(); len(all) != 1 || all[0].ID != ids[4] {
+		t.Errorf("XRANGE = %v, want only %s", all, ids[4])
+	}
+}
+
+// TestServer_Knobs tests latency, error and disconnect injection
+func TestServer_Knobs(t *testing.T) {
+	srv, client := startServer(t)
+	ctx := context.Background()
+
+	srv.SetLatency(30 * time.Millisecond)
+	start := time.Now()
+	client.Ping(ctx)
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Reply came after %v, want at least 30ms", elapsed)
+	}
+	srv.SetLatency(0)
+
+	srv.FailNext(2, errors.New("READONLY You can't write against a read only replica."))
+	for i := 0; i < 2; i++ {
+		if err := client.Incr(ctx, "k").Err(); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+			t.Errorf("Command %d: expected READONLY, got %v", i+1, err)
+		}
+	}
+	if err := client.Incr(ctx, "k").Err(); err != nil {
+		t.Errorf("Command after injected failures: %v", err)
+	}
+
+	srv.FailWith(errors.New("ERR injected"))
+	for i := 0; i < 3; i++ {
+		if err := client.Ping(ctx).Err(); err == nil {
+			t.Error("Expected injected error")
+		}
+	}
+	srv.ClearFailures()
+
+	srv.SetDown(true)
+	if err := client.Ping(ctx).Err(); err == nil {
+		t.Error("Expected connection error while down")
+	}
+	srv.SetDown(false)
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Errorf("PING after coming back up: %v", err)
+	}
+
+	if srv.CommandCount("ping") < 5 {
+		t.Errorf("Expected PING to be counted, got %d", srv.CommandCount("ping"))
+	}
+}
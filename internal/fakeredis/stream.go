@@ -0,0 +1,250 @@
+package fakeredis
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// streamID orders stream entries by milliseconds, then sequence
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseStreamID parses "ms-seq", "ms", "-" or "+". A missing sequence is
+// defaultSeq, so ranges can include the whole millisecond.
+func parseStreamID(s string, defaultSeq uint64) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return streamID{ms: ^uint64(0), seq: ^uint64(0)}, nil
+	}
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errStreamID
+	}
+	seq := defaultSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return streamID{}, errStreamID
+		}
+	}
+	return streamID{ms: ms, seq: seq}, nil
+}
+
+// streamEntry is one entry of a stream
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+// stream holds entries in ID order
+type stream struct {
+	entries []streamEntry
+	lastID  streamID
+}
+
+// stream returns the stream of key, creating it when missing
+func (db *DB) stream(key string) *stream {
+	e := db.lookup(key)
+	if e == nil {
+		e = &entry{}
+		db.entries[key] = e
+	}
+	if e.stream == nil {
+		e.stream = &stream{}
+	}
+	return e.stream
+}
+
+// XAdd appends fields under a generated ID and returns the ID
+func (db *DB) XAdd(key string, fields []string) string {
+	s := db.stream(key)
+	id := streamID{ms: uint64(time.Now().UnixMilli())}
+	if !s.lastID.less(id) {
+		id = streamID{ms: s.lastID.ms, seq: s.lastID.seq + 1}
+	}
+	s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	s.lastID = id
+	return id.String()
+}
+
+// XLen returns the number of entries in a stream
+func (db *DB) XLen(key string) int64 {
+	e := db.lookup(key)
+	if e == nil || e.stream == nil {
+		return 0
+	}
+	return int64(len(e.stream.entries))
+}
+
+// xtrimMaxLen keeps the newest maxLen entries and returns how many were
+// removed
+func (db *DB) xtrimMaxLen(key string, maxLen int) int64 {
+	e := db.lookup(key)
+	if e == nil || e.stream == nil || len(e.stream.entries) <= maxLen {
+		return 0
+	}
+	removed := len(e.stream.entries) - maxLen
+	e.stream.entries = e.stream.entries[removed:]
+	return int64(removed)
+}
+
+// xtrimMinID drops entries older than minID and returns how many were removed
+func (db *DB) xtrimMinID(key string, minID streamID) int64 {
+	e := db.lookup(key)
+	if e == nil || e.stream == nil {
+		return 0
+	}
+	i := 0
+	for i < len(e.stream.entries) && e.stream.entries[i].id.less(minID) {
+		i++
+	}
+	e.stream.entries = e.stream.entries[i:]
+	return int64(i)
+}
+
+// xrange returns up to count entries between start and end, newest first
+// when reverse is set. A count of zero or less returns all of them.
+func (db *DB) xrange(key string, start, end streamID, count int, reverse bool) []interface{} {
+	reply := []interface{}{}
+	e := db.lookup(key)
+	if e == nil || e.stream == nil {
+		return reply
+	}
+	entries := e.stream.entries
+	for i := range entries {
+		if count > 0 && len(reply) == count {
+			break
+		}
+		entry := entries[i]
+		if reverse {
+			entry = entries[len(entries)-1-i]
+		}
+		if entry.id.less(start) || end.less(entry.id) {
+			continue
+		}
+		reply = append(reply, []interface{}{entry.id.String(), entry.fields})
+	}
+	return reply
+}
+
+// xadd implements XADD with an optional MAXLEN or MINID cap
+func xadd(db *DB, args []string) interface{} {
+	if len(args) < 4 {
+		return errWrongNumber
+	}
+	key, args := args[0], args[1:]
+	trim := func() {}
+	if opt := strings.ToUpper(args[0]); opt == "MAXLEN" || opt == "MINID" {
+		args = args[1:]
+		if len(args) > 0 && (args[0] == "~" || args[0] == "=") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return errSyntax
+		}
+		fn, err := trimmer(db, key, opt, args[0])
+		if err != nil {
+			return err
+		}
+		trim = fn
+		args = args[1:]
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return errWrongNumber
+	}
+	if args[0] != "*" {
+		return errors.New("ERR fakeredis: only generated stream IDs are supported")
+	}
+	id := db.XAdd(key, append([]string(nil), args[1:]...))
+	trim()
+	return id
+}
+
+// xtrim implements XTRIM key MAXLEN|MINID [~|=] threshold [LIMIT n]
+func xtrim(db *DB, args []string) interface{} {
+	if len(args) < 3 {
+		return errWrongNumber
+	}
+	key, opt, args := args[0], strings.ToUpper(args[1]), args[2:]
+	if args[0] == "~" || args[0] == "=" {
+		args = args[1:]
+	}
+	if len(args) != 1 && !(len(args) == 3 && strings.ToUpper(args[1]) == "LIMIT") {
+		return errSyntax
+	}
+	if opt == "MAXLEN" {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return errNotInteger
+		}
+		return db.xtrimMaxLen(key, n)
+	}
+	if opt != "MINID" {
+		return errSyntax
+	}
+	id, err := parseStreamID(args[0], 0)
+	if err != nil {
+		return err
+	}
+	return db.xtrimMinID(key, id)
+}
+
+// trimmer returns the trim an XADD cap applies after appending
+func trimmer(db *DB, key, opt, threshold string) (func(), error) {
+	if opt == "MAXLEN" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			return nil, errNotInteger
+		}
+		return func() { db.xtrimMaxLen(key, n) }, nil
+	}
+	id, err := parseStreamID(threshold, 0)
+	if err != nil {
+		return nil, err
+	}
+	return func() { db.xtrimMinID(key, id) }, nil
+}
+
+// xrangeCommand implements XRANGE and XREVRANGE with an optional COUNT
+func xrangeCommand(db *DB, args []string, reverse bool) interface{} {
+	if len(args) != 3 && len(args) != 5 {
+		return errWrongNumber
+	}
+	lo, hi := args[1], args[2]
+	if reverse {
+		lo, hi = hi, lo
+	}
+	start, err := parseStreamID(lo, 0)
+	if err != nil {
+		return err
+	}
+	end, err := parseStreamID(hi, ^uint64(0))
+	if err != nil {
+		return err
+	}
+	count := 0
+	if len(args) == 5 {
+		if strings.ToUpper(args[3]) != "COUNT" {
+			return errSyntax
+		}
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return errNotInteger
+		}
+	}
+	return db.xrange(args[0], start, end, count, reverse)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KeyVersion is the layout of the keys and the scripts that maintain them.
+// Bump it whenever a script change makes existing data incompatible, so a
+// deploy starts from fresh keys instead of misreading the old ones. The
+// unprefixed "rate_limit*" keys of earlier releases are version 1.
+const KeyVersion = 2
+
+// DefaultKeyspaceName is used for an unset service or policy
+const DefaultKeyspaceName = "default"
+
+// Keyspace namespaces the keys of one limiter, so services sharing a Redis
+// don't count each other's requests. Every key starts with
+// "rl:<service>:<policy>:v<KeyVersion>:".
+type Keyspace struct {
+	// Service owning the keys
+	Service string
+	// Limit policy the counters enforce. The limiter sets it from the policy
+	// of each request; keys not tied to a request use the default policy.
+	Policy string
+}
+
+// forPolicy returns the keyspace of the counters of the named policy
+func (k Keyspace) forPolicy(name string) Keyspace {
+	k.Policy = name
+	return k
+}
+
+// withDefaults fills in an unset service or policy
+func (k Keyspace) withDefaults() Keyspace {
+	if k.Service == "" {
+		k.Service = DefaultKeyspaceName
+	}
+	if k.Policy == "" {
+		k.Policy = DefaultKeyspaceName
+	}
+	return k
+}
+
+// validate rejects names that would break key parsing or hash tags
+func (k Keyspace) validate() error {
+	for _, name := range []string{k.Service, k.Policy} {
+		if strings.ContainsAny(name, ":{}*?[] \t\n") {
+			return fmt.Errorf("invalid keyspace name %q", name)
+		}
+	}
+	return nil
+}
+
+// servicePrefix is the prefix shared by every policy and version of the
+// service's keys
+func (k Keyspace) servicePrefix() string {
+	return "rl:" + k.withDefaults().Service + ":"
+}
+
+// base is the prefix shared by every version of the keyspace
+func (k Keyspace) base() string {
+	return k.servicePrefix() + k.withDefaults().Policy + ":"
+}
+
+// prefix is the prefix of the keys of the current version
+func (k Keyspace) prefix() string {
+	return fmt.Sprintf("%sv%d:", k.base(), KeyVersion)
+}
+
+// windowKeys returns the sliding window keys of ip
+func (k Keyspace) windowKeys(ip string) WindowKeys {
+	p := k.prefix()
+	return WindowKeys{
+		Window:       p + "window:" + hashTag(ip),
+		Reservations: p + "reservations:" + hashTag(ip),
+	}
+}
+
+// penaltyKeys returns the penalty box keys of ip
+func (k Keyspace) penaltyKeys(ip string) PenaltyKeys {
+	p := k.prefix()
+	return PenaltyKeys{
+		Strikes:  p + "strikes:" + hashTag(ip),
+		Offenses: p + "offenses:" + hashTag(ip),
+		Ban:      p + "ban:" + hashTag(ip),
+	}
+}
+
+// quotaKey returns the key counting usage of ip in one calendar period
+func (k Keyspace) quotaKey(period QuotaPeriod, periodID, ip string) string {
+	return k.prefix() + "quota:" + string(period) + ":" + periodID + ":" + hashTag(ip)
+}
+
+// regionKey returns the G-counter of ip for one window bucket
+func (k Keyspace) regionKey(bucket int64, ip string) string {
+	return k.prefix() + "region:" + strconv.FormatInt(bucket, 10) + ":" + hashTag(ip)
+}
+
+// instancesKey holds the heartbeats of live limiter instances
+func (k Keyspace) instancesKey() string {
+	return k.prefix() + "instances"
+}
+
+// registryKey indexes the registered instances by their last report
+func (k Keyspace) registryKey() string {
+	return k.prefix() + "registry"
+}
+
+// instanceKey holds the last report of instance id
+func (k Keyspace) instanceKey(id string) string {
+	return k.prefix() + "instance:" + id
+}
+
+// eventsChannel is the Pub/Sub channel instances share activity events on
+func (k Keyspace) eventsChannel() string {
+	return k.prefix() + "events"
+}
+
+// eventsStreamKey is the capped stream holding the shared event history
+func (k Keyspace) eventsStreamKey() string {
+	return k.prefix() + "events:history"
+}
+
+// keyspaceFromEnv reads RATE_LIMIT_SERVICE
+func keyspaceFromEnv() (Keyspace, error) {
+	ks := Keyspace{Service: os.Getenv("RATE_LIMIT_SERVICE")}
+	if err := ks.validate(); err != nil {
+		return Keyspace{}, err
+	}
+	return ks, nil
+}
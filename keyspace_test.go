@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testKeys is the keyspace of limiters built from testConfig
+var testKeys = Keyspace{}
+
+// TestKeyspace tests key layout and isolation between services and policies
+func TestKeyspace(t *testing.T) {
+	if key := testKeys.windowKeys("1.2.3.4").Window; key != "rl:default:default:v2:window:{1.2.3.4}" {
+		t.Errorf("Unexpected default window key %s", key)
+	}
+
+	api := Keyspace{Service: "api", Policy: "search"}
+	if key := api.penaltyKeys("1.2.3.4").Ban; key != "rl:api:search:v2:ban:{1.2.3.4}" {
+		t.Errorf("Unexpected ban key %s", key)
+	}
+	if key := api.instancesKey(); key != "rl:api:search:v2:instances" {
+		t.Errorf("Unexpected instances key %s", key)
+	}
+
+	if key := api.forPolicy("upload").windowKeys("1.2.3.4").Window; key != "rl:api:upload:v2:window:{1.2.3.4}" {
+		t.Errorf("Unexpected window key of another policy %s", key)
+	}
+
+	other := Keyspace{Service: "billing", Policy: "search"}
+	if api.windowKeys("1.2.3.4").Window == other.windowKeys("1.2.3.4").Window {
+		t.Error("Services sharing Redis should not share keys")
+	}
+
+	for _, name := range []string{"a:b", "a{b}", "a b", "a*"} {
+		if err := (Keyspace{Service: name}).validate(); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+// TestKeyspaceFromEnv tests reading the keyspace from env vars
+func TestKeyspaceFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_SERVICE")
+	os.Setenv("RATE_LIMIT_SERVICE", "api")
+
+	ks, err := keyspaceFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(ks.windowKeys("ip").Window, "rl:api:default:") {
+		t.Errorf("Unexpected keyspace %+v", ks)
+	}
+
+	os.Setenv("RATE_LIMIT_SERVICE", "api:v1")
+	if _, err := keyspaceFromEnv(); err == nil {
+		t.Error("Expected error for a service name containing a colon")
+	}
+}
+
+// TestDistributedRateLimiter_PolicyKeys tests that requests are counted in
+// the keys of the policy matching them
+func TestDistributedRateLimiter_PolicyKeys(t *testing.T) {
+	defer func() { policies = nil }()
+	policies = []*Policy{{Name: "search", PathPrefix: "/search", Consistency: ConsistencyStrict}}
+
+	cfg := testConfig()
+	cfg.Limit = 1
+	store := NewMemoryStore()
+	drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+	defer func() { _ = drl.Close() }()
+
+	search := httptest.NewRequest("GET", "/search?q=x", nil)
+	if !drl.AllowWithRequest("policy-keys-ip", search) {
+		t.Fatal("First search request should be allowed")
+	}
+	if !drl.AllowWithRequest("policy-keys-ip", httptest.NewRequest("GET", "/", nil)) {
+		t.Error("Requests under another policy should not share the search limit")
+	}
+	if drl.AllowWithRequest("policy-keys-ip", search) {
+		t.Error("Second search request should be rejected")
+	}
+
+	key := testKeys.forPolicy("search").windowKeys("policy-keys-ip").Window
+	if count, _ := store.Count(context.Background(), key); count != 1 {
+		t.Errorf("Expected the search request in %s, got %d entries", key, count)
+	}
+}
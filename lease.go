@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultLeaseTTL is how long an instance may serve a leased chunk locally
+const DefaultLeaseTTL = time.Second
+
+// LeaseConfig controls local leasing of sliding window budget. A zero Size
+// disables leasing and every request goes to the store.
+type LeaseConfig struct {
+	// Size is the number of units leased from the store at once
+	Size int
+	// TTL is how long unused leased units are held before being returned
+	TTL time.Duration
+}
+
+// lease is a chunk of one key's window budget held by this instance. Units
+// are recorded in the store as "<id>:1".."<id>:<granted>".
+type lease struct {
+	id        string
+	granted   int
+	used      int
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
+// member returns the store member of leased unit n
+func (l *lease) member(n int) string {
+	return l.id + ":" + strconv.Itoa(n)
+}
+
+// unused returns the store members of units that were never served
+func (l *lease) unused() []string {
+	members := make([]string, 0, l.granted-l.used)
+	for n := l.used + 1; n <= l.granted; n++ {
+		members = append(members, l.member(n))
+	}
+	return members
+}
+
+// leaseSlot holds the current lease of one key
+type leaseSlot struct {
+	mu      sync.Mutex
+	current *lease
+	// Dropped from the table, so a new slot holds the key's lease
+	removed bool
+}
+
+// leaseTable tracks the leases held by this instance, by window key
+type leaseTable struct {
+	mu    sync.Mutex
+	slots map[string]*leaseSlot
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{slots: make(map[string]*leaseSlot)}
+}
+
+// slot returns the lease slot of window, creating it if needed
+func (t *leaseTable) slot(window string) *leaseSlot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.slots[window]
+	if !ok {
+		s = &leaseSlot{}
+		t.slots[window] = s
+	}
+	return s
+}
+
+// lock returns the slot of window locked. A slot dropped from the table
+// while waiting for its lock is skipped, so only one lease per key is held.
+func (t *leaseTable) lock(window string) *leaseSlot {
+	for {
+		s := t.slot(window)
+		s.mu.Lock()
+		if !s.removed {
+			return s
+		}
+		s.mu.Unlock()
+	}
+}
+
+// unlock releases the lock of the slot of window taken by lock. A slot left
+// without a lease, as when the store refused or failed, is dropped from the
+// table so keys that are only ever rejected leave nothing behind.
+func (t *leaseTable) unlock(window string, s *leaseSlot) {
+	if s.current != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.removed = true
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	if t.slots[window] == s {
+		delete(t.slots, window)
+	}
+	t.mu.Unlock()
+}
+
+// leaseAllow serves the request from a local lease of the window keys of
+// ip, acquiring a new lease from the store when the current one is used up
+// or expired
+func (drl *DistributedRateLimiter) leaseAllow(ctx context.Context, ks Keyspace, ip string, start time.Time) windowDecision {
+	keys := ks.windowKeys(ip)
+	slot := drl.leases.lock(keys.Window)
+	defer drl.leases.unlock(keys.Window, slot)
+
+	if l := slot.current; l != nil {
+		if l.used < l.granted && start.Before(l.expiresAt) {
+			l.used++
+			drl.metrics.mu.Lock()
+			drl.metrics.LeaseHits++
+			drl.metrics.mu.Unlock()
+			return windowDecision{allowed: true, unit: &consumedUnit{key: ip, keys: keys, member: l.member(l.used), remote: drl}}
+		}
+		slot.current = nil
+		if l.timer.Stop() {
+			drl.returnLease(ctx, keys.Window, l)
+		}
+	}
+
+	l := &lease{id: uuid.New().String()}
+	var granted int
+	err := drl.storeCall("lease", func() (err error) {
+		granted, err = drl.store.Lease(
+			ctx,
+			keys,
+			l.id,
+			drl.config.Lease.Size,
+			start,
+			drl.config.Window,
+			drl.config.Limit,
+		)
+		return err
+	})
+	if err != nil {
+		return drl.fallbackAllow(ks.Policy, ip)
+	}
+
+	latency := time.Since(start)
+	if granted == 0 {
+		return windowDecision{latency: latency}
+	}
+
+	ttl := drl.config.Lease.TTL
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	l.granted = granted
+	l.used = 1
+	l.expiresAt = start.Add(ttl)
+	l.timer = time.AfterFunc(ttl, func() {
+		drl.expireLease(keys.Window, slot, l)
+	})
+	slot.current = l
+	return windowDecision{allowed: true, unit: &consumedUnit{key: ip, keys: keys, member: l.member(1), remote: drl}, latency: latency}
+}
+
+// expireLease drops an expired lease and returns its unused units
+func (drl *DistributedRateLimiter) expireLease(window string, slot *leaseSlot, l *lease) {
+	drl.leases.mu.Lock()
+	slot.mu.Lock()
+	if slot.current == l {
+		slot.current = nil
+		if drl.leases.slots[window] == slot {
+			delete(drl.leases.slots, window)
+			slot.removed = true
+		}
+	}
+	slot.mu.Unlock()
+	drl.leases.mu.Unlock()
+
+	drl.returnLease(drl.ctx, window, l)
+}
+
+// returnLease gives the unused units of l back to the shared window within
+// the decision deadline of ctx. Units that cannot be returned leave the
+// window with it.
+func (drl *DistributedRateLimiter) returnLease(ctx context.Context, window string, l *lease) {
+	members := l.unused()
+	if len(members) == 0 || !drl.circuitBreaker.Allow() {
+		return
+	}
+
+	ctx, cancel := drl.decisionContext(ctx)
+	defer cancel()
+	_ = drl.storeCall("lease_return", func() error {
+		return drl.store.RemoveRequest(ctx, window, members...)
+	})
+}
+
+// returnAllLeases returns the unused units of every lease held
+func (drl *DistributedRateLimiter) returnAllLeases() {
+	drl.leases.mu.Lock()
+	slots := drl.leases.slots
+	drl.leases.slots = make(map[string]*leaseSlot)
+	drl.leases.mu.Unlock()
+
+	for window, slot := range slots {
+		slot.mu.Lock()
+		l := slot.current
+		slot.current = nil
+		slot.removed = true
+		slot.mu.Unlock()
+		if l != nil && l.timer.Stop() {
+			drl.returnLease(drl.ctx, window, l)
+		}
+	}
+}
+
+// leaseConfigFromEnv reads RATE_LIMIT_LEASE_SIZE and RATE_LIMIT_LEASE_TTL
+func leaseConfigFromEnv() (LeaseConfig, error) {
+	var cfg LeaseConfig
+	if v := os.Getenv("RATE_LIMIT_LEASE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return LeaseConfig{}, fmt.Errorf("invalid RATE_LIMIT_LEASE_SIZE %q", v)
+		}
+		cfg.Size = n
+	}
+	cfg.TTL = DefaultLeaseTTL
+	if v := os.Getenv("RATE_LIMIT_LEASE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return LeaseConfig{}, fmt.Errorf("invalid RATE_LIMIT_LEASE_TTL %q", v)
+		}
+		cfg.TTL = d
+	}
+	return cfg, nil
+}
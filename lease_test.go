@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts round trips made through a Store
+type countingStore struct {
+	Store
+	allows atomic.Int64
+	leases atomic.Int64
+	syncs  atomic.Int64
+}
+
+func (s *countingStore) AllowRequest(ctx context.Context, keys WindowKeys, member string, now time.Time, window time.Duration, limit int) (bool, error) {
+	s.allows.Add(1)
+	return s.Store.AllowRequest(ctx, keys, member, now, window, limit)
+}
+
+func (s *countingStore) Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error) {
+	s.leases.Add(1)
+	return s.Store.Lease(ctx, keys, id, units, now, window, limit)
+}
+
+func (s *countingStore) SyncWindows(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]int64, error) {
+	s.syncs.Add(1)
+	return s.Store.SyncWindows(ctx, syncs, now, window)
+}
+
+// TestStore_Lease tests partial grants near the limit
+func TestStore_Lease(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		keys := testKeys.windowKeys("store-lease-test")
+		_ = store.Delete(ctx, keys.Window, keys.Reservations)
+
+		now := time.Now()
+		if granted, err := store.Lease(ctx, keys, "a", 4, now, time.Minute, 6); err != nil || granted != 4 {
+			t.Fatalf("Expected 4 units granted, got %d: %v", granted, err)
+		}
+		if granted, _ := store.Lease(ctx, keys, "b", 4, now, time.Minute, 6); granted != 2 {
+			t.Errorf("Expected the remaining 2 units granted, got %d", granted)
+		}
+		if granted, _ := store.Lease(ctx, keys, "c", 4, now, time.Minute, 6); granted != 0 {
+			t.Errorf("Expected nothing granted from a full window, got %d", granted)
+		}
+
+		if err := store.RemoveRequest(ctx, keys.Window, "a:3", "a:4"); err != nil {
+			t.Fatalf("RemoveRequest failed: %v", err)
+		}
+		if count, _ := store.Count(ctx, keys.Window); count != 4 {
+			t.Errorf("Expected 4 entries after returning 2 units, got %d", count)
+		}
+	})
+}
+
+// TestDistributedRateLimiter_Lease tests that leased units are served locally
+func TestDistributedRateLimiter_Lease(t *testing.T) {
+	cfg := testConfig()
+	cfg.Limit = 100
+	cfg.Lease = LeaseConfig{Size: 10, TTL: time.Minute}
+	store := &countingStore{Store: NewMemoryStore()}
+	drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+	defer func() { _ = drl.Close() }()
+
+	for i := 0; i < 25; i++ {
+		if !drl.Allow("lease-ip") {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if n := store.leases.Load(); n != 3 {
+		t.Errorf("Expected 3 leases for 25 requests, got %d", n)
+	}
+	if n := store.allows.Load(); n != 0 {
+		t.Errorf("Expected no per-request store calls, got %d", n)
+	}
+	if hits := drl.GetMetrics().LeaseHits; hits != 22 {
+		t.Errorf("Expected 22 lease hits, got %d", hits)
+	}
+	if count, _ := store.Count(context.Background(), testKeys.windowKeys("lease-ip").Window); count != 30 {
+		t.Errorf("Expected 30 leased entries in the window, got %d", count)
+	}
+}
+
+// TestDistributedRateLimiter_LeaseNearLimit tests that leasing never lets
+// more than the limit through
+func TestDistributedRateLimiter_LeaseNearLimit(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.Limit = 5
+	cfg.Lease = LeaseConfig{Size: 10, TTL: time.Minute}
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	for i := 0; i < 5; i++ {
+		if !drl.Allow("lease-limit-ip") {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+	if drl.Allow("lease-limit-ip") {
+		t.Error("Request over the limit should be rejected")
+	}
+}
+
+// TestDistributedRateLimiter_LeaseExpiry tests that unused units go back to
+// the shared window when a lease expires
+func TestDistributedRateLimiter_LeaseExpiry(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.Lease = LeaseConfig{Size: 10, TTL: 50 * time.Millisecond}
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	for i := 0; i < 3; i++ {
+		drl.Allow("lease-expiry-ip")
+	}
+	key := testKeys.windowKeys("lease-expiry-ip").Window
+	if count, _ := drl.store.Count(context.Background(), key); count != 10 {
+		t.Fatalf("Expected the whole lease in the window, got %d", count)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		count, _ := drl.store.Count(context.Background(), key)
+		if count == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected unused units returned, window still has %d", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDistributedRateLimiter_LeaseStaleExpiry tests that the expiry of a
+// lease whose slot was already replaced leaves the new slot in place
+func TestDistributedRateLimiter_LeaseStaleExpiry(t *testing.T) {
+	cfg := testConfig()
+	cfg.Limit = 100
+	cfg.Lease = LeaseConfig{Size: 10, TTL: time.Minute}
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+
+	window := testKeys.windowKeys("lease-stale-ip").Window
+	drl.Allow("lease-stale-ip")
+	old := drl.leases.slot(window)
+	old.mu.Lock()
+	l := old.current
+	old.mu.Unlock()
+	l.timer.Stop()
+
+	drl.expireLease(window, old, l)
+	if !old.removed {
+		t.Fatal("Expected the expired slot to be dropped")
+	}
+	drl.Allow("lease-stale-ip")
+	current := drl.leases.slot(window)
+	if current == old {
+		t.Fatal("Expected a new slot after the expiry")
+	}
+
+	// An expiry racing with the replacement must not drop the new slot
+	stale := &lease{id: "stale"}
+	old.current = stale
+	drl.expireLease(window, old, stale)
+	if drl.leases.slot(window) != current {
+		t.Error("Expected the stale expiry to keep the current slot")
+	}
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	if current.current == nil {
+		t.Error("Expected the current lease to survive the stale expiry")
+	}
+}
+
+// failingLeaseStore fails every lease request
+type failingLeaseStore struct {
+	Store
+}
+
+func (s *failingLeaseStore) Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error) {
+	return 0, errors.New("lease failed")
+}
+
+// TestDistributedRateLimiter_LeaseSlotsDropped tests that keys left without
+// a lease leave no slot behind
+func TestDistributedRateLimiter_LeaseSlotsDropped(t *testing.T) {
+	cfg := testConfig()
+	cfg.Limit = 1
+	cfg.Lease = LeaseConfig{Size: 10, TTL: time.Minute}
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+
+	if !drl.Allow("lease-drop-ip") {
+		t.Fatal("First request should be allowed")
+	}
+	if drl.Allow("lease-drop-ip") {
+		t.Fatal("Request over the limit should be rejected")
+	}
+	if n := len(drl.leases.slots); n != 0 {
+		t.Errorf("Expected the slot of a refused lease dropped, got %d slots", n)
+	}
+
+	failing := NewDistributedRateLimiterWithStore(cfg, &failingLeaseStore{Store: NewMemoryStore()}, nil)
+	defer func() { _ = failing.Close() }()
+	for i := 0; i < 3; i++ {
+		failing.Allow("lease-fail-ip-" + strconv.Itoa(i))
+	}
+	if n := len(failing.leases.slots); n != 0 {
+		t.Errorf("Expected the slots of failed leases dropped, got %d slots", n)
+	}
+}
+
+func TestLeaseConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_LEASE_SIZE")
+	defer os.Unsetenv("RATE_LIMIT_LEASE_TTL")
+
+	cfg, err := leaseConfigFromEnv()
+	if err != nil || cfg.Size != 0 || cfg.TTL != DefaultLeaseTTL {
+		t.Errorf("Leasing should be disabled by default, got %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_LEASE_SIZE", "10")
+	os.Setenv("RATE_LIMIT_LEASE_TTL", "250ms")
+	cfg, err = leaseConfigFromEnv()
+	if err != nil || cfg.Size != 10 || cfg.TTL != 250*time.Millisecond {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_LEASE_TTL", "0s")
+	if _, err := leaseConfigFromEnv(); err == nil {
+		t.Error("Expected error for invalid lease TTL")
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -51,20 +53,34 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	
 	// Create metrics response
 	metricsData := struct {
-		Mode             string    `json:"mode"`
-		TotalRequests    int64     `json:"total_requests"`
-		AllowedRequests  int64     `json:"allowed_requests"`
-		RejectedRequests int64     `json:"rejected_requests"`
-		RedisLatency     string    `json:"redis_latency,omitempty"`
-		RedisFailures    int64     `json:"redis_failures,omitempty"`
-		FallbackCount    int64     `json:"fallback_count,omitempty"`
-		LastUpdated      string    `json:"last_updated"`
-		CircuitState     string    `json:"circuit_state,omitempty"`
+		Mode             string            `json:"mode"`
+		TotalRequests    int64             `json:"total_requests"`
+		AllowedRequests  int64             `json:"allowed_requests"`
+		RejectedRequests int64             `json:"rejected_requests"`
+		RedisLatency     string            `json:"redis_latency,omitempty"`
+		RedisFailures    int64             `json:"redis_failures,omitempty"`
+		RedisTimeouts    int64             `json:"redis_timeouts,omitempty"`
+		FailuresByClass  map[string]int64  `json:"redis_failures_by_class,omitempty"`
+		RefundedRequests int64             `json:"refunded_requests,omitempty"`
+		FallbackCount    int64             `json:"fallback_count,omitempty"`
+		LeaseHits        int64             `json:"lease_hits,omitempty"`
+		LocalDecisions   int64             `json:"local_decisions,omitempty"`
+		ReplicationLag   map[string]string `json:"replication_lag,omitempty"`
+		ClusterSize      int64             `json:"cluster_size,omitempty"`
+		LastUpdated      string            `json:"last_updated"`
+		CircuitState     string            `json:"circuit_state,omitempty"`
+		TarpitActive     int               `json:"tarpit_active"`
+		TarpitTotal      int64             `json:"tarpit_total"`
 	}{
 		Mode: "in-memory",
 		LastUpdated: time.Now().Format(time.RFC3339),
 	}
 	
+	if tarpit != nil {
+		metricsData.TarpitActive = tarpit.Active()
+		metricsData.TarpitTotal = tarpit.Total()
+	}
+	
 	// If using distributed limiter, get its metrics
 	if useDistributed && distributedLimiter != nil {
 		metrics := distributedLimiter.GetMetrics()
@@ -74,20 +90,57 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 		metricsData.RejectedRequests = metrics.RejectedRequests
 		metricsData.RedisLatency = metrics.RedisLatency.String()
 		metricsData.RedisFailures = metrics.RedisFailures
+		metricsData.RedisTimeouts = metrics.RedisTimeouts
+		if len(metrics.FailuresByClass) > 0 {
+			metricsData.FailuresByClass = make(map[string]int64, len(metrics.FailuresByClass))
+			for class, n := range metrics.FailuresByClass {
+				metricsData.FailuresByClass[string(class)] = n
+			}
+		}
+		metricsData.RefundedRequests = metrics.RefundedRequests
 		metricsData.FallbackCount = metrics.FallbackCount
+		metricsData.LeaseHits = metrics.LeaseHits
+		metricsData.LocalDecisions = metrics.LocalDecisions
+		if len(metrics.ReplicationLag) > 0 {
+			metricsData.ReplicationLag = make(map[string]string, len(metrics.ReplicationLag))
+			for region, lag := range metrics.ReplicationLag {
+				metricsData.ReplicationLag[region] = lag.String()
+			}
+		}
+		metricsData.ClusterSize = metrics.ClusterSize
 		metricsData.LastUpdated = metrics.LastUpdated.Format(time.RFC3339)
 		
 		// Add circuit breaker state
-		if distributedLimiter.circuitBreaker.IsOpen() {
-			metricsData.CircuitState = "open"
-		} else {
-			metricsData.CircuitState = "closed"
-		}
+		metricsData.CircuitState = distributedLimiter.circuitBreaker.State().String()
 	}
 	
 	_ = json.NewEncoder(w).Encode(metricsData)
 }
 
+// clusterMetricsHandler aggregates the metrics of every registered instance
+func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	
+	if !useDistributed || distributedLimiter == nil {
+		http.Error(w, "Cluster metrics need the distributed rate limiter", http.StatusServiceUnavailable)
+		return
+	}
+	
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	cluster, err := distributedLimiter.ClusterMetrics(ctx)
+	if err != nil {
+		http.Error(w, "Cluster metrics unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cluster)
+}
+
 // GetEventEmitter returns the global event emitter
 func GetEventEmitter() *EventEmitter {
 	return globalEventEmitter
@@ -113,7 +166,7 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	defer emitter.broadcaster.Unsubscribe(client)
 
 	// Send initial events from feed
-	recentEvents := emitter.feed.GetRecentEvents(50)
+	recentEvents := emitter.RecentEvents(50)
 	for _, event := range recentEvents {
 		data, err := json.Marshal(event)
 		if err != nil {
@@ -215,6 +268,26 @@ func activityFeedHandler(w http.ResponseWriter, r *http.Request) {
             border-left-color: #e67e22;
             background: #fff8f0;
         }
+        .event.quota_exhausted {
+            border-left-color: #8e44ad;
+            background: #f8f0ff;
+        }
+        .event.penalty_ban_issued {
+            border-left-color: #c0392b;
+            background: #fdecea;
+        }
+        .event.redis_failover {
+            border-left-color: #2980b9;
+            background: #eef6fc;
+        }
+        .event.peer_membership {
+            border-left-color: #16a085;
+            background: #edf9f6;
+        }
+        .event.reconciled {
+            border-left-color: #27ae60;
+            background: #eefaf2;
+        }
         .event-header {
             display: flex;
             justify-content: space-between;
@@ -321,6 +394,27 @@ func activityFeedHandler(w http.ResponseWriter, r *http.Request) {
                 }
             } else if (event.type === 'redis_failure') {
                 detailsHtml = 'Operation: ' + event.details.operation + ', Error: ' + event.details.error;
+            } else if (event.type === 'quota_exhausted') {
+                detailsHtml = 'IP: ' + event.ip + ', Quota: ' + event.details.limit + ' per ' + event.details.period + ', Resets: ' + event.details.reset_date;
+            } else if (event.type === 'penalty_ban_issued') {
+                detailsHtml = 'IP: ' + event.ip + ', Level: ' + event.details.level + ', Banned for ' + event.details.duration;
+            } else if (event.type === 'penalty_ban_expired') {
+                detailsHtml = 'IP: ' + event.ip + ', Level: ' + event.details.level;
+            } else if (event.type === 'redis_failover') {
+                detailsHtml = 'Master: ' + event.details.master + ', Phase: ' + event.details.phase + ', From: ' + event.details.from;
+                if (event.details.to) {
+                    detailsHtml += ', To: ' + event.details.to;
+                }
+            } else if (event.type === 'peer_membership') {
+                detailsHtml = 'Peers: ' + event.details.members.length;
+                if (event.details.joined) {
+                    detailsHtml += ', Joined: ' + event.details.joined.join(', ');
+                }
+                if (event.details.left) {
+                    detailsHtml += ', Left: ' + event.details.left.join(', ');
+                }
+            } else if (event.type === 'reconciled') {
+                detailsHtml = 'Synced ' + event.details.units + ' units across ' + event.details.keys + ' keys';
             }
             
             eventEl.innerHTML = ` + "`" + `
@@ -383,6 +477,11 @@ func activityFeedHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// One-off key migration instead of serving
+	if isMigrateKeysCommand(os.Args) {
+		os.Exit(runMigrateKeys(os.Args[2:]))
+	}
+
 	mux := http.NewServeMux()
 
 	// API endpoints
@@ -390,6 +489,7 @@ func main() {
 	mux.HandleFunc("/api/users", usersHandler)
 	mux.HandleFunc("/api/products", productsHandler)
 	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/metrics/cluster", clusterMetricsHandler)
 	
 	// Activity feed endpoints
 	mux.HandleFunc("/api/events/stream", sseHandler)
@@ -398,6 +498,15 @@ func main() {
 	// Apply rate limiting middleware to all requests
 	rateLimitedMux := RateLimitMiddleware(mux)
 
+	// Peer traffic carries other instances' decisions and is not limited
+	var handler http.Handler = rateLimitedMux
+	if peerStore != nil {
+		root := http.NewServeMux()
+		root.Handle(PeerPathPrefix, peerStore)
+		root.Handle("/", rateLimitedMux)
+		handler = root
+	}
+
 	log.Println("Starting server on :8080 with rate limiting (100 req/min per IP)")
-	log.Fatal(http.ListenAndServe(":8080", rateLimitedMux))
+	log.Fatal(http.ListenAndServe(":8080", handler))
 }
\ No newline at end of file
@@ -343,6 +343,47 @@ func TestMetricsHandler(t *testing.T) {
 	}
 }
 
+// TestClusterMetricsHandler tests the cluster-wide metrics endpoint
+func TestClusterMetricsHandler(t *testing.T) {
+	originalUseDistributed := useDistributed
+	originalDistributedLimiter := distributedLimiter
+	defer func() {
+		useDistributed = originalUseDistributed
+		distributedLimiter = originalDistributedLimiter
+	}()
+
+	useDistributed = false
+	distributedLimiter = nil
+	rr := httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics/cluster", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 in memory mode, got %d", rr.Code)
+	}
+
+	useDistributed = true
+	distributedLimiter = newRegisteredLimiter(t, startFakeRedis(t).URL())
+	waitForLive(t, distributedLimiter, 1)
+
+	rr = httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest(http.MethodPost, "/metrics/cluster", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics/cluster", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var cluster ClusterMetrics
+	if err := json.NewDecoder(rr.Body).Decode(&cluster); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if cluster.Live != 1 || len(cluster.Instances) != 1 || cluster.Instances[0].ID != distributedLimiter.instanceID {
+		t.Errorf("Expected this instance in the cluster, got %+v", cluster)
+	}
+}
+
 // TestSSEHandler tests the Server-Sent Events handler
 func TestSSEHandler(t *testing.T) {
 	// Save and restore global event emitter
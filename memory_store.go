@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a key held by MemoryStore: a sorted set, a counter or both
+type memoryEntry struct {
+	zset      map[string]int64 // member -> score in unix ms
+	counter   int64
+	expiresAt time.Time // zero means no expiry
+}
+
+// MemoryStore is an in-process Store. It gives the same decisions as
+// RedisStore but only within one process, which suits single-instance
+// deployments and tests.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+}
+
+// NewMemoryStore creates an empty in-process store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]*memoryEntry),
+	}
+}
+
+// lookup returns a live entry or nil. Must be called with s.mu held.
+func (s *MemoryStore) lookup(key string, now time.Time) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+// entry returns a live entry, creating it if needed. Must be called with
+// s.mu held.
+func (s *MemoryStore) entry(key string, now time.Time) *memoryEntry {
+	if e := s.lookup(key, now); e != nil {
+		return e
+	}
+	s.sweep(now)
+	e := &memoryEntry{zset: make(map[string]int64)}
+	s.entries[key] = e
+	return e
+}
+
+// sweep drops expired entries at most once per second. Must be called with
+// s.mu held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Second {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// purgeReservations releases units of expired reservations. Must be called
+// with s.mu held.
+func (s *MemoryStore) purgeReservations(keys WindowKeys, now time.Time) {
+	pending := s.lookup(keys.Reservations, now)
+	if pending == nil {
+		return
+	}
+	window := s.lookup(keys.Window, now)
+
+	for member, expiresAt := range pending.zset {
+		if expiresAt > now.UnixMilli() {
+			continue
+		}
+		delete(pending.zset, member)
+		if window == nil {
+			continue
+		}
+		id, units := splitReservationMember(member)
+		for i := 1; i <= units; i++ {
+			delete(window.zset, id+":"+strconv.Itoa(i))
+		}
+	}
+}
+
+// trimWindow drops sliding window entries at or before windowStart
+func trimWindow(e *memoryEntry, windowStart int64) {
+	for member, score := range e.zset {
+		if score <= windowStart {
+			delete(e.zset, member)
+		}
+	}
+}
+
+// splitReservationMember parses a "<id>:<units>" pending reservation member
+func splitReservationMember(member string) (string, int) {
+	idx := strings.LastIndex(member, ":")
+	if idx < 0 {
+		return member, 0
+	}
+	units, _ := strconv.Atoi(member[idx+1:])
+	return member[:idx], units
+}
+
+// AllowRequest records member in the sliding window if it is under limit
+func (s *MemoryStore) AllowRequest(ctx context.Context, keys WindowKeys, member string, now time.Time, window time.Duration, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purgeReservations(keys, now)
+	e := s.entry(keys.Window, now)
+	trimWindow(e, now.UnixMilli()-window.Milliseconds())
+
+	if len(e.zset) >= limit {
+		return false, nil
+	}
+	e.zset[member] = now.UnixMilli()
+	e.expiresAt = now.Add(120 * time.Second)
+	return true, nil
+}
+
+// RemoveRequest removes members from the sliding window
+func (s *MemoryStore) RemoveRequest(ctx context.Context, key string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.lookup(key, time.Now()); e != nil {
+		for _, member := range members {
+			delete(e.zset, member)
+		}
+	}
+	return nil
+}
+
+// Replay adds entries that are still inside the window and not yet present
+func (s *MemoryStore) Replay(ctx context.Context, keys WindowKeys, entries []WindowEntry, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windowStart := now.UnixMilli() - window.Milliseconds()
+	e := s.entry(keys.Window, now)
+	trimWindow(e, windowStart)
+
+	added := 0
+	for _, entry := range entries {
+		at := entry.At.UnixMilli()
+		if at <= windowStart {
+			continue
+		}
+		if _, ok := e.zset[entry.Member]; !ok {
+			added++
+		}
+		e.zset[entry.Member] = at
+	}
+	e.expiresAt = now.Add(120 * time.Second)
+	return added, nil
+}
+
+// SyncWindows replays and counts every window in turn
+func (s *MemoryStore) SyncWindows(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]int64, error) {
+	counts := make([]int64, len(syncs))
+	for i, sync := range syncs {
+		if _, err := s.Replay(ctx, sync.Keys, sync.Entries, now, window); err != nil {
+			return nil, err
+		}
+		count, err := s.Count(ctx, sync.Keys.Window)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = count
+	}
+	return counts, nil
+}
+
+// Lease records as many of units entries as fit under limit
+func (s *MemoryStore) Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purgeReservations(keys, now)
+	e := s.entry(keys.Window, now)
+	trimWindow(e, now.UnixMilli()-window.Milliseconds())
+
+	granted := limit - len(e.zset)
+	if units < granted {
+		granted = units
+	}
+	if granted <= 0 {
+		return 0, nil
+	}
+	for i := 1; i <= granted; i++ {
+		e.zset[id+":"+strconv.Itoa(i)] = now.UnixMilli()
+	}
+	e.expiresAt = now.Add(120 * time.Second)
+	return granted, nil
+}
+
+// Reserve claims units of the sliding window until expiresAt
+func (s *MemoryStore) Reserve(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purgeReservations(keys, now)
+	e := s.entry(keys.Window, now)
+	trimWindow(e, now.UnixMilli()-window.Milliseconds())
+
+	if len(e.zset)+units > limit {
+		return false, nil
+	}
+	for i := 1; i <= units; i++ {
+		e.zset[id+":"+strconv.Itoa(i)] = now.UnixMilli()
+	}
+	e.expiresAt = now.Add(120 * time.Second)
+
+	pending := s.entry(keys.Reservations, now)
+	pending.zset[id+":"+strconv.Itoa(units)] = expiresAt.UnixMilli()
+	pending.expiresAt = expiresAt.Add(time.Second)
+	return true, nil
+}
+
+// SettleReservation commits or cancels a reservation
+func (s *MemoryStore) SettleReservation(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, commit bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.lookup(keys.Reservations, now)
+	if pending == nil {
+		return false, nil
+	}
+	member := id + ":" + strconv.Itoa(units)
+	expiresAt, ok := pending.zset[member]
+	if !ok {
+		return false, nil
+	}
+	delete(pending.zset, member)
+
+	expired := expiresAt <= now.UnixMilli()
+	if commit && !expired {
+		return true, nil
+	}
+
+	if window := s.lookup(keys.Window, now); window != nil {
+		for i := 1; i <= units; i++ {
+			delete(window.zset, id+":"+strconv.Itoa(i))
+		}
+	}
+	return !expired, nil
+}
+
+// IncrementQuotas charges every counter if all have room
+func (s *MemoryStore) IncrementQuotas(ctx context.Context, counters []QuotaCounter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i, c := range counters {
+		if e := s.lookup(c.Key, now); e != nil && e.counter >= c.Limit {
+			return i + 1, nil
+		}
+	}
+	for _, c := range counters {
+		e := s.entry(c.Key, now)
+		e.counter++
+		if e.counter == 1 {
+			e.expiresAt = c.ResetAt
+		}
+	}
+	return 0, nil
+}
+
+// RefundQuotas gives one unit back to every counter that still exists
+func (s *MemoryStore) RefundQuotas(ctx context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if e := s.lookup(key, now); e != nil && e.counter > 0 {
+			e.counter--
+		}
+	}
+	return nil
+}
+
+// RecordStrike counts a rejection and bans once the threshold is reached
+func (s *MemoryStore) RecordStrike(ctx context.Context, keys PenaltyKeys, cfg PenaltyConfig) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.lookup(keys.Ban, now) != nil {
+		return 0, 0, nil
+	}
+
+	strikes := s.entry(keys.Strikes, now)
+	strikes.counter++
+	if strikes.counter == 1 {
+		strikes.expiresAt = now.Add(cfg.StrikeWindow)
+	}
+	if strikes.counter < int64(cfg.Threshold) {
+		return 0, 0, nil
+	}
+	delete(s.entries, keys.Strikes)
+
+	offenses := s.entry(keys.Offenses, now)
+	offenses.counter++
+	offenses.expiresAt = now.Add(cfg.OffenseTTL)
+
+	level := int(offenses.counter)
+	idx := level
+	if idx > len(cfg.Durations) {
+		idx = len(cfg.Durations)
+	}
+	duration := cfg.Durations[idx-1]
+
+	ban := s.entry(keys.Ban, now)
+	ban.counter = int64(level)
+	ban.expiresAt = now.Add(duration)
+	return level, duration, nil
+}
+
+// BanTTL returns how long a ban has left
+func (s *MemoryStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.TTL(ctx, key)
+}
+
+// Count returns the number of entries in a sliding window
+func (s *MemoryStore) Count(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.lookup(key, time.Now()); e != nil {
+		return int64(len(e.zset)), nil
+	}
+	return 0, nil
+}
+
+// TTL returns the time left before key expires
+func (s *MemoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e := s.lookup(key, now)
+	if e == nil || e.expiresAt.IsZero() {
+		return 0, nil
+	}
+	return e.expiresAt.Sub(now), nil
+}
+
+// Delete removes keys
+func (s *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// Heartbeat marks instance id alive until now+ttl and counts live instances
+func (s *MemoryStore) Heartbeat(ctx context.Context, key, id string, now time.Time, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entry(key, now)
+	e.zset[id] = now.Add(ttl).UnixMilli()
+	trimWindow(e, now.UnixMilli())
+	e.expiresAt = now.Add(ttl)
+	return len(e.zset), nil
+}
+
+// Deregister removes an instance heartbeat
+func (s *MemoryStore) Deregister(ctx context.Context, key, id string) error {
+	return s.RemoveRequest(ctx, key, id)
+}
+
+// Ping always succeeds for the in-process store
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op for the in-process store
+func (s *MemoryStore) Close() error {
+	return nil
+}
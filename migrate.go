@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// migrateLua moves KEYS[1] to KEYS[2]. Sorted sets are merged into what is
+// already there, strings are only copied when KEYS[2] is unset, and the new
+// key keeps the later of both expiries. Returns 1 when KEYS[1] existed.
+const migrateLua = `
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl == -2 then
+		return 0
+	end
+
+	if redis.call('TYPE', KEYS[1])['ok'] == 'zset' then
+		local entries = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+		for i = 1, #entries, 2 do
+			redis.call('ZADD', KEYS[2], entries[i + 1], entries[i])
+		end
+	elseif redis.call('EXISTS', KEYS[2]) == 0 then
+		redis.call('SET', KEYS[2], redis.call('GET', KEYS[1]))
+	end
+
+	if ttl > 0 and redis.call('PTTL', KEYS[2]) < ttl then
+		redis.call('PEXPIRE', KEYS[2], ttl)
+	end
+	redis.call('DEL', KEYS[1])
+	return 1
+`
+
+// startMigrationTimeout bounds converting version 1 keys when connecting
+const startMigrationTimeout = time.Minute
+
+// MigrateMode says what happens to keys left in an old format
+type MigrateMode string
+
+const (
+	// MigrateConvert moves version 1 keys into the current keyspace
+	MigrateConvert MigrateMode = "convert"
+	// MigrateExpire lets old keys run out after a grace period
+	MigrateExpire MigrateMode = "expire"
+)
+
+// MigrateStats counts what a migration did
+type MigrateStats struct {
+	Scanned   int
+	Converted int
+	Expired   int
+	Failed    int
+}
+
+// keyMigrator moves old-format keys into a keyspace
+type keyMigrator struct {
+	client redis.UniversalClient
+	keys   Keyspace
+	mode   MigrateMode
+	grace  time.Duration
+	dryRun bool
+	script *redis.Script
+	stats  MigrateStats
+}
+
+// migrateKeys converts or expires the unprefixed version 1 keys and expires
+// keys that older versions of ks left behind under any policy. Keys that fail are counted
+// and skipped so a rerun can pick them up.
+func migrateKeys(ctx context.Context, client redis.UniversalClient, ks Keyspace, mode MigrateMode, grace time.Duration, dryRun bool) (MigrateStats, error) {
+	m := &keyMigrator{
+		client: client,
+		keys:   ks,
+		mode:   mode,
+		grace:  grace,
+		dryRun: dryRun,
+		script: redis.NewScript(migrateLua),
+	}
+	if err := m.migrateLegacyKeys(ctx); err != nil {
+		return m.stats, err
+	}
+
+	service := ks.servicePrefix()
+	current := fmt.Sprintf("v%d", KeyVersion)
+	err := scanKeys(ctx, client, service+"*:v*", func(key string) {
+		_, rest, _ := strings.Cut(strings.TrimPrefix(key, service), ":")
+		if version, _, _ := strings.Cut(rest, ":"); version != current {
+			m.stats.Scanned++
+			m.expire(ctx, key)
+		}
+	})
+	return m.stats, err
+}
+
+// convertLegacyKeys moves the unprefixed version 1 keys into ks. Instances
+// run it when they connect, so counters and bans survive an upgrade from a
+// release without a keyspace. Keys of other versions are left to
+// migrate-keys, since instances of the old version may still use them.
+func convertLegacyKeys(ctx context.Context, client redis.UniversalClient, ks Keyspace) (MigrateStats, error) {
+	m := &keyMigrator{
+		client: client,
+		keys:   ks,
+		mode:   MigrateConvert,
+		script: redis.NewScript(migrateLua),
+	}
+	err := m.migrateLegacyKeys(ctx)
+	return m.stats, err
+}
+
+// migrateOnStart converts version 1 keys in the background and reports
+// keys that could not be converted
+func (drl *DistributedRateLimiter) migrateOnStart(client redis.UniversalClient) {
+	ctx, cancel := context.WithTimeout(drl.ctx, startMigrationTimeout)
+	defer cancel()
+
+	stats, err := convertLegacyKeys(ctx, client, drl.config.Keys)
+	if err == nil && stats.Failed > 0 {
+		err = fmt.Errorf("%d of %d version 1 keys not converted", stats.Failed, stats.Scanned)
+	}
+	if err != nil && drl.eventEmitter != nil {
+		drl.eventEmitter.EmitRedisFailure("key_migration", err)
+	}
+}
+
+// migrateLegacyKeys converts or expires every version 1 key
+func (m *keyMigrator) migrateLegacyKeys(ctx context.Context) error {
+	for _, pattern := range []string{"rate_limit:*", "rate_limit_*"} {
+		if err := scanKeys(ctx, m.client, pattern, func(key string) {
+			m.migrateLegacy(ctx, key)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacy converts or expires one version 1 key
+func (m *keyMigrator) migrateLegacy(ctx context.Context, key string) {
+	m.stats.Scanned++
+	target, ok := legacyTarget(m.keys, key)
+	if !ok || m.mode == MigrateExpire {
+		m.expire(ctx, key)
+		return
+	}
+	if m.dryRun {
+		m.stats.Converted++
+		return
+	}
+
+	if err := m.script.Run(ctx, m.client, []string{key, target}).Err(); err != nil {
+		m.stats.Failed++
+		return
+	}
+	m.stats.Converted++
+}
+
+// expire shortens the life of key to the grace period
+func (m *keyMigrator) expire(ctx context.Context, key string) {
+	if m.dryRun {
+		m.stats.Expired++
+		return
+	}
+
+	ttl, err := m.client.PTTL(ctx, key).Result()
+	if err == nil && (ttl < 0 || ttl > m.grace) {
+		if m.grace > 0 {
+			err = m.client.PExpire(ctx, key, m.grace).Err()
+		} else {
+			err = m.client.Del(ctx, key).Err()
+		}
+	}
+	if err != nil {
+		m.stats.Failed++
+		return
+	}
+	m.stats.Expired++
+}
+
+// legacyTarget maps a version 1 key to its key in ks. Instance heartbeats
+// and unknown keys have no target and are only expired.
+func legacyTarget(ks Keyspace, key string) (string, bool) {
+	name, rest, ok := strings.Cut(key, ":")
+	if !ok || rest == "" {
+		return "", false
+	}
+
+	switch name {
+	case "rate_limit":
+		return ks.windowKeys(legacyClient(rest)).Window, true
+	case "rate_limit_reservations":
+		return ks.windowKeys(legacyClient(rest)).Reservations, true
+	case "rate_limit_strikes":
+		return ks.penaltyKeys(legacyClient(rest)).Strikes, true
+	case "rate_limit_offenses":
+		return ks.penaltyKeys(legacyClient(rest)).Offenses, true
+	case "rate_limit_ban":
+		return ks.penaltyKeys(legacyClient(rest)).Ban, true
+	case "rate_limit_quota":
+		parts := strings.SplitN(rest, ":", 3)
+		if len(parts) != 3 {
+			return "", false
+		}
+		return ks.quotaKey(QuotaPeriod(parts[0]), parts[1], legacyClient(parts[2])), true
+	}
+	return "", false
+}
+
+// legacyClient strips the hash tag version 1 keys gained with Cluster support
+func legacyClient(s string) string {
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// scanKeys calls fn for every key matching pattern as the scan finds it,
+// on every primary of a Cluster. Calls are never concurrent.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string, fn func(key string)) error {
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scanNode(ctx, node, pattern, func(key string) {
+				mu.Lock()
+				defer mu.Unlock()
+				fn(key)
+			})
+		})
+	}
+	return scanNode(ctx, client, pattern, fn)
+}
+
+// scanNode calls fn for every key of one node matching pattern
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, fn func(key string)) error {
+	iter := client.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		fn(iter.Val())
+	}
+	return iter.Err()
+}
+
+// migrateOnStartFromEnv reads RATE_LIMIT_MIGRATE_ON_START. Converting
+// version 1 keys when connecting is opt-in: during a rolling deploy the
+// instances still on version 1 keep using those keys, so by default they
+// are left to the migrate-keys command.
+func migrateOnStartFromEnv() (bool, error) {
+	v := os.Getenv("RATE_LIMIT_MIGRATE_ON_START")
+	if v == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid RATE_LIMIT_MIGRATE_ON_START %q", v)
+	}
+	return enabled, nil
+}
+
+// isMigrateKeysCommand reports whether args run the migrate-keys command
+func isMigrateKeysCommand(args []string) bool {
+	return len(args) > 1 && args[1] == "migrate-keys"
+}
+
+// runMigrateKeys implements the migrate-keys command against the Redis and
+// keyspace configured in the environment
+func runMigrateKeys(args []string) int {
+	flags := flag.NewFlagSet("migrate-keys", flag.ContinueOnError)
+	mode := flags.String("mode", string(MigrateConvert), "what to do with version 1 keys: convert or expire")
+	grace := flags.Duration("grace", 2*time.Minute, "how long expired keys live on, 0 deletes them")
+	dryRun := flags.Bool("dry-run", false, "only count the keys that would change")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if m := MigrateMode(*mode); m != MigrateConvert && m != MigrateExpire {
+		fmt.Fprintf(os.Stderr, "Unknown mode %q\n", *mode)
+		return 2
+	}
+
+	cfg := &Config{RedisURL: os.Getenv("REDIS_URL")}
+	redisTopologyFromEnv(cfg)
+	conn, err := redisConnConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Redis connection settings: %v\n", err)
+		return 1
+	}
+	cfg.Redis = conn
+	keys, err := keyspaceFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid keyspace: %v\n", err)
+		return 1
+	}
+
+	opts, err := universalOptions(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Redis configuration: %v\n", err)
+		return 1
+	}
+	client := redis.NewUniversalClient(opts)
+	defer func() { _ = client.Close() }()
+
+	stats, err := migrateKeys(context.Background(), client, keys, MigrateMode(*mode), *grace, *dryRun)
+	fmt.Printf("Scanned %d keys into %s: %d converted, %d expired, %d failed\n",
+		stats.Scanned, keys.prefix(), stats.Converted, stats.Expired, stats.Failed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration stopped: %v\n", err)
+		return 1
+	}
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
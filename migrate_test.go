@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TestLegacyTarget tests mapping version 1 keys into a keyspace
+func TestLegacyTarget(t *testing.T) {
+	ks := Keyspace{Service: "api"}
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"rate_limit:1.2.3.4", "rl:api:default:v2:window:{1.2.3.4}", true},
+		{"rate_limit:{1.2.3.4}", "rl:api:default:v2:window:{1.2.3.4}", true},
+		{"rate_limit_reservations:{1.2.3.4}", "rl:api:default:v2:reservations:{1.2.3.4}", true},
+		{"rate_limit_ban:{1.2.3.4}", "rl:api:default:v2:ban:{1.2.3.4}", true},
+		{"rate_limit_quota:month:2026-10:{1.2.3.4}", "rl:api:default:v2:quota:month:2026-10:{1.2.3.4}", true},
+		{"rate_limit_instances", "", false},
+		{"rate_limit_quota:day", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := legacyTarget(ks, tt.key)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("legacyTarget(%s) = %s, %v, want %s, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// TestMigrateKeys tests converting and expiring old-format keys
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	ks := Keyspace{Service: "api"}
+	window := ks.windowKeys("10.0.0.1").Window
+	ban := ks.penaltyKeys("10.0.0.1").Ban
+	stale := ks.base() + "v1:window:{10.0.0.1}"
+	search := ks.forPolicy("search").windowKeys("10.0.0.1").Window
+	staleSearch := ks.forPolicy("search").base() + "v1:window:{10.0.0.1}"
+
+	setup := func(t *testing.T) redis.UniversalClient {
+		client := redis.NewClient(&redis.Options{Addr: startFakeRedis(t).Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		now := float64(time.Now().UnixMilli())
+		client.ZAdd(ctx, "rate_limit:{10.0.0.1}", redis.Z{Score: now, Member: "a"}, redis.Z{Score: now, Member: "b"})
+		client.Expire(ctx, "rate_limit:{10.0.0.1}", time.Minute)
+		client.ZAdd(ctx, window, redis.Z{Score: now, Member: "c"})
+		client.Set(ctx, "rate_limit_ban:{10.0.0.1}", "2", time.Hour)
+		client.ZAdd(ctx, "rate_limit_instances", redis.Z{Score: now, Member: "old"})
+		client.Set(ctx, stale, "1", 0)
+		client.ZAdd(ctx, search, redis.Z{Score: now, Member: "d"})
+		client.Set(ctx, staleSearch, "1", 0)
+		return client
+	}
+
+	t.Run("convert", func(t *testing.T) {
+		client := setup(t)
+		stats, err := migrateKeys(ctx, client, ks, MigrateConvert, 0, false)
+		if err != nil {
+			t.Fatalf("Migration failed: %v", err)
+		}
+		if stats.Scanned != 5 || stats.Converted != 2 || stats.Expired != 3 || stats.Failed != 0 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+
+		if n := client.ZCard(ctx, window).Val(); n != 3 {
+			t.Errorf("Expected old entries merged into the new window, got %d", n)
+		}
+		if ttl := client.PTTL(ctx, window).Val(); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("Expected the window to keep its expiry, got %v", ttl)
+		}
+		if v := client.Get(ctx, ban).Val(); v != "2" {
+			t.Errorf("Expected ban carried over, got %q", v)
+		}
+		if n := client.Exists(ctx, "rate_limit:{10.0.0.1}", "rate_limit_instances", stale, staleSearch).Val(); n != 0 {
+			t.Errorf("Expected old keys removed, %d left", n)
+		}
+		if n := client.ZCard(ctx, search).Val(); n != 1 {
+			t.Errorf("Expected the current keys of other policies kept, got %d entries", n)
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		client := setup(t)
+		stats, err := migrateKeys(ctx, client, ks, MigrateExpire, time.Second, false)
+		if err != nil {
+			t.Fatalf("Migration failed: %v", err)
+		}
+		if stats.Converted != 0 || stats.Expired != 5 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if ttl := client.PTTL(ctx, "rate_limit_ban:{10.0.0.1}").Val(); ttl <= 0 || ttl > time.Second {
+			t.Errorf("Expected the old ban to expire within the grace period, got %v", ttl)
+		}
+		if client.Exists(ctx, ban).Val() != 0 {
+			t.Error("Expire mode should not convert keys")
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		client := setup(t)
+		stats, _ := migrateKeys(ctx, client, ks, MigrateConvert, 0, true)
+		if stats.Converted != 2 || client.Exists(ctx, "rate_limit:{10.0.0.1}").Val() != 1 {
+			t.Errorf("Dry run should change nothing, got %+v", stats)
+		}
+	})
+}
+
+// TestDistributedRateLimiter_MigrateOnStart tests that counters and bans of
+// a release without a keyspace carry over when an instance connects
+func TestDistributedRateLimiter_MigrateOnStart(t *testing.T) {
+	ctx := context.Background()
+	srv := startFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer func() { _ = client.Close() }()
+
+	now := float64(time.Now().UnixMilli())
+	for i := 0; i < 10; i++ {
+		client.ZAdd(ctx, "rate_limit:10.0.0.2", redis.Z{Score: now, Member: i})
+	}
+	client.Expire(ctx, "rate_limit:10.0.0.2", time.Minute)
+
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	cfg.MigrateOnStart = true
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	deadline := time.Now().Add(time.Second)
+	for client.Exists(ctx, "rate_limit:10.0.0.2").Val() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the old window to be converted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if drl.Allow("10.0.0.2") {
+		t.Error("Requests counted before the upgrade should still count")
+	}
+}
+
+func TestIsMigrateKeysCommand(t *testing.T) {
+	if !isMigrateKeysCommand([]string{"server", "migrate-keys", "-dry-run"}) {
+		t.Error("Expected migrate-keys to be recognized")
+	}
+	if isMigrateKeysCommand([]string{"server"}) || isMigrateKeysCommand([]string{"server", "-test.v"}) {
+		t.Error("Expected serving to initialize the limiter")
+	}
+}
+
+// TestMigrateOnStartFromEnv tests that converting keys on start is opt-in
+func TestMigrateOnStartFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_MIGRATE_ON_START", "")
+	if enabled, err := migrateOnStartFromEnv(); err != nil || enabled {
+		t.Errorf("Expected migration on start off by default, got %v, %v", enabled, err)
+	}
+
+	t.Setenv("RATE_LIMIT_MIGRATE_ON_START", "true")
+	if enabled, err := migrateOnStartFromEnv(); err != nil || !enabled {
+		t.Errorf("Expected migration on start enabled, got %v, %v", enabled, err)
+	}
+
+	t.Setenv("RATE_LIMIT_MIGRATE_ON_START", "maybe")
+	if _, err := migrateOnStartFromEnv(); err == nil {
+		t.Error("Expected error for an invalid value")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// peerRingReplicas is the number of virtual nodes per peer, which keeps
+// ownership evenly spread and limits movement when a peer joins or leaves
+const peerRingReplicas = 128
+
+// peerRing assigns keys to peers by consistent hashing
+type peerRing struct {
+	peers  []string
+	points []uint32
+	owners map[uint32]string
+}
+
+// newPeerRing builds a ring over peers
+func newPeerRing(peers []string) *peerRing {
+	r := &peerRing{
+		peers:  append([]string(nil), peers...),
+		owners: make(map[uint32]string, len(peers)*peerRingReplicas),
+	}
+	sort.Strings(r.peers)
+	for _, peer := range r.peers {
+		for i := 0; i < peerRingReplicas; i++ {
+			point := ringHash(peer + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = peer
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the peer responsible for key, or "" for an empty ring
+func (r *peerRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(routingKey(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// ringHash maps s onto the ring
+func ringHash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// routingKey returns the hash tag of key, so every key of one client is
+// owned by the same peer, or the whole key when it has no tag
+func routingKey(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPeerRing_Balance(t *testing.T) {
+	ring := newPeerRing([]string{"http://a", "http://b", "http://c"})
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owned[ring.owner(testKeys.windowKeys("10.0.0."+strconv.Itoa(i)).Window)]++
+	}
+	for peer, n := range owned {
+		if n < 600 || n > 1400 {
+			t.Errorf("Peer %s owns %d of 3000 keys, expected roughly a third", peer, n)
+		}
+	}
+	if len(owned) != 3 {
+		t.Errorf("Expected keys spread over 3 peers, got %v", owned)
+	}
+}
+
+func TestPeerRing_Rebalance(t *testing.T) {
+	before := newPeerRing([]string{"http://a", "http://b", "http://c"})
+	after := newPeerRing([]string{"http://a", "http://b", "http://c", "http://d"})
+
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := "client-" + strconv.Itoa(i)
+		from, to := before.owner(key), after.owner(key)
+		if from != to {
+			moved++
+			if to != "http://d" {
+				t.Fatalf("Key %s moved from %s to %s instead of the new peer", key, from, to)
+			}
+		}
+	}
+	if moved == 0 || moved > 800 {
+		t.Errorf("Expected about a quarter of keys to move, got %d of 2000", moved)
+	}
+}
+
+func TestPeerRing_SameOwnerForClientKeys(t *testing.T) {
+	ring := newPeerRing([]string{"http://a", "http://b", "http://c"})
+
+	for i := 0; i < 50; i++ {
+		ip := "192.168.1." + strconv.Itoa(i)
+		owner := ring.owner(testKeys.windowKeys(ip).Window)
+		for _, key := range []string{testKeys.windowKeys(ip).Reservations, testKeys.penaltyKeys(ip).Ban, testKeys.penaltyKeys(ip).Strikes} {
+			if got := ring.owner(key); got != owner {
+				t.Fatalf("Key %s owned by %s, window owned by %s", key, got, owner)
+			}
+		}
+	}
+}
+
+func TestPeerRing_Empty(t *testing.T) {
+	if owner := newPeerRing(nil).owner("key"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %q", owner)
+	}
+}
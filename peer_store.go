@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PeerPathPrefix is where instances answer each other. It must be served
+// outside the rate limiting middleware.
+const PeerPathPrefix = "/internal/peer/"
+
+const (
+	// DefaultPeerRefresh is how often membership is re-read and health checked
+	DefaultPeerRefresh = 5 * time.Second
+	// DefaultPeerTimeout bounds one forwarded operation
+	DefaultPeerTimeout = 500 * time.Millisecond
+)
+
+const (
+	// maxPeerRequestBytes bounds the body of a forwarded operation
+	maxPeerRequestBytes = 4 << 20
+	// maxPeerSyncs bounds the windows synced by one forwarded operation
+	maxPeerSyncs = 256
+	// maxPeerEntries bounds the entries, members and counters carried by
+	// one forwarded operation
+	maxPeerEntries = 16384
+)
+
+// peerTokenHeader carries the shared secret between instances
+const peerTokenHeader = "X-Peer-Token"
+
+// PeerConfig describes a cluster of instances that share rate limit state
+// without Redis
+type PeerConfig struct {
+	// Self is this instance's base URL as the other peers know it
+	Self string
+	// Peers is a static list of base URLs
+	Peers []string
+	// SeedFile lists base URLs one per line and is re-read on every refresh
+	SeedFile string
+	// RefreshInterval is how often membership is refreshed
+	RefreshInterval time.Duration
+	// Timeout bounds a forwarded operation
+	Timeout time.Duration
+	// Token must accompany every peer request. Peer traffic shares the
+	// public listener, so a store without one refuses to start.
+	Token string
+}
+
+// enabled reports whether a peer cluster is configured
+func (c PeerConfig) enabled() bool {
+	return c.Self != "" && (len(c.Peers) > 0 || c.SeedFile != "")
+}
+
+// peerRequest is one Store operation forwarded to the owner of its keys
+type peerRequest struct {
+	Op        string         `json:"op"`
+	Keys      WindowKeys     `json:"keys"`
+	Penalty   PenaltyKeys    `json:"penalty"`
+	Counters  []QuotaCounter `json:"counters,omitempty"`
+	Entries   []WindowEntry  `json:"entries,omitempty"`
+	Syncs     []WindowSync   `json:"syncs,omitempty"`
+	Config    PenaltyConfig  `json:"config"`
+	Key       string         `json:"key,omitempty"`
+	Members   []string       `json:"members,omitempty"`
+	ID        string         `json:"id,omitempty"`
+	Units     int            `json:"units,omitempty"`
+	Now       time.Time      `json:"now"`
+	Window    time.Duration  `json:"window,omitempty"`
+	Limit     int            `json:"limit,omitempty"`
+	ExpiresAt time.Time      `json:"expires_at"`
+	Commit    bool           `json:"commit,omitempty"`
+}
+
+// items returns the number of entries, members and counters req carries
+func (req *peerRequest) items() int {
+	n := len(req.Counters) + len(req.Entries) + len(req.Members)
+	for _, sync := range req.Syncs {
+		n += len(sync.Entries)
+	}
+	return n
+}
+
+// peerResponse is the result of a forwarded operation
+type peerResponse struct {
+	OK       bool          `json:"ok,omitempty"`
+	N        int64         `json:"n,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Counts   []int64       `json:"counts,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// PeerStore is a Store spread over a cluster of instances. Each key is owned
+// by one peer chosen by consistent hashing on its hash tag, and operations
+// on keys owned elsewhere are forwarded to the owner over HTTP. Forwarding
+// errors surface like Redis errors, so DistributedRateLimiter falls back to
+// local limiting while an owner is unreachable.
+type PeerStore struct {
+	config       PeerConfig
+	local        *MemoryStore
+	client       *http.Client
+	eventEmitter *EventEmitter
+
+	mu   sync.RWMutex
+	ring *peerRing
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPeerStore joins the cluster described by cfg. All configured peers are
+// assumed up until the first refresh says otherwise.
+func NewPeerStore(cfg PeerConfig, eventEmitter *EventEmitter) (*PeerStore, error) {
+	if cfg.Self == "" {
+		return nil, errors.New("peer store needs the URL of this instance")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("peer store needs a shared token")
+	}
+	cfg.Self = normalizePeer(cfg.Self)
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = DefaultPeerRefresh
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultPeerTimeout
+	}
+
+	s := &PeerStore{
+		config:       cfg,
+		local:        NewMemoryStore(),
+		client:       &http.Client{Timeout: cfg.Timeout},
+		eventEmitter: eventEmitter,
+		done:         make(chan struct{}),
+	}
+
+	candidates, err := s.candidates()
+	if err != nil {
+		return nil, err
+	}
+	s.ring = newPeerRing(candidates)
+
+	s.wg.Add(1)
+	go s.refreshLoop()
+	return s, nil
+}
+
+// candidates returns the configured peers, always including this instance
+func (s *PeerStore) candidates() ([]string, error) {
+	seen := map[string]bool{s.config.Self: true}
+	peers := []string{s.config.Self}
+	add := func(peer string) {
+		peer = normalizePeer(peer)
+		if peer != "" && !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+
+	for _, peer := range s.config.Peers {
+		add(peer)
+	}
+	if s.config.SeedFile != "" {
+		seeds, err := readPeerSeedFile(s.config.SeedFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range seeds {
+			add(peer)
+		}
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+// refreshLoop periodically refreshes membership
+func (s *PeerStore) refreshLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_ = s.refresh(context.Background())
+		}
+	}
+}
+
+// refresh rebuilds the ring from the configured peers that answer a health
+// check, so ownership rebalances as instances join or leave
+func (s *PeerStore) refresh(ctx context.Context) error {
+	candidates, err := s.candidates()
+	if err != nil {
+		return err
+	}
+
+	healthy := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i, peer := range candidates {
+		if peer == s.config.Self {
+			healthy[i] = true
+			continue
+		}
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			healthy[i] = s.checkHealth(ctx, peer) == nil
+		}(i, peer)
+	}
+	wg.Wait()
+
+	members := make([]string, 0, len(candidates))
+	for i, peer := range candidates {
+		if healthy[i] {
+			members = append(members, peer)
+		}
+	}
+
+	s.mu.Lock()
+	old := s.ring.peers
+	changed := !equalStrings(old, members)
+	if changed {
+		s.ring = newPeerRing(members)
+	}
+	s.mu.Unlock()
+
+	if changed && s.eventEmitter != nil {
+		joined, left := diffStrings(old, members)
+		s.eventEmitter.EmitPeerMembership(members, joined, left)
+	}
+	return nil
+}
+
+// checkHealth asks peer whether it is serving
+func (s *PeerStore) checkHealth(ctx context.Context, peer string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+PeerPathPrefix+"health", nil)
+	if err != nil {
+		return err
+	}
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s: health check returned %d", peer, resp.StatusCode)
+	}
+	return nil
+}
+
+// Members returns the peers currently sharing the key space
+func (s *PeerStore) Members() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.ring.peers...)
+}
+
+// owner returns the peer owning key
+func (s *PeerStore) owner(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.owner(key)
+}
+
+// call runs req on the owner of key, locally when that is this instance
+func (s *PeerStore) call(ctx context.Context, key string, req *peerRequest) (*peerResponse, error) {
+	owner := s.owner(key)
+	if owner == s.config.Self {
+		return s.serve(ctx, req)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, owner+PeerPathPrefix+"rpc", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	s.authorize(httpReq)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", owner, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s: %s returned %d", owner, req.Op, resp.StatusCode)
+	}
+
+	var result peerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("peer %s: %w", owner, err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("peer %s: %s", owner, result.Error)
+	}
+	return &result, nil
+}
+
+// serve runs a forwarded operation against the keys this instance owns
+func (s *PeerStore) serve(ctx context.Context, req *peerRequest) (*peerResponse, error) {
+	var (
+		resp peerResponse
+		err  error
+	)
+	switch req.Op {
+	case "allow":
+		resp.OK, err = s.local.AllowRequest(ctx, req.Keys, req.ID, req.Now, req.Window, req.Limit)
+	case "remove":
+		err = s.local.RemoveRequest(ctx, req.Key, req.Members...)
+	case "replay":
+		var added int
+		added, err = s.local.Replay(ctx, req.Keys, req.Entries, req.Now, req.Window)
+		resp.N = int64(added)
+	case "sync":
+		resp.Counts, err = s.local.SyncWindows(ctx, req.Syncs, req.Now, req.Window)
+	case "lease":
+		var granted int
+		granted, err = s.local.Lease(ctx, req.Keys, req.ID, req.Units, req.Now, req.Window, req.Limit)
+		resp.N = int64(granted)
+	case "reserve":
+		resp.OK, err = s.local.Reserve(ctx, req.Keys, req.ID, req.Units, req.Now, req.Window, req.Limit, req.ExpiresAt)
+	case "settle":
+		resp.OK, err = s.local.SettleReservation(ctx, req.Keys, req.ID, req.Units, req.Now, req.Commit)
+	case "quotas":
+		var index int
+		index, err = s.local.IncrementQuotas(ctx, req.Counters)
+		resp.N = int64(index)
+	case "quota_refund":
+		err = s.local.RefundQuotas(ctx, req.Members)
+	case "strike":
+		var level int
+		level, resp.Duration, err = s.local.RecordStrike(ctx, req.Penalty, req.Config)
+		resp.N = int64(level)
+	case "ban_ttl":
+		resp.Duration, err = s.local.BanTTL(ctx, req.Key)
+	case "count":
+		resp.N, err = s.local.Count(ctx, req.Key)
+	case "ttl":
+		resp.Duration, err = s.local.TTL(ctx, req.Key)
+	case "delete":
+		err = s.local.Delete(ctx, req.Key)
+	default:
+		err = fmt.Errorf("unknown peer operation %q", req.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ServeHTTP answers health checks and forwarded operations from other peers
+func (s *PeerStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(peerTokenHeader)), []byte(s.config.Token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, PeerPathPrefix) {
+	case "health":
+		w.WriteHeader(http.StatusOK)
+	case "rpc":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req peerRequest
+		body := http.MaxBytesReader(w, r.Body, maxPeerRequestBytes)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Syncs) > maxPeerSyncs || req.items() > maxPeerEntries {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		resp, err := s.serve(r.Context(), &req)
+		if err != nil {
+			resp = &peerResponse{Error: err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize attaches the shared secret to an outgoing peer request
+func (s *PeerStore) authorize(req *http.Request) {
+	req.Header.Set(peerTokenHeader, s.config.Token)
+}
+
+// AllowRequest records member in the owner's sliding window
+func (s *PeerStore) AllowRequest(ctx context.Context, keys WindowKeys, member string, now time.Time, window time.Duration, limit int) (bool, error) {
+	resp, err := s.call(ctx, keys.Window, &peerRequest{Op: "allow", Keys: keys, ID: member, Now: now, Window: window, Limit: limit})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+// RemoveRequest removes members from the owner's sliding window
+func (s *PeerStore) RemoveRequest(ctx context.Context, key string, members ...string) error {
+	_, err := s.call(ctx, key, &peerRequest{Op: "remove", Key: key, Members: members})
+	return err
+}
+
+// Replay adds entries to the owner's sliding window, in as many requests as
+// the peer request limits need
+func (s *PeerStore) Replay(ctx context.Context, keys WindowKeys, entries []WindowEntry, now time.Time, window time.Duration) (int, error) {
+	added := 0
+	for len(entries) > 0 {
+		chunk := entries
+		if len(chunk) > maxPeerEntries {
+			chunk = chunk[:maxPeerEntries]
+		}
+		entries = entries[len(chunk):]
+
+		resp, err := s.call(ctx, keys.Window, &peerRequest{Op: "replay", Keys: keys, Entries: chunk, Now: now, Window: window})
+		if err != nil {
+			return added, err
+		}
+		added += int(resp.N)
+	}
+	return added, nil
+}
+
+// SyncWindows sends the syncs of every owner to it, in as few requests as
+// the peer request limits allow
+func (s *PeerStore) SyncWindows(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]int64, error) {
+	byOwner := make(map[string][]int)
+	for i, sync := range syncs {
+		owner := s.owner(sync.Keys.Window)
+		byOwner[owner] = append(byOwner[owner], i)
+	}
+
+	counts := make([]int64, len(syncs))
+	for _, owned := range byOwner {
+		for _, idx := range peerSyncBatches(syncs, owned) {
+			batch := make([]WindowSync, len(idx))
+			for j, i := range idx {
+				batch[j] = syncs[i]
+			}
+			resp, err := s.call(ctx, batch[0].Keys.Window, &peerRequest{Op: "sync", Syncs: batch, Now: now, Window: window})
+			if err != nil {
+				return nil, err
+			}
+			if len(resp.Counts) != len(batch) {
+				return nil, fmt.Errorf("peer sync returned %d counts for %d windows", len(resp.Counts), len(batch))
+			}
+			for j, i := range idx {
+				counts[i] = resp.Counts[j]
+			}
+		}
+	}
+	return counts, nil
+}
+
+// peerSyncBatches splits the indexes of syncs owned by one peer into
+// batches within the peer request limits
+func peerSyncBatches(syncs []WindowSync, owned []int) [][]int {
+	var batches [][]int
+	var batch []int
+	entries := 0
+	for _, i := range owned {
+		n := len(syncs[i].Entries)
+		if len(batch) > 0 && (len(batch) == maxPeerSyncs || entries+n > maxPeerEntries) {
+			batches = append(batches, batch)
+			batch, entries = nil, 0
+		}
+		batch = append(batch, i)
+		entries += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Lease grants units of the owner's sliding window
+func (s *PeerStore) Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error) {
+	resp, err := s.call(ctx, keys.Window, &peerRequest{Op: "lease", Keys: keys, ID: id, Units: units, Now: now, Window: window, Limit: limit})
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.N), nil
+}
+
+// Reserve claims units of the owner's sliding window until expiresAt
+func (s *PeerStore) Reserve(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int, expiresAt time.Time) (bool, error) {
+	resp, err := s.call(ctx, keys.Window, &peerRequest{Op: "reserve", Keys: keys, ID: id, Units: units, Now: now, Window: window, Limit: limit, ExpiresAt: expiresAt})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+// SettleReservation commits or cancels a reservation on its owner
+func (s *PeerStore) SettleReservation(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, commit bool) (bool, error) {
+	resp, err := s.call(ctx, keys.Window, &peerRequest{Op: "settle", Keys: keys, ID: id, Units: units, Now: now, Commit: commit})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+// IncrementQuotas charges the counters on their owner. Counters of one
+// client share a hash tag, so the first one decides the owner.
+func (s *PeerStore) IncrementQuotas(ctx context.Context, counters []QuotaCounter) (int, error) {
+	if len(counters) == 0 {
+		return 0, nil
+	}
+	resp, err := s.call(ctx, counters[0].Key, &peerRequest{Op: "quotas", Counters: counters})
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.N), nil
+}
+
+// RefundQuotas gives units back on the owner of the counters, which share a
+// hash tag like in IncrementQuotas
+func (s *PeerStore) RefundQuotas(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.call(ctx, keys[0], &peerRequest{Op: "quota_refund", Members: keys})
+	return err
+}
+
+// RecordStrike counts a rejection on the owner of the penalty record
+func (s *PeerStore) RecordStrike(ctx context.Context, keys PenaltyKeys, cfg PenaltyConfig) (int, time.Duration, error) {
+	resp, err := s.call(ctx, keys.Strikes, &peerRequest{Op: "strike", Penalty: keys, Config: cfg})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(resp.N), resp.Duration, nil
+}
+
+// BanTTL returns how long a ban has left on its owner
+func (s *PeerStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	resp, err := s.call(ctx, key, &peerRequest{Op: "ban_ttl", Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Duration, nil
+}
+
+// Count returns the number of entries in the owner's sliding window
+func (s *PeerStore) Count(ctx context.Context, key string) (int64, error) {
+	resp, err := s.call(ctx, key, &peerRequest{Op: "count", Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return resp.N, nil
+}
+
+// TTL returns the time left before key expires on its owner
+func (s *PeerStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	resp, err := s.call(ctx, key, &peerRequest{Op: "ttl", Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Duration, nil
+}
+
+// Delete removes keys from their owners
+func (s *PeerStore) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if _, err := s.call(ctx, key, &peerRequest{Op: "delete", Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Heartbeat returns the number of peers in the ring, which already tracks
+// live instances through health checks
+func (s *PeerStore) Heartbeat(ctx context.Context, key, id string, now time.Time, ttl time.Duration) (int, error) {
+	return len(s.Members()), nil
+}
+
+// Deregister is a no-op, peers leave the ring by failing health checks
+func (s *PeerStore) Deregister(ctx context.Context, key, id string) error {
+	return nil
+}
+
+// Ping refreshes membership, dropping unreachable peers from the ring so
+// their keys move to peers that answer
+func (s *PeerStore) Ping(ctx context.Context) error {
+	return s.refresh(ctx)
+}
+
+// Close stops refreshing membership
+func (s *PeerStore) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.wg.Wait()
+	return s.local.Close()
+}
+
+// normalizePeer trims whitespace and trailing slashes from a peer URL
+func normalizePeer(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
+
+// readPeerSeedFile reads one peer URL per line, skipping blanks and # comments
+func readPeerSeedFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var peers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers, scanner.Err()
+}
+
+// equalStrings reports whether two sorted lists hold the same strings
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffStrings returns what was added to and removed from old to get current
+func diffStrings(old, current []string) (added, removed []string) {
+	before := make(map[string]bool, len(old))
+	for _, s := range old {
+		before[s] = true
+	}
+	after := make(map[string]bool, len(current))
+	for _, s := range current {
+		after[s] = true
+		if !before[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !after[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// peerConfigFromEnv reads RATE_LIMIT_PEER_SELF, RATE_LIMIT_PEERS,
+// RATE_LIMIT_PEER_FILE, RATE_LIMIT_PEER_REFRESH, RATE_LIMIT_PEER_TIMEOUT and
+// RATE_LIMIT_PEER_TOKEN
+func peerConfigFromEnv() (PeerConfig, error) {
+	cfg := PeerConfig{
+		Self:     os.Getenv("RATE_LIMIT_PEER_SELF"),
+		Peers:    splitAddrs(os.Getenv("RATE_LIMIT_PEERS")),
+		SeedFile: os.Getenv("RATE_LIMIT_PEER_FILE"),
+		Token:    os.Getenv("RATE_LIMIT_PEER_TOKEN"),
+	}
+	if v := os.Getenv("RATE_LIMIT_PEER_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return PeerConfig{}, fmt.Errorf("invalid RATE_LIMIT_PEER_REFRESH %q", v)
+		}
+		cfg.RefreshInterval = d
+	}
+	if v := os.Getenv("RATE_LIMIT_PEER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return PeerConfig{}, fmt.Errorf("invalid RATE_LIMIT_PEER_TIMEOUT %q", v)
+		}
+		cfg.Timeout = d
+	}
+	if (len(cfg.Peers) > 0 || cfg.SeedFile != "") && cfg.Self == "" {
+		return PeerConfig{}, errors.New("RATE_LIMIT_PEER_SELF is required with RATE_LIMIT_PEERS or RATE_LIMIT_PEER_FILE")
+	}
+	if cfg.enabled() && cfg.Token == "" {
+		return PeerConfig{}, errors.New("RATE_LIMIT_PEER_TOKEN is required with RATE_LIMIT_PEERS or RATE_LIMIT_PEER_FILE")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPeer is one instance of a peer cluster under test
+type testPeer struct {
+	server *httptest.Server
+	store  *PeerStore
+}
+
+// testPeerToken is the shared secret of peer clusters under test
+const testPeerToken = "test-token"
+
+// startPeers starts n instances that know each other from a static list
+func startPeers(t *testing.T, n int, cfg PeerConfig) []*testPeer {
+	t.Helper()
+	peers := make([]*testPeer, n)
+	handlers := make([]atomic.Pointer[PeerStore], n)
+	urls := make([]string, n)
+	for i := range peers {
+		h := &handlers[i]
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s := h.Load(); s != nil {
+				s.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(server.Close)
+		peers[i] = &testPeer{server: server}
+		urls[i] = server.URL
+	}
+
+	for i, p := range peers {
+		c := cfg
+		c.Self = urls[i]
+		c.Peers = urls
+		if c.Token == "" {
+			c.Token = testPeerToken
+		}
+		if c.RefreshInterval == 0 {
+			c.RefreshInterval = time.Hour
+		}
+		store, err := NewPeerStore(c, nil)
+		if err != nil {
+			t.Fatalf("Failed to start peer %d: %v", i, err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		p.store = store
+		handlers[i].Store(store)
+	}
+	return peers
+}
+
+// ipOwnedBy finds a client whose keys peer owns
+func ipOwnedBy(t *testing.T, store *PeerStore, peer string) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		ip := "10.1." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		if store.owner(testKeys.windowKeys(ip).Window) == peer {
+			return ip
+		}
+	}
+	t.Fatalf("No client owned by %s", peer)
+	return ""
+}
+
+// TestPeerStore_SharedLimit tests that a limit holds across instances
+func TestPeerStore_SharedLimit(t *testing.T) {
+	peers := startPeers(t, 3, PeerConfig{})
+
+	cfg := testConfig()
+	cfg.Limit = 5
+	limiters := make([]*DistributedRateLimiter, len(peers))
+	for i, p := range peers {
+		limiters[i] = NewDistributedRateLimiterWithStore(cfg, p.store, nil)
+	}
+
+	for _, ip := range []string{"peer-a", "peer-b", "peer-c", "peer-d"} {
+		allowed := 0
+		for i := 0; i < 12; i++ {
+			if limiters[i%len(limiters)].Allow(ip) {
+				allowed++
+			}
+		}
+		if allowed != 5 {
+			t.Errorf("Client %s: expected 5 allowed across peers, got %d", ip, allowed)
+		}
+	}
+
+	for i, drl := range limiters {
+		if n := drl.GetMetrics().FallbackCount; n != 0 {
+			t.Errorf("Limiter %d fell back %d times with all peers up", i, n)
+		}
+	}
+}
+
+// TestPeerStore_OwnerUnreachable tests local fallback and rebalancing when
+// the owner of a key goes away
+func TestPeerStore_OwnerUnreachable(t *testing.T) {
+	peers := startPeers(t, 2, PeerConfig{Timeout: 200 * time.Millisecond})
+	self, other := peers[0], peers[1]
+	ip := ipOwnedBy(t, self.store, other.server.URL)
+
+	cfg := testConfig()
+	cfg.FailureThreshold = 1
+	cfg.RecoveryInterval = time.Hour
+	emitter := createTestEmitter()
+	drl := NewDistributedRateLimiterWithStore(cfg, self.store, emitter)
+
+	other.server.Close()
+
+	if !drl.Allow(ip) {
+		t.Error("Request should be allowed by the local fallback")
+	}
+	if n := drl.GetMetrics().FallbackCount; n != 1 {
+		t.Errorf("Expected 1 fallback decision, got %d", n)
+	}
+	if !drl.circuitBreaker.IsOpen() {
+		t.Error("Circuit should open when the owner is unreachable")
+	}
+
+	// A refresh drops the dead peer, so its keys move here
+	if err := self.store.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if members := self.store.Members(); len(members) != 1 || members[0] != self.server.URL {
+		t.Errorf("Expected only this instance left, got %v", members)
+	}
+	if owner := self.store.owner(testKeys.windowKeys(ip).Window); owner != self.server.URL {
+		t.Errorf("Expected the key to move here, owned by %s", owner)
+	}
+	if _, err := self.store.Count(context.Background(), testKeys.windowKeys(ip).Window); err != nil {
+		t.Errorf("Expected the key to be served locally: %v", err)
+	}
+}
+
+// TestPeerStore_SeedFile tests membership changes picked up from a seed file
+func TestPeerStore_SeedFile(t *testing.T) {
+	peers := startPeers(t, 3, PeerConfig{})
+	urls := []string{peers[0].server.URL, peers[1].server.URL, peers[2].server.URL}
+
+	seed := filepath.Join(t.TempDir(), "peers")
+	if err := os.WriteFile(seed, []byte("# cluster\n"+urls[1]+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	emitter := createTestEmitter()
+	store, err := NewPeerStore(PeerConfig{Self: urls[0], SeedFile: seed, RefreshInterval: time.Hour, Token: testPeerToken}, emitter)
+	if err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	defer func() { _ = store.Close() }()
+
+	if members := store.Members(); len(members) != 2 {
+		t.Fatalf("Expected 2 members from the seed file, got %v", members)
+	}
+
+	if err := os.WriteFile(seed, []byte(strings.Join(urls, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if members := store.Members(); len(members) != 3 {
+		t.Fatalf("Expected 3 members after the seed file grew, got %v", members)
+	}
+
+	events := emitter.feed.GetRecentEvents(10)
+	if len(events) != 1 || events[0].Type != EventTypePeerMembership {
+		t.Fatalf("Expected one membership event, got %+v", events)
+	}
+	if joined := events[0].Details["joined"].([]string); len(joined) != 1 || joined[0] != urls[2] {
+		t.Errorf("Expected %s to join, got %v", urls[2], joined)
+	}
+}
+
+// TestPeerStore_Token tests that peers reject requests without the secret
+func TestPeerStore_Token(t *testing.T) {
+	peers := startPeers(t, 1, PeerConfig{Token: "secret"})
+
+	resp, err := http.Get(peers[0].server.URL + PeerPathPrefix + "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 without the token, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, peers[0].server.URL+PeerPathPrefix+"health", nil)
+	req.Header.Set(peerTokenHeader, "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 with the token, got %d", resp.StatusCode)
+	}
+
+	if _, err := NewPeerStore(PeerConfig{Self: peers[0].server.URL, Peers: []string{peers[0].server.URL}}, nil); err == nil {
+		t.Error("Expected a peer store without a token to refuse to start")
+	}
+}
+
+// TestPeerStore_RequestLimits tests that peers refuse oversized requests
+// and that forwarded operations stay within the limits
+func TestPeerStore_RequestLimits(t *testing.T) {
+	peers := startPeers(t, 2, PeerConfig{})
+	post := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPost, peers[1].server.URL+PeerPathPrefix+"rpc", strings.NewReader(body))
+		req.Header.Set(peerTokenHeader, testPeerToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(`{"op":"count","key":"` + strings.Repeat("k", maxPeerRequestBytes) + `"}`); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized body, got %d", code)
+	}
+	members := `"m"` + strings.Repeat(`,"m"`, maxPeerEntries)
+	if code := post(`{"op":"remove","key":"k","members":[` + members + `]}`); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for too many members, got %d", code)
+	}
+
+	now := time.Now()
+	var syncs []WindowSync
+	for i := 0; len(syncs) <= maxPeerSyncs; i++ {
+		keys := testKeys.windowKeys("10.2." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256))
+		if peers[0].store.owner(keys.Window) == peers[1].store.config.Self {
+			syncs = append(syncs, WindowSync{Keys: keys, Entries: []WindowEntry{{Member: "m", At: now}}})
+		}
+	}
+	counts, err := peers[0].store.SyncWindows(context.Background(), syncs, now, time.Minute)
+	if err != nil {
+		t.Fatalf("SyncWindows over the sync limit failed: %v", err)
+	}
+	for i, n := range counts {
+		if n != 1 {
+			t.Fatalf("Expected a count of 1 for window %d, got %d", i, n)
+		}
+	}
+
+	entries := make([]WindowEntry, maxPeerEntries+1)
+	for i := range entries {
+		entries[i] = WindowEntry{Member: strconv.Itoa(i), At: now}
+	}
+	keys := testKeys.windowKeys(ipOwnedBy(t, peers[0].store, peers[1].store.config.Self))
+	if added, err := peers[0].store.Replay(context.Background(), keys, entries, now, time.Minute); err != nil || added != len(entries) {
+		t.Errorf("Expected all %d entries replayed, got %d: %v", len(entries), added, err)
+	}
+}
+
+func TestPeerConfigFromEnv(t *testing.T) {
+	for _, name := range []string{"RATE_LIMIT_PEER_SELF", "RATE_LIMIT_PEERS", "RATE_LIMIT_PEER_FILE", "RATE_LIMIT_PEER_REFRESH", "RATE_LIMIT_PEER_TOKEN"} {
+		defer os.Unsetenv(name)
+	}
+
+	cfg, err := peerConfigFromEnv()
+	if err != nil || cfg.enabled() {
+		t.Errorf("Peers should be disabled by default, got %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_PEERS", "http://a:8080, http://b:8080")
+	if _, err := peerConfigFromEnv(); err == nil {
+		t.Error("Expected error without RATE_LIMIT_PEER_SELF")
+	}
+
+	os.Setenv("RATE_LIMIT_PEER_SELF", "http://a:8080")
+	os.Setenv("RATE_LIMIT_PEER_REFRESH", "2s")
+	if _, err := peerConfigFromEnv(); err == nil {
+		t.Error("Expected error without RATE_LIMIT_PEER_TOKEN")
+	}
+
+	os.Setenv("RATE_LIMIT_PEER_TOKEN", "secret")
+	cfg, err = peerConfigFromEnv()
+	if err != nil || !cfg.enabled() || len(cfg.Peers) != 2 || cfg.RefreshInterval != 2*time.Second {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPenaltyDurations is the ban escalation ladder for repeat offenders
+var DefaultPenaltyDurations = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+}
+
+// DefaultBanCheckInterval is how long a client found not banned in the
+// store is trusted to stay so
+const DefaultBanCheckInterval = time.Second
+
+// PenaltyConfig controls when rejected clients are banned and for how long
+type PenaltyConfig struct {
+	Threshold     int             // rejections within StrikeWindow that trigger a ban
+	StrikeWindow  time.Duration   // window in which rejections are counted
+	Durations     []time.Duration // ban length per offense level, the last one repeats
+	OffenseTTL    time.Duration   // how long an offense level is remembered
+	CheckInterval time.Duration   // how long a "not banned" answer of the store is reused
+}
+
+// penaltyState is the local mirror of a client's penalty record
+type penaltyState struct {
+	strikes      int
+	strikesReset time.Time
+	level        int
+	levelExpires time.Time
+	bannedUntil  time.Time
+	// No ban in the store as of the last check, trusted until then
+	checkedUntil time.Time
+}
+
+// PenaltyBox escalates clients that keep hitting the limit into temporary bans
+type PenaltyBox struct {
+	mu           sync.Mutex
+	config       PenaltyConfig
+	states       map[string]*penaltyState
+	drl          *DistributedRateLimiter
+	eventEmitter *EventEmitter
+}
+
+// NewPenaltyBox creates a penalty box. Bans are shared through Redis when drl
+// is set and kept locally otherwise or while its circuit is open.
+func NewPenaltyBox(cfg PenaltyConfig, drl *DistributedRateLimiter, eventEmitter *EventEmitter) *PenaltyBox {
+	if len(cfg.Durations) == 0 {
+		cfg.Durations = DefaultPenaltyDurations
+	}
+	if cfg.StrikeWindow <= 0 {
+		cfg.StrikeWindow = time.Minute
+	}
+	if cfg.OffenseTTL <= 0 {
+		cfg.OffenseTTL = 24 * time.Hour
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultBanCheckInterval
+	}
+
+	return &PenaltyBox{
+		config:       cfg,
+		states:       make(map[string]*penaltyState),
+		drl:          drl,
+		eventEmitter: eventEmitter,
+	}
+}
+
+// useRedis reports whether ban state should be read from Redis. A granted
+// call must report its outcome to the circuit breaker.
+func (pb *PenaltyBox) useRedis() bool {
+	return pb.drl != nil && pb.drl.circuitBreaker.Allow()
+}
+
+// Banned reports whether ip is banned and for how much longer. The shared
+// ban state is read within the decision deadline of ctx, at most once per
+// check interval for a client that is not banned, so a ban issued by
+// another instance applies here within that interval.
+func (pb *PenaltyBox) Banned(ctx context.Context, ip string) (time.Duration, bool) {
+	now := time.Now()
+
+	pb.mu.Lock()
+	if state, ok := pb.states[ip]; ok {
+		if now.Before(state.bannedUntil) {
+			pb.mu.Unlock()
+			return state.bannedUntil.Sub(now), true
+		}
+		if now.Before(state.checkedUntil) {
+			pb.mu.Unlock()
+			return 0, false
+		}
+	}
+	pb.mu.Unlock()
+
+	if !pb.useRedis() {
+		return 0, false
+	}
+
+	ctx, cancel := pb.drl.decisionContext(ctx)
+	defer cancel()
+
+	var ttl time.Duration
+	err := pb.drl.storeCall("penalty_check", func() (err error) {
+		ttl, err = pb.drl.store.BanTTL(ctx, pb.drl.config.Keys.penaltyKeys(ip).Ban)
+		return err
+	})
+	if err != nil {
+		return 0, false
+	}
+
+	// Mirror the answer locally so further requests skip Redis
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	state := pb.state(ip, now)
+	if ttl <= 0 {
+		state.checkedUntil = now.Add(pb.config.CheckInterval)
+		return 0, false
+	}
+	state.bannedUntil = now.Add(ttl)
+	return ttl, true
+}
+
+// RecordRejection counts a rate limit rejection and bans ip once it crossed
+// the threshold
+func (pb *PenaltyBox) RecordRejection(ctx context.Context, ip string) {
+	if pb.useRedis() {
+		err := pb.drl.storeCall("penalty_record", func() error {
+			return pb.redisRecordRejection(ctx, ip)
+		})
+		if err == nil {
+			return
+		}
+	}
+
+	pb.localRecordRejection(ip)
+}
+
+// redisRecordRejection records a rejection in the shared store
+func (pb *PenaltyBox) redisRecordRejection(ctx context.Context, ip string) error {
+	ctx, cancel := pb.drl.decisionContext(ctx)
+	defer cancel()
+
+	level, duration, err := pb.drl.store.RecordStrike(ctx, pb.drl.config.Keys.penaltyKeys(ip), pb.config)
+	if err != nil {
+		return err
+	}
+
+	if level > 0 {
+		pb.issueBan(ip, level, duration)
+	}
+	return nil
+}
+
+// localRecordRejection records a rejection in the local mirror
+func (pb *PenaltyBox) localRecordRejection(ip string) {
+	now := time.Now()
+
+	pb.mu.Lock()
+	state := pb.state(ip, now)
+	if now.Before(state.bannedUntil) {
+		pb.mu.Unlock()
+		return
+	}
+
+	if !now.Before(state.strikesReset) {
+		state.strikes = 0
+		state.strikesReset = now.Add(pb.config.StrikeWindow)
+	}
+	state.strikes++
+	if state.strikes < pb.config.Threshold {
+		pb.mu.Unlock()
+		return
+	}
+
+	state.strikes = 0
+	if !now.Before(state.levelExpires) {
+		state.level = 0
+	}
+	state.level++
+	state.levelExpires = now.Add(pb.config.OffenseTTL)
+	level := state.level
+	pb.mu.Unlock()
+
+	pb.issueBan(ip, level, pb.duration(level))
+}
+
+// issueBan mirrors a new ban locally and reports its start and expiry
+func (pb *PenaltyBox) issueBan(ip string, level int, duration time.Duration) {
+	until := time.Now().Add(duration)
+
+	pb.mu.Lock()
+	pb.state(ip, time.Now()).bannedUntil = until
+	pb.mu.Unlock()
+
+	if pb.eventEmitter == nil {
+		return
+	}
+	pb.eventEmitter.EmitPenaltyBanIssued(ip, level, duration, until)
+	time.AfterFunc(duration, func() {
+		pb.eventEmitter.EmitPenaltyBanExpired(ip, level)
+	})
+}
+
+// duration returns the ban length for an offense level
+func (pb *PenaltyBox) duration(level int) time.Duration {
+	if level > len(pb.config.Durations) {
+		level = len(pb.config.Durations)
+	}
+	return pb.config.Durations[level-1]
+}
+
+// state returns the local record for ip, creating it if needed. Must be
+// called with pb.mu held.
+func (pb *PenaltyBox) state(ip string, now time.Time) *penaltyState {
+	state, ok := pb.states[ip]
+	if !ok {
+		pb.cleanup(now)
+		state = &penaltyState{}
+		pb.states[ip] = state
+	}
+	return state
+}
+
+// cleanup drops records with nothing left to remember. Must be called with
+// pb.mu held.
+func (pb *PenaltyBox) cleanup(now time.Time) {
+	for ip, state := range pb.states {
+		if !now.Before(state.bannedUntil) && !now.Before(state.strikesReset) && !now.Before(state.levelExpires) && !now.Before(state.checkedUntil) {
+			delete(pb.states, ip)
+		}
+	}
+}
+
+// penaltyConfigFromEnv reads RATE_LIMIT_PENALTY_THRESHOLD and
+// RATE_LIMIT_PENALTY_DURATIONS. A zero threshold disables the penalty box.
+func penaltyConfigFromEnv() (PenaltyConfig, error) {
+	cfg := PenaltyConfig{}
+
+	threshold := os.Getenv("RATE_LIMIT_PENALTY_THRESHOLD")
+	if threshold == "" {
+		return cfg, nil
+	}
+	n, err := strconv.Atoi(threshold)
+	if err != nil || n < 0 {
+		return cfg, fmt.Errorf("invalid RATE_LIMIT_PENALTY_THRESHOLD %q", threshold)
+	}
+	cfg.Threshold = n
+
+	if durations := os.Getenv("RATE_LIMIT_PENALTY_DURATIONS"); durations != "" {
+		for _, part := range strings.Split(durations, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("invalid penalty duration %q", part)
+			}
+			cfg.Durations = append(cfg.Durations, d)
+		}
+	}
+
+	return cfg, nil
+}
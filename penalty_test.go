@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPenaltyBox_Escalation tests that repeat offenders get growing bans
+func TestPenaltyBox_Escalation(t *testing.T) {
+	eventEmitter := createTestEmitter()
+	pb := NewPenaltyBox(PenaltyConfig{
+		Threshold: 2,
+		Durations: []time.Duration{30 * time.Millisecond, 80 * time.Millisecond},
+	}, nil, eventEmitter)
+
+	ip := "10.9.9.9"
+
+	pb.RecordRejection(context.Background(), ip)
+	if _, banned := pb.Banned(context.Background(), ip); banned {
+		t.Fatal("Client should not be banned below the threshold")
+	}
+
+	pb.RecordRejection(context.Background(), ip)
+	retryAfter, banned := pb.Banned(context.Background(), ip)
+	if !banned {
+		t.Fatal("Client should be banned at the threshold")
+	}
+	if retryAfter > 30*time.Millisecond {
+		t.Errorf("First ban should last at most 30ms, got %v", retryAfter)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, banned := pb.Banned(context.Background(), ip); banned {
+		t.Fatal("First ban should have expired")
+	}
+
+	// Second offense escalates to the next duration
+	pb.RecordRejection(context.Background(), ip)
+	pb.RecordRejection(context.Background(), ip)
+	retryAfter, banned = pb.Banned(context.Background(), ip)
+	if !banned {
+		t.Fatal("Client should be banned again")
+	}
+	if retryAfter <= 30*time.Millisecond {
+		t.Errorf("Second ban should be longer than the first, got %v", retryAfter)
+	}
+
+	// Third offense repeats the last duration
+	time.Sleep(100 * time.Millisecond)
+	pb.RecordRejection(context.Background(), ip)
+	pb.RecordRejection(context.Background(), ip)
+	if pb.duration(3) != 80*time.Millisecond {
+		t.Errorf("Levels past the ladder should reuse the last duration, got %v", pb.duration(3))
+	}
+
+	issued, expired := 0, 0
+	for _, event := range eventEmitter.feed.GetRecentEvents(20) {
+		switch event.Type {
+		case EventTypePenaltyBanIssued:
+			issued++
+			if event.IP != ip {
+				t.Errorf("Expected IP %s, got %s", ip, event.IP)
+			}
+		case EventTypePenaltyBanExpired:
+			expired++
+		}
+	}
+	if issued != 3 {
+		t.Errorf("Expected 3 ban issued events, got %d", issued)
+	}
+	if expired < 2 {
+		t.Errorf("Expected at least 2 ban expired events, got %d", expired)
+	}
+}
+
+// TestRateLimitMiddleware_PenaltyBox tests that banned clients are turned away
+func TestRateLimitMiddleware_PenaltyBox(t *testing.T) {
+	originalUseDistributed := useDistributed
+	originalLimiter := limiter
+	originalPenaltyBox := penaltyBox
+	defer func() {
+		useDistributed = originalUseDistributed
+		limiter = originalLimiter
+		penaltyBox = originalPenaltyBox
+	}()
+
+	useDistributed = false
+	limiter = &RateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    1,
+		window:   time.Minute,
+	}
+	penaltyBox = NewPenaltyBox(PenaltyConfig{
+		Threshold: 2,
+		Durations: []time.Duration{time.Minute},
+	}, nil, nil)
+
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "10.8.8.8:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(); rr.Code != http.StatusOK {
+		t.Fatalf("First request: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	for i := 0; i < 2; i++ {
+		if rr := serve(); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("Request over limit: got status %d, want %d", rr.Code, http.StatusTooManyRequests)
+		}
+	}
+
+	rr := serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Banned request: got status %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// Banned requests don't reach the limiter
+	limiter.mu.RLock()
+	entries := len(limiter.requests["10.8.8.8"])
+	limiter.mu.RUnlock()
+	if entries != 1 {
+		t.Errorf("Expected 1 limiter entry, got %d", entries)
+	}
+}
+
+// TestPenaltyConfigFromEnv tests penalty configuration through environment variables
+func TestPenaltyConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_PENALTY_THRESHOLD")
+	defer os.Unsetenv("RATE_LIMIT_PENALTY_DURATIONS")
+
+	cfg, err := penaltyConfigFromEnv()
+	if err != nil || cfg.Threshold != 0 {
+		t.Errorf("Penalty box should be disabled by default, got %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_PENALTY_THRESHOLD", "20")
+	os.Setenv("RATE_LIMIT_PENALTY_DURATIONS", "1m, 5m,30m")
+	cfg, err = penaltyConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Threshold != 20 || len(cfg.Durations) != 3 || cfg.Durations[2] != 30*time.Minute {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	os.Setenv("RATE_LIMIT_PENALTY_DURATIONS", "1m,soon")
+	if _, err := penaltyConfigFromEnv(); err == nil {
+		t.Error("Expected error for invalid duration")
+	}
+}
+
+// TestPenaltyBox_Store tests that bans are shared through the store
+func TestPenaltyBox_Store(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		drl := NewDistributedRateLimiterWithStore(testConfig(), store, nil)
+		defer func() { _ = drl.Close() }()
+
+		ip := "10.7.7.7"
+		keys := testKeys.penaltyKeys(ip)
+		_ = store.Delete(drl.ctx, keys.Strikes, keys.Offenses, keys.Ban)
+
+		cfg := PenaltyConfig{Threshold: 2, Durations: []time.Duration{time.Second}}
+		instanceA := NewPenaltyBox(cfg, drl, nil)
+		instanceB := NewPenaltyBox(cfg, drl, nil)
+
+		instanceA.RecordRejection(context.Background(), ip)
+		instanceA.RecordRejection(context.Background(), ip)
+
+		if _, banned := instanceB.Banned(context.Background(), ip); !banned {
+			t.Error("Ban issued by one instance should apply on another")
+		}
+
+		ttl, err := store.BanTTL(drl.ctx, keys.Ban)
+		if err != nil || ttl <= 0 || ttl > time.Second {
+			t.Errorf("Expected a ban of at most 1s in the store, got %v (%v)", ttl, err)
+		}
+	})
+}
+
+// banCheckStore counts ban lookups made through a Store
+type banCheckStore struct {
+	Store
+	checks atomic.Int64
+}
+
+func (s *banCheckStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	s.checks.Add(1)
+	return s.Store.BanTTL(ctx, key)
+}
+
+// TestPenaltyBox_CheckInterval tests that a client found not banned is not
+// looked up again until the check interval passes
+func TestPenaltyBox_CheckInterval(t *testing.T) {
+	store := &banCheckStore{Store: NewMemoryStore()}
+	drl := NewDistributedRateLimiterWithStore(testConfig(), store, nil)
+	defer func() { _ = drl.Close() }()
+
+	ip := "10.7.7.8"
+	cfg := PenaltyConfig{Threshold: 1, Durations: []time.Duration{time.Minute}, CheckInterval: 50 * time.Millisecond}
+	instanceA := NewPenaltyBox(cfg, drl, nil)
+	instanceB := NewPenaltyBox(cfg, drl, nil)
+
+	for i := 0; i < 10; i++ {
+		if _, banned := instanceB.Banned(context.Background(), ip); banned {
+			t.Fatal("Client should not be banned yet")
+		}
+	}
+	if n := store.checks.Load(); n != 1 {
+		t.Errorf("Expected 1 ban lookup for 10 checks, got %d", n)
+	}
+
+	instanceA.RecordRejection(context.Background(), ip)
+	if _, banned := instanceB.Banned(context.Background(), ip); banned {
+		t.Error("The answer of the last lookup should be reused within the interval")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, banned := instanceB.Banned(context.Background(), ip); !banned {
+		t.Error("Ban issued by another instance should apply after the interval")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ResponseMode selects how rejected requests are answered
+type ResponseMode string
+
+const (
+	ResponseReject ResponseMode = "reject" // immediate 429
+	ResponseTarpit ResponseMode = "tarpit" // slow 429 to hold back abusive clients
+)
+
+// Duration is a time.Duration that reads "500ms" style strings from JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "1m30s"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Policy groups the settings applied to requests under a path prefix
+type Policy struct {
+	Name       string       `json:"name"`
+	PathPrefix string       `json:"path_prefix"`
+	Response   ResponseMode `json:"response"`
+	Tarpit     TarpitConfig `json:"tarpit"`
+
+	// Consistency of the shared limit for requests under this policy.
+	// Quotas are checked strictly whatever the level.
+	Consistency ConsistencyLevel `json:"consistency"`
+}
+
+// defaultPolicy applies to requests no configured policy matches
+var defaultPolicy = &Policy{
+	Name:       "default",
+	PathPrefix: "/",
+	Response:   ResponseReject,
+
+	Consistency: ConsistencyStrict,
+}
+
+// policies holds the configured policies, loaded from RATE_LIMIT_POLICIES
+var policies []*Policy
+
+// parsePolicies reads a JSON array of policies
+func parsePolicies(data string) ([]*Policy, error) {
+	var parsed []*Policy
+	if err := json.Unmarshal([]byte(data), &parsed); err != nil {
+		return nil, err
+	}
+
+	for _, p := range parsed {
+		if p.Name == "" {
+			return nil, fmt.Errorf("policy for %q has no name", p.PathPrefix)
+		}
+		// The name becomes part of the policy's Redis keys
+		if err := (Keyspace{Policy: p.Name}).validate(); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		if p.PathPrefix == "" {
+			p.PathPrefix = "/"
+		}
+		switch p.Response {
+		case "":
+			p.Response = ResponseReject
+		case ResponseReject, ResponseTarpit:
+		default:
+			return nil, fmt.Errorf("policy %s: unknown response mode %q", p.Name, p.Response)
+		}
+		if err := p.Tarpit.validate(); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		if p.Consistency == "" {
+			p.Consistency = ConsistencyStrict
+		}
+		if err := p.Consistency.validate(); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+	}
+
+	return parsed, nil
+}
+
+// policyForRequest returns the policy with the longest prefix matching r
+func policyForRequest(r *http.Request) *Policy {
+	best := defaultPolicy
+	bestLen := -1
+	for _, p := range policies {
+		if strings.HasPrefix(r.URL.Path, p.PathPrefix) && len(p.PathPrefix) > bestLen {
+			best = p
+			bestLen = len(p.PathPrefix)
+		}
+	}
+	return best
+}
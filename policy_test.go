@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParsePolicies tests loading policies from JSON
+func TestParsePolicies(t *testing.T) {
+	t.Run("valid policies", func(t *testing.T) {
+		parsed, err := parsePolicies(`[
+			{"name": "scrapable", "path_prefix": "/api/products", "response": "tarpit",
+			 "tarpit": {"style": "drip", "delay": "30s"}},
+			{"name": "api", "path_prefix": "/api"}
+		]`)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(parsed) != 2 {
+			t.Fatalf("Expected 2 policies, got %d", len(parsed))
+		}
+		if parsed[0].Tarpit.Style != TarpitDrip || time.Duration(parsed[0].Tarpit.Delay) != 30*time.Second {
+			t.Errorf("Unexpected tarpit config: %+v", parsed[0].Tarpit)
+		}
+		if parsed[1].Response != ResponseReject {
+			t.Errorf("Response should default to reject, got %q", parsed[1].Response)
+		}
+		if parsed[1].Consistency != ConsistencyStrict {
+			t.Errorf("Consistency should default to strict, got %q", parsed[1].Consistency)
+		}
+	})
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", `policies`},
+		{"missing name", `[{"path_prefix": "/api"}]`},
+		{"name unfit for keys", `[{"name": "a:b"}]`},
+		{"unknown response", `[{"name": "a", "response": "ignore"}]`},
+		{"unknown tarpit style", `[{"name": "a", "response": "tarpit", "tarpit": {"style": "slow"}}]`},
+		{"bad duration", `[{"name": "a", "tarpit": {"delay": "forever"}}]`},
+		{"unknown consistency", `[{"name": "a", "consistency": "eventual"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePolicies(tt.data); err == nil {
+				t.Errorf("Expected error for %s", tt.data)
+			}
+		})
+	}
+}
+
+// TestPolicyForRequest tests longest-prefix policy selection
+func TestPolicyForRequest(t *testing.T) {
+	originalPolicies := policies
+	defer func() { policies = originalPolicies }()
+
+	policies = []*Policy{
+		{Name: "api", PathPrefix: "/api"},
+		{Name: "products", PathPrefix: "/api/products"},
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/products/42", "products"},
+		{"/api/users", "api"},
+		{"/metrics", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if got := policyForRequest(req).Name; got != tt.want {
+				t.Errorf("policyForRequest(%s) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QuotaPeriod is the calendar period a quota resets on
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "day"
+	QuotaMonthly QuotaPeriod = "month"
+)
+
+// QuotaConfig describes a calendar-aligned quota such as 10,000 calls per month
+type QuotaConfig struct {
+	Period   QuotaPeriod
+	Limit    int64
+	Location *time.Location
+}
+
+// bounds returns the start of the current period and the moment it resets
+func (q QuotaConfig) bounds(now time.Time) (time.Time, time.Time) {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	if q.Period == QuotaMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// periodID names the period starting at start, e.g. "2024-03" for a month
+func (q QuotaConfig) periodID(start time.Time) string {
+	if q.Period == QuotaMonthly {
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// counterKey returns the Redis key counting usage of ip in the current period
+func (q QuotaConfig) counterKey(ks Keyspace, ip string, start time.Time) string {
+	return ks.quotaKey(q.Period, q.periodID(start), ip)
+}
+
+// quotaExhaustion describes the quota that rejected a request
+type quotaExhaustion struct {
+	Period  QuotaPeriod
+	Limit   int64
+	ResetAt time.Time
+}
+
+// quotaCharge is the quota units taken for an allowed request, so they can
+// be given back along with its window unit
+type quotaCharge struct {
+	drl  *DistributedRateLimiter
+	keys []string
+	// Charged to the local counters while the store was unavailable
+	local bool
+}
+
+// refund gives one unit back to every counter charged
+func (c *quotaCharge) refund(ctx context.Context) error {
+	if c.local {
+		c.drl.localQuotas.refund(c.keys)
+		return nil
+	}
+	if !c.drl.circuitBreaker.Allow() {
+		return ErrCircuitOpen
+	}
+
+	ctx, cancel := c.drl.decisionContext(ctx)
+	defer cancel()
+	return c.drl.storeCall("quota_refund", func() error {
+		return c.drl.store.RefundQuotas(ctx, c.keys)
+	})
+}
+
+// localQuotaCounter is a fallback counter for one quota period
+type localQuotaCounter struct {
+	count   int64
+	resetAt time.Time
+}
+
+// quotaCounters tracks quota usage locally while Redis is unavailable
+type quotaCounters struct {
+	mu       sync.Mutex
+	counters map[string]*localQuotaCounter
+}
+
+// newQuotaCounters creates an empty set of local quota counters
+func newQuotaCounters() *quotaCounters {
+	return &quotaCounters{
+		counters: make(map[string]*localQuotaCounter),
+	}
+}
+
+// consume increments every counter if all quotas have room and returns the
+// keys of the counters it charged
+func (qc *quotaCounters) consume(quotas []QuotaConfig, ip string, now time.Time) (*quotaExhaustion, []string) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	keys := make([]string, len(quotas))
+	resets := make([]time.Time, len(quotas))
+	for i, q := range quotas {
+		start, reset := q.bounds(now)
+		keys[i] = string(q.Period) + ":" + q.periodID(start) + ":" + ip
+		resets[i] = reset
+
+		if c, ok := qc.counters[keys[i]]; ok && c.count >= q.Limit {
+			return &quotaExhaustion{Period: q.Period, Limit: q.Limit, ResetAt: reset}, nil
+		}
+	}
+
+	for i, key := range keys {
+		c, ok := qc.counters[key]
+		if !ok {
+			qc.expire(now)
+			c = &localQuotaCounter{resetAt: resets[i]}
+			qc.counters[key] = c
+		}
+		c.count++
+	}
+	return nil, keys
+}
+
+// refund gives one unit back to every counter in keys that still exists
+func (qc *quotaCounters) refund(keys []string) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	for _, key := range keys {
+		if c, ok := qc.counters[key]; ok && c.count > 0 {
+			c.count--
+		}
+	}
+}
+
+// expire drops counters of past periods. Must be called with qc.mu held.
+func (qc *quotaCounters) expire(now time.Time) {
+	for key, c := range qc.counters {
+		if !now.Before(c.resetAt) {
+			delete(qc.counters, key)
+		}
+	}
+}
+
+// consumeQuotas charges one unit against every configured quota and returns
+// the charge when all had room
+func (drl *DistributedRateLimiter) consumeQuotas(ctx context.Context, keys Keyspace, ip string) (*quotaExhaustion, *quotaCharge) {
+	quotas := drl.config.Quotas
+	now := time.Now()
+
+	if !drl.circuitBreaker.Allow() {
+		return drl.localConsumeQuotas(quotas, ip, now)
+	}
+
+	counters := make([]QuotaCounter, len(quotas))
+	for i, q := range quotas {
+		start, reset := q.bounds(now)
+		counters[i] = QuotaCounter{Key: q.counterKey(keys, ip, start), Limit: q.Limit, ResetAt: reset}
+	}
+
+	var idx int
+	err := drl.storeCall("quota_check", func() (err error) {
+		idx, err = drl.store.IncrementQuotas(ctx, counters)
+		return err
+	})
+	if err != nil {
+		return drl.localConsumeQuotas(quotas, ip, now)
+	}
+
+	if idx == 0 {
+		keys := make([]string, len(counters))
+		for i, c := range counters {
+			keys[i] = c.Key
+		}
+		return nil, &quotaCharge{drl: drl, keys: keys}
+	}
+	q := quotas[idx-1]
+	return &quotaExhaustion{Period: q.Period, Limit: q.Limit, ResetAt: counters[idx-1].ResetAt}, nil
+}
+
+// localConsumeQuotas charges the local counters used while the store is
+// unavailable
+func (drl *DistributedRateLimiter) localConsumeQuotas(quotas []QuotaConfig, ip string, now time.Time) (*quotaExhaustion, *quotaCharge) {
+	exhausted, keys := drl.localQuotas.consume(quotas, ip, now)
+	if exhausted != nil {
+		return exhausted, nil
+	}
+	return nil, &quotaCharge{drl: drl, keys: keys, local: true}
+}
+
+// quotasFromEnv reads calendar quotas from RATE_LIMIT_DAILY_QUOTA,
+// RATE_LIMIT_MONTHLY_QUOTA and RATE_LIMIT_QUOTA_TIMEZONE
+func quotasFromEnv() ([]QuotaConfig, error) {
+	loc := time.UTC
+	if tz := os.Getenv("RATE_LIMIT_QUOTA_TIMEZONE"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota timezone %q: %w", tz, err)
+		}
+		loc = l
+	}
+
+	var quotas []QuotaConfig
+	for _, env := range []struct {
+		name   string
+		period QuotaPeriod
+	}{
+		{"RATE_LIMIT_DAILY_QUOTA", QuotaDaily},
+		{"RATE_LIMIT_MONTHLY_QUOTA", QuotaMonthly},
+	} {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", env.name, value)
+		}
+		quotas = append(quotas, QuotaConfig{Period: env.period, Limit: limit, Location: loc})
+	}
+
+	return quotas, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestQuotaConfig_Bounds tests calendar alignment of quota periods
+func TestQuotaConfig_Bounds(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if err != nil {
+		t.Skipf("Timezone data unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		quota     QuotaConfig
+		now       time.Time
+		wantStart time.Time
+		wantReset time.Time
+		wantKey   string
+	}{
+		{
+			name:      "daily in UTC",
+			quota:     QuotaConfig{Period: QuotaDaily, Limit: 10},
+			now:       time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC),
+			wantStart: time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC),
+			wantReset: time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC),
+			wantKey:   "rl:default:default:v2:quota:day:2026-03-14:{1.2.3.4}",
+		},
+		{
+			name:      "monthly rolls over year",
+			quota:     QuotaConfig{Period: QuotaMonthly, Limit: 10},
+			now:       time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC),
+			wantStart: time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantReset: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantKey:   "rl:default:default:v2:quota:month:2026-12:{1.2.3.4}",
+		},
+		{
+			name:      "daily in configured timezone",
+			quota:     QuotaConfig{Period: QuotaDaily, Limit: 10, Location: kyiv},
+			now:       time.Date(2026, 6, 30, 22, 30, 0, 0, time.UTC),
+			wantStart: time.Date(2026, 7, 1, 0, 0, 0, 0, kyiv),
+			wantReset: time.Date(2026, 7, 2, 0, 0, 0, 0, kyiv),
+			wantKey:   "rl:default:default:v2:quota:day:2026-07-01:{1.2.3.4}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, reset := tt.quota.bounds(tt.now)
+			if !start.Equal(tt.wantStart) {
+				t.Errorf("start = %v, want %v", start, tt.wantStart)
+			}
+			if !reset.Equal(tt.wantReset) {
+				t.Errorf("reset = %v, want %v", reset, tt.wantReset)
+			}
+			if key := tt.quota.counterKey(testKeys, "1.2.3.4", start); key != tt.wantKey {
+				t.Errorf("key = %s, want %s", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+// TestQuotaCounters tests local quota counting used during fallback
+func TestQuotaCounters(t *testing.T) {
+	quotas := []QuotaConfig{
+		{Period: QuotaDaily, Limit: 3},
+		{Period: QuotaMonthly, Limit: 5},
+	}
+	qc := newQuotaCounters()
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if exhausted, _ := qc.consume(quotas, "ip", now); exhausted != nil {
+			t.Fatalf("Request %d should fit the quota", i+1)
+		}
+	}
+
+	exhausted, _ := qc.consume(quotas, "ip", now)
+	if exhausted == nil || exhausted.Period != QuotaDaily {
+		t.Fatalf("Expected daily quota exhaustion, got %+v", exhausted)
+	}
+	if !exhausted.ResetAt.Equal(time.Date(2026, 5, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected reset time %v", exhausted.ResetAt)
+	}
+
+	// Next day the daily quota resets but the monthly one keeps counting
+	nextDay := now.AddDate(0, 0, 1)
+	for i := 0; i < 2; i++ {
+		if exhausted, _ := qc.consume(quotas, "ip", nextDay); exhausted != nil {
+			t.Fatalf("Request %d should fit the monthly quota", i+1)
+		}
+	}
+	exhausted, _ = qc.consume(quotas, "ip", nextDay)
+	if exhausted == nil || exhausted.Period != QuotaMonthly {
+		t.Fatalf("Expected monthly quota exhaustion, got %+v", exhausted)
+	}
+	if !exhausted.ResetAt.Equal(time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected reset time %v", exhausted.ResetAt)
+	}
+}
+
+// TestQuotasFromEnv tests quota configuration through environment variables
+func TestQuotasFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_DAILY_QUOTA")
+	defer os.Unsetenv("RATE_LIMIT_MONTHLY_QUOTA")
+	defer os.Unsetenv("RATE_LIMIT_QUOTA_TIMEZONE")
+
+	os.Setenv("RATE_LIMIT_MONTHLY_QUOTA", "10000")
+	os.Setenv("RATE_LIMIT_QUOTA_TIMEZONE", "UTC")
+
+	quotas, err := quotasFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(quotas) != 1 || quotas[0].Period != QuotaMonthly || quotas[0].Limit != 10000 {
+		t.Errorf("Unexpected quotas: %+v", quotas)
+	}
+
+	os.Setenv("RATE_LIMIT_DAILY_QUOTA", "lots")
+	if _, err := quotasFromEnv(); err == nil {
+		t.Error("Expected error for invalid daily quota")
+	}
+
+	os.Unsetenv("RATE_LIMIT_DAILY_QUOTA")
+	os.Setenv("RATE_LIMIT_QUOTA_TIMEZONE", "Mars/Olympus_Mons")
+	if _, err := quotasFromEnv(); err == nil {
+		t.Error("Expected error for invalid timezone")
+	}
+}
+
+// TestDistributedRateLimiter_QuotaExhausted tests the quota event in fallback mode
+func TestDistributedRateLimiter_QuotaExhausted(t *testing.T) {
+	eventEmitter := createTestEmitter()
+
+	cfg := testConfig()
+	cfg.RedisURL = "redis://invalid:6379/0"
+	cfg.Limit = 10
+	cfg.Quotas = []QuotaConfig{{Period: QuotaMonthly, Limit: 2}}
+
+	drl, err := NewDistributedRateLimiter(cfg, eventEmitter)
+	if err != nil {
+		t.Fatalf("Failed to create DistributedRateLimiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	drl.circuitBreaker.mu.Lock()
+	drl.circuitBreaker.state = StateOpen
+	drl.circuitBreaker.mu.Unlock()
+
+	req, _ := http.NewRequest("GET", "/api/users", nil)
+	req.RemoteAddr = "10.0.0.9:1234"
+
+	for i := 0; i < 2; i++ {
+		if !drl.AllowWithRequest("10.0.0.9", req) {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+	if drl.AllowWithRequest("10.0.0.9", req) {
+		t.Fatal("Request beyond monthly quota should be rejected")
+	}
+
+	events := eventEmitter.feed.GetRecentEvents(10)
+	var quotaEvent *ActivityEvent
+	for _, event := range events {
+		if event.Type == EventTypeRateLimitRejected {
+			t.Error("Quota rejection should not emit rate_limit_rejected")
+		}
+		if event.Type == EventTypeQuotaExhausted {
+			quotaEvent = event
+		}
+	}
+	if quotaEvent == nil {
+		t.Fatal("quota_exhausted event not found")
+	}
+
+	_, reset := cfg.Quotas[0].bounds(time.Now())
+	if quotaEvent.Details["reset_date"] != reset.Format("2006-01-02") {
+		t.Errorf("Expected reset_date %s, got %v", reset.Format("2006-01-02"), quotaEvent.Details["reset_date"])
+	}
+	if quotaEvent.Details["period"] != "month" {
+		t.Errorf("Expected period month, got %v", quotaEvent.Details["period"])
+	}
+
+	// The window unit of the rejected request is given back
+	metrics := drl.GetMetrics()
+	if metrics.AllowedRequests != 2 || metrics.RejectedRequests != 1 {
+		t.Errorf("Expected 2 allowed and 1 rejected, got %d and %d", metrics.AllowedRequests, metrics.RejectedRequests)
+	}
+	if n := len(drl.fallbackLimiter.requests["10.0.0.9"]); n != 2 {
+		t.Errorf("Expected 2 window entries, got %d", n)
+	}
+}
+
+// TestDistributedRateLimiter_Quota tests quota counters in the shared store
+func TestDistributedRateLimiter_Quota(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		cfg := testConfig()
+		cfg.Limit = 10
+		cfg.Quotas = []QuotaConfig{{Period: QuotaDaily, Limit: 2}}
+
+		drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+		defer func() { _ = drl.Close() }()
+
+		ip := "10.3.3.3"
+		start, reset := cfg.Quotas[0].bounds(time.Now())
+		quotaKey := cfg.Quotas[0].counterKey(testKeys, ip, start)
+		_ = store.Delete(drl.ctx, testKeys.windowKeys(ip).Window, quotaKey)
+
+		for i := 0; i < 2; i++ {
+			if !drl.Allow(ip) {
+				t.Fatalf("Request %d should be allowed", i+1)
+			}
+		}
+		if drl.Allow(ip) {
+			t.Error("Request beyond daily quota should be rejected")
+		}
+
+		ttl, err := store.TTL(drl.ctx, quotaKey)
+		if err != nil {
+			t.Fatalf("TTL failed: %v", err)
+		}
+		if diff := ttl - time.Until(reset); diff < -time.Second || diff > time.Second {
+			t.Errorf("Quota key should expire at period end %v, got TTL %v", reset, ttl)
+		}
+	})
+}
+
+// TestDistributedRateLimiter_QuotaRefund tests that a refunded request gives
+// its quota unit back along with its window unit
+func TestDistributedRateLimiter_QuotaRefund(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fallback=%v", fallback), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Limit = 10
+			cfg.Quotas = []QuotaConfig{{Period: QuotaDaily, Limit: 2}, {Period: QuotaMonthly, Limit: 2}}
+			drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+			defer func() { _ = drl.Close() }()
+			if fallback {
+				drl.circuitBreaker.mu.Lock()
+				drl.circuitBreaker.state = StateOpen
+				drl.circuitBreaker.mu.Unlock()
+			}
+
+			ip := "10.3.3.4"
+			allowed, unit := drl.allowUnit(ip)
+			if !allowed {
+				t.Fatal("First request should be allowed")
+			}
+			if err := unit.Refund(context.Background()); err != nil {
+				t.Fatalf("Refund failed: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if !drl.Allow(ip) {
+					t.Fatalf("Request %d should fit the refunded quota", i+1)
+				}
+			}
+			if drl.Allow(ip) {
+				t.Error("Request beyond the quotas should be rejected")
+			}
+
+			m := drl.GetMetrics()
+			if m.AllowedRequests != 3 || m.RejectedRequests != 1 {
+				t.Errorf("Expected 3 allowed and 1 rejected, got %d and %d", m.AllowedRequests, m.RejectedRequests)
+			}
+		})
+	}
+}
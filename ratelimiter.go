@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,10 +13,12 @@ import (
 
 // RateLimiter tracks requests per IP
 type RateLimiter struct {
-	mu       sync.RWMutex
-	requests map[string][]time.Time
-	limit    int
-	window   time.Duration
+	mu             sync.RWMutex
+	requests       map[string][]time.Time
+	limit          int
+	window         time.Duration
+	reservationTTL time.Duration
+	reservations   map[string]*Reservation
 }
 
 var (
@@ -23,9 +26,17 @@ var (
 	distributedLimiter *DistributedRateLimiter
 	useDistributed     bool
 	globalEventEmitter *EventEmitter
+	refundPolicy       *RefundPolicy
+	penaltyBox         *PenaltyBox
+	tarpit             *Tarpit
+	peerStore          *PeerStore
 )
 
 func init() {
+	// The key migration command runs without connecting a limiter
+	if isMigrateKeysCommand(os.Args) {
+		return
+	}
 	initializeRateLimiter()
 }
 
@@ -37,29 +48,159 @@ func initializeRateLimiter() {
 		broadcaster: NewSSEBroadcaster(),
 	}
 	
-	// Check if Redis URL is provided
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL != "" {
+	// Statuses whose consumed unit is given back to the client
+	refundStatuses := os.Getenv("RATE_LIMIT_REFUND_STATUSES")
+	if refundStatuses == "" {
+		refundStatuses = DefaultRefundStatuses
+	}
+	policy, err := ParseRefundStatuses(refundStatuses)
+	if err != nil {
+		fmt.Printf("Invalid RATE_LIMIT_REFUND_STATUSES: %v\n", err)
+		policy, _ = ParseRefundStatuses(DefaultRefundStatuses)
+	}
+	refundPolicy = policy
+	
+	// Check if a Redis URL, Sentinel or Cluster is provided
+	cfg := &Config{
+		RedisURL:         os.Getenv("REDIS_URL"),
+		Limit:            100,
+		Window:           time.Minute,
+		FailureThreshold: 5,
+		RecoveryInterval: 10 * time.Second,
+	}
+	redisTopologyFromEnv(cfg)
+	// Without its TLS and ACL settings the connection must not be made
+	conn, connErr := redisConnConfigFromEnv()
+	cfg.Redis = conn
+	keys, err := keyspaceFromEnv()
+	if err != nil {
+		fmt.Printf("Using the default keyspace: %v\n", err)
+	}
+	cfg.Keys = keys
+	migrate, err := migrateOnStartFromEnv()
+	if err != nil {
+		fmt.Printf("Key migration on start disabled: %v\n", err)
+	}
+	cfg.MigrateOnStart = migrate
+	useRedis := cfg.RedisURL != "" || len(cfg.SentinelAddrs) > 0 || len(cfg.ClusterAddrs) > 0
+	
+	// Without Redis, instances may share state among themselves
+	peerStore = nil
+	peerCfg, err := peerConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Peer cluster disabled: %v\n", err)
+	}
+	
+	if useRedis || peerCfg.enabled() {
 		// Try to initialize distributed rate limiter
-		cfg := &Config{
-			RedisURL:         redisURL,
-			Limit:            100,
-			Window:           time.Minute,
-			FailureThreshold: 5,
-			RecoveryInterval: 10 * time.Second,
+		quotas, err := quotasFromEnv()
+		if err != nil {
+			fmt.Printf("Ignoring calendar quotas: %v\n", err)
+		}
+		cfg.Quotas = quotas
+		
+		batch, err := batchConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Redis batching disabled: %v\n", err)
+		}
+		cfg.Batch = batch
+		
+		leases, err := leaseConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Local leasing disabled: %v\n", err)
+		}
+		cfg.Lease = leases
+		
+		breaker, err := breakerConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Using default circuit breaker settings: %v\n", err)
+		}
+		cfg.Breaker = breaker
+		
+		timeout, err := decisionTimeoutFromEnv()
+		if err != nil {
+			fmt.Printf("Using default decision timeout: %v\n", err)
+		}
+		cfg.DecisionTimeout = timeout
+		
+		policies, err := errorPoliciesFromEnv()
+		if err != nil {
+			fmt.Printf("Using default error policies: %v\n", err)
+		}
+		cfg.ErrorPolicies = policies
+		
+		consistency, err := consistencyConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Using default consistency settings: %v\n", err)
+		}
+		cfg.Consistency = consistency
+		
+		regions, err := regionConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Multi-region counting disabled: %v\n", err)
+		}
+		cfg.Regions = regions
+		
+		relay, err := eventRelayFromEnv()
+		if err != nil {
+			fmt.Printf("Event relay disabled: %v\n", err)
 		}
+		cfg.EventRelay = relay
 		
-		drl, err := NewDistributedRateLimiter(cfg, globalEventEmitter)
-		if err == nil {
-			distributedLimiter = drl
+		history, err := eventHistoryConfigFromEnv()
+		if err != nil {
+			fmt.Printf("Event history disabled: %v\n", err)
+		}
+		cfg.EventHistory = history
+		
+		if useRedis && connErr != nil {
+			fmt.Printf("Failed to initialize distributed rate limiter: invalid Redis connection settings: %v\n", connErr)
+			fmt.Println("Falling back to in-memory rate limiter")
+		} else if useRedis {
+			drl, err := NewDistributedRateLimiter(cfg, globalEventEmitter)
+			if err == nil {
+				distributedLimiter = drl
+				useDistributed = true
+				fmt.Println("Using distributed rate limiter with Redis")
+			} else {
+				fmt.Printf("Failed to initialize distributed rate limiter: %v\n", err)
+				fmt.Println("Falling back to in-memory rate limiter")
+			}
+		} else if ps, err := NewPeerStore(peerCfg, globalEventEmitter); err == nil {
+			peerStore = ps
+			distributedLimiter = NewDistributedRateLimiterWithStore(cfg, ps, globalEventEmitter)
 			useDistributed = true
-			fmt.Println("Using distributed rate limiter with Redis")
+			fmt.Printf("Using distributed rate limiter with %d peers\n", len(ps.Members()))
 		} else {
 			fmt.Printf("Failed to initialize distributed rate limiter: %v\n", err)
 			fmt.Println("Falling back to in-memory rate limiter")
 		}
 	}
 	
+	// Escalate repeat offenders into temporary bans
+	penaltyBox = nil
+	penaltyCfg, err := penaltyConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Penalty box disabled: %v\n", err)
+	} else if penaltyCfg.Threshold > 0 {
+		penaltyBox = NewPenaltyBox(penaltyCfg, distributedLimiter, globalEventEmitter)
+	}
+	
+	// Load rate limit policies
+	policies = nil
+	if data := os.Getenv("RATE_LIMIT_POLICIES"); data != "" {
+		parsed, err := parsePolicies(data)
+		if err != nil {
+			fmt.Printf("Ignoring RATE_LIMIT_POLICIES: %v\n", err)
+		} else {
+			policies = parsed
+		}
+	}
+	
+	// Shared cap on connections held by tarpit policies
+	maxTarpit, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_TARPIT_MAX_CONNECTIONS"))
+	tarpit = NewTarpit(maxTarpit)
+	
 	// Always initialize the fallback limiter
 	limiter = &RateLimiter{
 		requests: make(map[string][]time.Time),
@@ -82,11 +223,21 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := getClientIP(r)
 
+		// Banned clients are turned away without touching the limiter
+		if penaltyBox != nil {
+			if retryAfter, banned := penaltyBox.Banned(r.Context(), ip); banned {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				writeRejection(w, r, `{"error":"Too many rate limit violations. Temporarily banned."}`)
+				return
+			}
+		}
+
 		var allowed bool
+		var unit *consumedUnit
 		if useDistributed && distributedLimiter != nil {
-			allowed = distributedLimiter.AllowWithRequest(ip, r)
+			allowed, unit = distributedLimiter.allowUnitWithRequest(ip, r)
 		} else {
-			allowed = limiter.allow(ip)
+			allowed, unit = limiter.allowUnit(ip)
 			// Emit event for local rate limiter too
 			if !allowed && globalEventEmitter != nil {
 				globalEventEmitter.EmitRateLimitRejection(r)
@@ -94,18 +245,45 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 		}
 
 		if !allowed {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusTooManyRequests)
-			_, _ = w.Write([]byte(`{"error":"Rate limit exceeded. Maximum 100 requests per minute allowed."}`))
+			if penaltyBox != nil {
+				penaltyBox.RecordRejection(r.Context(), ip)
+			}
+			writeRejection(w, r, `{"error":"Rate limit exceeded. Maximum 100 requests per minute allowed."}`)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		// Capture the final status so server errors don't burn client quota
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if unit != nil && refundPolicy.Matches(rec.Status()) {
+			_ = unit.Refund(r.Context())
+		}
 	})
 }
 
+// writeRejection answers with 429, slowly if the request's policy tarpits
+func writeRejection(w http.ResponseWriter, r *http.Request, body string) {
+	policy := policyForRequest(r)
+	if policy.Response == ResponseTarpit && tarpit != nil {
+		if tarpit.Serve(w, r, policy.Tarpit, []byte(body)) {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write([]byte(body))
+}
+
 // allow checks if request from IP is allowed
 func (rl *RateLimiter) allow(ip string) bool {
+	allowed, _ := rl.allowUnit(ip)
+	return allowed
+}
+
+// allowUnit checks if request from IP is allowed and returns the unit it consumed
+func (rl *RateLimiter) allowUnit(ip string) (bool, *consumedUnit) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -116,7 +294,7 @@ func (rl *RateLimiter) allow(ip string) bool {
 	requests, exists := rl.requests[ip]
 	if !exists {
 		rl.requests[ip] = []time.Time{now}
-		return true
+		return true, &consumedUnit{key: ip, at: now, local: rl}
 	}
 
 	// Remove old requests outside window
@@ -130,13 +308,25 @@ func (rl *RateLimiter) allow(ip string) bool {
 	// Check if under limit
 	if len(validRequests) >= rl.limit {
 		rl.requests[ip] = validRequests
-		return false
+		return false, nil
 	}
 
 	// Add current request
-	validRequests = append(validRequests, now)
+	at := nextStamp(validRequests, now)
+	validRequests = append(validRequests, at)
 	rl.requests[ip] = validRequests
-	return true
+	return true, &consumedUnit{key: ip, at: at, local: rl}
+}
+
+// nextStamp returns the time to record a new request at: now, or just after
+// the latest recorded request when that is not earlier. Every request of a
+// key thus has its own timestamp, which identifies its unit when it is
+// refunded or its reservation cancelled.
+func nextStamp(requests []time.Time, now time.Time) time.Time {
+	if n := len(requests); n > 0 && !requests[n-1].Before(now) {
+		return requests[n-1].Add(time.Nanosecond)
+	}
+	return now
 }
 
 // cleanup removes old entries
@@ -146,6 +336,7 @@ func (rl *RateLimiter) cleanup() {
 
 	now := time.Now()
 	windowStart := now.Add(-rl.window)
+	rl.expireReservations(now)
 
 	for ip, requests := range rl.requests {
 		validRequests := []time.Time{}
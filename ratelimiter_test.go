@@ -347,6 +347,41 @@ func TestInit(t *testing.T) {
 		}
 	})
 
+	t.Run("falls back with invalid Redis connection settings", func(t *testing.T) {
+		os.Setenv("REDIS_URL", "redis://localhost:6379")
+		os.Setenv("REDIS_TLS", "maybe")
+		defer os.Unsetenv("REDIS_URL")
+		defer os.Unsetenv("REDIS_TLS")
+
+		// Reset global variables
+		limiter = nil
+		distributedLimiter = nil
+		useDistributed = false
+		globalEventEmitter = nil
+
+		// Capture output
+		oldStdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+
+		initializeRateLimiter()
+
+		// Restore stdout
+		w.Close()
+		os.Stdout = oldStdout
+
+		output := make([]byte, 1024)
+		n, _ := r.Read(output)
+		outputStr := string(output[:n])
+
+		if useDistributed || distributedLimiter != nil {
+			t.Error("Distributed limiter should not connect without its TLS settings")
+		}
+		if !strings.Contains(outputStr, "Falling back to in-memory rate limiter") {
+			t.Error("Should print message about falling back")
+		}
+	})
+
 	t.Run("cleanup goroutine starts", func(t *testing.T) {
 		// This test verifies that the cleanup goroutine is started
 		// We can't directly test the goroutine, but we can verify
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fallbackKey names the fallback counter of ip under policy. Requests of the
+// default policy are counted under ip itself, shared with fallback
+// reservations; other policies prefix it with their name and a newline,
+// which neither policy names nor client addresses can contain.
+func fallbackKey(policy, ip string) string {
+	if policy == "" || policy == DefaultKeyspaceName {
+		return ip
+	}
+	return policy + "\n" + ip
+}
+
+// splitFallbackKey returns the policy and ip of a fallback counter
+func splitFallbackKey(key string) (policy, ip string) {
+	if policy, ip, ok := strings.Cut(key, "\n"); ok {
+		return policy, ip
+	}
+	return DefaultKeyspaceName, key
+}
+
+// fallbackEntries returns the requests the fallback limiter recorded that
+// are still inside the window, by fallback counter, as sliding window
+// entries named after this instance and their timestamps. The names are
+// stable, so replaying the same requests twice adds them only once.
+func (drl *DistributedRateLimiter) fallbackEntries(now time.Time) map[string][]WindowEntry {
+	rl := drl.fallbackLimiter
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	windowStart := now.Add(-rl.window)
+	entries := make(map[string][]WindowEntry)
+	for key, requests := range rl.requests {
+		seen := make(map[int64]int)
+		for _, at := range requests {
+			if !at.After(windowStart) {
+				continue
+			}
+			nanos := at.UnixNano()
+			seen[nanos]++
+			entries[key] = append(entries[key], WindowEntry{
+				Member: "fallback:" + drl.instanceID + ":" + strconv.FormatInt(nanos, 10) + ":" + strconv.Itoa(seen[nanos]),
+				At:     at,
+			})
+		}
+	}
+	return entries
+}
+
+// reconcileFallback replays requests allowed in fallback mode into the shared
+// window of their policy so clients don't get fresh budget after an outage.
+// Each key is replayed within the decision deadline; keys that fail, or that
+// the circuit breaker keeps out, are left for the next recovery.
+func (drl *DistributedRateLimiter) reconcileFallback() {
+	now := time.Now()
+	keys, units := 0, 0
+	for key, entries := range drl.fallbackEntries(now) {
+		added, err := drl.replayFallback(key, entries, now)
+		if err != nil {
+			break
+		}
+		if added > 0 {
+			keys++
+			units += added
+		}
+	}
+
+	if units > 0 && drl.eventEmitter != nil {
+		drl.eventEmitter.EmitReconciled(keys, units)
+	}
+}
+
+// replayFallback replays the entries of one fallback counter and returns how
+// many were new to the shared window
+func (drl *DistributedRateLimiter) replayFallback(key string, entries []WindowEntry, now time.Time) (int, error) {
+	if !drl.circuitBreaker.Allow() {
+		return 0, ErrCircuitOpen
+	}
+
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+	policy, ip := splitFallbackKey(key)
+	var added int
+	err := drl.storeCall("reconcile", func() (err error) {
+		added, err = drl.store.Replay(ctx, drl.config.Keys.forPolicy(policy).windowKeys(ip), entries, now, drl.config.Window)
+		return err
+	})
+	return added, err
+}
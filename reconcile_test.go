@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestStore_Replay tests that replaying entries is idempotent
+func TestStore_Replay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		keys := testKeys.windowKeys("store-replay-test")
+		_ = store.Delete(ctx, keys.Window, keys.Reservations)
+
+		now := time.Now()
+		entries := []WindowEntry{
+			{Member: "fb:1", At: now.Add(-10 * time.Second)},
+			{Member: "fb:2", At: now.Add(-5 * time.Second)},
+			{Member: "fb:old", At: now.Add(-2 * time.Minute)},
+		}
+		if added, err := store.Replay(ctx, keys, entries, now, time.Minute); err != nil || added != 2 {
+			t.Fatalf("Expected 2 entries replayed, got %d: %v", added, err)
+		}
+		if added, _ := store.Replay(ctx, keys, entries, now, time.Minute); added != 0 {
+			t.Errorf("Expected a repeated replay to add nothing, got %d", added)
+		}
+		if count, _ := store.Count(ctx, keys.Window); count != 2 {
+			t.Errorf("Expected 2 entries in the window, got %d", count)
+		}
+
+		// Replayed usage counts against the limit
+		if allowed, _ := store.AllowRequest(ctx, keys, "live", now, time.Minute, 2); allowed {
+			t.Error("Request should be rejected once replayed usage fills the window")
+		}
+	})
+}
+
+// TestDistributedRateLimiter_ReconcileFallback tests that requests allowed
+// during an outage are carried over to the shared window
+func TestDistributedRateLimiter_ReconcileFallback(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.Limit = 5
+	cfg.FailureThreshold = 1
+	emitter := createTestEmitter()
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	drl.circuitBreaker.RecordFailure()
+	for i := 0; i < 3; i++ {
+		if !drl.Allow("reconcile-ip") {
+			t.Fatalf("Fallback request %d should be allowed", i+1)
+		}
+	}
+
+	drl.circuitBreaker.Reset()
+	drl.reconcileFallback()
+	drl.reconcileFallback()
+
+	if count, _ := drl.store.Count(context.Background(), testKeys.windowKeys("reconcile-ip").Window); count != 3 {
+		t.Errorf("Expected 3 reconciled entries, got %d", count)
+	}
+
+	var reconciled []*ActivityEvent
+	for _, event := range emitter.feed.GetRecentEvents(100) {
+		if event.Type == EventTypeReconciled {
+			reconciled = append(reconciled, event)
+		}
+	}
+	if len(reconciled) != 1 {
+		t.Fatalf("Expected one reconciled event, got %d", len(reconciled))
+	}
+	if keys, units := reconciled[0].Details["keys"], reconciled[0].Details["units"]; keys != 1 || units != 3 {
+		t.Errorf("Expected 1 key and 3 units reconciled, got %v and %v", keys, units)
+	}
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if drl.Allow("reconcile-ip") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected only the remaining 2 units after recovery, got %d", allowed)
+	}
+}
+
+// TestDistributedRateLimiter_ReconcilePolicy tests that fallback usage is
+// replayed into the window of the policy it was counted under
+func TestDistributedRateLimiter_ReconcilePolicy(t *testing.T) {
+	cfg := testRedisConfig(t)
+	cfg.Limit = 5
+	cfg.FailureThreshold = 1
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+	ctx := context.Background()
+	search := &Policy{Name: "search", Consistency: ConsistencyStrict}
+
+	drl.circuitBreaker.RecordFailure()
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := drl.allowWithQuotas(ctx, "reconcile-policy-ip", search); !allowed {
+			t.Fatalf("Fallback request %d should be allowed", i+1)
+		}
+	}
+	drl.allowWithQuotas(ctx, "reconcile-policy-ip", defaultPolicy)
+
+	drl.circuitBreaker.Reset()
+	drl.reconcileFallback()
+
+	if count, _ := drl.store.Count(ctx, testKeys.forPolicy("search").windowKeys("reconcile-policy-ip").Window); count != 3 {
+		t.Errorf("Expected 3 entries reconciled into the search window, got %d", count)
+	}
+	if count, _ := drl.store.Count(ctx, testKeys.windowKeys("reconcile-policy-ip").Window); count != 1 {
+		t.Errorf("Expected 1 entry reconciled into the default window, got %d", count)
+	}
+}
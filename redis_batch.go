@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultBatchSize flushes a batch early once this many checks are queued
+	DefaultBatchSize = 64
+)
+
+// ErrBatcherClosed is returned for checks submitted after the store closed
+var ErrBatcherClosed = errors.New("redis batcher closed")
+
+// BatchConfig controls pipelining of concurrent sliding window checks.
+// A zero Window disables batching.
+type BatchConfig struct {
+	Window  time.Duration
+	MaxSize int
+}
+
+// allowCall is one sliding window check waiting for its batch
+type allowCall struct {
+	ctx    context.Context
+	keys   []string
+	args   []interface{}
+	result chan allowResult
+
+	// settled is taken by whichever of the caller giving up and the batch
+	// delivering the result happens first
+	settled atomic.Bool
+}
+
+type allowResult struct {
+	allowed bool
+	err     error
+}
+
+// allowBatcher collects concurrent sliding window checks and sends them to
+// Redis as one pipeline
+type allowBatcher struct {
+	store  *RedisStore
+	config BatchConfig
+	calls  chan *allowCall
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// mu keeps close from racing with callers queueing checks
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newAllowBatcher starts a batcher for store
+func newAllowBatcher(store *RedisStore, config BatchConfig) *allowBatcher {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultBatchSize
+	}
+
+	b := &allowBatcher{
+		store:  store,
+		config: config,
+		calls:  make(chan *allowCall, config.MaxSize),
+		done:   make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// allow queues a check and waits for its result
+func (b *allowBatcher) allow(ctx context.Context, keys []string, args []interface{}) (bool, error) {
+	call := &allowCall{ctx: ctx, keys: keys, args: args, result: make(chan allowResult, 1)}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return false, ErrBatcherClosed
+	}
+	select {
+	case b.calls <- call:
+		b.mu.RUnlock()
+	case <-ctx.Done():
+		b.mu.RUnlock()
+		return false, ctx.Err()
+	}
+
+	select {
+	case r := <-call.result:
+		return r.allowed, r.err
+	case <-ctx.Done():
+		if call.settled.CompareAndSwap(false, true) {
+			// The batch refunds the unit if it was counted after all
+			return false, ctx.Err()
+		}
+		r := <-call.result
+		return r.allowed, r.err
+	}
+}
+
+// run groups queued checks into batches until the batcher is closed
+func (b *allowBatcher) run() {
+	defer b.wg.Done()
+
+	for {
+		var batch []*allowCall
+		select {
+		case call := <-b.calls:
+			batch = append(batch, call)
+		case <-b.done:
+			b.drain()
+			return
+		}
+
+		timer := time.NewTimer(b.config.Window)
+	collect:
+		for len(batch) < b.config.MaxSize {
+			select {
+			case call := <-b.calls:
+				batch = append(batch, call)
+			case <-timer.C:
+				break collect
+			case <-b.done:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		// Keep collecting the next batch while this one is in flight
+		b.wg.Add(1)
+		go func(batch []*allowCall) {
+			defer b.wg.Done()
+			b.flush(batch)
+		}(batch)
+	}
+}
+
+// flush sends a batch as one pipeline and hands each caller its result.
+// Checks whose caller gave up before the batch went out are dropped, and
+// units counted for callers that gave up while it was in flight are
+// refunded, so a caller that fell back is not also counted in Redis.
+func (b *allowBatcher) flush(batch []*allowCall) {
+	pending := batch[:0]
+	for _, call := range batch {
+		if err := call.ctx.Err(); err != nil {
+			if call.settled.CompareAndSwap(false, true) {
+				call.result <- allowResult{err: err}
+			}
+			continue
+		}
+		pending = append(pending, call)
+	}
+	batch = pending
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := flushContext(batch)
+	defer cancel()
+	cmds := b.pipeline(ctx, batch)
+
+	// First use after a restart or flush: load the script and retry
+	var retry []*allowCall
+	var retryIdx []int
+	for i, cmd := range cmds {
+		if isNoScript(cmd.Err()) {
+			retry = append(retry, batch[i])
+			retryIdx = append(retryIdx, i)
+		}
+	}
+	if len(retry) > 0 {
+		if err := b.store.allowScript.load(ctx, b.store.client); err == nil {
+			for j, cmd := range b.pipeline(ctx, retry) {
+				cmds[retryIdx[j]] = cmd
+			}
+		}
+	}
+
+	var refunds []*allowCall
+	for i, call := range batch {
+		result, err := cmds[i].Int64()
+		if call.settled.CompareAndSwap(false, true) {
+			call.result <- allowResult{allowed: result == 1, err: err}
+		} else if result == 1 {
+			refunds = append(refunds, call)
+		}
+	}
+	b.refund(refunds)
+}
+
+// flushContext returns a context ending at the latest deadline of the
+// callers in batch, so a batch never outlives everyone waiting on it
+func flushContext(batch []*allowCall) (context.Context, context.CancelFunc) {
+	var latest time.Time
+	for _, call := range batch {
+		deadline, ok := call.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), latest)
+}
+
+// refund removes the units counted for callers that stopped waiting
+func (b *allowBatcher) refund(calls []*allowCall) {
+	if len(calls) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDecisionTimeout)
+	defer cancel()
+	_, _ = b.store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, call := range calls {
+			// The member is the request id, ARGV[4] of allowLua
+			pipe.ZRem(ctx, call.keys[0], call.args[3])
+		}
+		return nil
+	})
+}
+
+// pipeline runs the sliding window script for every call in one round trip
+func (b *allowBatcher) pipeline(ctx context.Context, batch []*allowCall) []*redis.Cmd {
+	cmds := make([]*redis.Cmd, len(batch))
+	_, _ = b.store.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, call := range batch {
+			cmds[i] = b.store.allowScript.EvalSha(ctx, pipe, call.keys, call.args...)
+		}
+		return nil
+	})
+	return cmds
+}
+
+// drain flushes checks queued before the batcher closed
+func (b *allowBatcher) drain() {
+	for {
+		var batch []*allowCall
+	collect:
+		for len(batch) < b.config.MaxSize {
+			select {
+			case call := <-b.calls:
+				batch = append(batch, call)
+			default:
+				break collect
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		b.flush(batch)
+	}
+}
+
+// close stops the batcher after flushing checks already queued
+func (b *allowBatcher) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// batchConfigFromEnv reads RATE_LIMIT_REDIS_BATCH_WINDOW and
+// RATE_LIMIT_REDIS_BATCH_SIZE
+func batchConfigFromEnv() (BatchConfig, error) {
+	var cfg BatchConfig
+	if v := os.Getenv("RATE_LIMIT_REDIS_BATCH_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return BatchConfig{}, fmt.Errorf("invalid RATE_LIMIT_REDIS_BATCH_WINDOW %q", v)
+		}
+		cfg.Window = d
+	}
+	if v := os.Getenv("RATE_LIMIT_REDIS_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return BatchConfig{}, fmt.Errorf("invalid RATE_LIMIT_REDIS_BATCH_SIZE %q", v)
+		}
+		cfg.MaxSize = n
+	}
+	return cfg, nil
+}
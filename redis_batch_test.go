@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// roundTripCounter is a go-redis hook counting single commands and pipelines
+type roundTripCounter struct {
+	commands  atomic.Int64
+	pipelines atomic.Int64
+}
+
+func (c *roundTripCounter) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (c *roundTripCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.commands.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (c *roundTripCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.pipelines.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// TestRedisStore_Batching tests that concurrent checks share pipelines
+func TestRedisStore_Batching(t *testing.T) {
+	srv := startFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	counter := &roundTripCounter{}
+	client.AddHook(counter)
+
+	store := NewRedisStore(client)
+	store.EnableBatching(BatchConfig{Window: 20 * time.Millisecond, MaxSize: 64})
+	defer func() { _ = store.Close() }()
+
+	keys := testKeys.windowKeys("10.10.10.10")
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := store.AllowRequest(context.Background(), keys, fmt.Sprintf("req-%d", i), now, time.Minute, 10)
+			if err != nil {
+				t.Errorf("AllowRequest failed: %v", err)
+			}
+			if ok {
+				allowed.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if allowed.Load() != 10 {
+		t.Errorf("Expected 10 allowed checks, got %d", allowed.Load())
+	}
+	// One batch, retried once after loading the script
+	if p := counter.pipelines.Load(); p == 0 || p > 4 {
+		t.Errorf("Expected a few pipelines for 30 concurrent checks, got %d", p)
+	}
+	if srv.CommandCount("EVAL") != 0 {
+		t.Errorf("Batched checks should not fall back to EVAL, got %d", srv.CommandCount("EVAL"))
+	}
+}
+
+// TestRedisStore_BatchingClosed tests checks submitted after Close
+func TestRedisStore_BatchingClosed(t *testing.T) {
+	srv := startFakeRedis(t)
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	store.EnableBatching(BatchConfig{Window: time.Millisecond})
+	_ = store.Close()
+
+	_, err := store.AllowRequest(context.Background(), testKeys.windowKeys("10.10.10.11"), "req", time.Now(), time.Minute, 10)
+	if !errors.Is(err, ErrBatcherClosed) {
+		t.Errorf("Expected ErrBatcherClosed, got %v", err)
+	}
+}
+
+// TestRedisStore_BatchingCallerGaveUp tests that a check whose caller timed
+// out while its batch was in flight is not left counted in Redis
+func TestRedisStore_BatchingCallerGaveUp(t *testing.T) {
+	srv := startFakeRedis(t)
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	store.EnableBatching(BatchConfig{Window: 5 * time.Millisecond})
+	defer func() { _ = store.Close() }()
+
+	keys := testKeys.windowKeys("10.10.10.12")
+	now := time.Now()
+	srv.SetLatency(100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	var patientErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, patientErr = store.AllowRequest(ctx, keys, "patient", now, time.Minute, 10)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := store.AllowRequest(ctx, keys, "impatient", now, time.Minute, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the impatient check to time out, got %v", err)
+	}
+	wg.Wait()
+	if patientErr != nil {
+		t.Fatalf("The patient check should succeed: %v", patientErr)
+	}
+
+	srv.SetLatency(0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		members, _ := store.client.ZRange(context.Background(), keys.Window, 0, -1).Result()
+		if len(members) == 1 && members[0] == "patient" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected only the patient check counted, got %v", members)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestBatchConfigFromEnv tests batching configuration through environment variables
+func TestBatchConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_REDIS_BATCH_WINDOW")
+	defer os.Unsetenv("RATE_LIMIT_REDIS_BATCH_SIZE")
+
+	cfg, err := batchConfigFromEnv()
+	if err != nil || cfg.Window != 0 {
+		t.Errorf("Batching should be disabled by default, got %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_REDIS_BATCH_WINDOW", "500us")
+	os.Setenv("RATE_LIMIT_REDIS_BATCH_SIZE", "32")
+	cfg, err = batchConfigFromEnv()
+	if err != nil || cfg.Window != 500*time.Microsecond || cfg.MaxSize != 32 {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_REDIS_BATCH_SIZE", "0")
+	if _, err := batchConfigFromEnv(); err == nil {
+		t.Error("Expected error for invalid batch size")
+	}
+}
+
+// benchmarkAllowRequest measures throughput and p99 latency of concurrent
+// checks against a fake Redis with a simulated 200µs round trip. Callers
+// outnumber pooled connections, as under production load.
+func benchmarkAllowRequest(b *testing.B, batch BatchConfig) {
+	srv := startFakeRedis(b)
+	srv.SetLatency(200 * time.Microsecond)
+
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr(), PoolSize: 4}))
+	store.EnableBatching(batch)
+	defer func() { _ = store.Close() }()
+
+	var mu sync.Mutex
+	latencies := make([]time.Duration, 0, b.N)
+	var seq atomic.Int64
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		local := make([]time.Duration, 0, 1024)
+		for pb.Next() {
+			n := seq.Add(1)
+			start := time.Now()
+			_, err := store.AllowRequest(context.Background(), testKeys.windowKeys(fmt.Sprintf("bench-%d", n)), fmt.Sprint(n), time.Now(), time.Minute, 1<<30)
+			if err != nil {
+				b.Errorf("AllowRequest failed: %v", err)
+				return
+			}
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 := latencies[len(latencies)*99/100]
+		b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
+	}
+}
+
+func BenchmarkRedisStore_AllowRequest(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		benchmarkAllowRequest(b, BatchConfig{})
+	})
+	b.Run("batched_500us", func(b *testing.B) {
+		benchmarkAllowRequest(b, BatchConfig{Window: 500 * time.Microsecond, MaxSize: 64})
+	})
+	b.Run("batched_100us", func(b *testing.B) {
+		benchmarkAllowRequest(b, BatchConfig{Window: 100 * time.Microsecond, MaxSize: 16})
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConnConfig holds connection settings applied on top of RedisURL.
+// Zero values keep what the URL or the client defaults provide.
+type RedisConnConfig struct {
+	// ACL user, with the password read from PasswordFile
+	Username     string `json:"username"`
+	PasswordFile string `json:"password_file"`
+
+	TLS RedisTLSConfig `json:"tls"`
+
+	PoolSize     int      `json:"pool_size"`
+	MinIdleConns int      `json:"min_idle_conns"`
+	DialTimeout  Duration `json:"dial_timeout"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	ClientName   string   `json:"client_name"`
+}
+
+// RedisTLSConfig enables TLS towards Redis. Setting any of the files implies
+// Enabled.
+type RedisTLSConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+}
+
+// enabled reports whether TLS was asked for
+func (c RedisTLSConfig) enabled() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// build returns the TLS config, starting from base when the URL already
+// asked for TLS
+func (c RedisTLSConfig) build(base *tls.Config) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if c.ServerName != "" {
+		cfg.ServerName = c.ServerName
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading redis CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("redis client certificate and key must be set together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading redis client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// apply sets the configured connection settings on opts
+func (c RedisConnConfig) apply(opts *redis.UniversalOptions) error {
+	if c.Username != "" {
+		opts.Username = c.Username
+	}
+	if c.PasswordFile != "" {
+		data, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading redis password: %w", err)
+		}
+		opts.Password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if c.TLS.enabled() {
+		tlsConfig, err := c.TLS.build(opts.TLSConfig)
+		if err != nil {
+			return err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	if c.PoolSize > 0 {
+		opts.PoolSize = c.PoolSize
+	}
+	if c.MinIdleConns > 0 {
+		opts.MinIdleConns = c.MinIdleConns
+	}
+	if c.DialTimeout > 0 {
+		opts.DialTimeout = time.Duration(c.DialTimeout)
+	}
+	if c.ReadTimeout > 0 {
+		opts.ReadTimeout = time.Duration(c.ReadTimeout)
+	}
+	if c.WriteTimeout > 0 {
+		opts.WriteTimeout = time.Duration(c.WriteTimeout)
+	}
+	if c.ClientName != "" {
+		opts.ClientName = c.ClientName
+	}
+	return nil
+}
+
+// universalOptions builds Redis client options from cfg. RedisURL supplies
+// the credentials, database, timeouts and pool settings, and the address of
+// a single node; cfg.Redis overrides the connection settings. Setting
+// SentinelAddrs switches to a Sentinel-managed primary, ClusterAddrs to a
+// Redis Cluster.
+func universalOptions(cfg *Config) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{}
+	if cfg.RedisURL != "" {
+		u, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		opts.Addrs = []string{u.Addr}
+		opts.Username = u.Username
+		opts.Password = u.Password
+		opts.DB = u.DB
+		opts.TLSConfig = u.TLSConfig
+		opts.Protocol = u.Protocol
+		opts.ClientName = u.ClientName
+		opts.MaxRetries = u.MaxRetries
+		opts.MinRetryBackoff = u.MinRetryBackoff
+		opts.MaxRetryBackoff = u.MaxRetryBackoff
+		opts.DialTimeout = u.DialTimeout
+		opts.ReadTimeout = u.ReadTimeout
+		opts.WriteTimeout = u.WriteTimeout
+		opts.PoolFIFO = u.PoolFIFO
+		opts.PoolSize = u.PoolSize
+		opts.PoolTimeout = u.PoolTimeout
+		opts.MinIdleConns = u.MinIdleConns
+		opts.MaxIdleConns = u.MaxIdleConns
+		opts.MaxActiveConns = u.MaxActiveConns
+		opts.ConnMaxIdleTime = u.ConnMaxIdleTime
+		opts.ConnMaxLifetime = u.ConnMaxLifetime
+	}
+
+	switch {
+	case len(cfg.SentinelAddrs) > 0:
+		if cfg.SentinelMaster == "" {
+			return nil, errors.New("sentinel master name is required")
+		}
+		opts.Addrs = cfg.SentinelAddrs
+		opts.MasterName = cfg.SentinelMaster
+		opts.SentinelPassword = cfg.SentinelPassword
+	case len(cfg.ClusterAddrs) > 0:
+		if opts.DB != 0 {
+			return nil, errors.New("redis cluster only supports database 0")
+		}
+		opts.Addrs = cfg.ClusterAddrs
+		opts.IsClusterMode = true
+	}
+
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("no redis address configured")
+	}
+	if err := cfg.Redis.apply(opts); err != nil {
+		return nil, err
+	}
+
+	// Let per-decision deadlines cut blocked calls short
+	opts.ContextTimeoutEnabled = true
+	return opts, nil
+}
+
+// redisTopologyFromEnv reads Sentinel and Cluster settings from
+// REDIS_SENTINEL_ADDRS, REDIS_SENTINEL_MASTER, REDIS_SENTINEL_PASSWORD and
+// REDIS_CLUSTER_ADDRS into cfg
+func redisTopologyFromEnv(cfg *Config) {
+	cfg.SentinelAddrs = splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS"))
+	cfg.SentinelMaster = os.Getenv("REDIS_SENTINEL_MASTER")
+	cfg.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	cfg.ClusterAddrs = splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS"))
+}
+
+// splitAddrs splits a comma-separated list of host:port addresses
+func splitAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// redisConnConfigFromEnv reads connection settings from the JSON file named
+// by REDIS_CONFIG_FILE, then lets REDIS_USERNAME, REDIS_PASSWORD_FILE,
+// REDIS_TLS, REDIS_TLS_CA_FILE, REDIS_TLS_CERT_FILE, REDIS_TLS_KEY_FILE,
+// REDIS_TLS_SERVER_NAME, REDIS_POOL_SIZE, REDIS_MIN_IDLE_CONNS,
+// REDIS_DIAL_TIMEOUT, REDIS_READ_TIMEOUT, REDIS_WRITE_TIMEOUT and
+// REDIS_CLIENT_NAME override it
+func redisConnConfigFromEnv() (RedisConnConfig, error) {
+	var cfg RedisConnConfig
+	if path := os.Getenv("REDIS_CONFIG_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return RedisConnConfig{}, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return RedisConnConfig{}, fmt.Errorf("invalid %s: %w", path, err)
+		}
+	}
+
+	strs := map[string]*string{
+		"REDIS_USERNAME":        &cfg.Username,
+		"REDIS_PASSWORD_FILE":   &cfg.PasswordFile,
+		"REDIS_TLS_CA_FILE":     &cfg.TLS.CAFile,
+		"REDIS_TLS_CERT_FILE":   &cfg.TLS.CertFile,
+		"REDIS_TLS_KEY_FILE":    &cfg.TLS.KeyFile,
+		"REDIS_TLS_SERVER_NAME": &cfg.TLS.ServerName,
+		"REDIS_CLIENT_NAME":     &cfg.ClientName,
+	}
+	for name, field := range strs {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	if v := os.Getenv("REDIS_TLS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return RedisConnConfig{}, fmt.Errorf("invalid REDIS_TLS %q", v)
+		}
+		cfg.TLS.Enabled = enabled
+	}
+
+	counts := map[string]*int{
+		"REDIS_POOL_SIZE":      &cfg.PoolSize,
+		"REDIS_MIN_IDLE_CONNS": &cfg.MinIdleConns,
+	}
+	for name, field := range counts {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return RedisConnConfig{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*field = n
+		}
+	}
+
+	durations := map[string]*Duration{
+		"REDIS_DIAL_TIMEOUT":  &cfg.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &cfg.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &cfg.WriteTimeout,
+	}
+	for name, field := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return RedisConnConfig{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*field = Duration(d)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUniversalOptions tests client options for each Redis topology
+func TestUniversalOptions(t *testing.T) {
+	t.Run("single node", func(t *testing.T) {
+		opts, err := universalOptions(&Config{RedisURL: "redis://:secret@cache:6380/2?read_timeout=250ms&max_retries=-1"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(opts.Addrs) != 1 || opts.Addrs[0] != "cache:6380" || opts.Password != "secret" || opts.DB != 2 {
+			t.Errorf("Unexpected options: %+v", opts)
+		}
+		if opts.ReadTimeout != 250*time.Millisecond || opts.MaxRetries != -1 {
+			t.Errorf("URL query options should be kept, got read timeout %v and max retries %d", opts.ReadTimeout, opts.MaxRetries)
+		}
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		opts, err := universalOptions(&Config{
+			RedisURL:       "redis://:secret@/1",
+			SentinelAddrs:  []string{"s1:26379", "s2:26379"},
+			SentinelMaster: "mymaster",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if opts.MasterName != "mymaster" || len(opts.Addrs) != 2 || opts.Password != "secret" || opts.DB != 1 {
+			t.Errorf("Unexpected options: %+v", opts)
+		}
+	})
+
+	t.Run("sentinel without master", func(t *testing.T) {
+		if _, err := universalOptions(&Config{SentinelAddrs: []string{"s1:26379"}}); err == nil {
+			t.Error("Expected error without master name")
+		}
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		opts, err := universalOptions(&Config{ClusterAddrs: []string{"n1:6379"}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !opts.IsClusterMode || opts.Addrs[0] != "n1:6379" {
+			t.Errorf("Unexpected options: %+v", opts)
+		}
+	})
+
+	t.Run("cluster with database", func(t *testing.T) {
+		if _, err := universalOptions(&Config{RedisURL: "redis://cache:6379/3", ClusterAddrs: []string{"n1:6379"}}); err == nil {
+			t.Error("Expected error for non-zero database in cluster mode")
+		}
+	})
+
+	t.Run("no address", func(t *testing.T) {
+		if _, err := universalOptions(&Config{}); err == nil {
+			t.Error("Expected error without any address")
+		}
+	})
+}
+
+// TestRedisTopologyFromEnv tests Sentinel and Cluster settings from the environment
+func TestRedisTopologyFromEnv(t *testing.T) {
+	defer os.Unsetenv("REDIS_SENTINEL_ADDRS")
+	defer os.Unsetenv("REDIS_SENTINEL_MASTER")
+
+	os.Setenv("REDIS_SENTINEL_ADDRS", "s1:26379, s2:26379,")
+	os.Setenv("REDIS_SENTINEL_MASTER", "mymaster")
+
+	cfg := &Config{}
+	redisTopologyFromEnv(cfg)
+	if len(cfg.SentinelAddrs) != 2 || cfg.SentinelAddrs[1] != "s2:26379" || cfg.SentinelMaster != "mymaster" {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if len(cfg.ClusterAddrs) != 0 {
+		t.Errorf("Expected no cluster addresses, got %v", cfg.ClusterAddrs)
+	}
+}
+
+// TestKeysShareHashSlot tests that every key of one client uses the same hash tag
+func TestKeysShareHashSlot(t *testing.T) {
+	ip := "2001:db8::1"
+	window := testKeys.windowKeys(ip)
+	penalty := testKeys.penaltyKeys(ip)
+	quota := QuotaConfig{Period: QuotaDaily}.counterKey(testKeys, ip, time.Now())
+
+	for _, key := range []string{window.Window, window.Reservations, penalty.Strikes, penalty.Offenses, penalty.Ban, quota} {
+		if !strings.HasSuffix(key, "{"+ip+"}") {
+			t.Errorf("Key %s should end with hash tag {%s}", key, ip)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "redis.crt")
+	keyFile = filepath.Join(dir, "redis.key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// TestUniversalOptions_ConnConfig tests TLS, ACL and pool settings
+func TestUniversalOptions_ConnConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	passwordFile := filepath.Join(dir, "password")
+	_ = os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600)
+
+	opts, err := universalOptions(&Config{
+		RedisURL: "redis://cache:6379/0?pool_size=5",
+		Redis: RedisConnConfig{
+			Username:     "limiter",
+			PasswordFile: passwordFile,
+			TLS:          RedisTLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "redis.internal"},
+			PoolSize:     20,
+			MinIdleConns: 4,
+			ReadTimeout:  Duration(200 * time.Millisecond),
+			ClientName:   "ratelimiter",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.Username != "limiter" || opts.Password != "s3cret" {
+		t.Errorf("Expected ACL credentials, got %q/%q", opts.Username, opts.Password)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil || len(opts.TLSConfig.Certificates) != 1 || opts.TLSConfig.ServerName != "redis.internal" {
+		t.Errorf("Unexpected TLS config: %+v", opts.TLSConfig)
+	}
+	if opts.PoolSize != 20 || opts.MinIdleConns != 4 || opts.ReadTimeout != 200*time.Millisecond || opts.ClientName != "ratelimiter" {
+		t.Errorf("Unexpected pool settings: %+v", opts)
+	}
+
+	t.Run("certificate without key", func(t *testing.T) {
+		_, err := universalOptions(&Config{RedisURL: "redis://cache:6379", Redis: RedisConnConfig{TLS: RedisTLSConfig{CertFile: certFile}}})
+		if err == nil {
+			t.Error("Expected error for a certificate without key")
+		}
+	})
+
+	t.Run("missing password file", func(t *testing.T) {
+		_, err := universalOptions(&Config{RedisURL: "redis://cache:6379", Redis: RedisConnConfig{PasswordFile: filepath.Join(dir, "missing")}})
+		if err == nil {
+			t.Error("Expected error for a missing password file")
+		}
+	})
+}
+
+// TestRedisConnConfigFromEnv tests that env vars override the config file
+func TestRedisConnConfigFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.json")
+	_ = os.WriteFile(path, []byte(`{"username": "file-user", "pool_size": 10, "read_timeout": "1s", "tls": {"enabled": true}}`), 0o600)
+
+	defer os.Unsetenv("REDIS_CONFIG_FILE")
+	defer os.Unsetenv("REDIS_USERNAME")
+	defer os.Unsetenv("REDIS_DIAL_TIMEOUT")
+	os.Setenv("REDIS_CONFIG_FILE", path)
+	os.Setenv("REDIS_USERNAME", "env-user")
+	os.Setenv("REDIS_DIAL_TIMEOUT", "2s")
+
+	cfg, err := redisConnConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Username != "env-user" || cfg.PoolSize != 10 || !cfg.TLS.Enabled {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if cfg.ReadTimeout != Duration(time.Second) || cfg.DialTimeout != Duration(2*time.Second) {
+		t.Errorf("Unexpected timeouts: %v and %v", cfg.ReadTimeout, cfg.DialTimeout)
+	}
+
+	_ = os.WriteFile(path, []byte(`{"pool": 10}`), 0o600)
+	if _, err := redisConnConfigFromEnv(); err == nil {
+		t.Error("Expected error for an unknown field")
+	}
+}
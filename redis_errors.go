@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// RedisErrorClass groups store errors that call for the same reaction
+type RedisErrorClass string
+
+const (
+	// ErrorClassTimeout is a call that ran out of time
+	ErrorClassTimeout RedisErrorClass = "timeout"
+	// ErrorClassConnRefused is a node that is not listening
+	ErrorClassConnRefused RedisErrorClass = "connection_refused"
+	// ErrorClassOOM is a write refused because Redis hit maxmemory
+	ErrorClassOOM RedisErrorClass = "oom"
+	// ErrorClassReadOnly is a write sent to a replica, usually a primary
+	// demoted by a failover
+	ErrorClassReadOnly RedisErrorClass = "readonly"
+	// ErrorClassFailover is a node loading its dataset or without a primary
+	ErrorClassFailover RedisErrorClass = "failover"
+	// ErrorClassNoScript is a script Redis did not know and could not reload
+	ErrorClassNoScript RedisErrorClass = "noscript"
+	// ErrorClassScript is a script that failed while running
+	ErrorClassScript RedisErrorClass = "script_error"
+	// ErrorClassCanceled is a call abandoned by its client
+	ErrorClassCanceled RedisErrorClass = "canceled"
+	// ErrorClassOther is any other error
+	ErrorClassOther RedisErrorClass = "other"
+)
+
+// ErrorPolicy is how the limiter reacts to a class of store errors. The
+// request falls back to local limiting whenever the error stands.
+type ErrorPolicy string
+
+const (
+	// PolicyTrip counts the error against the circuit breaker
+	PolicyTrip ErrorPolicy = "trip"
+	// PolicyRetry retries the call once and trips if that fails too
+	PolicyRetry ErrorPolicy = "retry"
+	// PolicyReconnect retries the call once on a new connection. The client
+	// drops a connection that answered READONLY, so the retry reaches the
+	// current primary. Not counted against the breaker.
+	PolicyReconnect ErrorPolicy = "reconnect"
+	// PolicyIgnore neither retries nor counts the error
+	PolicyIgnore ErrorPolicy = "ignore"
+)
+
+// defaultErrorPolicies keeps the circuit for errors that say Redis is
+// unhealthy and spares it for errors a retry or the client recovers from
+var defaultErrorPolicies = map[RedisErrorClass]ErrorPolicy{
+	ErrorClassTimeout:     PolicyTrip,
+	ErrorClassConnRefused: PolicyTrip,
+	ErrorClassOOM:         PolicyTrip,
+	ErrorClassReadOnly:    PolicyReconnect,
+	ErrorClassFailover:    PolicyIgnore,
+	ErrorClassNoScript:    PolicyRetry,
+	ErrorClassScript:      PolicyIgnore,
+	ErrorClassCanceled:    PolicyIgnore,
+	ErrorClassOther:       PolicyTrip,
+}
+
+// validate checks a policy named in the configuration
+func (p ErrorPolicy) validate() error {
+	switch p {
+	case PolicyTrip, PolicyRetry, PolicyReconnect, PolicyIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown error policy %q", p)
+}
+
+// classifyRedisError returns the class of a store error
+func classifyRedisError(err error) RedisErrorClass {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case isTimeout(err):
+		return ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "connection refused"):
+		return ErrorClassConnRefused
+	case strings.HasPrefix(msg, "OOM "):
+		return ErrorClassOOM
+	case strings.HasPrefix(msg, "READONLY "):
+		return ErrorClassReadOnly
+	case strings.HasPrefix(msg, "LOADING ") || strings.HasPrefix(msg, "MASTERDOWN "):
+		return ErrorClassFailover
+	case strings.HasPrefix(msg, "NOSCRIPT "):
+		return ErrorClassNoScript
+	case strings.Contains(msg, "Error running script") || strings.Contains(msg, "user_script:"):
+		return ErrorClassScript
+	}
+	return ErrorClassOther
+}
+
+// errorPolicy returns the configured policy of class
+func (drl *DistributedRateLimiter) errorPolicy(class RedisErrorClass) ErrorPolicy {
+	if p, ok := drl.config.ErrorPolicies[class]; ok {
+		return p
+	}
+	if p, ok := defaultErrorPolicies[class]; ok {
+		return p
+	}
+	return PolicyTrip
+}
+
+// shouldRetry reports whether a failed call is worth one more attempt
+func (drl *DistributedRateLimiter) shouldRetry(err error) bool {
+	switch drl.errorPolicy(classifyRedisError(err)) {
+	case PolicyRetry, PolicyReconnect:
+		return true
+	}
+	return false
+}
+
+// storeCall makes one store call under the error policies: once more when
+// the policy of its error asks for a retry, recording an error that stands
+// and reporting it as op, or reporting success to the circuit breaker.
+// Callers take the breaker probe first.
+func (drl *DistributedRateLimiter) storeCall(op string, call func() error) error {
+	err := call()
+	if err != nil && drl.shouldRetry(err) {
+		err = call()
+	}
+	if err != nil {
+		drl.recordFailure(err)
+		if drl.eventEmitter != nil {
+			drl.eventEmitter.EmitRedisFailure(op, err)
+		}
+		return err
+	}
+	drl.circuitBreaker.RecordSuccess()
+	return nil
+}
+
+// recordFailure counts a store error by class and, as its policy says,
+// against the circuit breaker. Nothing is counted against the breaker while
+// Sentinel reports a failover, which the client recovers from itself.
+// Timeouts are counted as their own kind of failure.
+func (drl *DistributedRateLimiter) recordFailure(err error) {
+	class := classifyRedisError(err)
+	drl.metrics.mu.Lock()
+	if drl.metrics.FailuresByClass == nil {
+		drl.metrics.FailuresByClass = make(map[RedisErrorClass]int64)
+	}
+	drl.metrics.FailuresByClass[class]++
+	drl.metrics.mu.Unlock()
+
+	if drl.failover.active() {
+		return
+	}
+	switch drl.errorPolicy(class) {
+	case PolicyIgnore, PolicyReconnect:
+		return
+	}
+
+	timeout := class == ErrorClassTimeout
+	drl.metrics.mu.Lock()
+	if timeout {
+		drl.metrics.RedisTimeouts++
+	} else {
+		drl.metrics.RedisFailures++
+	}
+	drl.metrics.mu.Unlock()
+
+	if timeout {
+		drl.circuitBreaker.RecordTimeout()
+	} else {
+		drl.circuitBreaker.RecordFailure()
+	}
+}
+
+// errorPoliciesFromEnv reads RATE_LIMIT_ERROR_POLICIES as a comma-separated
+// list of class=policy pairs overriding the defaults
+func errorPoliciesFromEnv() (map[RedisErrorClass]ErrorPolicy, error) {
+	v := os.Getenv("RATE_LIMIT_ERROR_POLICIES")
+	if v == "" {
+		return nil, nil
+	}
+	policies := make(map[RedisErrorClass]ErrorPolicy)
+	for _, pair := range strings.Split(v, ",") {
+		class, policy, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid error policy %q", pair)
+		}
+		if _, known := defaultErrorPolicies[RedisErrorClass(class)]; !known {
+			return nil, fmt.Errorf("unknown error class %q", class)
+		}
+		if err := ErrorPolicy(policy).validate(); err != nil {
+			return nil, err
+		}
+		policies[RedisErrorClass(class)] = ErrorPolicy(policy)
+	}
+	return policies, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestClassifyRedisError tests that store errors map to their class
+func TestClassifyRedisError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want RedisErrorClass
+	}{
+		{context.DeadlineExceeded, ErrorClassTimeout},
+		{context.Canceled, ErrorClassCanceled},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), ErrorClassConnRefused},
+		{errors.New("dial tcp 10.0.0.1:6379: connect: connection refused"), ErrorClassConnRefused},
+		{errors.New("OOM command not allowed when used memory > 'maxmemory'."), ErrorClassOOM},
+		{errors.New("READONLY You can't write against a read only replica."), ErrorClassReadOnly},
+		{errors.New("LOADING Redis is loading the dataset in memory"), ErrorClassFailover},
+		{errors.New("MASTERDOWN Link with MASTER is down"), ErrorClassFailover},
+		{errors.New("NOSCRIPT No matching script. Please use EVAL."), ErrorClassNoScript},
+		{errors.New("ERR Error running script (call to f_0a1b): @user_script:3: attempt to compare nil with number"), ErrorClassScript},
+		{errors.New("ERR user_script:1: Script attempted to access nonexistent global variable 'x'"), ErrorClassScript},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), ErrorClassOther},
+	}
+	for _, tt := range tests {
+		if got := classifyRedisError(tt.err); got != tt.want {
+			t.Errorf("classifyRedisError(%q) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestRecordFailure_Policies tests which classes count against the breaker
+func TestRecordFailure_Policies(t *testing.T) {
+	cfg := testConfig()
+	cfg.FailureThreshold = 2
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+
+	for _, err := range []error{
+		errors.New("READONLY You can't write against a read only replica."),
+		errors.New("ERR Error running script (call to f_0a1b): @user_script:3: oops"),
+		context.Canceled,
+		errors.New("READONLY You can't write against a read only replica."),
+	} {
+		drl.recordFailure(err)
+	}
+	if drl.circuitBreaker.IsOpen() {
+		t.Fatal("Reconnect and ignore policies should not open the circuit")
+	}
+	m := drl.GetMetrics()
+	if m.RedisFailures != 0 {
+		t.Errorf("Expected no breaker failures, got %d", m.RedisFailures)
+	}
+	if m.FailuresByClass[ErrorClassReadOnly] != 2 || m.FailuresByClass[ErrorClassScript] != 1 {
+		t.Errorf("Expected failures counted by class, got %v", m.FailuresByClass)
+	}
+
+	for i := 0; i < 2; i++ {
+		drl.recordFailure(errors.New("OOM command not allowed when used memory > 'maxmemory'."))
+	}
+	if !drl.circuitBreaker.IsOpen() {
+		t.Error("OOM errors should open the circuit")
+	}
+}
+
+// TestRecordFailure_ConfiguredPolicy tests overriding a default policy
+func TestRecordFailure_ConfiguredPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.FailureThreshold = 1
+	cfg.ErrorPolicies = map[RedisErrorClass]ErrorPolicy{ErrorClassOOM: PolicyIgnore}
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+
+	drl.recordFailure(errors.New("OOM command not allowed when used memory > 'maxmemory'."))
+	if drl.circuitBreaker.IsOpen() {
+		t.Error("Ignored OOM errors should not open the circuit")
+	}
+}
+
+// TestDistributedRateLimiter_ReadOnlyReconnects tests that a READONLY reply
+// is retried instead of falling back
+func TestDistributedRateLimiter_ReadOnlyReconnects(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL() + "?max_retries=-1"
+	cfg.FailureThreshold = 1
+	emitter := &EventEmitter{feed: NewActivityFeed(100), broadcaster: NewSSEBroadcaster()}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	srv.FailNext(1, errors.New("READONLY You can't write against a read only replica."))
+	if !drl.Allow("readonly-ip") {
+		t.Fatal("Request should be allowed after reconnecting")
+	}
+	m := drl.GetMetrics()
+	if m.FallbackCount != 0 || drl.circuitBreaker.IsOpen() {
+		t.Errorf("Expected no fallback, got %d fallbacks and circuit %s", m.FallbackCount, drl.circuitBreaker.State())
+	}
+	if n := len(eventsOfType(emitter, EventTypeRedisFailure)); n != 0 {
+		t.Errorf("Expected no redis_failure event for a recovered error, got %d", n)
+	}
+
+	// A script bug falls back for the request without tripping
+	srv.FailNext(1, errors.New("ERR Error running script (call to f_0a1b): @user_script:3: oops"))
+	drl.Allow("readonly-ip")
+	if drl.circuitBreaker.IsOpen() {
+		t.Error("Script errors should not open the circuit")
+	}
+	events := eventsOfType(emitter, EventTypeRedisFailure)
+	if len(events) != 1 || events[0].Details["class"] != string(ErrorClassScript) {
+		t.Errorf("Expected one script_error event, got %v", events)
+	}
+}
+
+// TestDistributedRateLimiter_PoliciesCoverEveryCall tests that lease, quota
+// and reservation calls are retried on READONLY like window checks
+func TestDistributedRateLimiter_PoliciesCoverEveryCall(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL() + "?max_retries=-1"
+	cfg.FailureThreshold = 1
+	cfg.Lease = LeaseConfig{Size: 2, TTL: time.Minute}
+	cfg.Quotas = []QuotaConfig{{Period: QuotaDaily, Limit: 100}}
+	emitter := &EventEmitter{feed: NewActivityFeed(100), broadcaster: NewSSEBroadcaster()}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	readOnly := errors.New("READONLY You can't write against a read only replica.")
+	// The first call of a request charges the quotas, the second leases
+	for i, ip := range []string{"readonly-quota-ip", "readonly-lease-ip"} {
+		if i == 1 {
+			drl.Allow(ip)
+		}
+		srv.FailNext(1, readOnly)
+		if !drl.Allow(ip) {
+			t.Fatalf("Request for %s should be allowed after reconnecting", ip)
+		}
+	}
+	srv.FailNext(1, readOnly)
+	if _, err := drl.Reserve("readonly-reserve", 1); err != nil {
+		t.Fatalf("Reservation should succeed after reconnecting: %v", err)
+	}
+
+	m := drl.GetMetrics()
+	if m.FallbackCount != 0 || drl.circuitBreaker.IsOpen() {
+		t.Errorf("Expected no fallback, got %d fallbacks and circuit %s", m.FallbackCount, drl.circuitBreaker.State())
+	}
+	if n := len(eventsOfType(emitter, EventTypeRedisFailure)); n != 0 {
+		t.Errorf("Expected no redis_failure event for recovered errors, got %d", n)
+	}
+	if n := m.FailuresByClass[ErrorClassReadOnly]; n != 0 {
+		t.Errorf("Expected recovered errors not to be recorded, got %d", n)
+	}
+}
+
+// TestErrorPoliciesFromEnv tests RATE_LIMIT_ERROR_POLICIES parsing
+func TestErrorPoliciesFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_ERROR_POLICIES", "oom=ignore, readonly=trip")
+	policies, err := errorPoliciesFromEnv()
+	if err != nil || policies[ErrorClassOOM] != PolicyIgnore || policies[ErrorClassReadOnly] != PolicyTrip {
+		t.Errorf("Unexpected policies %v (%v)", policies, err)
+	}
+
+	for _, v := range []string{"oom", "oom=explode", "disk=trip"} {
+		t.Setenv("RATE_LIMIT_ERROR_POLICIES", v)
+		if _, err := errorPoliciesFromEnv(); err == nil {
+			t.Errorf("Expected an error for %q", v)
+		}
+	}
+}
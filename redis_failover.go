@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// failoverTimeout bounds how long a started failover suppresses the
+	// circuit breaker if Sentinel never reports its outcome
+	failoverTimeout = 30 * time.Second
+	// failoverSettle covers clients reconnecting after the new primary
+	// has been announced
+	failoverSettle = 5 * time.Second
+)
+
+// failoverWatcher follows Sentinel announcements for one master so that
+// errors during a planned or automatic failover don't open the circuit
+type failoverWatcher struct {
+	mu           sync.Mutex
+	masterName   string
+	until        time.Time
+	sentinel     *redis.SentinelClient
+	pubsub       *redis.PubSub
+	eventEmitter *EventEmitter
+}
+
+// newFailoverWatcher creates a watcher for masterName without connecting
+func newFailoverWatcher(masterName string, eventEmitter *EventEmitter) *failoverWatcher {
+	return &failoverWatcher{
+		masterName:   masterName,
+		eventEmitter: eventEmitter,
+	}
+}
+
+// watchFailover subscribes to the failover channels of the first reachable
+// sentinel in opts
+func watchFailover(opts *redis.UniversalOptions, eventEmitter *EventEmitter) *failoverWatcher {
+	w := newFailoverWatcher(opts.MasterName, eventEmitter)
+	ctx := context.Background()
+
+	for _, addr := range opts.Addrs {
+		sentinel := redis.NewSentinelClient(&redis.Options{
+			Addr:      addr,
+			Username:  opts.SentinelUsername,
+			Password:  opts.SentinelPassword,
+			TLSConfig: opts.TLSConfig,
+		})
+		if err := sentinel.Ping(ctx).Err(); err != nil {
+			_ = sentinel.Close()
+			continue
+		}
+		w.sentinel = sentinel
+		w.pubsub = sentinel.Subscribe(ctx, "+try-failover", "+switch-master")
+		_ = w.pubsub.PSubscribe(ctx, "-failover-abort-*")
+		go w.run()
+		break
+	}
+	return w
+}
+
+// run handles Sentinel messages until the subscription is closed
+func (w *failoverWatcher) run() {
+	for msg := range w.pubsub.Channel() {
+		w.handle(msg.Channel, msg.Payload)
+	}
+}
+
+// handle processes one Sentinel announcement
+func (w *failoverWatcher) handle(channel, payload string) {
+	fields := strings.Fields(payload)
+
+	switch {
+	case channel == "+try-failover":
+		// <instance-type> <name> <ip> <port>
+		if len(fields) < 4 || fields[1] != w.masterName {
+			return
+		}
+		w.mu.Lock()
+		w.until = time.Now().Add(failoverTimeout)
+		w.mu.Unlock()
+		if w.eventEmitter != nil {
+			w.eventEmitter.EmitRedisFailover("started", w.masterName, fields[2]+":"+fields[3], "")
+		}
+
+	case channel == "+switch-master":
+		// <name> <old-ip> <old-port> <new-ip> <new-port>
+		if len(fields) < 5 || fields[0] != w.masterName {
+			return
+		}
+		w.mu.Lock()
+		w.until = time.Now().Add(failoverSettle)
+		w.mu.Unlock()
+		if w.eventEmitter != nil {
+			w.eventEmitter.EmitRedisFailover("completed", w.masterName, fields[1]+":"+fields[2], fields[3]+":"+fields[4])
+		}
+
+	case strings.HasPrefix(channel, "-failover-abort-"):
+		// <instance-type> <name> <ip> <port>
+		if len(fields) < 4 || fields[1] != w.masterName {
+			return
+		}
+		w.mu.Lock()
+		w.until = time.Time{}
+		w.mu.Unlock()
+		if w.eventEmitter != nil {
+			w.eventEmitter.EmitRedisFailover("aborted", w.masterName, fields[2]+":"+fields[3], "")
+		}
+	}
+}
+
+// active reports whether a failover is in progress or just finished
+func (w *failoverWatcher) active() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.until)
+}
+
+// Close stops watching Sentinel
+func (w *failoverWatcher) Close() error {
+	if w == nil || w.sentinel == nil {
+		return nil
+	}
+	_ = w.pubsub.Close()
+	return w.sentinel.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestFailoverWatcher tests handling of Sentinel failover announcements
+func TestFailoverWatcher(t *testing.T) {
+	eventEmitter := createTestEmitter()
+	w := newFailoverWatcher("mymaster", eventEmitter)
+
+	// Announcements for other masters are ignored
+	w.handle("+try-failover", "master othermaster 10.0.0.1 6379")
+	if w.active() {
+		t.Fatal("Failover of another master should be ignored")
+	}
+
+	w.handle("+try-failover", "master mymaster 10.0.0.1 6379")
+	if !w.active() {
+		t.Fatal("Failover should be active once started")
+	}
+
+	w.handle("+switch-master", "mymaster 10.0.0.1 6379 10.0.0.2 6379")
+	if !w.active() {
+		t.Error("Failover should stay active while clients reconnect")
+	}
+
+	events := eventEmitter.feed.GetRecentEvents(10)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 failover events, got %d", len(events))
+	}
+	completed := events[1]
+	if completed.Type != EventTypeRedisFailover || completed.Details["phase"] != "completed" {
+		t.Errorf("Expected completed failover event, got %+v", completed)
+	}
+	if completed.Details["from"] != "10.0.0.1:6379" || completed.Details["to"] != "10.0.0.2:6379" {
+		t.Errorf("Unexpected failover addresses: %v", completed.Details)
+	}
+
+	w.handle("-failover-abort-not-elected", "master mymaster 10.0.0.2 6379")
+	if w.active() {
+		t.Error("Aborted failover should no longer be active")
+	}
+}
+
+// TestDistributedRateLimiter_FailoverKeepsCircuitClosed tests that errors
+// during a Sentinel failover don't open the circuit
+func TestDistributedRateLimiter_FailoverKeepsCircuitClosed(t *testing.T) {
+	cfg := testConfig()
+	cfg.FailureThreshold = 2
+
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+
+	for i := 0; i < 3; i++ {
+		drl.recordFailure(errors.New("READONLY You can't write against a read only replica."))
+	}
+	if drl.circuitBreaker.IsOpen() {
+		t.Fatal("READONLY errors should not open the circuit")
+	}
+
+	drl.failover = newFailoverWatcher("mymaster", nil)
+	drl.failover.handle("+try-failover", "master mymaster 10.0.0.1 6379")
+	for i := 0; i < 3; i++ {
+		drl.recordFailure(errors.New("dial tcp 10.0.0.1:6379: connect: connection refused"))
+	}
+	if drl.circuitBreaker.IsOpen() {
+		t.Fatal("Errors during failover should not open the circuit")
+	}
+
+	drl.failover.mu.Lock()
+	drl.failover.until = time.Now()
+	drl.failover.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		drl.recordFailure(errors.New("dial tcp 10.0.0.2:6379: connect: connection refused"))
+	}
+	if !drl.circuitBreaker.IsOpen() {
+		t.Error("Errors after failover should open the circuit")
+	}
+}
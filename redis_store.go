@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// purgeReservationsLua releases units held by reservations that expired
+// without being committed or cancelled. Pending reservations are stored as
+// "<id>:<units>" members scored by their expiry time.
+const purgeReservationsLua = `
+	local function purgeExpiredReservations(key, pendingKey, now)
+		local expired = redis.call('ZRANGEBYSCORE', pendingKey, 0, now)
+		for _, entry in ipairs(expired) do
+			local id, units = string.match(entry, '^(.+):(%d+)$')
+			if id then
+				for i = 1, tonumber(units) do
+					redis.call('ZREM', key, id .. ':' .. i)
+				end
+			end
+		end
+		if #expired > 0 then
+			redis.call('ZREMRANGEBYSCORE', pendingKey, 0, now)
+		end
+	end
+`
+
+// allowLua is the sliding window check-and-increment
+const allowLua = purgeReservationsLua + `
+	local key = KEYS[1]
+	local now = ARGV[1]
+	local windowStart = ARGV[2]
+	local limit = tonumber(ARGV[3])
+	local requestId = ARGV[4]
+
+	-- Release capacity held by expired reservations
+	purgeExpiredReservations(key, KEYS[2], tonumber(now))
+
+	-- Remove old entries
+	redis.call('ZREMRANGEBYSCORE', key, 0, windowStart)
+
+	-- Count current requests
+	local count = redis.call('ZCARD', key)
+
+	-- Check limit
+	if count >= limit then
+		return 0
+	else
+		redis.call('ZADD', key, now, requestId)
+		redis.call('EXPIRE', key, 120)
+		return 1
+	end
+`
+
+// reserveLua atomically claims ARGV[4] units if they fit within the limit
+const reserveLua = purgeReservationsLua + `
+	local key = KEYS[1]
+	local pendingKey = KEYS[2]
+	local now = tonumber(ARGV[1])
+	local windowStart = ARGV[2]
+	local limit = tonumber(ARGV[3])
+	local units = tonumber(ARGV[4])
+	local id = ARGV[5]
+	local expiresAt = tonumber(ARGV[6])
+
+	purgeExpiredReservations(key, pendingKey, now)
+	redis.call('ZREMRANGEBYSCORE', key, 0, windowStart)
+
+	local count = redis.call('ZCARD', key)
+	if count + units > limit then
+		return 0
+	end
+
+	for i = 1, units do
+		redis.call('ZADD', key, now, id .. ':' .. i)
+	end
+	redis.call('ZADD', pendingKey, expiresAt, id .. ':' .. units)
+	redis.call('EXPIRE', key, 120)
+	redis.call('PEXPIREAT', pendingKey, expiresAt + 1000)
+	return 1
+`
+
+// settleReservationLua commits (ARGV[4] == "1") or cancels a reservation.
+// Returns 1 when settled and 0 when the reservation is unknown or expired.
+const settleReservationLua = `
+	local key = KEYS[1]
+	local pendingKey = KEYS[2]
+	local id = ARGV[1]
+	local units = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+	local commit = ARGV[4] == '1'
+	local member = id .. ':' .. units
+
+	local expiresAt = redis.call('ZSCORE', pendingKey, member)
+	if not expiresAt then
+		return 0
+	end
+	redis.call('ZREM', pendingKey, member)
+
+	local expired = tonumber(expiresAt) <= now
+	if commit and not expired then
+		return 1
+	end
+
+	for i = 1, units do
+		redis.call('ZREM', key, id .. ':' .. i)
+	end
+	if expired then
+		return 0
+	end
+	return 1
+`
+
+// leaseLua grants up to ARGV[4] units of the sliding window to one instance.
+// Returns the number of units granted, which is 0 when the window is full.
+const leaseLua = purgeReservationsLua + `
+	local key = KEYS[1]
+	local now = tonumber(ARGV[1])
+	local windowStart = ARGV[2]
+	local limit = tonumber(ARGV[3])
+	local units = tonumber(ARGV[4])
+	local id = ARGV[5]
+
+	purgeExpiredReservations(key, KEYS[2], now)
+	redis.call('ZREMRANGEBYSCORE', key, 0, windowStart)
+
+	local granted = math.min(units, limit - redis.call('ZCARD', key))
+	if granted <= 0 then
+		return 0
+	end
+
+	for i = 1, granted do
+		redis.call('ZADD', key, now, id .. ':' .. i)
+	end
+	redis.call('EXPIRE', key, 120)
+	return granted
+`
+
+// replayLua adds ARGV pairs of score and member that are still inside the
+// window starting at ARGV[1]. Returns the number of members added.
+const replayLua = `
+	local key = KEYS[1]
+	local windowStart = tonumber(ARGV[1])
+	redis.call('ZREMRANGEBYSCORE', key, 0, windowStart)
+
+	local added = 0
+	for i = 2, #ARGV, 2 do
+		if tonumber(ARGV[i]) > windowStart then
+			added = added + redis.call('ZADD', key, ARGV[i], ARGV[i + 1])
+		end
+	end
+	redis.call('EXPIRE', key, 120)
+	return added
+`
+
+// heartbeatLua records ARGV[1] as alive until ARGV[2] (ms), drops instances
+// whose heartbeat expired before ARGV[3] and returns the live count
+const heartbeatLua = `
+	local key = KEYS[1]
+	redis.call('ZADD', key, ARGV[2], ARGV[1])
+	redis.call('ZREMRANGEBYSCORE', key, 0, ARGV[3])
+	redis.call('PEXPIREAT', key, ARGV[2])
+	return redis.call('ZCARD', key)
+`
+
+// quotaLua checks every quota counter and increments them only if all have
+// room. ARGV holds a limit and a reset timestamp (ms) per key. Returns 0 when
+// allowed, otherwise the 1-based index of the exhausted quota.
+const quotaLua = `
+	for i, key in ipairs(KEYS) do
+		local count = tonumber(redis.call('GET', key) or '0')
+		if count >= tonumber(ARGV[2 * i - 1]) then
+			return i
+		end
+	end
+	for i, key in ipairs(KEYS) do
+		if redis.call('INCR', key) == 1 then
+			redis.call('PEXPIREAT', key, ARGV[2 * i])
+		end
+	end
+	return 0
+`
+
+// refundQuotaLua gives one unit back to every quota counter in KEYS. Counters
+// that expired with their period are left alone.
+const refundQuotaLua = `
+	for _, key in ipairs(KEYS) do
+		if tonumber(redis.call('GET', key) or '0') > 0 then
+			redis.call('DECR', key)
+		end
+	end
+	return 0
+`
+
+// penaltyLua records a rejection and issues a ban once the threshold is
+// reached. Returns {level, duration ms} for a new ban, {0, 0} otherwise.
+const penaltyLua = `
+	local strikesKey = KEYS[1]
+	local offensesKey = KEYS[2]
+	local banKey = KEYS[3]
+	local threshold = tonumber(ARGV[1])
+
+	if redis.call('EXISTS', banKey) == 1 then
+		return {0, 0}
+	end
+
+	local strikes = redis.call('INCR', strikesKey)
+	if strikes == 1 then
+		redis.call('PEXPIRE', strikesKey, ARGV[2])
+	end
+	if strikes < threshold then
+		return {0, 0}
+	end
+
+	redis.call('DEL', strikesKey)
+	local level = redis.call('INCR', offensesKey)
+	redis.call('PEXPIRE', offensesKey, ARGV[3])
+
+	local idx = math.min(level, #ARGV - 3)
+	local duration = tonumber(ARGV[3 + idx])
+	redis.call('SET', banKey, level, 'PX', duration)
+	return {level, duration}
+`
+
+// RedisStore keeps rate limit state in Redis using Lua scripts for atomicity
+type RedisStore struct {
+	client        redis.UniversalClient
+	scripts       *scriptRegistry
+	allowScript   *managedScript
+	reserveScript *managedScript
+	settleScript  *managedScript
+	leaseScript   *managedScript
+	beatScript    *managedScript
+	replayScript  *managedScript
+	quotaScript   *managedScript
+	refundScript  *managedScript
+	penaltyScript *managedScript
+	batcher       *allowBatcher
+}
+
+// NewRedisStore creates a store backed by a single node, Sentinel or Cluster client
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	scripts := &scriptRegistry{}
+	return &RedisStore{
+		client:        client,
+		scripts:       scripts,
+		allowScript:   scripts.register("allow", allowLua),
+		reserveScript: scripts.register("reserve", reserveLua),
+		settleScript:  scripts.register("settle_reservation", settleReservationLua),
+		leaseScript:   scripts.register("lease", leaseLua),
+		beatScript:    scripts.register("heartbeat", heartbeatLua),
+		replayScript:  scripts.register("replay", replayLua),
+		quotaScript:   scripts.register("quota", quotaLua),
+		refundScript:  scripts.register("quota_refund", refundQuotaLua),
+		penaltyScript: scripts.register("penalty", penaltyLua),
+	}
+}
+
+// LoadScripts loads every script into Redis ahead of use and verifies
+// their SHAs
+func (s *RedisStore) LoadScripts(ctx context.Context) error {
+	return s.scripts.preload(ctx, s.client)
+}
+
+// EnableBatching pipelines concurrent AllowRequest calls according to cfg
+func (s *RedisStore) EnableBatching(cfg BatchConfig) {
+	if cfg.Window > 0 {
+		s.batcher = newAllowBatcher(s, cfg)
+	}
+}
+
+// AllowRequest runs the sliding window script
+func (s *RedisStore) AllowRequest(ctx context.Context, keys WindowKeys, member string, now time.Time, window time.Duration, limit int) (bool, error) {
+	scriptKeys := []string{keys.Window, keys.Reservations}
+	args := []interface{}{
+		now.UnixMilli(),
+		now.UnixMilli() - window.Milliseconds(),
+		limit,
+		member,
+	}
+	if s.batcher != nil {
+		return s.batcher.allow(ctx, scriptKeys, args)
+	}
+
+	result, err := s.allowScript.Run(ctx, s.client, scriptKeys, args...).Int64()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// RemoveRequest removes members from the sliding window
+func (s *RedisStore) RemoveRequest(ctx context.Context, key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	return s.client.ZRem(ctx, key, args...).Err()
+}
+
+// Replay runs the replay script
+func (s *RedisStore) Replay(ctx context.Context, keys WindowKeys, entries []WindowEntry, now time.Time, window time.Duration) (int, error) {
+	args := make([]interface{}, 0, 1+2*len(entries))
+	args = append(args, now.UnixMilli()-window.Milliseconds())
+	for _, e := range entries {
+		args = append(args, e.At.UnixMilli(), e.Member)
+	}
+
+	result, err := s.replayScript.Run(ctx, s.client, []string{keys.Window}, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(result), nil
+}
+
+// SyncWindows runs the replay script and counts every window in one
+// pipeline. Replaying is idempotent, so the pipeline is simply sent again
+// after loading a script Redis lost.
+func (s *RedisStore) SyncWindows(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]int64, error) {
+	replays, counts := s.syncPipeline(ctx, syncs, now, window)
+	for _, cmd := range replays {
+		if isNoScript(cmd.Err()) {
+			if err := s.replayScript.load(ctx, s.client); err != nil {
+				return nil, err
+			}
+			replays, counts = s.syncPipeline(ctx, syncs, now, window)
+			break
+		}
+	}
+
+	result := make([]int64, len(syncs))
+	for i := range syncs {
+		if err := replays[i].Err(); err != nil {
+			return nil, err
+		}
+		n, err := counts[i].Result()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = n
+	}
+	return result, nil
+}
+
+// syncPipeline sends the replay and count of every sync in one round trip
+func (s *RedisStore) syncPipeline(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]*redis.Cmd, []*redis.IntCmd) {
+	windowStart := now.UnixMilli() - window.Milliseconds()
+	replays := make([]*redis.Cmd, len(syncs))
+	counts := make([]*redis.IntCmd, len(syncs))
+	_, _ = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, sync := range syncs {
+			args := make([]interface{}, 0, 1+2*len(sync.Entries))
+			args = append(args, windowStart)
+			for _, e := range sync.Entries {
+				args = append(args, e.At.UnixMilli(), e.Member)
+			}
+			replays[i] = s.replayScript.EvalSha(ctx, pipe, []string{sync.Keys.Window}, args...)
+			counts[i] = pipe.ZCard(ctx, sync.Keys.Window)
+		}
+		return nil
+	})
+	return replays, counts
+}
+
+// Lease runs the lease script
+func (s *RedisStore) Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error) {
+	result, err := s.leaseScript.Run(
+		ctx,
+		s.client,
+		[]string{keys.Window, keys.Reservations},
+		now.UnixMilli(),
+		now.UnixMilli()-window.Milliseconds(),
+		limit,
+		units,
+		id,
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(result), nil
+}
+
+// Reserve runs the reservation script
+func (s *RedisStore) Reserve(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int, expiresAt time.Time) (bool, error) {
+	result, err := s.reserveScript.Run(
+		ctx,
+		s.client,
+		[]string{keys.Window, keys.Reservations},
+		now.UnixMilli(),
+		now.UnixMilli()-window.Milliseconds(),
+		limit,
+		units,
+		id,
+		expiresAt.UnixMilli(),
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// SettleReservation runs the settle script
+func (s *RedisStore) SettleReservation(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, commit bool) (bool, error) {
+	mode := "0"
+	if commit {
+		mode = "1"
+	}
+
+	result, err := s.settleScript.Run(
+		ctx,
+		s.client,
+		[]string{keys.Window, keys.Reservations},
+		id,
+		units,
+		now.UnixMilli(),
+		mode,
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// IncrementQuotas runs the quota script
+func (s *RedisStore) IncrementQuotas(ctx context.Context, counters []QuotaCounter) (int, error) {
+	keys := make([]string, len(counters))
+	args := make([]interface{}, 0, 2*len(counters))
+	for i, c := range counters {
+		keys[i] = c.Key
+		args = append(args, c.Limit, c.ResetAt.UnixMilli())
+	}
+
+	result, err := s.quotaScript.Run(ctx, s.client, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(result), nil
+}
+
+// RefundQuotas runs the quota refund script
+func (s *RedisStore) RefundQuotas(ctx context.Context, keys []string) error {
+	return s.refundScript.Run(ctx, s.client, keys).Err()
+}
+
+// RecordStrike runs the penalty script
+func (s *RedisStore) RecordStrike(ctx context.Context, keys PenaltyKeys, cfg PenaltyConfig) (int, time.Duration, error) {
+	args := []interface{}{
+		cfg.Threshold,
+		cfg.StrikeWindow.Milliseconds(),
+		cfg.OffenseTTL.Milliseconds(),
+	}
+	for _, d := range cfg.Durations {
+		args = append(args, d.Milliseconds())
+	}
+
+	result, err := s.penaltyScript.Run(
+		ctx,
+		s.client,
+		[]string{keys.Strikes, keys.Offenses, keys.Ban},
+		args...,
+	).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(result[0]), time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// BanTTL returns the remaining time of a ban key
+func (s *RedisStore) BanTTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Count returns the cardinality of a sliding window
+func (s *RedisStore) Count(ctx context.Context, key string) (int64, error) {
+	return s.client.ZCard(ctx, key).Result()
+}
+
+// TTL returns the remaining time to live of key
+func (s *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Delete removes keys
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// Heartbeat runs the heartbeat script
+func (s *RedisStore) Heartbeat(ctx context.Context, key, id string, now time.Time, ttl time.Duration) (int, error) {
+	result, err := s.beatScript.Run(
+		ctx,
+		s.client,
+		[]string{key},
+		id,
+		now.Add(ttl).UnixMilli(),
+		now.UnixMilli(),
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(result), nil
+}
+
+// Deregister removes an instance heartbeat
+func (s *RedisStore) Deregister(ctx context.Context, key, id string) error {
+	return s.client.ZRem(ctx, key, id).Err()
+}
+
+// Ping checks the Redis connection
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Close closes the Redis connection
+func (s *RedisStore) Close() error {
+	if s.batcher != nil {
+		s.batcher.close()
+	}
+	return s.client.Close()
+}
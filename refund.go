@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRefundStatuses refunds requests that fail on our side
+const DefaultRefundStatuses = "5xx"
+
+// consumedUnit identifies the quota unit taken by an allowed request
+type consumedUnit struct {
+	key string
+	// Shared window the unit was recorded in
+	keys   WindowKeys
+	at     time.Time
+	member string
+	local  *RateLimiter
+	remote *DistributedRateLimiter
+	// Calendar quota units charged along with the window unit
+	quotas *quotaCharge
+}
+
+// Refund gives the consumed unit back to the limiter that issued it. The
+// shared store is updated within the decision deadline of ctx.
+func (u *consumedUnit) Refund(ctx context.Context) error {
+	if err := u.release(ctx); err != nil {
+		return err
+	}
+
+	if u.remote != nil {
+		u.remote.metrics.mu.Lock()
+		u.remote.metrics.RefundedRequests++
+		u.remote.metrics.mu.Unlock()
+	}
+	return nil
+}
+
+// release removes the unit from the limiter that issued it and gives back
+// the quota units charged with it
+func (u *consumedUnit) release(ctx context.Context) error {
+	var err error
+	switch {
+	case u.remote != nil:
+		err = u.remote.releaseUnit(ctx, u)
+	case u.local != nil:
+		u.local.releaseUnit(u)
+	}
+	if u.quotas != nil {
+		if qerr := u.quotas.refund(ctx); err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
+
+// releaseUnit removes the timestamp recorded for an allowed request. No two
+// requests of a key share a timestamp, so only this unit is removed.
+func (rl *RateLimiter) releaseUnit(u *consumedUnit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	requests := rl.requests[u.key]
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Equal(u.at) {
+			rl.requests[u.key] = append(requests[:i], requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// releaseUnit removes the ZSET member recorded for an allowed request
+func (drl *DistributedRateLimiter) releaseUnit(ctx context.Context, u *consumedUnit) error {
+	// Units decided locally may not have reached the store yet
+	if !u.at.IsZero() && drl.syncs.forget(u.keys.Window, u.member, u.at) {
+		return nil
+	}
+	if !drl.circuitBreaker.Allow() {
+		return ErrCircuitOpen
+	}
+
+	ctx, cancel := drl.decisionContext(ctx)
+	defer cancel()
+	return drl.storeCall("refund", func() error {
+		return drl.store.RemoveRequest(ctx, u.keys.Window, u.member)
+	})
+}
+
+// RefundPolicy decides which response statuses get their unit refunded
+type RefundPolicy struct {
+	codes   map[int]bool
+	classes map[int]bool
+}
+
+// ParseRefundStatuses parses a comma-separated list of status codes and
+// classes, e.g. "5xx,429" or "502,503"
+func ParseRefundStatuses(spec string) (*RefundPolicy, error) {
+	policy := &RefundPolicy{
+		codes:   make(map[int]bool),
+		classes: make(map[int]bool),
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+
+		if len(part) == 3 && strings.HasSuffix(part, "xx") {
+			class, err := strconv.Atoi(part[:1])
+			if err != nil || class < 1 || class > 5 {
+				return nil, fmt.Errorf("invalid status class %q", part)
+			}
+			policy.classes[class] = true
+			continue
+		}
+
+		code, err := strconv.Atoi(part)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", part)
+		}
+		policy.codes[code] = true
+	}
+
+	return policy, nil
+}
+
+// Matches reports whether a response with status should be refunded
+func (p *RefundPolicy) Matches(status int) bool {
+	if p == nil {
+		return false
+	}
+	return p.codes[status] || p.classes[status/100]
+}
+
+// statusRecorder captures the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the first status code written
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 when no header was written
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming handlers such as SSE working through the wrapper
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Status returns the final status code of the response
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParseRefundStatuses tests parsing of refund status specs
+func TestParseRefundStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		wantErr  bool
+		refunded []int
+		charged  []int
+	}{
+		{
+			name:     "server error class",
+			spec:     "5xx",
+			refunded: []int{500, 502, 503, 599},
+			charged:  []int{200, 404, 429},
+		},
+		{
+			name:     "specific codes",
+			spec:     "502, 503",
+			refunded: []int{502, 503},
+			charged:  []int{500, 504, 200},
+		},
+		{
+			name:     "class and code",
+			spec:     "5XX,429",
+			refunded: []int{429, 500},
+			charged:  []int{400, 200},
+		},
+		{
+			name:    "invalid class",
+			spec:    "9xx",
+			wantErr: true,
+		},
+		{
+			name:    "invalid code",
+			spec:    "abc",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseRefundStatuses(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for spec %q", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for _, status := range tt.refunded {
+				if !policy.Matches(status) {
+					t.Errorf("Status %d should be refunded", status)
+				}
+			}
+			for _, status := range tt.charged {
+				if policy.Matches(status) {
+					t.Errorf("Status %d should not be refunded", status)
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimitMiddleware_Refund tests that failed requests don't consume quota
+func TestRateLimitMiddleware_Refund(t *testing.T) {
+	originalUseDistributed := useDistributed
+	originalLimiter := limiter
+	originalPolicy := refundPolicy
+	defer func() {
+		useDistributed = originalUseDistributed
+		limiter = originalLimiter
+		refundPolicy = originalPolicy
+	}()
+
+	useDistributed = false
+	limiter = &RateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    2,
+		window:   time.Minute,
+	}
+	refundPolicy, _ = ParseRefundStatuses("5xx")
+
+	status := http.StatusServiceUnavailable
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "10.1.1.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Server errors are refunded, so they never exhaust the limit
+	for i := 0; i < 5; i++ {
+		if code := serve(); code != http.StatusServiceUnavailable {
+			t.Fatalf("Request %d: got status %d, want %d", i+1, code, http.StatusServiceUnavailable)
+		}
+	}
+
+	// Successful requests are charged
+	status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		if code := serve(); code != http.StatusOK {
+			t.Errorf("Request %d: got status %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected rate limit: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+// TestStatusRecorder tests status capture and flushing through the wrapper
+func TestStatusRecorder(t *testing.T) {
+	t.Run("implicit ok", func(t *testing.T) {
+		rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+		if rec.Status() != http.StatusOK {
+			t.Errorf("Expected implicit 200, got %d", rec.Status())
+		}
+		_, _ = rec.Write([]byte("ok"))
+		if rec.Status() != http.StatusOK {
+			t.Errorf("Expected 200 after write, got %d", rec.Status())
+		}
+	})
+
+	t.Run("first status wins", func(t *testing.T) {
+		rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+		rec.WriteHeader(http.StatusBadGateway)
+		rec.WriteHeader(http.StatusOK)
+		if rec.Status() != http.StatusBadGateway {
+			t.Errorf("Expected 502, got %d", rec.Status())
+		}
+	})
+
+	t.Run("flush reaches underlying writer", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		var w http.ResponseWriter = &statusRecorder{ResponseWriter: rr}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("statusRecorder should implement http.Flusher")
+		}
+		f.Flush()
+		if !rr.Flushed {
+			t.Error("Flush should reach the underlying writer")
+		}
+	})
+}
+
+// TestDistributedRateLimiter_Refund tests refunding a unit held in the shared store
+func TestDistributedRateLimiter_Refund(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		cfg := testConfig()
+		cfg.Limit = 1
+
+		drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+		defer func() { _ = drl.Close() }()
+
+		ip := "10.2.2.2"
+		_ = store.Delete(drl.ctx, testKeys.windowKeys(ip).Window)
+
+		allowed, unit := drl.allowUnit(ip)
+		if !allowed || unit == nil {
+			t.Fatal("First request should be allowed")
+		}
+		if drl.Allow(ip) {
+			t.Error("Second request should be rejected")
+		}
+
+		if err := unit.Refund(context.Background()); err != nil {
+			t.Fatalf("Refund failed: %v", err)
+		}
+		if !drl.Allow(ip) {
+			t.Error("Request should be allowed after refund")
+		}
+		if drl.GetMetrics().RefundedRequests != 1 {
+			t.Errorf("Expected 1 refunded request, got %d", drl.GetMetrics().RefundedRequests)
+		}
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRegionSyncInterval is how often counts are exchanged between regions
+const DefaultRegionSyncInterval = time.Second
+
+// regionCountersLua sums a G-counter: a sorted set holding one member per
+// region scored by that region's count
+const regionCountersLua = `
+	local function total(key)
+		local sum = 0
+		local counts = redis.call('ZRANGE', key, 0, -1, 'WITHSCORES')
+		for i = 2, #counts, 2 do
+			sum = sum + tonumber(counts[i])
+		end
+		return sum
+	end
+`
+
+// regionAllowLua admits a request when the merged counts of the current
+// window bucket KEYS[1] plus the previous bucket KEYS[2] weighted by ARGV[3]
+// stay under limit ARGV[2], counting it for region ARGV[1]. Returns 1 when
+// admitted.
+const regionAllowLua = regionCountersLua + `
+	local estimate = total(KEYS[1]) + total(KEYS[2]) * tonumber(ARGV[3])
+	if estimate + 1 > tonumber(ARGV[2]) then
+		return 0
+	end
+	redis.call('ZINCRBY', KEYS[1], 1, ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+	return 1
+`
+
+// regionMergeLua merges ARGV pairs of region and count into the G-counter
+// KEYS[1], keeping the higher count of each region. ARGV[1] is the TTL (ms).
+const regionMergeLua = `
+	local key = KEYS[1]
+	for i = 2, #ARGV, 2 do
+		local current = tonumber(redis.call('ZSCORE', key, ARGV[i]) or '0')
+		if tonumber(ARGV[i + 1]) > current then
+			redis.call('ZADD', key, ARGV[i + 1], ARGV[i])
+		end
+	end
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('PEXPIRE', key, ARGV[1])
+	end
+	return 0
+`
+
+// regionReadLua returns the G-counter KEYS[1] as region, count pairs
+const regionReadLua = `
+	return redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+`
+
+// RegionConfig enables multi-region counting. Each region increments its
+// own G-counter in its own Redis and exchanges counters with the Redis of
+// every peer region, so limits hold approximately across regions without a
+// cross-region round trip per request.
+type RegionConfig struct {
+	// Name of this region
+	Name string
+	// Redis URLs of the other regions, by region name
+	Peers map[string]string
+	// How often counts are exchanged with the peer regions
+	SyncInterval time.Duration
+}
+
+// enabled reports whether multi-region counting was configured
+func (c RegionConfig) enabled() bool {
+	return c.Name != "" && len(c.Peers) > 0
+}
+
+// regionClient is a client counted under the policy of keys
+type regionClient struct {
+	keys Keyspace
+	ip   string
+}
+
+// regionCounters keeps the G-counters of this region and replicates them
+type regionCounters struct {
+	name    string
+	local   redis.UniversalClient
+	peers   map[string]redis.UniversalClient
+	scripts *scriptRegistry
+	allow   *managedScript
+	merge   *managedScript
+	read    *managedScript
+	window  time.Duration
+
+	mu      sync.Mutex
+	active  map[regionClient]int64
+	started time.Time
+	synced  map[string]time.Time
+}
+
+// newRegionCounters connects to the Redis of every peer region, using the
+// connection settings of cfg
+func newRegionCounters(cfg *Config, local redis.UniversalClient) (*regionCounters, error) {
+	scripts := &scriptRegistry{}
+	rc := &regionCounters{
+		name:    cfg.Regions.Name,
+		local:   local,
+		peers:   make(map[string]redis.UniversalClient),
+		scripts: scripts,
+		allow:   scripts.register("region_allow", regionAllowLua),
+		merge:   scripts.register("region_merge", regionMergeLua),
+		read:    scripts.register("region_read", regionReadLua),
+		window:  cfg.Window,
+		active:  make(map[regionClient]int64),
+		started: time.Now(),
+		synced:  make(map[string]time.Time),
+	}
+	for name, url := range cfg.Regions.Peers {
+		opts, err := universalOptions(&Config{RedisURL: url, Redis: cfg.Redis})
+		if err != nil {
+			rc.close()
+			return nil, fmt.Errorf("region %s: %w", name, err)
+		}
+		rc.peers[name] = redis.NewUniversalClient(opts)
+	}
+	return rc, nil
+}
+
+// bucket returns the window bucket now falls in and the weight the previous
+// bucket still carries
+func (rc *regionCounters) bucket(now time.Time) (int64, float64) {
+	size := rc.window.Milliseconds()
+	ms := now.UnixMilli()
+	elapsed := float64(ms%size) / float64(size)
+	return ms / size, 1 - elapsed
+}
+
+// allowRequest counts a request for ip in this region's G-counter if the
+// merged estimate leaves room under limit
+func (rc *regionCounters) allowRequest(ctx context.Context, keys Keyspace, ip string, now time.Time, limit int) (bool, error) {
+	bucket, weight := rc.bucket(now)
+	result, err := rc.allow.Run(
+		ctx,
+		rc.local,
+		[]string{keys.regionKey(bucket, ip), keys.regionKey(bucket-1, ip)},
+		rc.name,
+		limit,
+		strconv.FormatFloat(weight, 'f', 4, 64),
+		rc.ttl().Milliseconds(),
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	rc.mu.Lock()
+	rc.active[regionClient{keys: keys, ip: ip}] = bucket
+	rc.mu.Unlock()
+	return result == 1, nil
+}
+
+// ttl keeps a bucket while it can still weigh in on decisions
+func (rc *regionCounters) ttl() time.Duration {
+	return 3 * rc.window
+}
+
+// exchange replicates the G-counters of recently used keys with every peer
+// region in both directions. Regions that fail keep their last sync time,
+// which shows up as replication lag.
+func (rc *regionCounters) exchange(ctx context.Context, now time.Time) map[string]error {
+	bucket, _ := rc.bucket(now)
+
+	rc.mu.Lock()
+	var counterKeys []string
+	for c, last := range rc.active {
+		if last < bucket-1 {
+			delete(rc.active, c)
+			continue
+		}
+		counterKeys = append(counterKeys, c.keys.regionKey(bucket, c.ip), c.keys.regionKey(bucket-1, c.ip))
+	}
+	rc.mu.Unlock()
+
+	failures := make(map[string]error)
+	for name, peer := range rc.peers {
+		if err := rc.exchangeWith(ctx, peer, counterKeys); err != nil {
+			failures[name] = err
+			continue
+		}
+		rc.mu.Lock()
+		rc.synced[name] = now
+		rc.mu.Unlock()
+	}
+	return failures
+}
+
+// exchangeWith pushes the local counts of counterKeys to peer and merges
+// the peer's counts back. Each step is one pipeline, so an exchange takes
+// four round trips however many keys are active.
+func (rc *regionCounters) exchangeWith(ctx context.Context, peer redis.UniversalClient, counterKeys []string) error {
+	if len(counterKeys) == 0 {
+		return nil
+	}
+	reads := make([]regionCall, len(counterKeys))
+	for i, key := range counterKeys {
+		reads[i] = regionCall{key: key}
+	}
+	local, err := rc.runPipelined(ctx, rc.local, rc.read, reads)
+	if err != nil {
+		return err
+	}
+	remote, err := rc.runPipelined(ctx, peer, rc.read, reads)
+	if err != nil {
+		return err
+	}
+	if err := rc.mergeInto(ctx, peer, counterKeys, local); err != nil {
+		return err
+	}
+	return rc.mergeInto(ctx, rc.local, counterKeys, remote)
+}
+
+// mergeInto merges the region, count pairs read for every key into the
+// G-counters on client
+func (rc *regionCounters) mergeInto(ctx context.Context, client redis.UniversalClient, counterKeys []string, reads []*redis.Cmd) error {
+	var merges []regionCall
+	for i, key := range counterKeys {
+		counts, err := reads[i].StringSlice()
+		if err != nil {
+			return err
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		args := make([]interface{}, 0, 1+len(counts))
+		args = append(args, rc.ttl().Milliseconds())
+		for _, c := range counts {
+			args = append(args, c)
+		}
+		merges = append(merges, regionCall{key: key, args: args})
+	}
+	if len(merges) == 0 {
+		return nil
+	}
+	_, err := rc.runPipelined(ctx, client, rc.merge, merges)
+	return err
+}
+
+// regionCall is one run of a region script on a G-counter
+type regionCall struct {
+	key  string
+	args []interface{}
+}
+
+// runPipelined runs script for every call on client in one round trip. If
+// client lost the script it is loaded and the pipeline sent again, which is
+// safe as reads and merges can be repeated.
+func (rc *regionCounters) runPipelined(ctx context.Context, client redis.UniversalClient, script *managedScript, calls []regionCall) ([]*redis.Cmd, error) {
+	run := func() []*redis.Cmd {
+		cmds := make([]*redis.Cmd, len(calls))
+		_, _ = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, call := range calls {
+				cmds[i] = script.EvalSha(ctx, pipe, []string{call.key}, call.args...)
+			}
+			return nil
+		})
+		return cmds
+	}
+
+	cmds := run()
+	for _, cmd := range cmds {
+		if isNoScript(cmd.Err()) {
+			if err := script.load(ctx, client); err != nil {
+				return nil, err
+			}
+			cmds = run()
+			break
+		}
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return cmds, nil
+}
+
+// lag returns, for every peer region, how long ago counts were last
+// exchanged with it
+func (rc *regionCounters) lag(now time.Time) map[string]time.Duration {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	lag := make(map[string]time.Duration, len(rc.peers))
+	for name := range rc.peers {
+		since, ok := rc.synced[name]
+		if !ok {
+			since = rc.started
+		}
+		lag[name] = now.Sub(since)
+	}
+	return lag
+}
+
+// close disconnects from the peer regions
+func (rc *regionCounters) close() {
+	for _, peer := range rc.peers {
+		_ = peer.Close()
+	}
+}
+
+// regionAllow applies the limit to the merged count of every region
+func (drl *DistributedRateLimiter) regionAllow(ctx context.Context, keys Keyspace, ip string, start time.Time) windowDecision {
+	var allowed bool
+	err := drl.storeCall("region_check", func() (err error) {
+		allowed, err = drl.regions.allowRequest(ctx, keys, ip, start, drl.config.Limit)
+		return err
+	})
+	if err != nil {
+		return drl.fallbackAllow(keys.Policy, ip)
+	}
+
+	// G-counters only grow, so admitted units cannot be refunded
+	return windowDecision{allowed: allowed, latency: time.Since(start)}
+}
+
+// startRegionSync exchanges counts with the peer regions every sync
+// interval until the limiter is closed
+func (drl *DistributedRateLimiter) startRegionSync() {
+	interval := drl.config.Regions.SyncInterval
+	if interval <= 0 {
+		interval = DefaultRegionSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-drl.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(drl.ctx, interval)
+		failures := drl.regions.exchange(ctx, time.Now())
+		cancel()
+		for name, err := range failures {
+			if drl.eventEmitter != nil {
+				drl.eventEmitter.EmitRedisFailure("region_sync:"+name, err)
+			}
+		}
+	}
+}
+
+// regionConfigFromEnv reads RATE_LIMIT_REGION, RATE_LIMIT_REGION_PEERS as a
+// comma-separated list of name=redis-url pairs and
+// RATE_LIMIT_REGION_SYNC_INTERVAL
+func regionConfigFromEnv() (RegionConfig, error) {
+	cfg := RegionConfig{Name: os.Getenv("RATE_LIMIT_REGION")}
+	if v := os.Getenv("RATE_LIMIT_REGION_PEERS"); v != "" {
+		cfg.Peers = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			name, url, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || name == "" || url == "" {
+				return RegionConfig{}, fmt.Errorf("invalid region peer %q", pair)
+			}
+			cfg.Peers[name] = url
+		}
+	}
+	if len(cfg.Peers) > 0 && cfg.Name == "" {
+		return RegionConfig{}, errors.New("RATE_LIMIT_REGION_PEERS needs RATE_LIMIT_REGION")
+	}
+	if _, ok := cfg.Peers[cfg.Name]; ok {
+		return RegionConfig{}, fmt.Errorf("region %s lists itself as a peer", cfg.Name)
+	}
+
+	if v := os.Getenv("RATE_LIMIT_REGION_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return RegionConfig{}, fmt.Errorf("invalid RATE_LIMIT_REGION_SYNC_INTERVAL %q", v)
+		}
+		cfg.SyncInterval = d
+	}
+	return cfg, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newRegionLimiter creates a limiter for region name on its own fake Redis
+// that exchanges counts with peers
+func newRegionLimiter(t *testing.T, name, url string, peers map[string]string) *DistributedRateLimiter {
+	t.Helper()
+	cfg := testConfig()
+	cfg.RedisURL = url
+	cfg.Regions = RegionConfig{Name: name, Peers: peers, SyncInterval: time.Hour}
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter for %s: %v", name, err)
+	}
+	t.Cleanup(func() { _ = drl.Close() })
+	return drl
+}
+
+// TestDistributedRateLimiter_Regions tests that limits hold across regions
+// once their counters are exchanged
+func TestDistributedRateLimiter_Regions(t *testing.T) {
+	eu, us := startFakeRedis(t), startFakeRedis(t)
+	euLimiter := newRegionLimiter(t, "eu", eu.URL(), map[string]string{"us": us.URL()})
+	usLimiter := newRegionLimiter(t, "us", us.URL(), map[string]string{"eu": eu.URL()})
+	ip := "region-ip"
+
+	for i := 0; i < 6; i++ {
+		if !euLimiter.Allow(ip) {
+			t.Fatalf("EU request %d should be allowed", i+1)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if !usLimiter.Allow(ip) {
+			t.Fatalf("US request %d should be allowed", i+1)
+		}
+	}
+
+	failures := euLimiter.regions.exchange(context.Background(), time.Now())
+	if len(failures) != 0 {
+		t.Fatalf("Exchange failed: %v", failures)
+	}
+	if euLimiter.Allow(ip) || usLimiter.Allow(ip) {
+		t.Error("Both regions should see the merged count and reject")
+	}
+
+	// Exchanging again changes nothing, merging keeps the highest count
+	euLimiter.regions.exchange(context.Background(), time.Now())
+	if usLimiter.Allow(ip) {
+		t.Error("Repeated exchange should not reset the count")
+	}
+}
+
+// TestRegionCounters_PipelinedExchange tests that an exchange takes a few
+// round trips per peer however many keys are active, and survives a peer
+// that lost its scripts
+func TestRegionCounters_PipelinedExchange(t *testing.T) {
+	eu, us := startFakeRedis(t), startFakeRedis(t)
+	euLimiter := newRegionLimiter(t, "eu", eu.URL(), map[string]string{"us": us.URL()})
+	usLimiter := newRegionLimiter(t, "us", us.URL(), map[string]string{"eu": eu.URL()})
+
+	for i := 0; i < 20; i++ {
+		ip := "pipelined-ip-" + strconv.Itoa(i)
+		for j := 0; j < 10; j++ {
+			euLimiter.Allow(ip)
+		}
+	}
+
+	us.FlushScripts()
+	us.SetLatency(20 * time.Millisecond)
+	defer us.SetLatency(0)
+	start := time.Now()
+	if failures := euLimiter.regions.exchange(context.Background(), time.Now()); len(failures) != 0 {
+		t.Fatalf("Exchange failed: %v", failures)
+	}
+	// Serial calls would take at least 40 round trips to the peer
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected the exchange to be pipelined, took %v", elapsed)
+	}
+
+	us.SetLatency(0)
+	if usLimiter.Allow("pipelined-ip-19") {
+		t.Error("The peer should see the merged count and reject")
+	}
+}
+
+// TestRegionCounters_Lag tests replication lag reporting
+func TestRegionCounters_Lag(t *testing.T) {
+	eu, us := startFakeRedis(t), startFakeRedis(t)
+	drl := newRegionLimiter(t, "eu", eu.URL(), map[string]string{"us": us.URL()})
+	drl.Allow("lag-ip")
+
+	now := time.Now()
+	drl.regions.exchange(context.Background(), now)
+	if lag := drl.regions.lag(now)["us"]; lag != 0 {
+		t.Errorf("Expected no lag right after an exchange, got %v", lag)
+	}
+
+	_ = us.Close()
+	later := now.Add(5 * time.Second)
+	if failures := drl.regions.exchange(context.Background(), later); failures["us"] == nil {
+		t.Error("Expected the exchange with a down region to fail")
+	}
+	if lag := drl.regions.lag(later)["us"]; lag != 5*time.Second {
+		t.Errorf("Expected lag to grow while the region is down, got %v", lag)
+	}
+	if _, ok := drl.GetMetrics().ReplicationLag["us"]; !ok {
+		t.Error("Expected replication lag in the metrics")
+	}
+}
+
+func TestRegionConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_REGION")
+	defer os.Unsetenv("RATE_LIMIT_REGION_PEERS")
+
+	os.Setenv("RATE_LIMIT_REGION", "eu")
+	os.Setenv("RATE_LIMIT_REGION_PEERS", "us=redis://us-cache:6379/0, ap=redis://ap-cache:6379/0")
+	cfg, err := regionConfigFromEnv()
+	if err != nil || !cfg.enabled() || len(cfg.Peers) != 2 || cfg.Peers["ap"] != "redis://ap-cache:6379/0" {
+		t.Errorf("Unexpected config: %+v, %v", cfg, err)
+	}
+
+	os.Setenv("RATE_LIMIT_REGION_PEERS", "eu=redis://eu-cache:6379/0")
+	if _, err := regionConfigFromEnv(); err == nil {
+		t.Error("Expected error for a region peering with itself")
+	}
+
+	os.Unsetenv("RATE_LIMIT_REGION")
+	os.Setenv("RATE_LIMIT_REGION_PEERS", "us=redis://us-cache:6379/0")
+	if _, err := regionConfigFromEnv(); err == nil {
+		t.Error("Expected error for peers without a region name")
+	}
+}
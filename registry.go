@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Version is the build of this instance, set with
+// -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// registryRetention is how many heartbeat intervals a silent instance stays
+// listed, flagged as stale, before it is dropped from the registry
+const registryRetention = 20
+
+// InstanceReport is what an instance publishes about itself on every
+// heartbeat
+type InstanceReport struct {
+	ID               string    `json:"id"`
+	Version          string    `json:"version"`
+	StartedAt        time.Time `json:"started_at"`
+	ReportedAt       time.Time `json:"reported_at"`
+	Uptime           string    `json:"uptime"`
+	Mode             string    `json:"mode"`
+	CircuitState     string    `json:"circuit_state"`
+	TotalRequests    int64     `json:"total_requests"`
+	AllowedRequests  int64     `json:"allowed_requests"`
+	RejectedRequests int64     `json:"rejected_requests"`
+	RedisFailures    int64     `json:"redis_failures"`
+	RedisTimeouts    int64     `json:"redis_timeouts"`
+	RefundedRequests int64     `json:"refunded_requests"`
+	FallbackCount    int64     `json:"fallback_count"`
+	LeaseHits        int64     `json:"lease_hits"`
+	LocalDecisions   int64     `json:"local_decisions"`
+	// Set when read back if the instance missed its heartbeats
+	Stale bool `json:"stale,omitempty"`
+}
+
+// ClusterMetrics aggregates the reports of every registered instance.
+// Totals and circuit states only count live instances.
+type ClusterMetrics struct {
+	Live             int              `json:"live"`
+	Stale            int              `json:"stale"`
+	TotalRequests    int64            `json:"total_requests"`
+	AllowedRequests  int64            `json:"allowed_requests"`
+	RejectedRequests int64            `json:"rejected_requests"`
+	RedisFailures    int64            `json:"redis_failures"`
+	RedisTimeouts    int64            `json:"redis_timeouts"`
+	RefundedRequests int64            `json:"refunded_requests"`
+	FallbackCount    int64            `json:"fallback_count"`
+	LeaseHits        int64            `json:"lease_hits"`
+	LocalDecisions   int64            `json:"local_decisions"`
+	CircuitStates    map[string]int   `json:"circuit_states"`
+	Versions         map[string]int   `json:"versions"`
+	Instances        []InstanceReport `json:"instances"`
+}
+
+// add counts a live instance into the totals
+func (m *ClusterMetrics) add(r InstanceReport) {
+	m.Live++
+	m.TotalRequests += r.TotalRequests
+	m.AllowedRequests += r.AllowedRequests
+	m.RejectedRequests += r.RejectedRequests
+	m.RedisFailures += r.RedisFailures
+	m.RedisTimeouts += r.RedisTimeouts
+	m.RefundedRequests += r.RefundedRequests
+	m.FallbackCount += r.FallbackCount
+	m.LeaseHits += r.LeaseHits
+	m.LocalDecisions += r.LocalDecisions
+	m.CircuitStates[r.CircuitState]++
+	m.Versions[r.Version]++
+}
+
+// instanceRegistry keeps one report per instance in Redis, indexed by a
+// sorted set scored by the time of the last report
+type instanceRegistry struct {
+	client    redis.UniversalClient
+	keys      Keyspace
+	startedAt time.Time
+}
+
+func newInstanceRegistry(client redis.UniversalClient, keys Keyspace) *instanceRegistry {
+	return &instanceRegistry{client: client, keys: keys, startedAt: time.Now()}
+}
+
+// publish stores report, kept for retention, and drops instances that have
+// been silent for longer
+func (reg *instanceRegistry) publish(ctx context.Context, report InstanceReport, retention time.Duration) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	index := reg.keys.registryKey()
+	now := report.ReportedAt
+	_, err = reg.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, reg.keys.instanceKey(report.ID), payload, retention)
+		pipe.ZAdd(ctx, index, redis.Z{Score: float64(now.UnixMilli()), Member: report.ID})
+		pipe.ZRemRangeByScore(ctx, index, "-inf", strconv.FormatInt(now.Add(-retention).UnixMilli(), 10))
+		pipe.PExpire(ctx, index, retention)
+		return nil
+	})
+	return err
+}
+
+// remove deletes the report of instance id
+func (reg *instanceRegistry) remove(ctx context.Context, id string) error {
+	_, err := reg.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, reg.keys.instanceKey(id))
+		pipe.ZRem(ctx, reg.keys.registryKey(), id)
+		return nil
+	})
+	return err
+}
+
+// cluster reads every registered report and flags those older than
+// staleAfter
+func (reg *instanceRegistry) cluster(ctx context.Context, now time.Time, staleAfter time.Duration) (*ClusterMetrics, error) {
+	ids, err := reg.client.ZRangeByScore(ctx, reg.keys.registryKey(), &redis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.StringCmd, len(ids))
+	if len(ids) > 0 {
+		_, err = reg.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Get(ctx, reg.keys.instanceKey(id))
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+
+	metrics := &ClusterMetrics{
+		CircuitStates: make(map[string]int),
+		Versions:      make(map[string]int),
+		Instances:     []InstanceReport{},
+	}
+	for _, cmd := range cmds {
+		payload, err := cmd.Bytes()
+		if err != nil {
+			// Expired between the two reads
+			continue
+		}
+		var report InstanceReport
+		if err := json.Unmarshal(payload, &report); err != nil {
+			continue
+		}
+		if now.Sub(report.ReportedAt) > staleAfter {
+			report.Stale = true
+			metrics.Stale++
+		} else {
+			metrics.add(report)
+		}
+		metrics.Instances = append(metrics.Instances, report)
+	}
+	sort.Slice(metrics.Instances, func(i, j int) bool {
+		return metrics.Instances[i].StartedAt.Before(metrics.Instances[j].StartedAt)
+	})
+	return metrics, nil
+}
+
+// instanceReport describes this instance as of now
+func (drl *DistributedRateLimiter) instanceReport(now time.Time) InstanceReport {
+	m := drl.GetMetrics()
+	return InstanceReport{
+		ID:               drl.instanceID,
+		Version:          Version,
+		StartedAt:        drl.registry.startedAt,
+		ReportedAt:       now,
+		Uptime:           now.Sub(drl.registry.startedAt).Round(time.Second).String(),
+		Mode:             m.FallbackMode,
+		CircuitState:     drl.circuitBreaker.State().String(),
+		TotalRequests:    m.TotalRequests,
+		AllowedRequests:  m.AllowedRequests,
+		RejectedRequests: m.RejectedRequests,
+		RedisFailures:    m.RedisFailures,
+		RedisTimeouts:    m.RedisTimeouts,
+		RefundedRequests: m.RefundedRequests,
+		FallbackCount:    m.FallbackCount,
+		LeaseHits:        m.LeaseHits,
+		LocalDecisions:   m.LocalDecisions,
+	}
+}
+
+// register publishes this instance's report. Failures are left to the next
+// heartbeat.
+func (drl *DistributedRateLimiter) register(interval time.Duration) {
+	if drl.registry == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(drl.ctx, interval)
+	defer cancel()
+	_ = drl.registry.publish(ctx, drl.instanceReport(time.Now()), interval*registryRetention)
+}
+
+// ClusterMetrics aggregates the reports of every instance sharing this
+// limiter's keyspace. Instances that missed their heartbeats are listed as
+// stale and left out of the totals.
+func (drl *DistributedRateLimiter) ClusterMetrics(ctx context.Context) (*ClusterMetrics, error) {
+	if drl.registry == nil {
+		return nil, errors.New("instance registry needs Redis")
+	}
+	return drl.registry.cluster(ctx, time.Now(), drl.heartbeatInterval()*heartbeatMisses)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newRegisteredLimiter creates a limiter on url that reports to the
+// instance registry
+func newRegisteredLimiter(t *testing.T, url string) *DistributedRateLimiter {
+	t.Helper()
+	cfg := testConfig()
+	cfg.RedisURL = url
+	cfg.HeartbeatInterval = time.Hour
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	t.Cleanup(func() { _ = drl.Close() })
+	return drl
+}
+
+// waitForLive waits until the registry lists n live instances
+func waitForLive(t *testing.T, drl *DistributedRateLimiter, n int) *ClusterMetrics {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		cluster, err := drl.ClusterMetrics(context.Background())
+		if err == nil && cluster.Live == n {
+			return cluster
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d live instances, got %+v (%v)", n, cluster, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestClusterMetrics_Aggregates tests that the reports of every instance
+// are summed
+func TestClusterMetrics_Aggregates(t *testing.T) {
+	url := startFakeRedis(t).URL()
+	a := newRegisteredLimiter(t, url)
+	b := newRegisteredLimiter(t, url)
+	waitForLive(t, a, 2)
+
+	for i := 0; i < 3; i++ {
+		a.Allow("registry-a")
+	}
+	for i := 0; i < 12; i++ {
+		b.Allow("registry-b")
+	}
+	a.register(time.Hour)
+	b.register(time.Hour)
+
+	cluster := waitForLive(t, a, 2)
+	if cluster.TotalRequests != 15 || cluster.AllowedRequests != 13 || cluster.RejectedRequests != 2 {
+		t.Errorf("Unexpected totals %+v", cluster)
+	}
+	if cluster.CircuitStates["closed"] != 2 || cluster.Versions[Version] != 2 {
+		t.Errorf("Expected two closed instances of version %s, got %v and %v", Version, cluster.CircuitStates, cluster.Versions)
+	}
+	if len(cluster.Instances) != 2 || cluster.Instances[0].ID != a.instanceID {
+		t.Errorf("Expected both instances ordered by start, got %+v", cluster.Instances)
+	}
+}
+
+// TestClusterMetrics_Stale tests that instances which stopped reporting are
+// flagged and left out of the totals
+func TestClusterMetrics_Stale(t *testing.T) {
+	drl := newRegisteredLimiter(t, startFakeRedis(t).URL())
+	waitForLive(t, drl, 1)
+
+	ghost := InstanceReport{
+		ID:            "ghost",
+		Version:       "old",
+		CircuitState:  "open",
+		TotalRequests: 1000,
+		ReportedAt:    time.Now().Add(-time.Minute),
+	}
+	if err := drl.registry.publish(context.Background(), ghost, time.Hour); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	cluster, err := drl.registry.cluster(context.Background(), time.Now(), 15*time.Second)
+	if err != nil {
+		t.Fatalf("Cluster failed: %v", err)
+	}
+	if cluster.Live != 1 || cluster.Stale != 1 {
+		t.Errorf("Expected one live and one stale instance, got %d and %d", cluster.Live, cluster.Stale)
+	}
+	if cluster.TotalRequests != 0 || cluster.CircuitStates["open"] != 0 {
+		t.Errorf("Stale instance should not count, got %+v", cluster)
+	}
+	for _, r := range cluster.Instances {
+		if r.ID == "ghost" && !r.Stale {
+			t.Error("Expected the silent instance to be flagged stale")
+		}
+	}
+}
+
+// TestClusterMetrics_Close tests that a closed instance leaves the registry
+func TestClusterMetrics_Close(t *testing.T) {
+	url := startFakeRedis(t).URL()
+	a := newRegisteredLimiter(t, url)
+	b := newRegisteredLimiter(t, url)
+	waitForLive(t, a, 2)
+
+	_ = b.Close()
+	cluster := waitForLive(t, a, 1)
+	if cluster.Stale != 0 || len(cluster.Instances) != 1 {
+		t.Errorf("Closed instance should be gone, got %+v", cluster.Instances)
+	}
+}
+
+// TestClusterMetrics_WithoutRedis tests limiters on other stores
+func TestClusterMetrics_WithoutRedis(t *testing.T) {
+	drl := NewDistributedRateLimiterWithStore(testConfig(), NewMemoryStore(), nil)
+	defer func() { _ = drl.Close() }()
+	if _, err := drl.ClusterMetrics(context.Background()); err == nil {
+		t.Error("Expected an error without a registry")
+	}
+}
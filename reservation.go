@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultReservationTTL is how long a reservation stays pending before its
+// capacity is released automatically
+const DefaultReservationTTL = 5 * time.Minute
+
+// Reservation errors
+var (
+	ErrInvalidReservation   = errors.New("reservation units must be positive")
+	ErrInsufficientCapacity = errors.New("insufficient capacity for reservation")
+	ErrReservationSettled   = errors.New("reservation already settled")
+	ErrReservationExpired   = errors.New("reservation expired")
+)
+
+// reservationSettler is implemented by limiters that can issue reservations
+type reservationSettler interface {
+	settleReservation(res *Reservation, commit bool) error
+}
+
+// Reservation is capacity claimed ahead of a long operation. It must be
+// committed once the operation went ahead or cancelled to give the capacity
+// back; otherwise it is released when it expires.
+type Reservation struct {
+	ID        string
+	Key       string
+	Units     int
+	ExpiresAt time.Time
+
+	mu      sync.Mutex
+	settled bool
+	stamps  []time.Time // units recorded by the in-memory limiter
+	settler reservationSettler
+}
+
+// newReservation creates a pending reservation owned by settler
+func newReservation(key string, n int, now time.Time, ttl time.Duration, settler reservationSettler) *Reservation {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	return &Reservation{
+		ID:        uuid.New().String(),
+		Key:       key,
+		Units:     n,
+		ExpiresAt: now.Add(ttl),
+		settler:   settler,
+	}
+}
+
+// Commit confirms the reserved capacity as consumed
+func (res *Reservation) Commit() error {
+	return res.settle(true)
+}
+
+// Cancel gives the reserved capacity back
+func (res *Reservation) Cancel() error {
+	return res.settle(false)
+}
+
+// settle commits or cancels the reservation exactly once
+func (res *Reservation) settle(commit bool) error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if res.settled {
+		return ErrReservationSettled
+	}
+
+	err := res.settler.settleReservation(res, commit)
+	if err == nil || errors.Is(err, ErrReservationExpired) {
+		res.settled = true
+	}
+	return err
+}
+
+// Reserve claims n units of capacity for key
+func (rl *RateLimiter) Reserve(key string, n int) (*Reservation, error) {
+	if n <= 0 {
+		return nil, ErrInvalidReservation
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.expireReservations(now)
+	windowStart := now.Add(-rl.window)
+
+	validRequests := []time.Time{}
+	for _, reqTime := range rl.requests[key] {
+		if reqTime.After(windowStart) {
+			validRequests = append(validRequests, reqTime)
+		}
+	}
+
+	if len(validRequests)+n > rl.limit {
+		rl.requests[key] = validRequests
+		return nil, ErrInsufficientCapacity
+	}
+
+	res := newReservation(key, n, now, rl.reservationTTL, rl)
+	for i := 0; i < n; i++ {
+		at := nextStamp(validRequests, now)
+		validRequests = append(validRequests, at)
+		res.stamps = append(res.stamps, at)
+	}
+	rl.requests[key] = validRequests
+
+	if rl.reservations == nil {
+		rl.reservations = make(map[string]*Reservation)
+	}
+	rl.reservations[res.ID] = res
+	return res, nil
+}
+
+// settleReservation commits or cancels a reservation issued by Reserve
+func (rl *RateLimiter) settleReservation(res *Reservation, commit bool) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if _, ok := rl.reservations[res.ID]; !ok {
+		return ErrReservationExpired
+	}
+	delete(rl.reservations, res.ID)
+
+	expired := !time.Now().Before(res.ExpiresAt)
+	if commit && !expired {
+		return nil
+	}
+
+	rl.releaseUnits(res)
+	if expired {
+		return ErrReservationExpired
+	}
+	return nil
+}
+
+// expireReservations releases capacity held by reservations past their
+// expiry. Must be called with rl.mu held.
+func (rl *RateLimiter) expireReservations(now time.Time) {
+	for id, res := range rl.reservations {
+		if !now.Before(res.ExpiresAt) {
+			rl.releaseUnits(res)
+			delete(rl.reservations, id)
+		}
+	}
+}
+
+// releaseUnits removes the timestamps recorded for a reservation. Must be
+// called with rl.mu held.
+func (rl *RateLimiter) releaseUnits(res *Reservation) {
+	requests := rl.requests[res.Key]
+	kept := requests[:0]
+	for _, reqTime := range requests {
+		if reservedUnit(res, reqTime) {
+			continue
+		}
+		kept = append(kept, reqTime)
+	}
+
+	if len(kept) == 0 {
+		delete(rl.requests, res.Key)
+	} else {
+		rl.requests[res.Key] = kept
+	}
+}
+
+// reservedUnit reports whether the request recorded at reqTime belongs to res
+func reservedUnit(res *Reservation, reqTime time.Time) bool {
+	for _, at := range res.stamps {
+		if reqTime.Equal(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve claims n units of capacity for key across all instances
+func (drl *DistributedRateLimiter) Reserve(key string, n int) (*Reservation, error) {
+	if n <= 0 {
+		return nil, ErrInvalidReservation
+	}
+
+	start := time.Now()
+	drl.metrics.mu.Lock()
+	drl.metrics.TotalRequests++
+	drl.metrics.mu.Unlock()
+
+	if !drl.circuitBreaker.Allow() {
+		return drl.fallbackReserve(key, n)
+	}
+
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+
+	var res *Reservation
+	err := drl.storeCall("reserve", func() (err error) {
+		res, err = drl.redisReserve(ctx, key, n)
+		return err
+	})
+	if err != nil {
+		return drl.fallbackReserve(key, n)
+	}
+
+	drl.recordMetrics(res != nil, time.Since(start), false)
+
+	if res == nil {
+		return nil, ErrInsufficientCapacity
+	}
+	return res, nil
+}
+
+// redisReserve claims capacity in the shared store, returning nil when it
+// does not fit
+func (drl *DistributedRateLimiter) redisReserve(ctx context.Context, key string, n int) (*Reservation, error) {
+	now := time.Now()
+	res := newReservation(key, n, now, drl.config.ReservationTTL, drl)
+
+	reserved, err := drl.store.Reserve(
+		ctx,
+		drl.config.Keys.windowKeys(key),
+		res.ID,
+		n,
+		now,
+		drl.config.Window,
+		drl.config.Limit,
+		res.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reserved {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// fallbackReserve claims capacity from the local limiter
+func (drl *DistributedRateLimiter) fallbackReserve(key string, n int) (*Reservation, error) {
+	drl.metrics.mu.Lock()
+	drl.metrics.FallbackCount++
+	drl.metrics.FallbackMode = "fallback"
+	drl.metrics.mu.Unlock()
+
+	res, err := drl.fallbackLimiter.Reserve(key, n)
+	drl.recordMetrics(err == nil, 0, true)
+
+	return res, err
+}
+
+// settleReservation commits or cancels a reservation held in the shared store
+func (drl *DistributedRateLimiter) settleReservation(res *Reservation, commit bool) error {
+	if !drl.circuitBreaker.Allow() {
+		return ErrCircuitOpen
+	}
+
+	ctx, cancel := drl.decisionContext(drl.ctx)
+	defer cancel()
+	var settled bool
+	err := drl.storeCall("settle_reservation", func() (err error) {
+		settled, err = drl.store.SettleReservation(ctx, drl.config.Keys.windowKeys(res.Key), res.ID, res.Units, time.Now(), commit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !settled {
+		return ErrReservationExpired
+	}
+	return nil
+}
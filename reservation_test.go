@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit int) *RateLimiter {
+	return &RateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    limit,
+		window:   time.Minute,
+	}
+}
+
+// Test reserving, committing and cancelling with the in-memory limiter
+func TestRateLimiter_Reserve(t *testing.T) {
+	t.Run("commit keeps capacity consumed", func(t *testing.T) {
+		rl := newTestLimiter(5)
+
+		res, err := rl.Reserve("worker", 3)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if err := res.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+
+		if _, err := rl.Reserve("worker", 3); !errors.Is(err, ErrInsufficientCapacity) {
+			t.Errorf("Expected ErrInsufficientCapacity, got %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if !rl.allow("worker") {
+				t.Errorf("Request %d should fit in remaining capacity", i+1)
+			}
+		}
+		if rl.allow("worker") {
+			t.Error("Request beyond limit should be rejected")
+		}
+	})
+
+	t.Run("cancel gives capacity back", func(t *testing.T) {
+		rl := newTestLimiter(5)
+
+		res, err := rl.Reserve("worker", 5)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if rl.allow("worker") {
+			t.Error("Request should be rejected while capacity is reserved")
+		}
+		if err := res.Cancel(); err != nil {
+			t.Fatalf("Cancel failed: %v", err)
+		}
+		if !rl.allow("worker") {
+			t.Error("Request should be allowed after cancel")
+		}
+	})
+
+	t.Run("settling twice fails", func(t *testing.T) {
+		rl := newTestLimiter(5)
+
+		res, _ := rl.Reserve("worker", 1)
+		if err := res.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		if err := res.Cancel(); !errors.Is(err, ErrReservationSettled) {
+			t.Errorf("Expected ErrReservationSettled, got %v", err)
+		}
+	})
+
+	t.Run("invalid units", func(t *testing.T) {
+		rl := newTestLimiter(5)
+
+		if _, err := rl.Reserve("worker", 0); !errors.Is(err, ErrInvalidReservation) {
+			t.Errorf("Expected ErrInvalidReservation, got %v", err)
+		}
+	})
+
+	t.Run("unsettled reservation expires", func(t *testing.T) {
+		rl := newTestLimiter(2)
+		rl.reservationTTL = 20 * time.Millisecond
+
+		res, err := rl.Reserve("worker", 2)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		rl.cleanup()
+
+		if !rl.allow("worker") {
+			t.Error("Expired reservation should release its capacity")
+		}
+		if err := res.Commit(); !errors.Is(err, ErrReservationExpired) {
+			t.Errorf("Expected ErrReservationExpired, got %v", err)
+		}
+	})
+
+	t.Run("cancel and refund release only their own units", func(t *testing.T) {
+		rl := newTestLimiter(5)
+		// A request recorded at the same instant as the ones that follow
+		rl.requests["worker"] = []time.Time{time.Now().Add(time.Second)}
+
+		res, err := rl.Reserve("worker", 2)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		allowed, unit := rl.allowUnit("worker")
+		if !allowed {
+			t.Fatal("Request should be allowed")
+		}
+		if err := res.Cancel(); err != nil {
+			t.Fatalf("Cancel failed: %v", err)
+		}
+		if err := unit.Refund(context.Background()); err != nil {
+			t.Fatalf("Refund failed: %v", err)
+		}
+
+		if n := len(rl.requests["worker"]); n != 1 {
+			t.Errorf("Expected the other request to stay recorded, got %d entries", n)
+		}
+	})
+}
+
+// Test reservations against the shared store
+func TestDistributedRateLimiter_Reserve(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		cfg := testConfig()
+		cfg.Limit = 4
+		cfg.Window = time.Second
+
+		drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+		defer func() { _ = drl.Close() }()
+
+		key := "reserve-test"
+		_ = store.Delete(drl.ctx, testKeys.windowKeys(key).Window, testKeys.windowKeys(key).Reservations)
+
+		res, err := drl.Reserve(key, 4)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if drl.Allow(key) {
+			t.Error("Request should be rejected while capacity is reserved")
+		}
+		if err := res.Cancel(); err != nil {
+			t.Fatalf("Cancel failed: %v", err)
+		}
+		if !drl.Allow(key) {
+			t.Error("Request should be allowed after cancel")
+		}
+
+		res, err = drl.Reserve(key, 3)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if err := res.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		if drl.Allow(key) {
+			t.Error("Committed reservation should keep capacity consumed")
+		}
+	})
+}
+
+// Test that unsettled reservations expire in the shared store
+func TestDistributedRateLimiter_Reserve_Expiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		cfg := testConfig()
+		cfg.Limit = 2
+		cfg.ReservationTTL = 50 * time.Millisecond
+
+		drl := NewDistributedRateLimiterWithStore(cfg, store, nil)
+		defer func() { _ = drl.Close() }()
+
+		key := "reserve-expiry-test"
+		_ = store.Delete(drl.ctx, testKeys.windowKeys(key).Window, testKeys.windowKeys(key).Reservations)
+
+		res, err := drl.Reserve(key, 2)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		if !drl.Allow(key) {
+			t.Error("Expired reservation should release its capacity")
+		}
+		if err := res.Commit(); !errors.Is(err, ErrReservationExpired) {
+			t.Errorf("Expected ErrReservationExpired, got %v", err)
+		}
+	})
+}
+
+// Test reservations fall back to the local limiter when the circuit is open
+func TestDistributedRateLimiter_Reserve_Fallback(t *testing.T) {
+	cfg := testConfig()
+	cfg.RedisURL = "redis://invalid:6379/0"
+	cfg.Limit = 3
+
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create DistributedRateLimiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	drl.circuitBreaker.mu.Lock()
+	drl.circuitBreaker.state = StateOpen
+	drl.circuitBreaker.mu.Unlock()
+
+	res, err := drl.Reserve("worker", 3)
+	if err != nil {
+		t.Fatalf("Fallback reserve failed: %v", err)
+	}
+	if _, err := drl.Reserve("worker", 1); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Expected ErrInsufficientCapacity, got %v", err)
+	}
+	if err := res.Cancel(); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if _, err := drl.Reserve("worker", 1); err != nil {
+		t.Errorf("Reserve after cancel failed: %v", err)
+	}
+
+	metrics := drl.GetMetrics()
+	if metrics.FallbackMode != "fallback" {
+		t.Errorf("Expected fallback mode, got %s", metrics.FallbackMode)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptLoadTimeout bounds preloading the scripts when connecting
+const scriptLoadTimeout = 5 * time.Second
+
+// ScriptLoadError reports a Lua script that Redis refused to load, because
+// it doesn't compile or came back under an unexpected SHA. Unlike a
+// connection error it will not go away by retrying.
+type ScriptLoadError struct {
+	Name string
+	Err  error
+}
+
+func (e *ScriptLoadError) Error() string {
+	return fmt.Sprintf("lua script %s rejected: %v", e.Name, e.Err)
+}
+
+func (e *ScriptLoadError) Unwrap() error {
+	return e.Err
+}
+
+// managedScript is a script of a registry. Run reloads it when Redis lost
+// its script cache after a restart or failover instead of failing.
+type managedScript struct {
+	*redis.Script
+	name string
+	src  string
+}
+
+// Run executes the script by SHA. On NOSCRIPT the script is loaded into c
+// and run again, so the error never reaches the caller.
+func (s *managedScript) Run(ctx context.Context, c redis.Scripter, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := s.EvalSha(ctx, c, keys, args...)
+	if !isNoScript(cmd.Err()) {
+		return cmd
+	}
+	if err := s.load(ctx, c); err != nil {
+		// Send the source along instead
+		return s.Eval(ctx, c, keys, args...)
+	}
+	return s.EvalSha(ctx, c, keys, args...)
+}
+
+// load runs SCRIPT LOAD on c, on every primary of a Cluster, and checks
+// the SHA Redis assigned
+func (s *managedScript) load(ctx context.Context, c redis.Scripter) error {
+	sha, err := c.ScriptLoad(ctx, s.src).Result()
+	if err != nil {
+		// Compile errors come back as ERR, unlike LOADING or a lost connection
+		var reply redis.Error
+		if errors.As(err, &reply) && strings.HasPrefix(reply.Error(), "ERR ") {
+			return &ScriptLoadError{Name: s.name, Err: err}
+		}
+		return err
+	}
+	if sha != s.Hash() {
+		return &ScriptLoadError{Name: s.name, Err: fmt.Errorf("loaded as %s, expected %s", sha, s.Hash())}
+	}
+	return nil
+}
+
+// scriptRegistry holds the scripts a component runs so they can be loaded
+// before the first request needs them
+type scriptRegistry struct {
+	scripts []*managedScript
+}
+
+// register adds a script under name and returns it
+func (r *scriptRegistry) register(name, src string) *managedScript {
+	s := &managedScript{Script: redis.NewScript(src), name: name, src: src}
+	r.scripts = append(r.scripts, s)
+	return s
+}
+
+// preload loads every script into c. It stops at the first failure; a
+// *ScriptLoadError means a script is broken rather than Redis unreachable.
+func (r *scriptRegistry) preload(ctx context.Context, c redis.Scripter) error {
+	for _, s := range r.scripts {
+		if err := s.load(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNoScript reports whether Redis did not know the script's SHA
+func isNoScript(err error) bool {
+	return redis.HasErrorPrefix(err, "NOSCRIPT")
+}
+
+// isScriptLoadError reports whether err comes from a rejected script
+func isScriptLoadError(err error) bool {
+	var loadErr *ScriptLoadError
+	return errors.As(err, &loadErr)
+}
+
+// loadScripts preloads the scripts of the store and of the region counters
+func (drl *DistributedRateLimiter) loadScripts(ctx context.Context) error {
+	if loader, ok := drl.store.(interface{ LoadScripts(context.Context) error }); ok {
+		if err := loader.LoadScripts(ctx); err != nil {
+			return err
+		}
+	}
+	if drl.regions != nil {
+		return drl.regions.scripts.preload(ctx, drl.regions.local)
+	}
+	return nil
+}
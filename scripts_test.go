@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TestScripts_PreloadedOnConnect tests that every script is loaded before
+// the first request
+func TestScripts_PreloadedOnConnect(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer func() { _ = client.Close() }()
+	for _, src := range []string{allowLua, reserveLua, quotaLua, penaltyLua} {
+		if exists := redis.NewScript(src).Exists(context.Background(), client).Val(); len(exists) != 1 || !exists[0] {
+			t.Errorf("Expected script %s to be loaded", redis.NewScript(src).Hash())
+		}
+	}
+}
+
+// TestScripts_ReloadAfterFlush tests that a Redis that lost its scripts,
+// as after a restart or failover, is handled without failures
+func TestScripts_ReloadAfterFlush(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	emitter := &EventEmitter{feed: NewActivityFeed(100), broadcaster: NewSSEBroadcaster()}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	for i := 0; i < 3; i++ {
+		srv.FlushScripts()
+		if !drl.Allow("noscript-ip") {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+
+	if m := drl.GetMetrics(); m.RedisFailures != 0 {
+		t.Errorf("NOSCRIPT should not count as a failure, got %d", m.RedisFailures)
+	}
+	if drl.circuitBreaker.IsOpen() {
+		t.Error("NOSCRIPT should not open the circuit")
+	}
+	if n := len(eventsOfType(emitter, EventTypeRedisFailure)); n != 0 {
+		t.Errorf("Expected no redis_failure events, got %d", n)
+	}
+	if n := srv.CommandCount("eval"); n != 0 {
+		t.Errorf("Expected the scripts to be reloaded instead of sent with EVAL, got %d EVALs", n)
+	}
+}
+
+// TestScripts_BrokenScriptFailsStartup tests that a script Redis refuses
+// stops the limiter from starting
+func TestScripts_BrokenScriptFailsStartup(t *testing.T) {
+	srv := startFakeRedis(t)
+	srv.RejectScripts(true)
+
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err == nil {
+		_ = drl.Close()
+		t.Fatal("Expected startup to fail on a rejected script")
+	}
+	var loadErr *ScriptLoadError
+	if !errors.As(err, &loadErr) || loadErr.Name == "" {
+		t.Errorf("Expected a ScriptLoadError naming the script, got %v", err)
+	}
+}
+
+// TestScripts_StartsWhileRedisDown tests that an unreachable Redis does not
+// count as a broken script
+func TestScripts_StartsWhileRedisDown(t *testing.T) {
+	srv := startFakeRedis(t)
+	srv.SetDown(true)
+
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	drl, err := NewDistributedRateLimiter(cfg, nil)
+	if err != nil {
+		t.Fatalf("Expected the limiter to start in fallback, got %v", err)
+	}
+	_ = drl.Close()
+}
+
+// TestScripts_BrokenScriptKeepsCircuitOpen tests that recovery does not
+// close the circuit while a script can't be loaded
+func TestScripts_BrokenScriptKeepsCircuitOpen(t *testing.T) {
+	srv := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RedisURL = srv.URL()
+	cfg.FailureThreshold = 1
+	cfg.RecoveryInterval = 20 * time.Millisecond
+	emitter := &EventEmitter{feed: NewActivityFeed(100), broadcaster: NewSSEBroadcaster()}
+	drl, err := NewDistributedRateLimiter(cfg, emitter)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer func() { _ = drl.Close() }()
+
+	drl.store.(*RedisStore).scripts.register("broken", "return (")
+	drl.circuitBreaker.RecordFailure()
+
+	time.Sleep(100 * time.Millisecond)
+	if !drl.circuitBreaker.IsOpen() {
+		t.Error("Expected the circuit to stay open")
+	}
+	found := false
+	for _, e := range eventsOfType(emitter, EventTypeRedisFailure) {
+		if e.Details["operation"] == "script_load" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected a script_load failure event")
+	}
+}
+
+// TestScriptRegistry_Preload tests loading and rejection of scripts
+func TestScriptRegistry_Preload(t *testing.T) {
+	srv := startFakeRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer func() { _ = client.Close() }()
+	ctx := context.Background()
+
+	reg := &scriptRegistry{}
+	reg.register("allow", allowLua)
+	if err := reg.preload(ctx, client); err != nil {
+		t.Fatalf("Preload failed: %v", err)
+	}
+
+	reg.register("broken", "return (")
+	err := reg.preload(ctx, client)
+	if !isScriptLoadError(err) {
+		t.Errorf("Expected a ScriptLoadError, got %v", err)
+	}
+
+	srv.SetDown(true)
+	if err := reg.preload(ctx, client); err == nil || isScriptLoadError(err) {
+		t.Errorf("Expected a connection error, got %v", err)
+	}
+}
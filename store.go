@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// WindowKeys names the sliding window of a client and its pending reservations
+type WindowKeys struct {
+	Window       string
+	Reservations string
+}
+
+// WindowEntry is one request recorded in a sliding window
+type WindowEntry struct {
+	Member string
+	At     time.Time
+}
+
+// WindowSync is a batch of entries decided locally for one sliding window
+type WindowSync struct {
+	Keys    WindowKeys
+	Entries []WindowEntry
+}
+
+// PenaltyKeys names the penalty box records of a client
+type PenaltyKeys struct {
+	Strikes  string
+	Offenses string
+	Ban      string
+}
+
+// QuotaCounter is one calendar quota counter to charge
+type QuotaCounter struct {
+	Key     string
+	Limit   int64
+	ResetAt time.Time
+}
+
+// Store is the shared backend behind DistributedRateLimiter. Every operation
+// that checks and updates state must be atomic across all instances using
+// the same store.
+type Store interface {
+	// AllowRequest records member in the sliding window if it is under limit
+	AllowRequest(ctx context.Context, keys WindowKeys, member string, now time.Time, window time.Duration, limit int) (bool, error)
+	// RemoveRequest takes recorded requests back out of a sliding window
+	RemoveRequest(ctx context.Context, key string, members ...string) error
+	// Replay adds entries consumed elsewhere to a sliding window regardless of
+	// the limit. Entries already present are skipped, so replaying is
+	// idempotent, and it returns how many were new.
+	Replay(ctx context.Context, keys WindowKeys, entries []WindowEntry, now time.Time, window time.Duration) (int, error)
+	// SyncWindows replays the entries of every sync into its sliding window
+	// and returns the resulting counts, in one round trip where the store
+	// allows it
+	SyncWindows(ctx context.Context, syncs []WindowSync, now time.Time, window time.Duration) ([]int64, error)
+	// Lease records up to units entries "<id>:1".."<id>:<n>" in the sliding
+	// window, as many as fit under limit, and returns how many it granted
+	Lease(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int) (int, error)
+
+	// Reserve claims units of the sliding window until expiresAt
+	Reserve(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, window time.Duration, limit int, expiresAt time.Time) (bool, error)
+	// SettleReservation commits or cancels a reservation, reporting false
+	// when it is unknown or already expired
+	SettleReservation(ctx context.Context, keys WindowKeys, id string, units int, now time.Time, commit bool) (bool, error)
+
+	// IncrementQuotas charges every counter if all have room. It returns 0
+	// when charged, otherwise the 1-based index of the exhausted counter.
+	IncrementQuotas(ctx context.Context, counters []QuotaCounter) (int, error)
+	// RefundQuotas gives one unit back to every counter that still exists
+	RefundQuotas(ctx context.Context, keys []string) error
+
+	// RecordStrike counts a rejection and bans once the threshold is reached,
+	// returning the offense level and ban duration of a new ban
+	RecordStrike(ctx context.Context, keys PenaltyKeys, cfg PenaltyConfig) (int, time.Duration, error)
+	// BanTTL returns how long a ban has left, or zero when there is none
+	BanTTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Count returns the number of entries in a sliding window
+	Count(ctx context.Context, key string) (int64, error)
+	// TTL returns the time left before key expires, or zero without expiry
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Delete removes keys
+	Delete(ctx context.Context, keys ...string) error
+
+	// Heartbeat marks instance id alive in key until now+ttl and returns how
+	// many instances are alive
+	Heartbeat(ctx context.Context, key, id string, now time.Time, ttl time.Duration) (int, error)
+	// Deregister removes instance id from the live instances in key
+	Deregister(ctx context.Context, key, id string) error
+
+	// Ping checks that the store is reachable
+	Ping(ctx context.Context) error
+	// Close releases the store's resources
+	Close() error
+}
+
+// hashTag wraps ip in a Redis Cluster hash tag so every key of one client
+// hashes to the same slot and multi-key scripts stay on one node
+func hashTag(ip string) string {
+	return "{" + ip + "}"
+}
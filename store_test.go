@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// forEachStore runs fn against the in-process store, Redis scripts on the fake
+// server, a two-instance peer cluster and, when available, a real Redis
+func forEachStore(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("fake-redis", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		fn(t, NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()})))
+	})
+	t.Run("peers", func(t *testing.T) {
+		fn(t, startPeers(t, 2, PeerConfig{})[0].store)
+	})
+	t.Run("redis", func(t *testing.T) {
+		skipIfRedisUnavailable(t)
+		fn(t, NewRedisStore(redis.NewClient(&redis.Options{Addr: "localhost:6379"})))
+	})
+}
+
+// TestStore_SlidingWindow tests check-and-increment and removal
+func TestStore_SlidingWindow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		keys := testKeys.windowKeys("store-window-test")
+		_ = store.Delete(ctx, keys.Window, keys.Reservations)
+
+		now := time.Now()
+		for i, member := range []string{"a", "b", "c"} {
+			allowed, err := store.AllowRequest(ctx, keys, member, now, time.Minute, 3)
+			if err != nil || !allowed {
+				t.Fatalf("Request %d should be allowed: %v", i+1, err)
+			}
+		}
+		if allowed, _ := store.AllowRequest(ctx, keys, "d", now, time.Minute, 3); allowed {
+			t.Error("Request over limit should be rejected")
+		}
+
+		if count, _ := store.Count(ctx, keys.Window); count != 3 {
+			t.Errorf("Expected 3 entries, got %d", count)
+		}
+		if ttl, _ := store.TTL(ctx, keys.Window); ttl <= 0 || ttl > 120*time.Second {
+			t.Errorf("Expected window TTL up to 120s, got %v", ttl)
+		}
+
+		if err := store.RemoveRequest(ctx, keys.Window, "b"); err != nil {
+			t.Fatalf("RemoveRequest failed: %v", err)
+		}
+		if allowed, _ := store.AllowRequest(ctx, keys, "d", now, time.Minute, 3); !allowed {
+			t.Error("Request should be allowed after removal")
+		}
+
+		// Entries older than the window no longer count
+		later := now.Add(2 * time.Minute)
+		if allowed, _ := store.AllowRequest(ctx, keys, "e", later, time.Minute, 1); !allowed {
+			t.Error("Request should be allowed once old entries left the window")
+		}
+	})
+}
+
+// TestStore_SyncWindows tests replaying and counting several windows at once
+func TestStore_SyncWindows(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		a, b := testKeys.windowKeys("store-sync-a"), testKeys.windowKeys("store-sync-b")
+		_ = store.Delete(ctx, a.Window, b.Window)
+
+		now := time.Now()
+		syncs := []WindowSync{
+			{Keys: a, Entries: []WindowEntry{{Member: "a1", At: now}, {Member: "a2", At: now}}},
+			{Keys: b, Entries: []WindowEntry{{Member: "b1", At: now}, {Member: "old", At: now.Add(-2 * time.Minute)}}},
+		}
+		counts, err := store.SyncWindows(ctx, syncs, now, time.Minute)
+		if err != nil {
+			t.Fatalf("SyncWindows failed: %v", err)
+		}
+		if len(counts) != 2 || counts[0] != 2 || counts[1] != 1 {
+			t.Errorf("Expected counts [2 1], got %v", counts)
+		}
+
+		// Replaying again changes nothing, and a window without entries is
+		// only counted
+		syncs[1].Entries = nil
+		if counts, _ := store.SyncWindows(ctx, syncs, now, time.Minute); len(counts) != 2 || counts[0] != 2 || counts[1] != 1 {
+			t.Errorf("Expected counts [2 1] after the second sync, got %v", counts)
+		}
+	})
+}
+
+// TestStore_Quotas tests that quota counters are charged together
+func TestStore_Quotas(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		reset := time.Now().Add(time.Hour)
+		counters := []QuotaCounter{
+			{Key: "store-quota-test:day", Limit: 5, ResetAt: reset},
+			{Key: "store-quota-test:month", Limit: 2, ResetAt: reset},
+		}
+		_ = store.Delete(ctx, counters[0].Key, counters[1].Key)
+
+		for i := 0; i < 2; i++ {
+			if idx, err := store.IncrementQuotas(ctx, counters); err != nil || idx != 0 {
+				t.Fatalf("Increment %d should succeed, got %d (%v)", i+1, idx, err)
+			}
+		}
+		if idx, _ := store.IncrementQuotas(ctx, counters); idx != 2 {
+			t.Errorf("Expected second counter to be exhausted, got %d", idx)
+		}
+
+		// Exhaustion of one counter leaves the others untouched
+		counters[1].Limit = 10
+		for i := 0; i < 3; i++ {
+			if idx, _ := store.IncrementQuotas(ctx, counters); idx != 0 {
+				t.Fatalf("Increment %d should succeed, got %d", i+1, idx)
+			}
+		}
+		if idx, _ := store.IncrementQuotas(ctx, counters); idx != 1 {
+			t.Errorf("Expected first counter to be exhausted, got %d", idx)
+		}
+
+		// A refunded unit makes room again, but only in counters that exist
+		keys := []string{counters[0].Key, "store-quota-test:missing"}
+		if err := store.RefundQuotas(ctx, keys); err != nil {
+			t.Fatalf("RefundQuotas failed: %v", err)
+		}
+		if idx, _ := store.IncrementQuotas(ctx, counters); idx != 0 {
+			t.Errorf("Expected room after a refund, got %d", idx)
+		}
+		if ttl, _ := store.TTL(ctx, keys[1]); ttl != 0 {
+			t.Errorf("Refund should not create counters, got TTL %v", ttl)
+		}
+	})
+}
+
+// TestStore_RecordStrike tests ban escalation in the store
+func TestStore_RecordStrike(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		defer func() { _ = store.Close() }()
+		ctx := context.Background()
+		keys := testKeys.penaltyKeys("store-strike-test")
+		_ = store.Delete(ctx, keys.Strikes, keys.Offenses, keys.Ban)
+
+		cfg := PenaltyConfig{
+			Threshold:    2,
+			StrikeWindow: time.Minute,
+			OffenseTTL:   time.Hour,
+			Durations:    []time.Duration{50 * time.Millisecond, time.Minute},
+		}
+
+		if level, _, _ := store.RecordStrike(ctx, keys, cfg); level != 0 {
+			t.Fatalf("First strike should not ban, got level %d", level)
+		}
+		level, duration, err := store.RecordStrike(ctx, keys, cfg)
+		if err != nil || level != 1 || duration != 50*time.Millisecond {
+			t.Fatalf("Expected level 1 ban of 50ms, got %d %v (%v)", level, duration, err)
+		}
+		if ttl, _ := store.BanTTL(ctx, keys.Ban); ttl <= 0 {
+			t.Error("Ban should be active")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if ttl, _ := store.BanTTL(ctx, keys.Ban); ttl != 0 {
+			t.Errorf("Ban should have expired, got %v", ttl)
+		}
+
+		store.RecordStrike(ctx, keys, cfg)
+		level, duration, _ = store.RecordStrike(ctx, keys, cfg)
+		if level != 2 || duration != time.Minute {
+			t.Errorf("Expected level 2 ban of 1m, got %d %v", level, duration)
+		}
+	})
+}
+
+// TestDistributedRateLimiter_MemoryStore tests the limiter on the in-process store
+func TestDistributedRateLimiter_MemoryStore(t *testing.T) {
+	eventEmitter := createTestEmitter()
+	cfg := testConfig()
+	cfg.Limit = 3
+
+	drl := NewDistributedRateLimiterWithStore(cfg, NewMemoryStore(), eventEmitter)
+	defer func() { _ = drl.Close() }()
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "10.4.4.4:1234"
+
+	for i := 0; i < 3; i++ {
+		if !drl.AllowWithRequest("10.4.4.4", req) {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+	if drl.AllowWithRequest("10.4.4.4", req) {
+		t.Error("4th request should be rejected")
+	}
+
+	metrics := drl.GetMetrics()
+	if metrics.FallbackMode != "distributed" {
+		t.Errorf("Expected distributed mode, got %s", metrics.FallbackMode)
+	}
+	if metrics.FallbackCount != 0 {
+		t.Errorf("Expected no fallback requests, got %d", metrics.FallbackCount)
+	}
+	if metrics.AllowedRequests != 3 || metrics.RejectedRequests != 1 {
+		t.Errorf("Expected 3 allowed and 1 rejected, got %d and %d", metrics.AllowedRequests, metrics.RejectedRequests)
+	}
+
+	found := false
+	for _, event := range eventEmitter.feed.GetRecentEvents(10) {
+		if event.Type == EventTypeRateLimitRejected {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Rate limit rejection event not found")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTarpitDelay is how long a tarpitted connection is held
+const DefaultTarpitDelay = 10 * time.Second
+
+// DefaultTarpitMaxConnections caps concurrent tarpitted connections
+const DefaultTarpitMaxConnections = 100
+
+// minDripInterval is the shortest pause between dripped bytes, so a delay
+// shorter than the body still gives the ticker a positive interval
+const minDripInterval = time.Millisecond
+
+// TarpitStyle selects how a tarpitted response is slowed down
+type TarpitStyle string
+
+const (
+	TarpitDelay TarpitStyle = "delay" // wait, then reply at once
+	TarpitDrip  TarpitStyle = "drip"  // send the body a byte at a time
+)
+
+// TarpitConfig controls the tarpit response of a policy
+type TarpitConfig struct {
+	Style TarpitStyle `json:"style"`
+	Delay Duration    `json:"delay"`
+}
+
+// validate checks the tarpit style
+func (c TarpitConfig) validate() error {
+	switch c.Style {
+	case "", TarpitDelay, TarpitDrip:
+		return nil
+	}
+	return fmt.Errorf("unknown tarpit style %q", c.Style)
+}
+
+// Tarpit slows down rejected clients while bounding our own cost
+type Tarpit struct {
+	slots  chan struct{}
+	active int64
+	total  int64
+}
+
+// NewTarpit creates a tarpit holding at most maxConnections at once
+func NewTarpit(maxConnections int) *Tarpit {
+	if maxConnections <= 0 {
+		maxConnections = DefaultTarpitMaxConnections
+	}
+	return &Tarpit{
+		slots: make(chan struct{}, maxConnections),
+	}
+}
+
+// Serve holds the connection and answers with a slow 429. It returns false
+// without writing anything when the tarpit is full.
+func (tp *Tarpit) Serve(w http.ResponseWriter, r *http.Request, cfg TarpitConfig, body []byte) bool {
+	select {
+	case tp.slots <- struct{}{}:
+	default:
+		return false
+	}
+	atomic.AddInt64(&tp.active, 1)
+	atomic.AddInt64(&tp.total, 1)
+	defer func() {
+		atomic.AddInt64(&tp.active, -1)
+		<-tp.slots
+	}()
+
+	delay := time.Duration(cfg.Delay)
+	if delay <= 0 {
+		delay = DefaultTarpitDelay
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if cfg.Style != TarpitDrip {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return true
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write(body)
+		return true
+	}
+
+	// Drip the body over the delay, flushing every byte
+	w.WriteHeader(http.StatusTooManyRequests)
+	flusher, _ := w.(http.Flusher)
+	interval := delay / time.Duration(len(body)+1)
+	if interval < minDripInterval {
+		interval = minDripInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := range body {
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return true
+		}
+		if _, err := w.Write(body[i : i+1]); err != nil {
+			return true
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return true
+}
+
+// Active returns the number of connections currently held
+func (tp *Tarpit) Active() int {
+	return int(atomic.LoadInt64(&tp.active))
+}
+
+// Total returns the number of connections tarpitted so far
+func (tp *Tarpit) Total() int64 {
+	return atomic.LoadInt64(&tp.total)
+}
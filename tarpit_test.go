@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTarpit_Delay tests that a delayed response is held before replying
+func TestTarpit_Delay(t *testing.T) {
+	tp := NewTarpit(1)
+	req := httptest.NewRequest("GET", "/test", nil)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	if !tp.Serve(rr, req, TarpitConfig{Style: TarpitDelay, Delay: Duration(50 * time.Millisecond)}, []byte(`{}`)) {
+		t.Fatal("Tarpit with free slots should serve the request")
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Response should be delayed, took %v", elapsed)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Body.String() != `{}` {
+		t.Errorf("Unexpected body %q", rr.Body.String())
+	}
+	if tp.Active() != 0 || tp.Total() != 1 {
+		t.Errorf("Expected 0 active and 1 total, got %d and %d", tp.Active(), tp.Total())
+	}
+}
+
+// TestTarpit_Drip tests that the body is dripped over the delay
+func TestTarpit_Drip(t *testing.T) {
+	tp := NewTarpit(1)
+	req := httptest.NewRequest("GET", "/test", nil)
+	rr := httptest.NewRecorder()
+	body := []byte(`{"error":"slow"}`)
+
+	start := time.Now()
+	tp.Serve(rr, req, TarpitConfig{Style: TarpitDrip, Delay: Duration(85 * time.Millisecond)}, body)
+
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Drip should take about the configured delay, took %v", elapsed)
+	}
+	if rr.Body.String() != string(body) {
+		t.Errorf("Expected full body %q, got %q", body, rr.Body.String())
+	}
+	if !rr.Flushed {
+		t.Error("Drip should flush each byte")
+	}
+}
+
+// TestTarpit_DripShortDelay tests a delay shorter than one tick per byte
+func TestTarpit_DripShortDelay(t *testing.T) {
+	tp := NewTarpit(1)
+	req := httptest.NewRequest("GET", "/test", nil)
+	rr := httptest.NewRecorder()
+	body := []byte(`{"error":"slow"}`)
+
+	tp.Serve(rr, req, TarpitConfig{Style: TarpitDrip, Delay: Duration(time.Nanosecond)}, body)
+
+	if rr.Body.String() != string(body) {
+		t.Errorf("Expected full body %q, got %q", body, rr.Body.String())
+	}
+}
+
+// TestTarpit_Capacity tests the global cap on tarpitted connections
+func TestTarpit_Capacity(t *testing.T) {
+	tp := NewTarpit(1)
+	cfg := TarpitConfig{Delay: Duration(100 * time.Millisecond)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tp.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil), cfg, []byte(`{}`))
+	}()
+
+	// Wait for the first connection to take the only slot
+	for i := 0; i < 100 && tp.Active() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	if tp.Serve(rr, httptest.NewRequest("GET", "/test", nil), cfg, []byte(`{}`)) {
+		t.Error("Full tarpit should refuse the connection")
+	}
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Error("Refused connection should be left untouched")
+	}
+
+	wg.Wait()
+}
+
+// TestTarpit_ClientGone tests that a disconnected client frees its slot
+func TestTarpit_ClientGone(t *testing.T) {
+	tp := NewTarpit(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		tp.Serve(httptest.NewRecorder(), req, TarpitConfig{Delay: Duration(time.Minute)}, []byte(`{}`))
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Tarpit should release a disconnected client")
+	}
+	if tp.Active() != 0 {
+		t.Errorf("Expected 0 active connections, got %d", tp.Active())
+	}
+}
+
+// TestRateLimitMiddleware_Tarpit tests that tarpit policies slow down rejections
+func TestRateLimitMiddleware_Tarpit(t *testing.T) {
+	originalUseDistributed := useDistributed
+	originalLimiter := limiter
+	originalPolicies := policies
+	originalTarpit := tarpit
+	defer func() {
+		useDistributed = originalUseDistributed
+		limiter = originalLimiter
+		policies = originalPolicies
+		tarpit = originalTarpit
+	}()
+
+	useDistributed = false
+	limiter = &RateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    1,
+		window:   time.Minute,
+	}
+	policies = []*Policy{{
+		Name:       "scrapable",
+		PathPrefix: "/api/products",
+		Response:   ResponseTarpit,
+		Tarpit:     TarpitConfig{Style: TarpitDelay, Delay: Duration(50 * time.Millisecond)},
+	}}
+	tarpit = NewTarpit(10)
+
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) (int, time.Duration) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.6.6.6:1234"
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, time.Since(start)
+	}
+
+	serve("/api/products")
+
+	code, elapsed := serve("/api/products")
+	if code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+	if elapsed < 50*time.Millisecond {
+		t.Errorf("Tarpit policy should delay the rejection, took %v", elapsed)
+	}
+
+	code, elapsed = serve("/api/users")
+	if code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+	if elapsed >= 50*time.Millisecond {
+		t.Errorf("Default policy should reject immediately, took %v", elapsed)
+	}
+}